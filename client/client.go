@@ -1,11 +1,15 @@
 package main
 
 import (
+    "context"
+    "errors"
     "io"
-    "log"
+    "log/slog"
+    "ajb497/ptmp/ptmplog"
+    "ajb497/ptmp/ptmpclient"
+    "ajb497/ptmp/scenario"
     "ajb497/ptmp"
     "time"
-    "net"
     "os"
     "bufio"
     "strings"
@@ -13,21 +17,21 @@ import (
     "strconv"
 )
 
-var buff_incoming = make([]byte, 2048)
 const CONFIG_FILENAME string = "client.cfg"
 var host string
 var PRINT_MSGS bool = true
-var connection_established bool = false
-var connection net.Conn
+var client *ptmpclient.Client
 var demo_mode bool = false
-const BASE_PROTO string = "tcp" // I had been implementing this with QUIC, but the instruction about not using any libraries more advanced than the language's socket APIs made me switch to just plain unsecure TCP
+const REQUEST_TIMEOUT time.Duration = 30 * time.Second
+const CONNECT_TIMEOUT time.Duration = 2 * time.Minute // how long to keep trying to reach a server that isn't up yet
+const DEMO_SCENARIO_FILE string = "scenarios/demo.scenario"
 var input_scanner *bufio.Scanner
 
 func readConfig() {
     // The only item read from the configuration file for this demo is the host name/port number
     fileHandle, err_status := os.Open(CONFIG_FILENAME)
     if err_status != nil {
-        log.Printf("Error reading %v:\n%v\n",CONFIG_FILENAME, err_status)
+        msg_logger.Error("Unable to read the configuration file", "path", CONFIG_FILENAME, "error", err_status)
         return
     }
     rdr := bufio.NewReader(fileHandle)
@@ -39,7 +43,7 @@ func readConfig() {
             if this_err == io.EOF {
                 hit_end = true
             } else {
-                log.Printf("Error reading line from file:\n%v\n", this_err)
+                msg_logger.Error("Unable to read a line of the configuration file", "path", CONFIG_FILENAME, "error", this_err)
                 return
             }
         }
@@ -53,116 +57,125 @@ func readConfig() {
     }
 }
 
-func connect_to_server() (net.Conn, error) {
+func connect_to_server() (*ptmpclient.Client, error) {
 
-    // Very straightforward, specify our protocol (TCP) and put in the host ID and go ahead and connect.
-    conn, err_status := net.Dial(BASE_PROTO, host)
+    // Very straightforward, go ahead and connect to the host from the config file.  The ptmpclient package does the rest,
+    // including trying again for a while if the server isn't up yet, and connecting again (and picking the session
+    // back up) if the connection drops later on.
+    ctx, cancel := context.WithTimeout(context.Background(), CONNECT_TIMEOUT)
+    defer cancel()
+    new_client, err_status := ptmpclient.DialWithBackoff(ctx, host, ptmpclient.Backoff{Initial: time.Second, Max: 15*time.Second})
     if err_status != nil {
-        log.Printf("connection error (attempted host %v):\n%v\n", host, err_status)
+        msg_logger.Error("Unable to connect to the server", "host", host, "error", err_status)
         return nil, err_status
     }
-
-    return conn, nil
+    new_client.Logger = msg_logger
+    return new_client, nil
 }
 
-func recv(conn net.Conn) (int, error) {
+// The level the message traffic gets logged at.  PTMP_LOG_LEVEL picks one outright; otherwise every message is
+// logged (at debug) while PRINT_MSGS is on, and only warnings and errors get through while it's off.
+type msg_log_level struct{}
 
-    // This receive function is called whenever the client expects to be getting a message from the server...
-    // Given more time, I would set up the listener as a second thread, but since this is my first time programming with go,
-    // it would take me a while to get that set up correctly and robustly
-    num_bytes_in, err_status := conn.Read(buff_incoming)
-    if (err_status != nil) && (err_status != io.ErrUnexpectedEOF) {
-        log.Printf("ERROR GETTING SERVER RESPONSE %+v", err_status)
-        return 0, err_status
+func (msg_log_level) Level() slog.Level {
+    if level, err_status := ptmplog.ParseLevel(os.Getenv("PTMP_LOG_LEVEL")); os.Getenv("PTMP_LOG_LEVEL") != "" && err_status == nil {
+        return level
     }
-
-    pckt := ptmp.DecodePacket(buff_incoming[0:num_bytes_in]) // Utilize the common library's decoder function to get at least the heaeder decoded.
-    num_subsequent := determine_action(pckt) // Do we expect to get more messages in sequence in this transaction?
-    return num_subsequent, nil
+    if PRINT_MSGS {
+        return slog.LevelDebug
+    }
+    return slog.LevelWarn
 }
 
-// Given a PTMP_Msg, take some action and return an integer indicating how many more messages are expected in this sequence.
-func determine_action(packet_in* ptmp.PTMP_Msg) int {
-    switch packet_in.Hdr.Msg_Type_ID {
-        case ptmp.CONNECTION_RULES:
-            if connection_established {
-                log.Printf("This is weird - we shouldn't be getting a Connection_Rules message since we already got the connection established...\n")
-                // The protocol doesn't define any action that the client should take in response to an out-of-context message from the server, so just mark it as weird and move on.
-            }
-            received_contents := ptmp.DecodePayload[ptmp.Connection_Rules](packet_in.Pld)
-            connection_established = ptmp.Byte2Bool(received_contents.Username_Ok) && ptmp.Byte2Bool(received_contents.Password_Ok)
-            if PRINT_MSGS {
-                log.Printf("Received a Connection_Rules message, contents follow:\n\t%+v\n", received_contents)
-            }
-        case ptmp.ACKNOWLEDGMENT:
-            // Generally the most common type of message we can expect from the server
-            received_contents := ptmp.DecodePayload[ptmp.Acknowledgment](packet_in.Pld)
-            if PRINT_MSGS {
-                log.Printf("Received an acknowledgement with code %v responding to our %v message.", received_contents.Response_Code, received_contents.ID_Responding_To)
-            }
-        case ptmp.TASK_INFORMATION:
-            // If we queried the tasks held on the server and it responded positively, this will tell us what tasks are held on the server.
-            received_contents := ptmp.DecodePayload[ptmp.Task_Information](packet_in.Pld)
-            if PRINT_MSGS {
-                log.Printf("Received a Task_Information message:\n")
-                for ii := 0; ii < len(received_contents.Task_Infos); ii++ {
-                    printTinfo(received_contents.Task_Infos[ii])
-                }
-                log.Printf("Expecting %v more Task_Information messages to follow.\n", packet_in.Hdr.Msgs_To_Follow)
-            }
+// Where the traffic with the server, and anything that goes wrong along the way, gets logged: stderr, as text unless
+// PTMP_LOG_FORMAT says json.  What the user asked to see (tasks, prompts and so on) is printed to stdout with fmt instead.
+var msg_logger = func() *slog.Logger {
+    handler, err_status := ptmplog.NewHandler(os.Stderr, os.Getenv("PTMP_LOG_FORMAT"), msg_log_level{})
+    if err_status != nil {
+        handler, _ = ptmplog.NewHandler(os.Stderr, ptmplog.FORMAT_TEXT, msg_log_level{})
+    }
+    return slog.New(handler)
+}()
 
-        default:
-            if PRINT_MSGS {
-                log.Printf("\n\tReceived a message of type %v for which we don't have any actions defined.\n\n", packet_in.Hdr.Msg_Type_ID)
-            }
+// Every request to the server gets this long to finish before we give up on it.
+func requestContext() (context.Context, context.CancelFunc) {
+    return context.WithTimeout(context.Background(), REQUEST_TIMEOUT)
+}
+
+// Print how the server answered a message that only gets an acknowledgment back.
+func reportResult(action string, err_status error) {
+    if err_status != nil {
+        msg_logger.Error(action + " failed", "error", err_status)
+    } else if PRINT_MSGS {
+        fmt.Printf("%v succeeded.\n", action)
     }
-    return int(packet_in.Hdr.Msgs_To_Follow)
 }
 
-func xmit(conn net.Conn, ptmp_out ptmp.PTMP_Msg) (int, error) {
-    // Input params are the connection over which the message should be sent and the PTMP_Msg to be sent
+func printTask(task ptmpclient.Task) {
+    // helper function to print out the details of the tasks that we've received info on from the server
+    fmt.Printf("\n\tReference Number: %v\n\tPriority: %v\n\tTitle: %v\n\tDescription: %v\n\tCompletion: %v\n",
+               task.Ref,
+               task.Priority,
+               task.Title,
+               task.Description,
+               task.Completed)
+}
 
-    // There's only one message type that we might not expect a response from the server for
-    var expect_response bool
-    if ptmp_out.Hdr.Msg_Type_ID == ptmp.CLOSE_CONNECTION {
-        sending_contents := ptmp.DecodePayload[ptmp.Close_Connection](ptmp_out.Pld)
-        expect_response = ptmp.Byte2Bool(sending_contents.Will_Await_Ack)
-    } else {
-        expect_response = true
+func printTasks(tasks []ptmpclient.Task, err_status error) {
+    if err_status != nil {
+        msg_logger.Error("Querying tasks failed", "error", err_status)
+        return
+    }
+    fmt.Printf("The server is holding %v matching task(s):\n", len(tasks))
+    for _, task := range tasks {
+        printTask(task)
     }
+}
 
-    serialized := ptmp.EncodePacket(ptmp_out) // get the byte-array representation of the full message
-    num_bytes_out, err_status := conn.Write(serialized) // send the message
+func printTrash(trashed []ptmpclient.TrashedTask, err_status error) {
     if err_status != nil {
-        log.Printf("Error writing to server: %+v", err_status)
-        return 0, err_status
+        msg_logger.Error("Querying the trash failed", "error", err_status)
+        return
     }
-    if PRINT_MSGS {
-        log.Printf("Message type %v just sent to the server.\n", ptmp_out.Hdr.Msg_Type_ID)
+    fmt.Printf("There are %v task(s) in the trash:\n", len(trashed))
+    for _, tt := range trashed {
+        fmt.Printf("\n\tList: %v\n\tPermanently deleted in: %v\n", tt.List_ID, tt.Until_Purge)
+        printTask(tt.Task)
     }
-    if expect_response{
-        // Unlike on the server-side where listening for incoming messages is its primary role, the client's main job is
-        // sending messages to the server, so going into receive mode is only done in response to us sending a message to the server.
+}
 
-        num_to_follow := 1 // if we've decided that a response is expected, then we expect at least one message
-                           // but when we receive that message, it may say that there are more messages to come in the same sequence,
-                           // and if that's the case, then we should say in receive mode until there are no more messages expected to come in
-        for num_to_follow > 0 {
-            num_to_follow, err_status = recv(conn)
-        }
+func locationName(state ptmpclient.TaskState) string {
+    // helper for printHistory to describe where a task was before/after a change
+    switch state.Location {
+        case ptmp.TASK_LOCATION_ACTIVE:
+            return fmt.Sprintf("active (completed: %v)", state.Completed)
+        case ptmp.TASK_LOCATION_TRASH:
+            return fmt.Sprintf("in the trash (completed: %v)", state.Completed)
     }
-    time.Sleep(250 * time.Millisecond) // after each transmission, give the server some time before we flood it with additional traffic
-    return num_bytes_out, err_status
+    return "nonexistent"
 }
 
-func printTinfo(tinfo ptmp.T_Inf) {
-    // helper function to print out the details of the tasks that we've received info on from the server
-    log.Printf("\n\tReference Number: %v\n\tPriority: %v\n\tTitle: %v\n\tDescription: %v\n\tCompletion: %v\n",
-               tinfo.Task_Reference_Number,
-               tinfo.Task_Priority_Value,
-               string(tinfo.Task_Title[:]),
-               string(tinfo.Task_Description),
-               tinfo.Completion_Status > 0)
+func printHistory(entries []ptmpclient.HistoryEntry, err_status error) {
+    if err_status != nil {
+        msg_logger.Error("Querying history failed", "error", err_status)
+        return
+    }
+    fmt.Printf("%v history entries:\n", len(entries))
+    for _, entry := range entries {
+        // one change from a task's history
+        fmt.Printf("\n\tWhen: %v\n\tUser: %v (session %v)\n\tMessage type: %v (%v)\n\tList: %v\n\tBefore: %v\n\tAfter: %v\n",
+                   entry.Time,
+                   entry.User,
+                   entry.Session_ID,
+                   entry.Msg_Type_ID,
+                   ptmpclient.ResponseCodeName(entry.Response_Code),
+                   entry.List_ID,
+                   locationName(entry.Before),
+                   locationName(entry.After))
+        if entry.Task != nil {
+            printTask(*entry.Task)
+        }
+    }
 }
 
 func prompt_for_str(prompt_in string, max_length int) string {
@@ -174,7 +187,7 @@ func prompt_for_str(prompt_in string, max_length int) string {
         outVal = input_scanner.Text()
         fmt.Printf("\n")
         if len(outVal) < 1 || len(outVal) > max_length {
-            fmt.Printf("\nYour response must be between 1 and %v characters long.", 1, max_length)
+            fmt.Printf("\nYour response must be between %v and %v characters long.", 1, max_length)
         } else {
             break
         }
@@ -206,17 +219,40 @@ func prompt_for_int(prompt_in string, min_val, max_val int) int {
 func read_input() {
     // This user-input portion is by far the least-tested component of the project.
     input_scanner = bufio.NewScanner(os.Stdin) // set up a way to read user input
-    for false == connection_established {
+    for logged_in := false; !logged_in; {
         // until we've established the connection, we need to keep on asking for login credentials
         uname := prompt_for_str("Please tell me the username you'd like to use: ", int(ptmp.USERNAME_SIZE))
         pw := prompt_for_str("And the password: ", int(ptmp.PASSWORD_SIZE))
-        xmit(connection, ptmp.Prep_Request_Connection(uname, pw, 0, []uint16{1}, []uint16{})) // determining whether or not the connection has been established is part of
-                                                                                              // the client-side logic handling responses from the server
+        ctx, cancel := requestContext()
+        err_status := client.Login(ctx, uname, pw)
+        cancel()
+        if errors.Is(err_status, ptmpclient.ErrBadCredentials) {
+            fmt.Printf("The server didn't accept those credentials (%v), please try again.\n", err_status)
+            continue
+        } else if errors.Is(err_status, ptmpclient.ErrLoginThrottled) {
+            fmt.Printf("There have been too many failed logins, so the server is refusing them for a while.  Please wait a bit and try again.\n")
+            continue
+        } else if err_status != nil {
+            msg_logger.Error("Unable to log in", "error", err_status)
+            return
+        }
+        logged_in = true
+    }
+    // Keep the session from timing out while the user is thinking, and find out about a dropped connection (and get
+    // it back) before they ask for anything.
+    client.StartHeartbeats(ptmpclient.DEFAULT_HEARTBEAT_INTERVAL)
+    if PRINT_MSGS {
+        ctx, cancel := requestContext()
+        if latency, err_status := client.Ping(ctx); err_status == nil {
+            msg_logger.Info("Logged in", "round_trip", latency)
+        }
+        cancel()
     }
     quit_program := false
     for false == quit_program {
-        curr_choice := prompt_for_int("\nWould you like to\n\t1. Make a new task\n\t2. See current tasks\n\t3. Mark a task completed\n\t4. Remove a task\n\t5. Quit\n", 1, 5)
+        curr_choice := prompt_for_int("\nWould you like to\n\t1. Make a new task\n\t2. See current tasks\n\t3. Mark a task completed\n\t4. Remove a task\n\t5. See removed tasks\n\t6. Restore a removed task\n\t7. Permanently delete removed tasks\n\t8. See task history\n\t9. Export a list to a file\n\t10. Import tasks from a file\n\t11. Quit\n", 1, 11)
 
+        ctx, cancel := requestContext()
         switch curr_choice {
             case 1:
                 // make a new task
@@ -229,7 +265,7 @@ func read_input() {
                 priority_val := prompt_for_int("\nAnd what is the priority value of this task: ", 1, 60000)
                 title := prompt_for_str("\nWhat is the task's title: ", int(ptmp.TITLE_MAX_LENGTH))
                 description := prompt_for_str("\nTask description: ", int(ptmp.DESCRIPTION_MAX_LENGTH))
-                xmit(connection, ptmp.Prep_Create_New_Task(uint16(list_id), uint16(priority_val), title, description))
+                reportResult("Creating the task", client.CreateTask(ctx, uint16(list_id), uint16(priority_val), title, description))
 
             case 2:
                 // see current tasks
@@ -239,72 +275,100 @@ func read_input() {
                 // max priority
                 min_priority := prompt_for_int("\nWhat is the minimum priority value of task that should be returned? ", 0, 60000)
                 max_priority := prompt_for_int("\nWhat is the maximum priority value of task that should be returned? ", 0, 60000)
-                xmit(connection, ptmp.Prep_Query_Tasks(uint16(min_priority), uint16(max_priority)))
+                printTasks(client.QueryTasks(ctx, uint16(min_priority), uint16(max_priority)))
             case 3:
                 // mark a task completed
                 // just need to know what task ID to mark
                 list_id := prompt_for_int("\nWhat list does the task belong to? ", 0, 255)
                 task_id := prompt_for_int("\nTask ID to mark completed: ", 0, 60000)
-                xmit(connection, ptmp.Prep_Mark_Task_Completed(uint16(list_id), uint16(task_id)))
+                reportResult("Marking the task completed", client.CompleteTask(ctx, uint16(list_id), uint16(task_id)))
             case 4:
                 // remove a task
                 permit_incomplete := 1 == prompt_for_int("\nShould incomplete tasks be allowed to be removed? (1 for yes, 0 for no) ", 0, 1)
                 list_id := prompt_for_int("\nList ID to remove task from: ", 0, 255)
                 task_id := prompt_for_int("\nTask ID to remove: ", 0, 60000) // I'm only allowing one at a time here, but the message allows for multiple tasks to be removed from the list
-                xmit(connection, ptmp.Prep_Remove_Tasks(permit_incomplete, uint16(list_id), []uint16{uint16(task_id)}))
+                reportResult("Removing the task", client.RemoveTasks(ctx, uint16(list_id), []uint16{uint16(task_id)}, permit_incomplete))
             case 5:
+                // see what's in the trash
+                list_id := prompt_for_int("\nList ID to see the removed tasks of: ", 0, 255)
+                printTrash(client.QueryTrash(ctx, uint16(list_id)))
+            case 6:
+                // restore a task from the trash
+                list_id := prompt_for_int("\nList ID the task was removed from: ", 0, 255)
+                task_id := prompt_for_int("\nTask ID to restore: ", 0, 60000)
+                reportResult("Restoring the task", client.RestoreTasks(ctx, uint16(list_id), []uint16{uint16(task_id)}))
+            case 7:
+                // purge the trash
+                list_id := prompt_for_int("\nList ID to permanently delete removed tasks from: ", 0, 255)
+                purge_all := 1 == prompt_for_int("\nDelete everything in that list's trash? (1 for yes, 0 to pick a single task) ", 0, 1)
+                to_purge := []uint16{}
+                if !purge_all {
+                    to_purge = append(to_purge, uint16(prompt_for_int("\nTask ID to permanently delete: ", 0, 60000)))
+                }
+                reportResult("Purging the trash", client.PurgeTrash(ctx, uint16(list_id), to_purge))
+            case 8:
+                // see the history of a task or a whole list
+                list_id := prompt_for_int("\nList ID to see the history of: ", 0, 255)
+                whole_list := 1 == prompt_for_int("\nShow the history of the whole list? (1 for yes, 0 to pick a single task) ", 0, 1)
+                task_id := 0
+                if !whole_list {
+                    task_id = prompt_for_int("\nTask ID to see the history of: ", 0, 60000)
+                }
+                printHistory(client.QueryHistory(ctx, uint16(list_id), whole_list, uint16(task_id)))
+            case 9:
+                // export a list
+                list_id := prompt_for_int("\nList ID to export: ", 0, 255)
+                filename := prompt_for_str("\nFile to export to (.json, .csv, .txt for todo.txt, or .ics for iCalendar): ", 4096)
+                if err_status := exportList(ctx, uint16(list_id), filename); err_status != nil {
+                    fmt.Printf("Export failed: %v\n", err_status)
+                }
+            case 10:
+                // import tasks into a list
+                list_id := prompt_for_int("\nList ID to import into: ", 0, 255)
+                filename := prompt_for_str("\nFile to import from (.json, .csv, .txt for todo.txt, or .ics for iCalendar): ", 4096)
+                if err_status := importList(ctx, uint16(list_id), filename); err_status != nil {
+                    fmt.Printf("Import failed: %v\n", err_status)
+                }
+            case 11:
                 // quit
                 await_server := 1 == prompt_for_int("\nShould we wait for a server response before shutting down? (0 for no, 1 for yes) ", 0, 1)
-                xmit(connection, ptmp.Prep_Close_Connection(await_server))
+                if await_server {
+                    reportResult("Closing the connection", client.CloseAndWait(ctx))
+                } else {
+                    client.Close()
+                }
                 quit_program = true
             default:
                 fmt.Println("It shouldn't have been possible for you to get here...")
         }
+        cancel()
 
     }
 
 }
 
 func main() {
+    if len(os.Args) > 1 {
+        os.Exit(runCommand(os.Args[1:]))
+    }
     readConfig()
-    connection, _ = connect_to_server()//HOST)
-
 
     if demo_mode {
-        // This was how I was testing the protocol portion of the assignment before getting to the user input parsing
-        req_conn := ptmp.Prep_Request_Connection("Ed Ucational", "p@55w0rd", 42, []uint16{1}, []uint16{})
-
-        for false == connection_established {
-            // keep trying to connect until it's established
-            xmit(connection, req_conn)
+        // The demo is just a scenario file now, so it's run the same way as any other (see the run subcommand).
+        demo, err_status := scenario.ParseFile(DEMO_SCENARIO_FILE)
+        if err_status != nil {
+            msg_logger.Error("Unable to read the demo scenario", "path", DEMO_SCENARIO_FILE, "error", err_status)
+            os.Exit(EXIT_USAGE)
         }
-
-        // send some tasks to the server for it to keep track of
-        new_task := ptmp.Prep_Create_New_Task(1, 1000, "Grade this assignment", "You should give Alec an A for doing such an awesome job with this project!")
-        xmit(connection, new_task)
-
-        new_task = ptmp.Prep_Create_New_Task(2, 1000, "Reject this!", "This is specifying a list that doesn't exist, so it should get rejected.")
-        xmit(connection, new_task)
-
-        new_task = ptmp.Prep_Create_New_Task(1, 1000, "Be another task", "This is the second successful task, I hope.")
-        xmit(connection, new_task)
-
-
-        new_task = ptmp.Prep_Create_New_Task(1, 1000, "Be yet another task", "This is the third successful task, I hope.")
-        xmit(connection, new_task)
-
-        // prep a message to query the server about the tasks that it has stored
-        querier := ptmp.Prep_Query_Tasks(0, 50000)
-        xmit(connection, querier) // should show three tasks stored at this point
-        xmit(connection, ptmp.Prep_Mark_Task_Completed(1, 1)) // set the second task (Be another task) to completed
-        xmit(connection, querier) // query again, and we should see three tasks with the second one showing its status as completed
-        xmit(connection, ptmp.Prep_Remove_Tasks(true, uint16(1), []uint16{2})) // remove that completed task from the list
-        xmit(connection, querier) // we should now only see two tasks in the list that's returned
-        xmit(connection, ptmp.Prep_Close_Connection(false)) // tell the server we're done
-    } else {
-        read_input()
+        os.Exit(runScenario(host, REQUEST_TIMEOUT, demo, os.Stdout))
     }
 
-    connection.Close()
+    var err_status error
+    client, err_status = connect_to_server()
+    if err_status != nil {
+        os.Exit(1)
+    }
+    read_input()
+    client.Close() // a no-op if the user already quit through the menu
 
 }
@@ -0,0 +1,671 @@
+package main
+
+import (
+    "context"
+    "encoding/csv"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "flag"
+    "fmt"
+    "io"
+    "ajb497/ptmp/ptmpclient"
+    "ajb497/ptmp/scenario"
+    "ajb497/ptmp"
+    "ajb497/ptmp/ptmplog"
+    "os"
+    "strconv"
+    "strings"
+    "text/tabwriter"
+    "time"
+)
+
+// Running the client with a subcommand (e.g. "client list -format json") does that one thing and exits, instead of
+// going through the menu or the DEMO sequence, so that it can be used from shell scripts and CI.
+//
+// Exit codes:
+//     0          the server accepted everything
+//     1          bad usage, or something went wrong on our end (reading a file, encoding the output, ...)
+//     2          couldn't connect to or talk to the server
+//     3          the server didn't accept the username/password
+//     4          a scenario (see the run subcommand) had steps that failed
+//     5          rm only removed some of the tasks (the rest are listed on stderr)
+//     100-255    the server rejected a message, and the exit code is its response code minus 300
+//                (so UNABLE_TO_COMPLY = 100, LIST_DOES_NOT_EXIST = 101, TASK_DOES_NOT_EXIST = 102, SYNTAX_ERROR = 200, ...)
+const (
+    EXIT_OK int = 0
+    EXIT_USAGE int = 1
+    EXIT_CONNECTION int = 2
+    EXIT_LOGIN int = 3
+    EXIT_SCENARIO_FAILED int = 4
+    EXIT_PARTIAL_SUCCESS int = 5
+    EXIT_RESPONSE_CODE_OFFSET int = 300
+)
+
+const (
+    OUTPUT_TABLE string = "table"
+    OUTPUT_JSON string = "json"
+    OUTPUT_CSV string = "csv"
+)
+
+// Credentials can come from the environment so that they don't have to show up in the command line (and in ps).
+const USER_ENV_VAR string = "PTMP_USER"
+const PASSWORD_ENV_VAR string = "PTMP_PASSWORD"
+
+type subcommand struct {
+    usage string
+    description string
+    run func(args []string) int
+}
+
+var subcommands map[string]subcommand
+
+func init() {
+    // filled in here rather than in the declaration, since printUsage refers back to the map
+    subcommands = map[string]subcommand{
+        "add": {"add [flags] TITLE [DESCRIPTION]", "Create a new task (the description defaults to the title).", runAdd},
+        "list": {"list [flags]", "Show the tasks in lists, searched, filtered, sorted and paged.", runList},
+        "complete": {"complete [flags] REF...", "Mark tasks completed.", runComplete},
+        "rm": {"rm [flags] REF...", "Move tasks to the list's trash.", runRemove},
+        "lists": {"lists [flags]", "Show the lists on the server.", runLists},
+        "ping": {"ping [flags]", "Check the server is answering, and how long it takes to.", runPing},
+        "capabilities": {"capabilities [flags]", "Show what the server can do: its version, message types, extensions and limits.", runCapabilities},
+        "run": {"run [flags] SCENARIO_FILE...", "Run scenario files against the server, reporting pass/fail for each step.", runScenarios},
+    }
+}
+
+// The flags every subcommand has, for where the server is and who we are.
+type common_flags struct {
+    host string
+    user string
+    password string
+    timeout time.Duration
+}
+
+func addCommonFlags(flags *flag.FlagSet) *common_flags {
+    common := &common_flags{}
+    flags.StringVar(&common.host, "host", "", "server host:port (defaults to the first line of " + CONFIG_FILENAME + ")")
+    // the environment is only checked after parsing, so that -h doesn't print the password back out
+    flags.StringVar(&common.user, "user", "", "username to log in with (or set " + USER_ENV_VAR + ")")
+    flags.StringVar(&common.password, "password", "", "password to log in with (or set " + PASSWORD_ENV_VAR + ")")
+    flags.DurationVar(&common.timeout, "timeout", REQUEST_TIMEOUT, "how long to wait for the server before giving up")
+    return common
+}
+
+func newFlagSet(name string) *flag.FlagSet {
+    flags := flag.NewFlagSet(name, flag.ContinueOnError)
+    flags.Usage = func() {
+        fmt.Fprintf(flags.Output(), "Usage: client %v\n%v\n\nFlags:\n", subcommands[name].usage, subcommands[name].description)
+        flags.PrintDefaults()
+    }
+    return flags
+}
+
+func printUsage(w io.Writer) {
+    fmt.Fprintf(w, "Usage: client [SUBCOMMAND [flags] [args]]\n\nWith no subcommand, the client runs interactively (or the DEMO sequence if %v asks for it).\n\nSubcommands:\n", CONFIG_FILENAME)
+    for _, name := range []string{"add", "list", "complete", "rm", "lists", "ping", "capabilities", "run"} {
+        fmt.Fprintf(w, "  %-32v %v\n", subcommands[name].usage, subcommands[name].description)
+    }
+    fmt.Fprintf(w, "\nRun 'client SUBCOMMAND -h' for the flags of a subcommand.\n")
+}
+
+// Run the subcommand named by args[0] and return the exit code for the process.
+func runCommand(args []string) int {
+    if args[0] == "help" || args[0] == "-h" || args[0] == "-help" || args[0] == "--help" {
+        printUsage(os.Stdout)
+        return EXIT_OK
+    }
+    cmd, known := subcommands[args[0]]
+    if !known {
+        fmt.Fprintf(os.Stderr, "Unknown subcommand '%v'.\n\n", args[0])
+        printUsage(os.Stderr)
+        return EXIT_USAGE
+    }
+    PRINT_MSGS = false // the output of a subcommand is meant for other programs, so no chatter about every message
+    return cmd.run(args[1:])
+}
+
+// Work out the exit code for an error from the ptmpclient package.
+func exitCodeFor(err_status error) int {
+    var rejection *ptmpclient.ResponseError
+    switch {
+        case err_status == nil:
+            return EXIT_OK
+        case errors.Is(err_status, ptmpclient.ErrPartialSuccess):
+            return EXIT_PARTIAL_SUCCESS
+        case errors.As(err_status, &rejection):
+            return int(rejection.Response_Code) - EXIT_RESPONSE_CODE_OFFSET
+        case errors.Is(err_status, ptmpclient.ErrBadCredentials):
+            return EXIT_LOGIN
+        case errors.Is(err_status, errOutput):
+            return EXIT_USAGE
+    }
+    return EXIT_CONNECTION
+}
+
+// Print what went wrong and hand back the exit code to go with it.
+func commandFailed(err_status error) int {
+    fmt.Fprintf(os.Stderr, "%v\n", err_status)
+    return exitCodeFor(err_status)
+}
+
+// Connect and log in, using the config file for the host if it wasn't given as a flag.
+func connectForCommand(ctx context.Context, common *common_flags) (*ptmpclient.Client, error) {
+    if common.host == "" {
+        readConfig()
+        common.host = host
+    }
+    new_client, err_status := ptmpclient.Dial(ctx, common.host)
+    if err_status != nil {
+        return nil, err_status
+    }
+    new_client.Logger = msg_logger // quiet unless PTMP_LOG_LEVEL asks for the traffic
+    if err_status = new_client.Login(ctx, common.user, common.password); err_status != nil {
+        new_client.Close()
+        return nil, err_status
+    }
+    return new_client, nil
+}
+
+// Everything the subcommands have in common: parse the flags, check the positional args, log in, do the thing, and log out.
+func runWithClient(flags *flag.FlagSet, common *common_flags, args []string, min_args int, max_args int,
+                   action func(ctx context.Context, session *ptmpclient.Client, args []string) error) int {
+    if err_status := flags.Parse(args); err_status != nil {
+        if errors.Is(err_status, flag.ErrHelp) {
+            return EXIT_OK
+        }
+        return EXIT_USAGE
+    }
+    if flags.NArg() < min_args || (max_args >= 0 && flags.NArg() > max_args) {
+        flags.Usage()
+        return EXIT_USAGE
+    }
+    if common.user == "" {
+        common.user = os.Getenv(USER_ENV_VAR)
+    }
+    if common.password == "" {
+        common.password = os.Getenv(PASSWORD_ENV_VAR)
+    }
+    if common.user == "" || common.password == "" {
+        fmt.Fprintf(os.Stderr, "A username and password are needed (-user and -password, or %v and %v).\n", USER_ENV_VAR, PASSWORD_ENV_VAR)
+        return EXIT_USAGE
+    }
+    ctx, cancel := context.WithTimeout(context.Background(), common.timeout)
+    defer cancel()
+    session, err_status := connectForCommand(ctx, common)
+    if err_status != nil {
+        return commandFailed(err_status)
+    }
+    defer session.Close()
+    if err_status = action(ctx, session, flags.Args()); err_status != nil {
+        if errors.Is(err_status, errUsage) {
+            flags.Usage()
+            return EXIT_USAGE
+        }
+        return commandFailed(err_status)
+    }
+    return EXIT_OK
+}
+
+// Returned by a subcommand's action when its arguments turn out to be bad, so that the usage gets printed.
+var errUsage = errors.New("bad arguments")
+// Wrapped around problems writing a subcommand's output, which are our fault rather than the server's.
+var errOutput = errors.New("unable to write the output")
+
+func parseRefs(args []string) ([]uint16, error) {
+    refs := []uint16{}
+    for _, arg := range args {
+        ref, err_status := strconv.ParseUint(arg, 10, 16)
+        if err_status != nil {
+            fmt.Fprintf(os.Stderr, "'%v' isn't a task reference number.\n", arg)
+            return nil, errUsage
+        }
+        refs = append(refs, uint16(ref))
+    }
+    return refs, nil
+}
+
+func checkOutputFormat(format string) bool {
+    switch format {
+        case OUTPUT_TABLE, OUTPUT_JSON, OUTPUT_CSV:
+            return true
+    }
+    fmt.Fprintf(os.Stderr, "Output format must be %v, %v or %v.\n", OUTPUT_TABLE, OUTPUT_JSON, OUTPUT_CSV)
+    return false
+}
+
+func runAdd(args []string) int {
+    flags := newFlagSet("add")
+    common := addCommonFlags(flags)
+    list_id := flags.Uint("list", 1, "list to add the task to")
+    priority := flags.Uint("priority", 1000, "priority value of the task (bigger is more important)")
+    return runWithClient(flags, common, args, 1, 2, func(ctx context.Context, session *ptmpclient.Client, args []string) error {
+        if *list_id > 65535 || *priority > 65535 {
+            fmt.Fprintf(os.Stderr, "-list and -priority must be from 0 to 65535.\n")
+            return errUsage
+        }
+        description := args[0]
+        if len(args) > 1 {
+            description = args[1]
+        }
+        return session.CreateTask(ctx, uint16(*list_id), uint16(*priority), args[0], description)
+    })
+}
+
+func runList(args []string) int {
+    flags := newFlagSet("list")
+    common := addCommonFlags(flags)
+    lists := flags.String("list", "1", "lists to show the tasks of, separated by commas, or \"all\"")
+    min_priority := flags.Uint("min", 0, "lowest priority value to show")
+    max_priority := flags.Uint("max", 65535, "highest priority value to show")
+    status := flags.String("status", "all", "which tasks to show: all, open or done")
+    search := flags.String("search", "", "only show tasks with this in their title or description")
+    search_in := flags.String("in", "both", "where to look for -search: title, description or both")
+    regex := flags.Bool("regex", false, "-search is a regular expression rather than a substring")
+    ignore_case := flags.Bool("i", false, "ignore case in -search")
+    sort_by := flags.String("sort", "", "sort keys separated by commas (ref, priority, title or status), each with :desc to reverse it")
+    limit := flags.Uint("limit", 0, "show one page of at most this many tasks, rather than all of them")
+    offset := flags.Uint("offset", 0, "skip this many tasks")
+    cursor := flags.String("cursor", "", "start where the page before ended (the cursor it printed)")
+    format := flags.String("format", OUTPUT_TABLE, "output format: table, json or csv")
+    return runWithClient(flags, common, args, 0, 0, func(ctx context.Context, session *ptmpclient.Client, args []string) error {
+        if !checkOutputFormat(*format) {
+            return errUsage
+        }
+        if *min_priority > 65535 || *max_priority > 65535 || *limit > 65535 || *offset > 65535 {
+            fmt.Fprintf(os.Stderr, "-min, -max, -limit and -offset must be from 0 to 65535.\n")
+            return errUsage
+        }
+        query := ptmpclient.TaskQuery{Min_Priority: uint16(*min_priority), Max_Priority: uint16(*max_priority), Search: *search, Limit: uint16(*limit), Offset: uint16(*offset)}
+        var err_status error
+        if query.Lists, err_status = parseLists(*lists); err_status != nil {
+            return err_status
+        }
+        if query.Status, query.Search_Flags, err_status = parseTaskFilters(*status, *search_in, *regex, *ignore_case); err_status != nil {
+            return err_status
+        }
+        if query.Sort, err_status = parseSortKeys(*sort_by); err_status != nil {
+            return err_status
+        }
+        if query.Cursor, err_status = hex.DecodeString(*cursor); err_status != nil {
+            fmt.Fprintf(os.Stderr, "'%v' isn't a cursor from an earlier page.\n", *cursor)
+            return errUsage
+        }
+        one_page := *limit > 0 || *cursor != ""
+        tasks := []ptmpclient.Task{}
+        for {
+            page, err_status := session.SearchTasks(ctx, query)
+            if errors.Is(err_status, ptmpclient.ErrProtocolVersionsIncompatible) && query.Status == ptmp.QUERY_ANY_STATUS && query.Search == "" && len(query.Sort) == 0 && !one_page && query.Offset == 0 {
+                // a version 1 server can still do what a version 1 query can
+                tasks, err_status = listTasksV1(ctx, session, query)
+                if err_status != nil {
+                    return err_status
+                }
+                break
+            }
+            if err_status != nil {
+                return err_status
+            }
+            tasks = append(tasks, page.Tasks...)
+            if page.Next_Cursor == nil {
+                break
+            }
+            if one_page {
+                fmt.Fprintf(os.Stderr, "%v of %v tasks shown, the next page is -cursor %v\n", len(tasks), page.Total, hex.EncodeToString(page.Next_Cursor))
+                break
+            }
+            query.Cursor, query.Offset = page.Next_Cursor, 0
+        }
+        if err_status = writeTasks(os.Stdout, *format, tasks); err_status != nil {
+            return fmt.Errorf("%w: %v", errOutput, err_status)
+        }
+        return nil
+    })
+}
+
+// Query_Tasks version 1 doesn't name a list, since list 1 is the only one there is.  Asking for any other list
+// gets the same answer the server gives to every other message about a list that doesn't exist.
+func listTasksV1(ctx context.Context, session *ptmpclient.Client, query ptmpclient.TaskQuery) ([]ptmpclient.Task, error) {
+    for _, list_id := range query.Lists {
+        if list_id != 1 {
+            return nil, &ptmpclient.ResponseError{Response_Code: ptmp.LIST_DOES_NOT_EXIST, Msg_Type_ID: ptmp.QUERY_TASKS}
+        }
+    }
+    return session.QueryTasks(ctx, query.Min_Priority, query.Max_Priority)
+}
+
+// "all" for every list (nil), or list IDs separated by commas.
+func parseLists(value string) ([]uint16, error) {
+    if value == "all" {
+        return nil, nil
+    }
+    lists := []uint16{}
+    for _, field := range strings.Split(value, ",") {
+        list_id, err_status := strconv.ParseUint(strings.TrimSpace(field), 10, 16)
+        if err_status != nil {
+            fmt.Fprintf(os.Stderr, "'%v' isn't a list ID.\n", field)
+            return nil, errUsage
+        }
+        lists = append(lists, uint16(list_id))
+    }
+    return lists, nil
+}
+
+func parseTaskFilters(status string, search_in string, regex bool, ignore_case bool) (byte, byte, error) {
+    statuses := map[string]byte{"all": ptmp.QUERY_ANY_STATUS, "open": ptmp.QUERY_INCOMPLETE_ONLY, "done": ptmp.QUERY_COMPLETED_ONLY}
+    places := map[string]byte{"both": 0, "title": ptmp.SEARCH_IN_TITLE, "description": ptmp.SEARCH_IN_DESCRIPTION}
+    completion, status_ok := statuses[status]
+    flags, place_ok := places[search_in]
+    if !status_ok || !place_ok {
+        fmt.Fprintf(os.Stderr, "-status must be all, open or done, and -in must be title, description or both.\n")
+        return 0, 0, errUsage
+    }
+    if regex {
+        flags |= ptmp.SEARCH_REGEX
+    }
+    if ignore_case {
+        flags |= ptmp.SEARCH_IGNORE_CASE
+    }
+    return completion, flags, nil
+}
+
+// Sort keys like "priority:desc,title".
+func parseSortKeys(value string) ([]ptmp.Sort_Key, error) {
+    keys := []ptmp.Sort_Key{}
+    if value == "" {
+        return keys, nil
+    }
+    names := map[string]byte{"ref": ptmp.SORT_BY_REFERENCE, "priority": ptmp.SORT_BY_PRIORITY, "title": ptmp.SORT_BY_TITLE, "status": ptmp.SORT_BY_STATUS}
+    for _, field := range strings.Split(value, ",") {
+        name, direction, _ := strings.Cut(strings.TrimSpace(field), ":")
+        key, known := names[name]
+        if !known || (direction != "" && direction != "asc" && direction != "desc") {
+            fmt.Fprintf(os.Stderr, "'%v' isn't a sort key (ref, priority, title or status, with :asc or :desc).\n", field)
+            return nil, errUsage
+        }
+        keys = append(keys, ptmp.Sort_Key{Key: key, Descending: ptmp.Bool2Byte(direction == "desc")})
+    }
+    return keys, nil
+}
+
+func runComplete(args []string) int {
+    flags := newFlagSet("complete")
+    common := addCommonFlags(flags)
+    list_id := flags.Uint("list", 1, "list the tasks are in")
+    return runWithClient(flags, common, args, 1, -1, func(ctx context.Context, session *ptmpclient.Client, args []string) error {
+        refs, err_status := parseRefs(args)
+        if err_status != nil {
+            return err_status
+        }
+        // Mark_Task_Completed only takes one task, so stop at the first one the server turns down.
+        for _, ref := range refs {
+            if err_status = session.CompleteTask(ctx, uint16(*list_id), ref); err_status != nil {
+                return err_status
+            }
+        }
+        return nil
+    })
+}
+
+func runRemove(args []string) int {
+    flags := newFlagSet("rm")
+    common := addCommonFlags(flags)
+    list_id := flags.Uint("list", 1, "list the tasks are in")
+    permit_incomplete := flags.Bool("incomplete", false, "allow removing tasks that haven't been completed")
+    return runWithClient(flags, common, args, 1, -1, func(ctx context.Context, session *ptmpclient.Client, args []string) error {
+        refs, err_status := parseRefs(args)
+        if err_status != nil {
+            return err_status
+        }
+        return session.RemoveTasks(ctx, uint16(*list_id), refs, *permit_incomplete)
+    })
+}
+
+type list_summary struct {
+    List_ID uint16 `json:"list_id"`
+    Task_Count int `json:"task_count"`
+    Completed_Count int `json:"completed_count"`
+}
+
+func runLists(args []string) int {
+    flags := newFlagSet("lists")
+    common := addCommonFlags(flags)
+    format := flags.String("format", OUTPUT_TABLE, "output format: table, json or csv")
+    return runWithClient(flags, common, args, 0, 0, func(ctx context.Context, session *ptmpclient.Client, args []string) error {
+        if !checkOutputFormat(*format) {
+            return errUsage
+        }
+        // The list management messages aren't implemented, so there's no asking the server what lists it has.
+        // List 1 is the only one there is, and querying its tasks gets us the counts.
+        tasks, err_status := session.QueryTasks(ctx, 0, 65535)
+        if err_status != nil {
+            return err_status
+        }
+        summary := list_summary{List_ID: 1, Task_Count: len(tasks)}
+        for _, task := range tasks {
+            if task.Completed {
+                summary.Completed_Count++
+            }
+        }
+        if err_status = writeLists(os.Stdout, *format, []list_summary{summary}); err_status != nil {
+            return fmt.Errorf("%w: %v", errOutput, err_status)
+        }
+        return nil
+    })
+}
+
+func runPing(args []string) int {
+    flags := newFlagSet("ping")
+    common := addCommonFlags(flags)
+    count := flags.Int("count", 3, "how many pings to send")
+    interval := flags.Duration("interval", time.Second, "how long to wait between pings")
+    return runWithClient(flags, common, args, 0, 0, func(ctx context.Context, session *ptmpclient.Client, args []string) error {
+        if *count < 1 {
+            return errUsage
+        }
+        var total, slowest time.Duration
+        fastest := time.Duration(-1)
+        for ii := 1; ii <= *count; ii++ {
+            if ii > 1 {
+                time.Sleep(*interval)
+            }
+            latency, err_status := session.Ping(ctx)
+            if err_status != nil {
+                return err_status
+            }
+            fmt.Printf("pong %v from %v: %v\n", ii, common.host, latency)
+            total += latency
+            if latency > slowest {
+                slowest = latency
+            }
+            if fastest < 0 || latency < fastest {
+                fastest = latency
+            }
+        }
+        fmt.Printf("round trip min/avg/max = %v/%v/%v\n", fastest, total / time.Duration(*count), slowest)
+        return nil
+    })
+}
+
+// The capabilities as they're shown, with names for the message types and extensions instead of their numbers.
+type capabilities_summary struct {
+    Server_Version string `json:"server_version"`
+    Protocol_Versions []uint16 `json:"protocol_versions"`
+    Msg_Types []string `json:"msg_types"`
+    Extensions []string `json:"extensions"`
+    Max_Payload_Size uint16 `json:"max_payload_size"`
+    Max_Title_Length uint16 `json:"max_title_length"`
+    Max_Description_Length uint16 `json:"max_description_length"`
+    Max_Tasks_Per_List uint16 `json:"max_tasks_per_list"` // 0 for no limit
+    Max_Title_Chars uint16 `json:"max_title_chars"` // 0 if the server didn't say
+    Max_Description_Chars uint16 `json:"max_description_chars"`
+}
+
+var extension_names = map[uint16]string{
+    ptmp.EXT_DETAILED_ACKS: "detailed-acks",
+    ptmp.EXT_IDEMPOTENCY_KEYS: "idempotency-keys",
+    ptmp.EXT_SESSION_RESUMPTION: "session-resumption",
+}
+
+func runCapabilities(args []string) int {
+    flags := newFlagSet("capabilities")
+    common := addCommonFlags(flags)
+    format := flags.String("format", OUTPUT_TABLE, "output format: table, json or csv")
+    return runWithClient(flags, common, args, 0, 0, func(ctx context.Context, session *ptmpclient.Client, args []string) error {
+        if !checkOutputFormat(*format) {
+            return errUsage
+        }
+        caps, err_status := session.Capabilities(ctx)
+        if err_status != nil {
+            return err_status
+        }
+        summary := capabilities_summary{
+                                        Server_Version: caps.Server_Version,
+                                        Protocol_Versions: caps.Protocol_Versions,
+                                        Msg_Types: []string{},
+                                        Extensions: []string{},
+                                        Max_Payload_Size: caps.Max_Payload_Size,
+                                        Max_Title_Length: caps.Max_Title_Length,
+                                        Max_Description_Length: caps.Max_Description_Length,
+                                        Max_Tasks_Per_List: caps.Max_Tasks_Per_List,
+                                        Max_Title_Chars: caps.Max_Title_Chars,
+                                        Max_Description_Chars: caps.Max_Description_Chars,
+                                       }
+        for _, msg_type := range caps.Msg_Types {
+            summary.Msg_Types = append(summary.Msg_Types, ptmplog.MsgTypeName(msg_type))
+        }
+        for _, ext := range caps.Extensions {
+            name, known := extension_names[ext]
+            if !known {
+                name = strconv.Itoa(int(ext))
+            }
+            summary.Extensions = append(summary.Extensions, name)
+        }
+        if err_status = writeCapabilities(os.Stdout, *format, summary); err_status != nil {
+            return fmt.Errorf("%w: %v", errOutput, err_status)
+        }
+        return nil
+    })
+}
+
+func writeTasks(w io.Writer, format string, tasks []ptmpclient.Task) error {
+    header := []string{"ref", "priority", "completed", "title", "description"}
+    rows := [][]string{}
+    for _, task := range tasks {
+        rows = append(rows, []string{strconv.Itoa(int(task.Ref)), strconv.Itoa(int(task.Priority)), strconv.FormatBool(task.Completed), task.Title, task.Description})
+    }
+    return writeOutput(w, format, tasks, header, rows)
+}
+
+func writeLists(w io.Writer, format string, lists []list_summary) error {
+    header := []string{"list_id", "task_count", "completed_count"}
+    rows := [][]string{}
+    for _, summary := range lists {
+        rows = append(rows, []string{strconv.Itoa(int(summary.List_ID)), strconv.Itoa(summary.Task_Count), strconv.Itoa(summary.Completed_Count)})
+    }
+    return writeOutput(w, format, lists, header, rows)
+}
+
+// One row per setting, since there's only the one server.
+func writeCapabilities(w io.Writer, format string, summary capabilities_summary) error {
+    versions := []string{}
+    for _, version := range summary.Protocol_Versions {
+        versions = append(versions, strconv.Itoa(int(version)))
+    }
+    rows := [][]string{
+        {"server_version", summary.Server_Version},
+        {"protocol_versions", strings.Join(versions, " ")},
+        {"msg_types", strings.Join(summary.Msg_Types, " ")},
+        {"extensions", strings.Join(summary.Extensions, " ")},
+        {"max_payload_size", strconv.Itoa(int(summary.Max_Payload_Size))},
+        {"max_title_length", strconv.Itoa(int(summary.Max_Title_Length))},
+        {"max_description_length", strconv.Itoa(int(summary.Max_Description_Length))},
+        {"max_tasks_per_list", strconv.Itoa(int(summary.Max_Tasks_Per_List))},
+        {"max_title_chars", strconv.Itoa(int(summary.Max_Title_Chars))},
+        {"max_description_chars", strconv.Itoa(int(summary.Max_Description_Chars))},
+    }
+    return writeOutput(w, format, summary, []string{"setting", "value"}, rows)
+}
+
+// JSON output is the values themselves, CSV and table output are the same header and rows.
+func writeOutput(w io.Writer, format string, values interface{}, header []string, rows [][]string) error {
+    switch format {
+        case OUTPUT_JSON:
+            encoder := json.NewEncoder(w)
+            encoder.SetIndent("", "  ")
+            return encoder.Encode(values)
+        case OUTPUT_CSV:
+            csv_writer := csv.NewWriter(w)
+            csv_writer.Write(header)
+            csv_writer.WriteAll(rows)
+            return csv_writer.Error()
+    }
+    table := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+    fmt.Fprintln(table, strings.ToUpper(strings.Join(header, "\t")))
+    for _, row := range rows {
+        // keep each task on one line of the table
+        for ii := range row {
+            row[ii] = strings.ReplaceAll(row[ii], "\n", " ")
+        }
+        fmt.Fprintln(table, strings.Join(row, "\t"))
+    }
+    return table.Flush()
+}
+
+// Scenarios log themselves in (or deliberately don't), so this is the one subcommand that doesn't take credentials.
+func runScenarios(args []string) int {
+    flags := newFlagSet("run")
+    host_flag := flags.String("host", "", "server host:port (defaults to the first line of " + CONFIG_FILENAME + ")")
+    timeout := flags.Duration("timeout", REQUEST_TIMEOUT, "how long to give each scenario before giving up")
+    if err_status := flags.Parse(args); err_status != nil {
+        if errors.Is(err_status, flag.ErrHelp) {
+            return EXIT_OK
+        }
+        return EXIT_USAGE
+    }
+    if flags.NArg() < 1 {
+        flags.Usage()
+        return EXIT_USAGE
+    }
+    if *host_flag == "" {
+        readConfig()
+        *host_flag = host
+    }
+    // Parse everything first so that a typo in the last file doesn't turn up after the others have already run.
+    scenarios := []*scenario.Scenario{}
+    for _, filename := range flags.Args() {
+        parsed, err_status := scenario.ParseFile(filename)
+        if err_status != nil {
+            fmt.Fprintf(os.Stderr, "%v\n", err_status)
+            return EXIT_USAGE
+        }
+        scenarios = append(scenarios, parsed)
+    }
+    exit_code := EXIT_OK
+    for _, to_run := range scenarios {
+        if code := runScenario(*host_flag, *timeout, to_run, os.Stdout); code != EXIT_OK && exit_code == EXIT_OK {
+            exit_code = code
+        }
+    }
+    return exit_code
+}
+
+// Each scenario gets a connection of its own, since they generally start by logging in and end by closing the connection.
+func runScenario(addr string, timeout time.Duration, to_run *scenario.Scenario, report io.Writer) int {
+    ctx, cancel := context.WithTimeout(context.Background(), timeout)
+    defer cancel()
+    session, err_status := ptmpclient.Dial(ctx, addr)
+    if err_status != nil {
+        return commandFailed(err_status)
+    }
+    session.Logger = msg_logger
+    defer session.Close()
+    result, err_status := to_run.Run(ctx, session, report)
+    if err_status != nil {
+        return commandFailed(err_status)
+    }
+    if result.Failed > 0 {
+        return EXIT_SCENARIO_FAILED
+    }
+    return EXIT_OK
+}
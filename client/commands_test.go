@@ -0,0 +1,87 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "errors"
+    "ajb497/ptmp/ptmpclient"
+    "ajb497/ptmp"
+    "fmt"
+    "reflect"
+    "testing"
+)
+
+func TestExitCodeFor(t *testing.T) {
+    for _, test := range []struct {
+        name string
+        err_status error
+        exit_code int
+    }{
+        {"no error", nil, EXIT_OK},
+        {"a partial success", ptmpclient.ErrPartialSuccess, EXIT_PARTIAL_SUCCESS},
+        {"a wrapped partial success", fmt.Errorf("rm: %w", &ptmpclient.ResponseError{Response_Code: ptmp.CONDITIONAL_SUCCESS, Msg_Type_ID: ptmp.REMOVE_TASK}), EXIT_PARTIAL_SUCCESS},
+        {"a 4xx code", &ptmpclient.ResponseError{Response_Code: ptmp.TASK_DOES_NOT_EXIST, Msg_Type_ID: ptmp.MARK_TASK_COMPLETED}, 102},
+        {"a wrapped 4xx code", fmt.Errorf("add: %w", ptmpclient.ErrListDoesNotExist), 101},
+        {"a 5xx code", &ptmpclient.ResponseError{Response_Code: ptmp.MSG_NOT_IMPLEMENTED, Msg_Type_ID: ptmp.TRANSACTION}, 202},
+        {"a refused login", &ptmpclient.LoginError{Username_Ok: true}, EXIT_LOGIN},
+        {"an output failure", fmt.Errorf("%w: disk full", errOutput), EXIT_USAGE},
+        {"a dropped connection", ptmpclient.ErrDropped, EXIT_CONNECTION},
+        {"anything else", errors.New("connection refused"), EXIT_CONNECTION},
+    } {
+        if exit_code := exitCodeFor(test.err_status); exit_code != test.exit_code {
+            t.Errorf("%v (%v) got exit code %v, expected %v", test.name, test.err_status, exit_code, test.exit_code)
+        }
+    }
+}
+
+// Each format gets the same tasks, with a description that has a newline (which the table flattens) and a comma
+// and quotes (which CSV has to quote).
+func TestWriteTasks(t *testing.T) {
+    tasks := []ptmpclient.Task{
+        {Ref: 0, Priority: 9000, Title: "Grade this", Description: "Give it an A", Completed: false},
+        {Ref: 12, Priority: 5, Title: "Reply", Description: "Say \"thanks\",\nthen go home", Completed: true},
+    }
+    for _, test := range []struct {
+        format string
+        want string
+    }{
+        {OUTPUT_TABLE, "REF  PRIORITY  COMPLETED  TITLE       DESCRIPTION\n" +
+                       "0    9000      false      Grade this  Give it an A\n" +
+                       "12   5         true       Reply       Say \"thanks\", then go home\n"},
+        {OUTPUT_CSV, "ref,priority,completed,title,description\n" +
+                     "0,9000,false,Grade this,Give it an A\n" +
+                     "12,5,true,Reply,\"Say \"\"thanks\"\",\nthen go home\"\n"},
+    } {
+        buff := bytes.Buffer{}
+        if err_status := writeTasks(&buff, test.format, tasks); err_status != nil {
+            t.Fatalf("%v: %v", test.format, err_status)
+        }
+        if buff.String() != test.want {
+            t.Errorf("%v output was:\n%v\nexpected:\n%v", test.format, buff.String(), test.want)
+        }
+    }
+
+    // JSON is the tasks themselves, so it should come back as them
+    buff := bytes.Buffer{}
+    if err_status := writeTasks(&buff, OUTPUT_JSON, tasks); err_status != nil {
+        t.Fatalf("%v: %v", OUTPUT_JSON, err_status)
+    }
+    read_back := []ptmpclient.Task{}
+    if err_status := json.Unmarshal(buff.Bytes(), &read_back); err_status != nil || !reflect.DeepEqual(read_back, tasks) {
+        t.Errorf("%v output %v read back as %+v (%v)", OUTPUT_JSON, buff.String(), read_back, err_status)
+    }
+}
+
+// No tasks is still a header (or an empty array), not nothing at all, so scripts can tell it apart from a failure.
+func TestWriteOutputEmpty(t *testing.T) {
+    for format, want := range map[string]string{
+        OUTPUT_TABLE: "A  B\n",
+        OUTPUT_CSV: "a,b\n",
+        OUTPUT_JSON: "[]\n",
+    } {
+        buff := bytes.Buffer{}
+        if err_status := writeOutput(&buff, format, []ptmpclient.Task{}, []string{"a", "b"}, [][]string{}); err_status != nil || buff.String() != want {
+            t.Errorf("%v output was %q (%v), expected %q", format, buff.String(), err_status, want)
+        }
+    }
+}
@@ -1,8 +1,11 @@
 module ajb497/client
 
-go 1.20
+go 1.21
 
-require github.com/quic-go/quic-go v0.32.0
+require (
+	ajb497/ptmp v0.0.0
+	github.com/quic-go/quic-go v0.32.0
+)
 
 require (
 	github.com/go-task/slim-sprig v0.0.0-20210107165309-348f09dbbbc0 // indirect
@@ -18,3 +21,5 @@ require (
 	golang.org/x/sys v0.5.0 // indirect
 	golang.org/x/tools v0.2.0 // indirect
 )
+
+replace ajb497/ptmp => ../ptmp
@@ -0,0 +1,213 @@
+package main
+
+import (
+    "fmt"
+    "io"
+    "strconv"
+    "strings"
+    "time"
+    "unicode/utf8"
+)
+
+const FORMAT_ICAL string = "ical"
+
+// iCalendar priorities run from 1 (most important) to 9 (least), with 0 meaning no priority.  Same idea as the
+// todo.txt letters, each one stands for a band of PTMP priority values: 1 = 9000, 2 = 8000, ..., 9 = 1000.
+const ICAL_PRIORITY_STEP uint16 = 1000
+const ICAL_PRODID string = "-//ajb497//PTMP client//EN"
+const ICAL_MAX_LINE_OCTETS int = 75 // RFC 5545 says content lines get folded once they'd be longer than this
+
+// A VTODO's UID has to stay the same every time the same task is exported, or calendar tools will treat each
+// export as a brand new set of tasks.  The list ID and reference number are what identify a task on the server,
+// so the UID is built from just those two.
+func taskUID(list_id uint16, ref uint16) string {
+    return fmt.Sprintf("ptmp-list%v-task%v@ptmp", list_id, ref)
+}
+
+// The other direction of taskUID, for recognizing our own tasks when a file comes back in.
+func parseTaskUID(uid string) (uint16, uint16, bool) {
+    var list_id, ref uint16
+    if _, err_status := fmt.Sscanf(uid, "ptmp-list%d-task%d@ptmp", &list_id, &ref); err_status != nil {
+        return 0, 0, false
+    }
+    if uid != taskUID(list_id, ref) {
+        return 0, 0, false // something extra tacked on the end, so it's not one of ours
+    }
+    return list_id, ref, true
+}
+
+func priorityToICal(priority uint16) int {
+    // (rounded as an int, since anything within half a step of 65535 would wrap around as a uint16)
+    steps := (int(priority) + int(ICAL_PRIORITY_STEP/2)) / int(ICAL_PRIORITY_STEP) // round to the nearest band
+    if steps == 0 {
+        return 0
+    }
+    if steps > 9 {
+        steps = 9
+    }
+    return 10 - steps
+}
+
+func icalToPriority(ical_priority int) uint16 {
+    if ical_priority < 1 || ical_priority > 9 {
+        return 0
+    }
+    return uint16(10 - ical_priority) * ICAL_PRIORITY_STEP
+}
+
+// TEXT values need backslashes, semicolons, commas and newlines escaped.
+func escapeICalText(in_str string) string {
+    replacer := strings.NewReplacer("\\", "\\\\", ";", "\\;", ",", "\\,", "\r\n", "\\n", "\n", "\\n")
+    return replacer.Replace(in_str)
+}
+
+func unescapeICalText(in_str string) string {
+    replacer := strings.NewReplacer("\\\\", "\\", "\\;", ";", "\\,", ",", "\\n", "\n", "\\N", "\n")
+    return replacer.Replace(in_str)
+}
+
+// Break a content line up into 75-octet pieces, with each continuation starting with a space.  Splits only happen
+// between characters so that multi-byte characters don't get cut in half.
+func foldICalLine(line string) string {
+    folded := strings.Builder{}
+    limit := ICAL_MAX_LINE_OCTETS
+    for len(line) > limit {
+        cut := limit
+        for cut > 0 && !utf8.RuneStart(line[cut]) {
+            cut--
+        }
+        folded.WriteString(line[:cut])
+        folded.WriteString("\r\n ")
+        line = line[cut:]
+        limit = ICAL_MAX_LINE_OCTETS - 1 // the leading space counts towards the length of the continuation lines
+    }
+    folded.WriteString(line)
+    folded.WriteString("\r\n")
+    return folded.String()
+}
+
+func writeICal(w io.Writer, out_list portable_list) error {
+    stamp := time.Now().UTC().Format("20060102T150405Z")
+    lines := []string{"BEGIN:VCALENDAR", "VERSION:2.0", "PRODID:" + ICAL_PRODID}
+    for _, task := range out_list.Tasks {
+        status := "NEEDS-ACTION"
+        if task.Completed {
+            status = "COMPLETED"
+        }
+        lines = append(lines,
+                       "BEGIN:VTODO",
+                       "UID:" + taskUID(out_list.List_ID, task.Reference_Number),
+                       "DTSTAMP:" + stamp,
+                       "SUMMARY:" + escapeICalText(task.Title),
+                       "DESCRIPTION:" + escapeICalText(task.Description),
+                       "PRIORITY:" + strconv.Itoa(priorityToICal(task.Priority)),
+                       "STATUS:" + status,
+                       "END:VTODO")
+        // Tasks don't have due dates on the server, so there's no DUE to write out.
+    }
+    lines = append(lines, "END:VCALENDAR")
+    for _, line := range lines {
+        if _, err_status := io.WriteString(w, foldICalLine(line)); err_status != nil {
+            return err_status
+        }
+    }
+    return nil
+}
+
+// Pull the VTODOs out of an iCalendar file.  Anything that isn't a VTODO (events, alarms, timezones) is skipped over.
+// Rows are counted by VTODO, so row 1 is the first VTODO in the file.
+func readICal(r io.Reader) ([]portable_task, []row_error) {
+    raw, err_status := io.ReadAll(r)
+    if err_status != nil {
+        return nil, []row_error{{row: 0, reason: fmt.Sprintf("Unable to read the file: %v", err_status)}}
+    }
+    // Unfold first: any line starting with a space or tab is a continuation of the one before it.
+    unfolded := []string{}
+    for _, line := range strings.Split(strings.ReplaceAll(string(raw), "\r\n", "\n"), "\n") {
+        if len(line) > 0 && (line[0] == ' ' || line[0] == '\t') && len(unfolded) > 0 {
+            unfolded[len(unfolded)-1] += line[1:]
+            continue
+        }
+        unfolded = append(unfolded, line)
+    }
+
+    tasks := []portable_task{}
+    row_errs := []row_error{}
+    var task *portable_task
+    task_err := ""
+    depth := 0 // how many components deep inside the VTODO we are, so that a VALARM's properties don't get mistaken for the task's
+    row := 0
+    for _, line := range unfolded {
+        name, value, ok := splitICalLine(line)
+        if !ok {
+            continue
+        }
+        switch {
+            case name == "BEGIN" && strings.EqualFold(value, "VTODO") && task == nil:
+                row++
+                task = &portable_task{row: row}
+                task_err = ""
+                depth = 0
+            case task == nil:
+                continue
+            case name == "BEGIN":
+                depth++
+            case name == "END" && depth > 0:
+                depth--
+            case name == "END" && strings.EqualFold(value, "VTODO"):
+                if task_err != "" {
+                    row_errs = append(row_errs, row_error{row: task.row, reason: task_err})
+                } else {
+                    tasks = append(tasks, *task)
+                }
+                task = nil
+            case depth > 0:
+                continue
+            case name == "UID":
+                if list_id, ref, is_ours := parseTaskUID(value); is_ours {
+                    task.from_list, task.Reference_Number = list_id, ref
+                    task.from_uid = true
+                }
+            case name == "SUMMARY":
+                task.Title = unescapeICalText(value)
+            case name == "DESCRIPTION":
+                task.Description = unescapeICalText(value)
+            case name == "PRIORITY":
+                ical_priority, parse_err := strconv.Atoi(strings.TrimSpace(value))
+                if parse_err != nil || ical_priority < 0 || ical_priority > 9 {
+                    task_err = fmt.Sprintf("PRIORITY '%v' isn't a number from 0 to 9.", value)
+                }
+                task.Priority = icalToPriority(ical_priority)
+            case name == "STATUS":
+                task.Completed = strings.EqualFold(strings.TrimSpace(value), "COMPLETED")
+            case name == "COMPLETED":
+                task.Completed = true // some tools only set the completion time and leave STATUS alone
+            // DUE is left alone since tasks on the server don't have due dates to put it in.
+        }
+    }
+    if task != nil {
+        row_errs = append(row_errs, row_error{row: task.row, reason: "The file ended before this VTODO did."})
+    }
+    return tasks, row_errs
+}
+
+// Split a content line into its property name (upper-cased, parameters dropped) and value.  The value starts
+// after the first colon that isn't inside a quoted parameter value.
+func splitICalLine(line string) (string, string, bool) {
+    in_quotes := false
+    for ii := 0; ii < len(line); ii++ {
+        switch line[ii] {
+            case '"':
+                in_quotes = !in_quotes
+            case ':':
+                if !in_quotes {
+                    name := line[:ii]
+                    if semi := strings.IndexByte(name, ';'); semi >= 0 {
+                        name = name[:semi]
+                    }
+                    return strings.ToUpper(strings.TrimSpace(name)), line[ii+1:], true
+                }
+        }
+    }
+    return "", "", false
+}
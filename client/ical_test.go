@@ -0,0 +1,125 @@
+package main
+
+import (
+    "bytes"
+    "strings"
+    "testing"
+    "unicode/utf8"
+)
+
+func sampleList() portable_list {
+    return portable_list{
+                         List_ID: 1,
+                         Tasks: []portable_task{
+                             {Reference_Number: 0, Title: "Grade this assignment", Description: "Give it an A", Priority: 9000, Completed: false},
+                             {Reference_Number: 7, Title: "Escapes; commas, and \\ backslashes", Description: "Line one\nLine two", Priority: 1000, Completed: true},
+                             {Reference_Number: 65535, Title: "No priority", Description: strings.Repeat("long description ünïcödé ", 20), Priority: 0, Completed: false},
+                         },
+                        }
+}
+
+func exportICal(t *testing.T, out_list portable_list) string {
+    t.Helper()
+    buff := bytes.Buffer{}
+    if err_status := writeICal(&buff, out_list); err_status != nil {
+        t.Fatalf("writeICal failed: %v", err_status)
+    }
+    return buff.String()
+}
+
+func TestICalRoundTrip(t *testing.T) {
+    out_list := sampleList()
+    tasks, row_errs := readICal(strings.NewReader(exportICal(t, out_list)))
+    if len(row_errs) != 0 {
+        t.Fatalf("unexpected row errors: %+v", row_errs)
+    }
+    if len(tasks) != len(out_list.Tasks) {
+        t.Fatalf("got %v tasks back, expected %v", len(tasks), len(out_list.Tasks))
+    }
+    for ii, want := range out_list.Tasks {
+        got := tasks[ii]
+        if !got.from_uid || got.from_list != out_list.List_ID || got.Reference_Number != want.Reference_Number {
+            t.Errorf("task %v: list %v reference number %v (from UID: %v), expected %v %v", ii, got.from_list, got.Reference_Number, got.from_uid, out_list.List_ID, want.Reference_Number)
+        }
+        if got.Title != want.Title || got.Description != want.Description {
+            t.Errorf("task %v: got title %q description %q, expected %q %q", ii, got.Title, got.Description, want.Title, want.Description)
+        }
+        if got.Priority != want.Priority || got.Completed != want.Completed {
+            t.Errorf("task %v: got priority %v completed %v, expected %v %v", ii, got.Priority, got.Completed, want.Priority, want.Completed)
+        }
+    }
+}
+
+func TestICalUIDStability(t *testing.T) {
+    out_list := sampleList()
+    first := exportICal(t, out_list)
+
+    // Same tasks in a different order with another task added and one of them changed - the UIDs of the
+    // tasks that were already there shouldn't budge.
+    changed := sampleList()
+    changed.Tasks[0].Completed = true
+    changed.Tasks[0].Title = "Graded"
+    changed.Tasks = append([]portable_task{{Reference_Number: 3, Title: "New", Description: "New"}}, changed.Tasks[2], changed.Tasks[0], changed.Tasks[1])
+    second := exportICal(t, changed)
+
+    for _, task := range out_list.Tasks {
+        uid_line := "UID:" + taskUID(out_list.List_ID, task.Reference_Number) + "\r\n"
+        if !strings.Contains(first, uid_line) || !strings.Contains(second, uid_line) {
+            t.Errorf("UID for task %v missing from one of the exports", task.Reference_Number)
+        }
+    }
+    if taskUID(1, 7) == taskUID(2, 7) {
+        t.Errorf("tasks with the same reference number in different lists share a UID")
+    }
+}
+
+func TestParseTaskUID(t *testing.T) {
+    list_id, ref, ok := parseTaskUID(taskUID(4, 1234))
+    if !ok || list_id != 4 || ref != 1234 {
+        t.Errorf("parseTaskUID(taskUID(4, 1234)) = %v, %v, %v", list_id, ref, ok)
+    }
+    for _, uid := range []string{"", "someone-elses-uid@example.com", "ptmp-list1-task2@ptmp.example.com", "ptmp-list1-task99999@ptmp"} {
+        if _, _, ok := parseTaskUID(uid); ok {
+            t.Errorf("parseTaskUID(%q) claimed it was one of ours", uid)
+        }
+    }
+}
+
+func TestICalPriorityMapping(t *testing.T) {
+    for ical_priority := 0; ical_priority <= 9; ical_priority++ {
+        if got := priorityToICal(icalToPriority(ical_priority)); got != ical_priority {
+            t.Errorf("PRIORITY %v came back as %v", ical_priority, got)
+        }
+    }
+    if priorityToICal(60000) != 1 || priorityToICal(65535) != 1 || priorityToICal(1) != 0 {
+        t.Errorf("out of range PTMP priorities should clamp to 1 and 0")
+    }
+}
+
+func TestICalLineFolding(t *testing.T) {
+    exported := exportICal(t, sampleList())
+    for _, line := range strings.Split(exported, "\r\n") {
+        if len(line) > ICAL_MAX_LINE_OCTETS {
+            t.Errorf("line longer than %v octets: %q", ICAL_MAX_LINE_OCTETS, line)
+        }
+        if !utf8.ValidString(line) {
+            t.Errorf("folding split a multi-byte character: %q", line)
+        }
+    }
+}
+
+func TestReadICalFromOtherTools(t *testing.T) {
+    in_file := "BEGIN:VCALENDAR\r\n" +
+               "BEGIN:VEVENT\r\nSUMMARY:Not a task\r\nEND:VEVENT\r\n" +
+               "BEGIN:VTODO\r\nUID:abc@example.com\r\nSUMMARY;LANGUAGE=en:Water\r\n  the plants\r\nDUE:20261020T090000Z\r\n" +
+               "COMPLETED:20261019T090000Z\r\nBEGIN:VALARM\r\nDESCRIPTION:Reminder\r\nEND:VALARM\r\nEND:VTODO\r\n" +
+               "BEGIN:VTODO\r\nSUMMARY:Bad\r\nPRIORITY:high\r\nEND:VTODO\r\n" +
+               "END:VCALENDAR\r\n"
+    tasks, row_errs := readICal(strings.NewReader(in_file))
+    if len(tasks) != 1 || tasks[0].Title != "Water the plants" || !tasks[0].Completed || tasks[0].from_uid || tasks[0].Description != "" {
+        t.Errorf("unexpected tasks: %+v", tasks)
+    }
+    if len(row_errs) != 1 || row_errs[0].row != 2 {
+        t.Errorf("expected an error for the second VTODO, got %+v", row_errs)
+    }
+}
@@ -0,0 +1,523 @@
+package main
+
+import (
+    "context"
+    "encoding/csv"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "ajb497/ptmp/ptmpclient"
+    "ajb497/ptmp"
+    "net/url"
+    "os"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "strings"
+    "unicode/utf8"
+)
+
+const (
+    FORMAT_JSON string = "json"
+    FORMAT_CSV string = "csv"
+    FORMAT_TODOTXT string = "todo.txt"
+)
+
+// todo.txt priorities are the letters A (most important) through Z, and PTMP priorities are plain numbers where bigger
+// means more important, so each letter stands for a band of this many priority values: (A) = 26000, (B) = 25000, ..., (Z) = 1000.
+// A task with no todo.txt priority gets a priority value of 0, and anything under 500 exports without a letter.
+const TODOTXT_PRIORITY_STEP uint16 = 1000
+
+// How many creates an import puts in each transaction: few enough that the server's answer has room to list the
+// reference number of every one of them (see ptmp.Detailed_Acknowledgment).
+const IMPORT_BATCH_SIZE int = 200
+
+// A task in the form it takes in an exported file, independent of the file format.
+type portable_task struct {
+    Reference_Number uint16 `json:"ref"`
+    Title string `json:"title"`
+    Description string `json:"description"`
+    Priority uint16 `json:"priority"`
+    Completed bool `json:"completed"`
+    row int // where the task came from in an imported file, for error reporting
+    from_uid bool // whether Reference_Number (and from_list) were read from one of our own iCalendar UIDs
+    from_list uint16 // the list the task was exported from, if from_uid
+    ref_known bool // whether Reference_Number is the one the server gave the task when it was imported
+}
+
+type portable_list struct {
+    List_ID uint16 `json:"list_id"`
+    Tasks []portable_task `json:"tasks"`
+}
+
+// A problem with one row of an imported file.  Row numbers count from 1 (and include the header line for CSV)
+// so that they match up with what someone sees when they open the file.  For JSON, the row is the task's position in the tasks array.
+type row_error struct {
+    row int
+    reason string
+}
+
+// Figure out which format a file is in (or should be written in) from its name.
+func formatFromFilename(filename string) (string, error) {
+    lower := strings.ToLower(filename)
+    switch {
+        case strings.HasSuffix(lower, ".json"):
+            return FORMAT_JSON, nil
+        case strings.HasSuffix(lower, ".csv"):
+            return FORMAT_CSV, nil
+        case strings.HasSuffix(lower, ".txt"):
+            return FORMAT_TODOTXT, nil
+        case strings.HasSuffix(lower, ".ics"):
+            return FORMAT_ICAL, nil
+    }
+    return "", fmt.Errorf("Can't tell the format of %v from its name (expected .json, .csv, .txt or .ics).", filepath.Base(filename))
+}
+
+// Ask the server for every task in the list, a page at a time, sorted by reference number.  A version 1 server can
+// only be asked for everything it's holding, which is list 1 (see listTasksV1), and a list the server doesn't have
+// comes back as its LIST_DOES_NOT_EXIST.
+func queryListTasks(ctx context.Context, list_id uint16) ([]ptmpclient.Task, error) {
+    query := ptmpclient.TaskQuery{Lists: []uint16{list_id}}
+    tasks := []ptmpclient.Task{}
+    for {
+        page, err_status := client.SearchTasks(ctx, query)
+        if errors.Is(err_status, ptmpclient.ErrProtocolVersionsIncompatible) {
+            tasks, err_status = listTasksV1(ctx, client, ptmpclient.TaskQuery{Lists: query.Lists, Max_Priority: 65535})
+            if err_status != nil {
+                return nil, err_status
+            }
+            break
+        }
+        if err_status != nil {
+            return nil, err_status
+        }
+        tasks = append(tasks, page.Tasks...)
+        if page.Next_Cursor == nil {
+            break
+        }
+        query.Cursor = page.Next_Cursor
+    }
+    sort.Slice(tasks, func(ii, jj int) bool {
+        return tasks[ii].Ref < tasks[jj].Ref
+    })
+    return tasks, nil
+}
+
+// Write out everything in the given list to a file, in whichever format the filename calls for.
+func exportList(ctx context.Context, list_id uint16, filename string) error {
+    format, err_status := formatFromFilename(filename)
+    if err_status != nil {
+        return err_status
+    }
+    was_printing := PRINT_MSGS
+    PRINT_MSGS = false
+    tasks, err_status := queryListTasks(ctx, list_id)
+    PRINT_MSGS = was_printing
+    if err_status != nil {
+        return err_status
+    }
+
+    out_list := portable_list{List_ID: list_id, Tasks: []portable_task{}}
+    for _, task := range tasks {
+        out_list.Tasks = append(out_list.Tasks, portable_task{
+                                                             Reference_Number: task.Ref,
+                                                             Title: task.Title,
+                                                             Description: task.Description,
+                                                             Priority: task.Priority,
+                                                             Completed: task.Completed,
+                                                            })
+    }
+
+    fileHandle, err_status := os.Create(filename)
+    if err_status != nil {
+        return err_status
+    }
+    defer fileHandle.Close()
+    switch format {
+        case FORMAT_JSON:
+            err_status = writeJSON(fileHandle, out_list)
+        case FORMAT_CSV:
+            err_status = writeCSV(fileHandle, out_list.Tasks)
+        case FORMAT_TODOTXT:
+            err_status = writeTodoTxt(fileHandle, out_list.Tasks)
+        case FORMAT_ICAL:
+            err_status = writeICal(fileHandle, out_list)
+    }
+    if err_status == nil {
+        fmt.Printf("Exported %v task(s) from list %v to %v.\n", len(out_list.Tasks), list_id, filename)
+    }
+    return err_status
+}
+
+func writeJSON(w io.Writer, out_list portable_list) error {
+    encoder := json.NewEncoder(w)
+    encoder.SetIndent("", "  ")
+    return encoder.Encode(out_list)
+}
+
+func writeCSV(w io.Writer, tasks []portable_task) error {
+    csv_writer := csv.NewWriter(w)
+    csv_writer.Write([]string{"title", "description", "priority", "completed"})
+    for _, task := range tasks {
+        csv_writer.Write([]string{task.Title, task.Description, strconv.Itoa(int(task.Priority)), strconv.FormatBool(task.Completed)})
+    }
+    csv_writer.Flush()
+    return csv_writer.Error()
+}
+
+// todo.txt only has the one line of text per task, so the title is the text and the description rides along as a
+// desc: tag (escaped, since tag values can't have spaces in them).
+func writeTodoTxt(w io.Writer, tasks []portable_task) error {
+    for _, task := range tasks {
+        line := ""
+        if task.Completed {
+            line += "x "
+        }
+        if letter, has_letter := priorityToLetter(task.Priority); has_letter {
+            line += "(" + string(letter) + ") "
+        }
+        line += task.Title
+        if task.Description != task.Title {
+            line += " desc:" + url.QueryEscape(task.Description)
+        }
+        if _, err_status := fmt.Fprintln(w, line); err_status != nil {
+            return err_status
+        }
+    }
+    return nil
+}
+
+func priorityToLetter(priority uint16) (byte, bool) {
+    // (rounded as an int, since anything within half a step of 65535 would wrap around as a uint16)
+    steps := (int(priority) + int(TODOTXT_PRIORITY_STEP/2)) / int(TODOTXT_PRIORITY_STEP) // round to the nearest band
+    if steps == 0 {
+        return 0, false
+    }
+    if steps > 26 {
+        steps = 26
+    }
+    return byte('A' + 26 - steps), true
+}
+
+func letterToPriority(letter byte) uint16 {
+    return uint16(26 - (letter - 'A')) * TODOTXT_PRIORITY_STEP
+}
+
+func readJSON(r io.Reader) ([]portable_task, []row_error) {
+    in_list := portable_list{}
+    if err_status := json.NewDecoder(r).Decode(&in_list); err_status != nil {
+        return nil, []row_error{{row: 0, reason: fmt.Sprintf("Unable to parse the file: %v", err_status)}}
+    }
+    for ii := range in_list.Tasks {
+        in_list.Tasks[ii].row = ii+1
+    }
+    return in_list.Tasks, nil
+}
+
+func readCSV(r io.Reader) ([]portable_task, []row_error) {
+    csv_reader := csv.NewReader(r)
+    csv_reader.FieldsPerRecord = -1 // rows with the wrong number of columns get reported per-row below instead of stopping everything
+    header, err_status := csv_reader.Read()
+    if err_status != nil {
+        return nil, []row_error{{row: 1, reason: fmt.Sprintf("Unable to read the header line: %v", err_status)}}
+    }
+    // Columns are found by name so that they can be in any order (and extra columns are just ignored).
+    columns := map[string]int{}
+    for ii, name := range header {
+        columns[strings.ToLower(strings.TrimSpace(name))] = ii
+    }
+    if _, has_title := columns["title"]; !has_title {
+        return nil, []row_error{{row: 1, reason: "The header line needs to have a 'title' column."}}
+    }
+
+    tasks := []portable_task{}
+    row_errs := []row_error{}
+    field := func(record []string, name string) string {
+        if idx, present := columns[name]; present && idx < len(record) {
+            return strings.TrimSpace(record[idx])
+        }
+        return ""
+    }
+    for row := 2; ; row++ {
+        record, err_status := csv_reader.Read()
+        if err_status == io.EOF {
+            break
+        }
+        if err_status != nil {
+            row_errs = append(row_errs, row_error{row: row, reason: err_status.Error()})
+            continue
+        }
+        task := portable_task{Title: field(record, "title"), Description: field(record, "description"), row: row}
+        if priority_str := field(record, "priority"); priority_str != "" {
+            priority, parse_err := strconv.ParseUint(priority_str, 10, 16)
+            if parse_err != nil {
+                row_errs = append(row_errs, row_error{row: row, reason: fmt.Sprintf("Priority '%v' isn't a number from 0 to 65535.", priority_str)})
+                continue
+            }
+            task.Priority = uint16(priority)
+        }
+        switch strings.ToLower(field(record, "completed")) {
+            case "", "false", "0", "no", "n":
+                task.Completed = false
+            case "true", "1", "yes", "y", "x":
+                task.Completed = true
+            default:
+                row_errs = append(row_errs, row_error{row: row, reason: fmt.Sprintf("Completed value '%v' isn't true or false.", field(record, "completed"))})
+                continue
+        }
+        tasks = append(tasks, task)
+    }
+    return tasks, row_errs
+}
+
+func readTodoTxt(r io.Reader) ([]portable_task, []row_error) {
+    raw, err_status := io.ReadAll(r)
+    if err_status != nil {
+        return nil, []row_error{{row: 0, reason: fmt.Sprintf("Unable to read the file: %v", err_status)}}
+    }
+    tasks := []portable_task{}
+    row_errs := []row_error{}
+    for ii, line := range strings.Split(string(raw), "\n") {
+        line = strings.TrimSpace(line)
+        if line == "" {
+            continue
+        }
+        task := portable_task{row: ii+1}
+        if strings.HasPrefix(line, "x ") {
+            task.Completed = true
+            line = strings.TrimSpace(line[2:])
+        }
+        if len(line) >= 4 && line[0] == '(' && line[1] >= 'A' && line[1] <= 'Z' && line[2] == ')' && line[3] == ' ' {
+            task.Priority = letterToPriority(line[1])
+            line = strings.TrimSpace(line[4:])
+        }
+        // Pull the desc: tag back out of the text, everything else (including other tags, projects and contexts) stays in the title.
+        words := []string{}
+        for _, word := range strings.Fields(line) {
+            if strings.HasPrefix(word, "desc:") {
+                description, unescape_err := url.QueryUnescape(word[len("desc:"):])
+                if unescape_err != nil {
+                    row_errs = append(row_errs, row_error{row: ii+1, reason: fmt.Sprintf("Unable to read the description: %v", unescape_err)})
+                    words = nil
+                    break
+                }
+                task.Description = description
+                continue
+            }
+            words = append(words, word)
+        }
+        if words == nil {
+            continue
+        }
+        task.Title = strings.Join(words, " ")
+        tasks = append(tasks, task)
+    }
+    return tasks, row_errs
+}
+
+// Make sure a task can actually be turned into a Create_New_Task message, so bad rows get reported by row number.
+// The protocol requires a description, so a task without one gets its title as the description.
+func validateImport(task *portable_task) string {
+    if task.Description == "" {
+        task.Description = task.Title
+    }
+    if !utf8.ValidString(task.Title) || !utf8.ValidString(task.Description) {
+        return "Title and description must be UTF-8."
+    }
+    if len(task.Title) < 1 || len(task.Title) > int(ptmp.TITLE_MAX_LENGTH) {
+        return fmt.Sprintf("Title must be between 1 and %v characters long.", ptmp.TITLE_MAX_LENGTH)
+    }
+    if len(task.Description) > int(ptmp.DESCRIPTION_MAX_LENGTH) {
+        return fmt.Sprintf("Description must be no more than %v characters long.", ptmp.DESCRIPTION_MAX_LENGTH)
+    }
+    return ""
+}
+
+// Read tasks in from a file and create them on the server in the given list, reporting any rows that couldn't be
+// read or were rejected by the server.
+func importList(ctx context.Context, list_id uint16, filename string) error {
+    format, err_status := formatFromFilename(filename)
+    if err_status != nil {
+        return err_status
+    }
+    fileHandle, err_status := os.Open(filename)
+    if err_status != nil {
+        return err_status
+    }
+    var tasks []portable_task
+    var row_errs []row_error
+    switch format {
+        case FORMAT_JSON:
+            tasks, row_errs = readJSON(fileHandle)
+        case FORMAT_CSV:
+            tasks, row_errs = readCSV(fileHandle)
+        case FORMAT_TODOTXT:
+            tasks, row_errs = readTodoTxt(fileHandle)
+        case FORMAT_ICAL:
+            tasks, row_errs = readICal(fileHandle)
+    }
+    fileHandle.Close()
+
+    was_printing := PRINT_MSGS
+    PRINT_MSGS = false
+    defer func() { PRINT_MSGS = was_printing }()
+
+    before, err_status := queryListTasks(ctx, list_id)
+    if err_status != nil {
+        return err_status
+    }
+    existing := map[uint16]bool{}
+    for _, task := range before {
+        existing[task.Ref] = true
+    }
+
+    // Everything gets checked before anything is sent, so that bad rows never make it onto the wire.
+    to_create := []portable_task{}
+    for ii := range tasks {
+        if reason := validateImport(&tasks[ii]); reason != "" {
+            row_errs = append(row_errs, row_error{row: tasks[ii].row, reason: reason})
+            continue
+        }
+        // A task carrying one of our own UIDs for a task that's still in this list came from an earlier export of
+        // it, so importing it again would just make a duplicate.  (One exported from another list is a different
+        // task, whatever its reference number.)
+        if tasks[ii].from_uid && tasks[ii].from_list == list_id && existing[tasks[ii].Reference_Number] {
+            row_errs = append(row_errs, row_error{row: tasks[ii].row, reason: fmt.Sprintf("Task '%v' is already on the server (reference number %v).", tasks[ii].Title, tasks[ii].Reference_Number)})
+            continue
+        }
+        to_create = append(to_create, tasks[ii])
+    }
+    created, create_errs, err_status := createImported(ctx, list_id, to_create)
+    row_errs = append(row_errs, create_errs...)
+    if err_status != nil {
+        return err_status
+    }
+    // New tasks can only be made incomplete, so the completed ones get marked completed afterwards, going by the
+    // reference numbers the server said they got.  (All of the completions go out together too, the same way the
+    // creates did.)
+    to_complete := []uint16{}
+    unknown := 0
+    for _, task := range created {
+        switch {
+            case !task.Completed:
+                continue
+            case task.ref_known:
+                to_complete = append(to_complete, task.Reference_Number)
+            default:
+                unknown++
+        }
+    }
+    if unknown > 0 {
+        msg_logger.Warn("The server didn't say what reference numbers the new tasks got, so some completed tasks were imported as incomplete", "list", list_id, "tasks", unknown)
+    }
+    if err_status = completeImported(ctx, list_id, to_complete); err_status != nil {
+        msg_logger.Warn("Unable to mark the completed imported tasks completed", "list", list_id, "error", err_status)
+    }
+
+    sort.Slice(row_errs, func(ii, jj int) bool { return row_errs[ii].row < row_errs[jj].row })
+    fmt.Printf("Imported %v of %v task(s) into list %v from %v.\n", len(created), len(tasks), list_id, filename)
+    for _, row_err := range row_errs {
+        fmt.Printf("\tRow %v: %v\n", row_err.row, row_err.reason)
+    }
+    return nil
+}
+
+// Create the imported tasks in as few exchanges as it takes: transactions of up to IMPORT_BATCH_SIZE creates each.
+// A transaction is all-or-nothing, so when the server turns one of its creates away, that row gets reported and the
+// rest of the transaction goes again without it.  Servers that don't take transactions get the creates one at a time
+// instead.  Comes back with the tasks that were created, in the order they were created, and the rows the server
+// turned away.  The created tasks have the reference numbers they got, if the server said (see ref_known).
+func createImported(ctx context.Context, list_id uint16, to_create []portable_task) ([]portable_task, []row_error, error) {
+    created := []portable_task{}
+    row_errs := []row_error{}
+    rejected := func(task portable_task, response_code uint16) {
+        row_errs = append(row_errs, row_error{row: task.row, reason: fmt.Sprintf("Server rejected the task '%v' with %v.", task.Title, ptmpclient.ResponseCodeName(response_code))})
+    }
+    one_at_a_time := false
+    for len(to_create) > 0 {
+        if one_at_a_time {
+            task := to_create[0]
+            ref, ref_known, err_status := client.CreateTaskRef(ctx, list_id, task.Priority, task.Title, task.Description)
+            var rejection *ptmpclient.ResponseError
+            if errors.As(err_status, &rejection) {
+                rejected(task, rejection.Response_Code)
+            } else if err_status != nil {
+                return created, row_errs, err_status
+            } else {
+                if ref_known {
+                    task.Reference_Number, task.ref_known = ref, true
+                }
+                created = append(created, task)
+            }
+            to_create = to_create[1:]
+            continue
+        }
+
+        chunk := to_create
+        if len(chunk) > IMPORT_BATCH_SIZE {
+            chunk = chunk[:IMPORT_BATCH_SIZE]
+        }
+        batch := &ptmpclient.Batch{}
+        for _, task := range chunk {
+            batch.CreateTask(list_id, task.Priority, task.Title, task.Description)
+        }
+        items, err_status := client.CommitResults(ctx, batch)
+        var failure *ptmpclient.TransactionError
+        switch {
+            case err_status == nil:
+                // (one item per create, in the order they were added, if the server said)
+                for ii, task := range chunk {
+                    if len(items) == len(chunk) {
+                        task.Reference_Number, task.ref_known = items[ii].Ref, true
+                    }
+                    created = append(created, task)
+                }
+                to_create = to_create[len(chunk):]
+            case errors.As(err_status, &failure) && failure.Index >= 0 && failure.Index < len(chunk):
+                // (none of the transaction was made, so everything in it but the bad row goes again)
+                rejected(chunk[failure.Index], failure.Response_Code)
+                to_create = append(append([]portable_task{}, to_create[:failure.Index]...), to_create[failure.Index+1:]...)
+            case transactionsNotImplemented(err_status):
+                one_at_a_time = true
+            default:
+                return created, row_errs, err_status
+        }
+    }
+    return created, row_errs, nil
+}
+
+// Mark the imported tasks that were completed in the file completed, in transactions like createImported (or one at
+// a time, for servers that don't take them).
+func completeImported(ctx context.Context, list_id uint16, refs []uint16) error {
+    for len(refs) > 0 {
+        chunk := refs
+        if len(chunk) > ptmpclient.MAX_BATCH_CHANGES {
+            chunk = chunk[:ptmpclient.MAX_BATCH_CHANGES]
+        }
+        batch := &ptmpclient.Batch{}
+        for _, ref := range chunk {
+            batch.CompleteTask(list_id, ref)
+        }
+        err_status := client.Commit(ctx, batch)
+        if transactionsNotImplemented(err_status) {
+            for _, ref := range refs {
+                if err_status = client.CompleteTask(ctx, list_id, ref); err_status != nil {
+                    return err_status
+                }
+            }
+            return nil
+        }
+        if err_status != nil {
+            return err_status
+        }
+        refs = refs[len(chunk):]
+    }
+    return nil
+}
+
+// Whether a Commit was turned away because the server doesn't do transactions at all.
+func transactionsNotImplemented(err_status error) bool {
+    var rejection *ptmpclient.ResponseError
+    return errors.As(err_status, &rejection) && rejection.Response_Code == ptmp.MSG_NOT_IMPLEMENTED && rejection.Msg_Type_ID == ptmp.TRANSACTION
+}
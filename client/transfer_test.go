@@ -0,0 +1,398 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "errors"
+    "ajb497/ptmp/ptmpclient"
+    "ajb497/ptmp"
+    "ajb497/ptmp/ptmpserver"
+    "net"
+    "os"
+    "path/filepath"
+    "strings"
+    "sync"
+    "testing"
+)
+
+const TEST_UNAME string = "Ed Ucational"
+const TEST_PW string = "p@55w0rd"
+
+// A server holding list 1 in memory, for importing into.  It turns away any task titled "Reject ..." with
+// UNABLE_TO_COMPLY, makes another task of its own just before any titled "Crowded ..." (like another session
+// creating one at the same time), and counts the messages of each type it gets so that tests can see how the import
+// talked to it.
+type test_store struct {
+    lock sync.Mutex
+    tasks []ptmp.T_Inf
+    next_ref uint16
+    received map[byte]int
+}
+
+func (store *test_store) create(w ptmpserver.ResponseWriter, r *ptmpserver.Request) {
+    creation := ptmp.DecodePayload[ptmp.Create_New_Task](r.Msg.Pld)
+    if creation.Associated_List_ID != 1 {
+        w.Ack(ptmp.LIST_DOES_NOT_EXIST)
+        return
+    }
+    if strings.HasPrefix(string(creation.Task_Title), "Reject") {
+        w.Ack(ptmp.UNABLE_TO_COMPLY)
+        return
+    }
+    if strings.HasPrefix(string(creation.Task_Title), "Crowded") {
+        store.tasks = append(store.tasks, ptmp.T_Inf{Task_Reference_Number: store.next_ref, Length_of_Title: 14, Task_Title: []byte("Someone else's"), Task_Description: []byte{}})
+        store.next_ref++
+    }
+    store.tasks = append(store.tasks, ptmp.T_Inf{
+                                                 Task_Reference_Number: store.next_ref,
+                                                 Task_Priority_Value: creation.Priority_Value,
+                                                 Length_of_Title: byte(len(creation.Task_Title)),
+                                                 Task_Title: creation.Task_Title,
+                                                 Description_Length: uint16(len(creation.Task_Description)),
+                                                 Task_Description: creation.Task_Description,
+                                                })
+    store.next_ref++
+    ptmpserver.AckDetailed(w, r, ptmp.SINGULAR_MSG_SUCCESS, []ptmp.Item_Result{{Task_Reference_Number: store.next_ref-1, Response_Code: ptmp.SINGULAR_MSG_SUCCESS}}, "")
+}
+
+func (store *test_store) complete(w ptmpserver.ResponseWriter, r *ptmpserver.Request) {
+    marking := ptmp.DecodePayload[ptmp.Mark_Task_Completed](r.Msg.Pld)
+    for ii := range store.tasks {
+        if marking.List_ID == 1 && store.tasks[ii].Task_Reference_Number == marking.Task_To_Mark {
+            store.tasks[ii].Completion_Status = ptmp.Bool2Byte(true)
+            w.Ack(ptmp.SINGULAR_MSG_SUCCESS)
+            return
+        }
+    }
+    w.Ack(ptmp.TASK_DOES_NOT_EXIST)
+}
+
+// Version 2 queries only get list 1 (there isn't any other), and end with the page end; version 1 queries get
+// everything.
+func (store *test_store) query(w ptmpserver.ResponseWriter, r *ptmpserver.Request) {
+    if r.Msg.Hdr.Protocol_Version >= ptmp.PROTOCOL_VERSION_2 {
+        for _, list_id := range ptmp.DecodePayload[ptmp.Query_Tasks_V2](r.Msg.Pld).List_IDs {
+            if list_id != 1 {
+                w.Ack(ptmp.LIST_DOES_NOT_EXIST)
+                return
+            }
+        }
+        for ii := range store.tasks {
+            w.Send(ptmp.Prep_Task_Information(store.tasks[ii:ii+1], byte(len(store.tasks)-ii)))
+        }
+        w.Send(ptmp.Prep_Task_Page_End(uint16(len(store.tasks)), nil))
+        return
+    }
+    if len(store.tasks) == 0 {
+        w.Ack(ptmp.UNABLE_TO_COMPLY)
+        return
+    }
+    for ii := range store.tasks {
+        w.Send(ptmp.Prep_Task_Information(store.tasks[ii:ii+1], byte(len(store.tasks)-1-ii)))
+    }
+}
+
+// Start the server (taking transactions or not), and point the client at it, logged in.
+func startTestStore(t *testing.T, transactions bool) *test_store {
+    t.Helper()
+    store := &test_store{received: map[byte]int{}}
+    srv := ptmpserver.NewServer(func(username string, password string) (bool, bool) {
+        return username == TEST_UNAME, password == TEST_PW
+    })
+    srv.Reply_Pacing = 0
+    srv.Extensions = []uint16{ptmp.EXT_DETAILED_ACKS}
+    srv.Use(func(next ptmpserver.Handler) ptmpserver.Handler {
+        return ptmpserver.HandlerFunc(func(w ptmpserver.ResponseWriter, r *ptmpserver.Request) {
+            store.lock.Lock()
+            defer store.lock.Unlock()
+            store.received[r.Msg.Hdr.Msg_Type_ID]++
+            next.ServePTMP(w, r)
+        })
+    })
+    if transactions {
+        srv.Atomically = func(apply func() bool) {
+            tasks, next_ref := append([]ptmp.T_Inf{}, store.tasks...), store.next_ref
+            if !apply() {
+                store.tasks, store.next_ref = tasks, next_ref
+            }
+        }
+    }
+    srv.HandleFunc(ptmp.CREATE_NEW_TASK, store.create)
+    srv.HandleFunc(ptmp.MARK_TASK_COMPLETED, store.complete)
+    srv.HandleFunc(ptmp.QUERY_TASKS, store.query)
+
+    listener, err_status := net.Listen("tcp", "127.0.0.1:0")
+    if err_status != nil {
+        t.Fatal(err_status)
+    }
+    t.Cleanup(func() { listener.Close() })
+    go srv.Serve(listener)
+
+    ctx, cancel := requestContext()
+    defer cancel()
+    was_client := client
+    client, err_status = ptmpclient.Dial(ctx, listener.Addr().String())
+    if err_status != nil {
+        t.Fatal(err_status)
+    }
+    if err_status = client.Login(ctx, TEST_UNAME, TEST_PW); err_status != nil {
+        t.Fatal(err_status)
+    }
+    t.Cleanup(func() {
+        client.Close()
+        client = was_client
+    })
+    return store
+}
+
+func (store *test_store) snapshot() ([]ptmp.T_Inf, map[byte]int) {
+    store.lock.Lock()
+    defer store.lock.Unlock()
+    received := map[byte]int{}
+    for msg_type, count := range store.received {
+        received[msg_type] = count
+    }
+    return append([]ptmp.T_Inf{}, store.tasks...), received
+}
+
+func TestTransferRoundTrip(t *testing.T) {
+    out_list := sampleList()
+    for _, format := range []string{FORMAT_JSON, FORMAT_CSV, FORMAT_TODOTXT} {
+        buff := bytes.Buffer{}
+        var err_status error
+        var tasks []portable_task
+        var row_errs []row_error
+        switch format {
+            case FORMAT_JSON:
+                err_status = writeJSON(&buff, out_list)
+                tasks, row_errs = readJSON(&buff)
+            case FORMAT_CSV:
+                err_status = writeCSV(&buff, out_list.Tasks)
+                tasks, row_errs = readCSV(&buff)
+            case FORMAT_TODOTXT:
+                err_status = writeTodoTxt(&buff, out_list.Tasks)
+                tasks, row_errs = readTodoTxt(&buff)
+        }
+        if err_status != nil || len(row_errs) != 0 {
+            t.Fatalf("%v: write failed with %v, read had row errors %+v", format, err_status, row_errs)
+        }
+        if len(tasks) != len(out_list.Tasks) {
+            t.Fatalf("%v: got %v tasks back, expected %v", format, len(tasks), len(out_list.Tasks))
+        }
+        for ii, want := range out_list.Tasks {
+            got := tasks[ii]
+            // (CSV fields get the spaces around them trimmed on the way in, since people hand-edit them)
+            if format == FORMAT_CSV {
+                want.Description = strings.TrimSpace(want.Description)
+            }
+            if got.Title != want.Title || got.Description != want.Description {
+                t.Errorf("%v task %v: got title %q description %q, expected %q %q", format, ii, got.Title, got.Description, want.Title, want.Description)
+            }
+            if got.Priority != want.Priority || got.Completed != want.Completed {
+                t.Errorf("%v task %v: got priority %v completed %v, expected %v %v", format, ii, got.Priority, got.Completed, want.Priority, want.Completed)
+            }
+        }
+    }
+}
+
+func TestTodoTxtPriorityLetters(t *testing.T) {
+    for _, test := range []struct {
+        priority uint16
+        letter byte
+        has_letter bool
+    }{
+        {0, 0, false},
+        {499, 0, false},
+        {500, 'Z', true},
+        {1000, 'Z', true},
+        {26000, 'A', true},
+        {60000, 'A', true},
+        {65535, 'A', true},
+    } {
+        if letter, has_letter := priorityToLetter(test.priority); letter != test.letter || has_letter != test.has_letter {
+            t.Errorf("priority %v got letter %q (%v), expected %q (%v)", test.priority, letter, has_letter, test.letter, test.has_letter)
+        }
+    }
+}
+
+func TestReadCSVRowErrors(t *testing.T) {
+    in_file := "title,priority,completed\n" +
+               "Good one,1000,false\n" +
+               "Bad priority,lots,false\n" +
+               "Bad completed,5,maybe\n" +
+               "Another good one,,x\n"
+    tasks, row_errs := readCSV(strings.NewReader(in_file))
+    if len(tasks) != 2 || tasks[0].row != 2 || tasks[1].row != 5 || !tasks[1].Completed {
+        t.Errorf("got tasks %+v", tasks)
+    }
+    if len(row_errs) != 2 || row_errs[0].row != 3 || row_errs[1].row != 4 {
+        t.Errorf("got row errors %+v, expected rows 3 and 4", row_errs)
+    }
+    if _, row_errs = readCSV(strings.NewReader("name,priority\nNo title column,1\n")); len(row_errs) != 1 || row_errs[0].row != 1 {
+        t.Errorf("a header without a title column got %+v", row_errs)
+    }
+}
+
+// The creates and completions go out in transactions, a row the server turns away is reported without taking the
+// rest of its transaction down with it, and each task is made exactly once.
+func TestImportInTransactions(t *testing.T) {
+    store := startTestStore(t, true)
+    filename := filepath.Join(t.TempDir(), "import.csv")
+    in_file := "title,description,priority,completed\n" +
+               "Grade this assignment,Give it an A,9000,false\n" +
+               "Reject this one,,1000,false\n" +
+               ",No title,1000,false\n" +
+               "Already graded,,2000,true\n" +
+               "Grade the next one,,3000,true\n"
+    if err_status := os.WriteFile(filename, []byte(in_file), 0644); err_status != nil {
+        t.Fatal(err_status)
+    }
+    ctx, cancel := requestContext()
+    defer cancel()
+    if err_status := importList(ctx, 1, filename); err_status != nil {
+        t.Fatalf("importList failed: %v", err_status)
+    }
+
+    tasks, received := store.snapshot()
+    want := []struct {
+        title string
+        completed bool
+    }{{"Grade this assignment", false}, {"Already graded", true}, {"Grade the next one", true}}
+    if len(tasks) != len(want) {
+        t.Fatalf("the server is holding %+v, expected %v tasks", tasks, len(want))
+    }
+    for ii, task := range tasks {
+        if string(task.Task_Title) != want[ii].title || ptmp.Byte2Bool(task.Completion_Status) != want[ii].completed {
+            t.Errorf("task %v is %q (completed %v), expected %q (completed %v)", ii, task.Task_Title, ptmp.Byte2Bool(task.Completion_Status), want[ii].title, want[ii].completed)
+        }
+    }
+    // one transaction that failed on the rejected row, the same again without it, and one with the completions
+    if received[ptmp.TRANSACTION] != 3 || received[ptmp.MARK_TASK_COMPLETED] != 2 {
+        t.Errorf("the server got %v transactions and %v completions, expected 3 and 2", received[ptmp.TRANSACTION], received[ptmp.MARK_TASK_COMPLETED])
+    }
+}
+
+func TestCreateImportedRowErrors(t *testing.T) {
+    for _, transactions := range []bool{true, false} {
+        store := startTestStore(t, transactions)
+        to_create := []portable_task{
+            {Title: "Reject me first", Description: "no", row: 2},
+            {Title: "Keep me", Description: "yes", row: 3},
+            {Title: "Reject me too", Description: "no", row: 4},
+            {Title: "Keep me too", Description: "yes", row: 5},
+        }
+        ctx, cancel := requestContext()
+        created, row_errs, err_status := createImported(ctx, 1, to_create)
+        cancel()
+        if err_status != nil {
+            t.Fatalf("transactions %v: createImported failed: %v", transactions, err_status)
+        }
+        if len(created) != 2 || created[0].row != 3 || created[1].row != 5 {
+            t.Errorf("transactions %v: created %+v, expected rows 3 and 5", transactions, created)
+        }
+        for ii := range created {
+            if !created[ii].ref_known || created[ii].Reference_Number != uint16(ii) {
+                t.Errorf("transactions %v: created task %v has reference number %v (known %v), expected %v", transactions, ii, created[ii].Reference_Number, created[ii].ref_known, ii)
+            }
+        }
+        if len(row_errs) != 2 || row_errs[0].row != 2 || row_errs[1].row != 4 || !strings.Contains(row_errs[0].reason, "UNABLE_TO_COMPLY") {
+            t.Errorf("transactions %v: got row errors %+v, expected rows 2 and 4 turned away", transactions, row_errs)
+        }
+        if tasks, received := store.snapshot(); len(tasks) != 2 || (received[ptmp.TRANSACTION] == 0) != !transactions {
+            t.Errorf("transactions %v: the server is holding %+v after %v transactions", transactions, tasks, received[ptmp.TRANSACTION])
+        }
+    }
+}
+
+func TestImportToMissingList(t *testing.T) {
+    startTestStore(t, true)
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+    _, row_errs, err_status := createImported(ctx, 7, []portable_task{{Title: "Nowhere to go", Description: "list 7", row: 1}})
+    if err_status != nil || len(row_errs) != 1 || !strings.Contains(row_errs[0].reason, "LIST_DOES_NOT_EXIST") {
+        t.Errorf("creating in list 7 got %v, row errors %+v", err_status, row_errs)
+    }
+}
+
+// Exporting a list the server doesn't have is the server's LIST_DOES_NOT_EXIST, rather than some other list's tasks.
+func TestExportList(t *testing.T) {
+    store := startTestStore(t, true)
+    store.tasks = []ptmp.T_Inf{{Task_Reference_Number: 3, Task_Priority_Value: 10, Length_of_Title: 4, Task_Title: []byte("Keep"), Description_Length: 0, Task_Description: []byte{}}}
+    ctx, cancel := requestContext()
+    defer cancel()
+
+    filename := filepath.Join(t.TempDir(), "export.json")
+    if err_status := exportList(ctx, 7, filename); !errors.Is(err_status, ptmpclient.ErrListDoesNotExist) {
+        t.Errorf("Exporting list 7 got %v, expected LIST_DOES_NOT_EXIST", err_status)
+    }
+    if err_status := exportList(ctx, 1, filename); err_status != nil {
+        t.Fatalf("Exporting list 1 failed: %v", err_status)
+    }
+    in_file, err_status := os.Open(filename)
+    if err_status != nil {
+        t.Fatal(err_status)
+    }
+    defer in_file.Close()
+    tasks, row_errs := readJSON(in_file)
+    if len(row_errs) != 0 || len(tasks) != 1 || tasks[0].Title != "Keep" || tasks[0].Reference_Number != 3 {
+        t.Errorf("List 1 exported as %+v (row errors %+v)", tasks, row_errs)
+    }
+}
+
+// A task exported from list 1 that's still there is a duplicate, but one with the same reference number exported
+// from another list isn't.
+func TestImportSkipsOwnDuplicates(t *testing.T) {
+    store := startTestStore(t, true)
+    store.tasks = []ptmp.T_Inf{{Task_Reference_Number: 0, Length_of_Title: 5, Task_Title: []byte("First"), Task_Description: []byte{}}}
+    store.next_ref = 1
+    exported := func(list_id uint16, title string) string {
+        buff := bytes.Buffer{}
+        if err_status := writeICal(&buff, portable_list{List_ID: list_id, Tasks: []portable_task{{Reference_Number: 0, Title: title, Description: "exported"}}}); err_status != nil {
+            t.Fatal(err_status)
+        }
+        return buff.String()
+    }
+    filename := filepath.Join(t.TempDir(), "import.ics")
+    in_file := exported(1, "First") + exported(2, "From list 2")
+    if err_status := os.WriteFile(filename, []byte(in_file), 0644); err_status != nil {
+        t.Fatal(err_status)
+    }
+    ctx, cancel := requestContext()
+    defer cancel()
+    if err_status := importList(ctx, 1, filename); err_status != nil {
+        t.Fatalf("importList failed: %v", err_status)
+    }
+    if tasks, _ := store.snapshot(); len(tasks) != 2 || string(tasks[1].Task_Title) != "From list 2" {
+        t.Errorf("The server is holding %+v, expected the first task and the one from list 2", tasks)
+    }
+}
+
+// Completions go to the tasks the import made, going by the reference numbers the server said they got, even when
+// someone else makes tasks in the list at the same time.
+func TestImportWithOtherCreates(t *testing.T) {
+    for _, transactions := range []bool{true, false} {
+        store := startTestStore(t, transactions)
+        filename := filepath.Join(t.TempDir(), "import.csv")
+        in_file := "title,description,priority,completed\n" +
+                   "Crowded out,,1000,true\n" +
+                   "Not done,,1000,false\n" +
+                   "Crowded again,,1000,true\n"
+        if err_status := os.WriteFile(filename, []byte(in_file), 0644); err_status != nil {
+            t.Fatal(err_status)
+        }
+        ctx, cancel := requestContext()
+        if err_status := importList(ctx, 1, filename); err_status != nil {
+            t.Fatalf("transactions %v: importList failed: %v", transactions, err_status)
+        }
+        cancel()
+        tasks, _ := store.snapshot()
+        if len(tasks) != 5 {
+            t.Fatalf("transactions %v: the server is holding %+v, expected 5 tasks", transactions, tasks)
+        }
+        for _, task := range tasks {
+            if want := strings.HasPrefix(string(task.Task_Title), "Crowded"); ptmp.Byte2Bool(task.Completion_Status) != want {
+                t.Errorf("transactions %v: %q has completed %v, expected %v", transactions, task.Task_Title, ptmp.Byte2Bool(task.Completion_Status), want)
+            }
+        }
+    }
+}
@@ -0,0 +1,1013 @@
+// Package conformance is a test suite for PTMP servers.  It connects to the server under test and walks it through
+// every state of the protocol's DFA (before the handshake, during it, once the connection is established, in the
+// middle of a transaction, and closing), sending every message type in each state and checking the exact replies
+// that come back.
+//
+// It only needs a way to open connections to the server, so it works for any PTMP server implementation, e.g.
+//
+//     func TestConformance(t *testing.T) {
+//         conformance.Run(t, conformance.Target{
+//             Dial: func() (net.Conn, error) { return net.Dial("tcp", "localhost:10101") },
+//             Username: "Ed Ucational",
+//             Password: "p@55w0rd",
+//         })
+//     }
+//
+// The server may serve one connection at a time; the suite never has more than one open at once.
+package conformance
+
+import (
+    "bufio"
+    "errors"
+    "fmt"
+    "io"
+    "ajb497/ptmp"
+    "net"
+    "os"
+    "strings"
+    "testing"
+    "time"
+)
+
+const DEFAULT_REPLY_TIMEOUT time.Duration = 5 * time.Second
+// What the suite proposes as its Max_Payload_Size when it's checking the negotiation.
+const PROPOSED_PAYLOAD_SIZE uint16 = 4096
+
+// The server under test.
+type Target struct {
+    // Opens a new connection to the server.
+    Dial func() (net.Conn, error)
+    // A username and password the server accepts.
+    Username string
+    Password string
+    // Puts the server back to having no tasks, trash or history.  The checks that depend on starting out empty
+    // (like querying an empty list) are skipped if this is nil.
+    Reset func()
+    // How long to wait for each reply.  Zero means DEFAULT_REPLY_TIMEOUT.
+    Reply_Timeout time.Duration
+}
+
+// A connection to the server under test, with helpers for checking what it sends back.
+type session struct {
+    t *testing.T
+    conn net.Conn
+    reader *bufio.Reader
+    timeout time.Duration
+    max_payload uint16 // what the handshake agreed to (0 for the original fixed framing)
+    version byte // the protocol version the handshake agreed to (0 until then)
+}
+
+func (target Target) connect(t *testing.T) *session {
+    t.Helper()
+    conn, err_status := target.Dial()
+    if err_status != nil {
+        t.Fatalf("Unable to connect to the server: %v", err_status)
+    }
+    timeout := target.Reply_Timeout
+    if timeout == 0 {
+        timeout = DEFAULT_REPLY_TIMEOUT
+    }
+    s := &session{t: t, conn: conn, reader: bufio.NewReader(conn), timeout: timeout}
+    t.Cleanup(func() { conn.Close() })
+    return s
+}
+
+// A connection that has already made it through the handshake.
+func (target Target) login(t *testing.T) *session {
+    t.Helper()
+    s := target.connect(t)
+    s.login(target.Username, target.Password)
+    return s
+}
+
+func (s *session) requestConnection(username string, password string, extensions ...uint16) *ptmp.Connection_Rules {
+    s.t.Helper()
+    if extensions == nil {
+        extensions = []uint16{}
+    }
+    return s.expectConnectionRules(ptmp.Prep_Request_Connection_V2(username, password, 0, []uint16{uint16(ptmp.CURR_PROTOCOL_VERSION)}, extensions, 0))
+}
+
+func (s *session) login(username string, password string) {
+    s.t.Helper()
+    rules := s.requestConnection(username, password)
+    if !ptmp.Byte2Bool(rules.Username_Ok) || !ptmp.Byte2Bool(rules.Password_Ok) {
+        s.t.Fatalf("The server didn't accept the target's username and password: %+v", rules)
+    }
+}
+
+// Close the connection properly, waiting for the server's ack so that a server that serves one connection at a
+// time is ready for the next one by the time this returns.
+func (s *session) close() {
+    s.t.Helper()
+    s.expectAck(ptmp.Prep_Close_Connection(true), ptmp.SINGULAR_MSG_SUCCESS)
+    s.expectClosed()
+}
+
+func (s *session) send(msg ptmp.PTMP_Msg) {
+    s.t.Helper()
+    packet, err_status := ptmp.EncodePacketFor(msg, s.max_payload)
+    if err_status != nil {
+        s.t.Fatalf("Unable to send message type %v: %v", msg.Hdr.Msg_Type_ID, err_status)
+    }
+    s.sendPacket(msg.Hdr.Msg_Type_ID, packet)
+}
+
+// Send a message that's already been encoded (which lets the suite send what a well-behaved client wouldn't).
+func (s *session) sendPacket(msg_type byte, packet []byte) {
+    s.t.Helper()
+    s.conn.SetWriteDeadline(time.Now().Add(s.timeout))
+    if _, err_status := s.conn.Write(packet); err_status != nil {
+        s.t.Fatalf("Unable to send message type %v: %v", msg_type, err_status)
+    }
+}
+
+// Read one message from the server.  A nil message means the connection was closed.
+func (s *session) read() (*ptmp.PTMP_Msg, error) {
+    s.conn.SetReadDeadline(time.Now().Add(s.timeout))
+    msg, err_status := ptmp.ReadPacket(s.reader, s.max_payload)
+    if errors.Is(err_status, io.EOF) {
+        return nil, nil
+    }
+    if err_status != nil {
+        return nil, err_status
+    }
+    return msg, nil
+}
+
+// Send a message and collect the whole reply, however many messages it takes.
+func (s *session) exchange(msg ptmp.PTMP_Msg) []*ptmp.PTMP_Msg {
+    s.t.Helper()
+    s.send(msg)
+    return s.replies(msg.Hdr.Msg_Type_ID)
+}
+
+// Collect the whole reply to a message that's already been sent.
+func (s *session) replies(msg_type byte) []*ptmp.PTMP_Msg {
+    s.t.Helper()
+    replies := []*ptmp.PTMP_Msg{}
+    for {
+        reply, err_status := s.read()
+        if err_status != nil {
+            s.t.Fatalf("No reply to message type %v: %v", msg_type, err_status)
+        }
+        if reply == nil {
+            s.t.Fatalf("The server closed the connection instead of replying to message type %v", msg_type)
+        }
+        // (until the handshake settles on a version, anything we speak will do)
+        if (s.version != 0 && reply.Hdr.Protocol_Version != s.version) || reply.Hdr.Protocol_Version < ptmp.PROTOCOL_VERSION_1 || reply.Hdr.Protocol_Version > ptmp.CURR_PROTOCOL_VERSION {
+            s.t.Errorf("Reply to message type %v has protocol version %v", msg_type, reply.Hdr.Protocol_Version)
+        }
+        replies = append(replies, reply)
+        if reply.Hdr.Msgs_To_Follow == 0 {
+            return replies
+        }
+    }
+}
+
+func describe(replies []*ptmp.PTMP_Msg) string {
+    described := []string{}
+    for _, reply := range replies {
+        if reply.Hdr.Msg_Type_ID == ptmp.ACKNOWLEDGMENT {
+            ack := ptmp.DecodePayload[ptmp.Acknowledgment](reply.Pld)
+            described = append(described, fmt.Sprintf("ack %v for type %v", ack.Response_Code, ack.ID_Responding_To))
+        } else if reply.Hdr.Msg_Type_ID == ptmp.DETAILED_ACKNOWLEDGMENT {
+            ack := ptmp.DecodePayload[ptmp.Detailed_Acknowledgment](reply.Pld)
+            described = append(described, fmt.Sprintf("detailed ack %v for type %v with items %v", ack.Response_Code, ack.ID_Responding_To, ack.Item_Results))
+        } else {
+            described = append(described, fmt.Sprintf("type %v", reply.Hdr.Msg_Type_ID))
+        }
+    }
+    return "[" + strings.Join(described, ", ") + "]"
+}
+
+// Send a message that should be answered with a single acknowledgment carrying the given code.
+func (s *session) expectAck(msg ptmp.PTMP_Msg, response_code uint16) {
+    s.t.Helper()
+    s.send(msg)
+    s.expectAckTo(msg.Hdr.Msg_Type_ID, response_code)
+}
+
+// The reply to a message that's already been sent should be a single acknowledgment carrying the given code.
+func (s *session) expectAckTo(msg_type byte, response_code uint16) {
+    s.t.Helper()
+    replies := s.replies(msg_type)
+    if len(replies) != 1 || replies[0].Hdr.Msg_Type_ID != ptmp.ACKNOWLEDGMENT {
+        s.t.Errorf("Message type %v: expected an ack with code %v, got %v", msg_type, response_code, describe(replies))
+        return
+    }
+    ack := ptmp.DecodePayload[ptmp.Acknowledgment](replies[0].Pld)
+    if ack.Response_Code != response_code || ack.ID_Responding_To != msg_type {
+        s.t.Errorf("Message type %v: expected an ack with code %v, got %v", msg_type, response_code, describe(replies))
+    }
+}
+
+func (s *session) expectConnectionRules(msg ptmp.PTMP_Msg) *ptmp.Connection_Rules {
+    s.t.Helper()
+    replies := s.exchange(msg)
+    if len(replies) != 1 || replies[0].Hdr.Msg_Type_ID != ptmp.CONNECTION_RULES {
+        s.t.Fatalf("Expected Connection_Rules in reply to Request_Connection, got %v", describe(replies))
+    }
+    rules := ptmp.DecodePayload[ptmp.Connection_Rules](replies[0].Pld)
+    if ptmp.Byte2Bool(rules.Username_Ok) && ptmp.Byte2Bool(rules.Password_Ok) && s.version == 0 {
+        // everything from here on should be in the version the server chose, starting with this
+        s.version = byte(rules.Protocol_Version_To_Use)
+        if replies[0].Hdr.Protocol_Version != s.version {
+            s.t.Errorf("Connection_Rules choosing protocol version %v came in version %v", s.version, replies[0].Hdr.Protocol_Version)
+        }
+    }
+    return rules
+}
+
+// Send a message that should be answered with a series of info messages of the given type (numbered down to 0).
+func (s *session) expectInfo(msg ptmp.PTMP_Msg, info_type byte) []*ptmp.PTMP_Msg {
+    s.t.Helper()
+    replies := s.exchange(msg)
+    for ii, reply := range replies {
+        if reply.Hdr.Msg_Type_ID != info_type || int(reply.Hdr.Msgs_To_Follow) != len(replies)-1-ii {
+            s.t.Errorf("Message type %v: expected a series of type %v messages, got %v", msg.Hdr.Msg_Type_ID, info_type, describe(replies))
+            return nil
+        }
+    }
+    return replies
+}
+
+// The server should close the connection without sending anything else.
+func (s *session) expectClosed() {
+    s.t.Helper()
+    reply, err_status := s.read()
+    if err_status != nil {
+        if errors.Is(err_status, os.ErrDeadlineExceeded) {
+            s.t.Errorf("The server didn't close the connection")
+        }
+        return // reset by the server, which is closed as far as we're concerned
+    }
+    if reply != nil {
+        s.t.Errorf("Expected the connection to be closed, got %v", describe([]*ptmp.PTMP_Msg{reply}))
+    }
+}
+
+// A message of the given type with an empty payload, for the types the server shouldn't be looking inside of.
+func bareMessage(msg_type byte) ptmp.PTMP_Msg {
+    return ptmp.PTMP_Msg{Hdr: ptmp.PTMP_Header{Protocol_Version: ptmp.CURR_PROTOCOL_VERSION, Msg_Type_ID: msg_type}}
+}
+
+// Well-formed examples of the messages a client can send (other than Request_Connection), referring to a list that exists.
+func clientMessages() []ptmp.PTMP_Msg {
+    return []ptmp.PTMP_Msg{
+        ptmp.Prep_Close_Connection(false),
+        ptmp.Prep_Transaction(0),
+        ptmp.Prep_Ping(1),
+        ptmp.Prep_Query_Capabilities(),
+        ptmp.Prep_Create_New_Task(1, 1000, "Conformance", "Should never be created"),
+        ptmp.Prep_Query_Tasks(0, 65535),
+        ptmp.Prep_Mark_Task_Completed(1, 0),
+        ptmp.Prep_Remove_Tasks(true, 1, []uint16{0}),
+        ptmp.Prep_Query_Trash(1),
+        ptmp.Prep_Restore_Tasks(1, []uint16{0}),
+        ptmp.Prep_Purge_Trash(1, []uint16{}),
+        ptmp.Prep_Query_History(1, true, 0),
+    }
+}
+
+// Messages that only a server sends.  A server receiving one of them is out of context no matter what state it's in.
+func serverMessages() []ptmp.PTMP_Msg {
+    return []ptmp.PTMP_Msg{
+        ptmp.Prep_Connection_Rules(true, true, uint16(ptmp.CURR_PROTOCOL_VERSION), []uint16{}, 0, 0),
+        ptmp.Prep_Acknowledgment(ptmp.SINGULAR_MSG_SUCCESS, ptmp.QUERY_TASKS),
+        ptmp.Prep_Transaction_Failure(0, ptmp.CREATE_NEW_TASK, ptmp.LIST_DOES_NOT_EXIST),
+        ptmp.Prep_Detailed_Acknowledgment(ptmp.TASK_DOES_NOT_EXIST, ptmp.REMOVE_TASK, []ptmp.Item_Result{{Task_Reference_Number: 0, Response_Code: ptmp.TASK_DOES_NOT_EXIST}}, "x"),
+        ptmp.Prep_Pong(1, 0),
+        ptmp.Prep_Capabilities_Information("x", []uint16{1}, []byte{ptmp.PING}, []uint16{}, ptmp.MAX_PAYLOAD_SIZE, ptmp.TITLE_MAX_LENGTH, ptmp.DESCRIPTION_MAX_LENGTH, 0, 0, 0),
+        bareMessage(ptmp.LIST_INFORMATION),
+        ptmp.Prep_Task_Information([]ptmp.T_Inf{{Length_of_Title: 1, Task_Title: []byte("x"), Description_Length: 1, Task_Description: []byte("x")}}, 0),
+        ptmp.Prep_Trash_Information([]ptmp.Trashed_T_Inf{}, 0),
+        ptmp.Prep_History_Information([]ptmp.Audit_Entry{}, 0),
+    }
+}
+
+// Message types that are either part of the protocol but optional (list management) or not defined at all.
+func unimplementedTypes() []byte {
+    return []byte{9, ptmp.CREATE_NEW_LIST, ptmp.QUERY_LISTS, ptmp.REMOVE_LIST, 19, 29, 99, 255}
+}
+
+// Run the whole suite against the target, as subtests of t.
+func Run(t *testing.T, target Target) {
+    t.Run("PreHandshake", func(t *testing.T) { testPreHandshake(t, target) })
+    t.Run("Handshake", func(t *testing.T) { testHandshake(t, target) })
+    t.Run("Established", func(t *testing.T) { testEstablished(t, target) })
+    t.Run("Capabilities", func(t *testing.T) { testCapabilities(t, target) })
+    t.Run("Tasks", func(t *testing.T) { testTasks(t, target) })
+    t.Run("TaskQueries", func(t *testing.T) { testTaskQueries(t, target) })
+    t.Run("Trash", func(t *testing.T) { testTrash(t, target) })
+    t.Run("History", func(t *testing.T) { testHistory(t, target) })
+    t.Run("Transactions", func(t *testing.T) { testTransactions(t, target) })
+    t.Run("DetailedAcks", func(t *testing.T) { testDetailedAcks(t, target) })
+    t.Run("IdempotencyKeys", func(t *testing.T) { testIdempotencyKeys(t, target) })
+    t.Run("SessionResumption", func(t *testing.T) { testSessionResumption(t, target) })
+    t.Run("PayloadSize", func(t *testing.T) { testPayloadSize(t, target) })
+    t.Run("ProtocolVersions", func(t *testing.T) { testProtocolVersions(t, target) })
+    t.Run("Close", func(t *testing.T) { testClose(t, target) })
+}
+
+// Before the handshake, Request_Connection is the only thing the server should accept.
+func testPreHandshake(t *testing.T, target Target) {
+    s := target.connect(t)
+    all := append(clientMessages(), serverMessages()...)
+    for _, msg_type := range unimplementedTypes() {
+        all = append(all, bareMessage(msg_type))
+    }
+    for _, msg := range all {
+        s.expectAck(msg, ptmp.MSG_CONTEXT_INVALID)
+    }
+    // and none of that should have gotten in the way of logging in
+    s.login(target.Username, target.Password)
+    s.close()
+}
+
+func testHandshake(t *testing.T, target Target) {
+    s := target.connect(t)
+    attempts := []struct {
+        username string
+        password string
+        username_ok bool
+        password_ok bool
+    }{
+        {target.Username + "x", target.Password, false, true},
+        {target.Username, target.Password + "x", true, false},
+        {target.Username + "x", target.Password + "x", false, false},
+        {"", "", false, false},
+    }
+    for _, attempt := range attempts {
+        rules := s.requestConnection(attempt.username, attempt.password)
+        if ptmp.Byte2Bool(rules.Username_Ok) != attempt.username_ok || ptmp.Byte2Bool(rules.Password_Ok) != attempt.password_ok {
+            t.Errorf("Logging in as %q/%q: got username ok %v, password ok %v", attempt.username, attempt.password, rules.Username_Ok, rules.Password_Ok)
+        }
+        // a failed attempt leaves us where we were, still needing to log in
+        s.expectAck(ptmp.Prep_Query_Tasks(0, 65535), ptmp.MSG_CONTEXT_INVALID)
+    }
+    rules := s.requestConnection(target.Username, target.Password)
+    if !ptmp.Byte2Bool(rules.Username_Ok) || !ptmp.Byte2Bool(rules.Password_Ok) {
+        t.Errorf("Login refused after failed attempts: %+v", rules)
+    }
+    if rules.Protocol_Version_To_Use != uint16(ptmp.CURR_PROTOCOL_VERSION) {
+        t.Errorf("Server chose protocol version %v, but only %v was offered", rules.Protocol_Version_To_Use, ptmp.CURR_PROTOCOL_VERSION)
+    }
+    if len(rules.Acceptable_Exts) != 0 {
+        t.Errorf("Server accepted extensions %v, but none were offered", rules.Acceptable_Exts)
+    }
+    s.close()
+}
+
+// Once established, logging in again and messages meant for clients are out of context, the message types the
+// server doesn't do are reported as such, and pings are answered.
+func testEstablished(t *testing.T, target Target) {
+    s := target.login(t)
+    s.expectAck(ptmp.Prep_Request_Connection_V2(target.Username, target.Password, 0, []uint16{uint16(ptmp.CURR_PROTOCOL_VERSION)}, []uint16{}, 0), ptmp.MSG_CONTEXT_INVALID)
+    for _, msg := range serverMessages() {
+        s.expectAck(msg, ptmp.MSG_CONTEXT_INVALID)
+    }
+    for _, msg_type := range unimplementedTypes() {
+        s.expectAck(bareMessage(msg_type), ptmp.MSG_NOT_IMPLEMENTED)
+    }
+    // a ping gets a pong with the same timestamp, and leaves the session where it was
+    sent := time.Now().UnixNano()
+    replies := s.exchange(ptmp.Prep_Ping(sent))
+    if len(replies) != 1 || replies[0].Hdr.Msg_Type_ID != ptmp.PONG || ptmp.DecodePayload[ptmp.Pong](replies[0].Pld).Timestamp != sent {
+        t.Errorf("Expected a Pong echoing timestamp %v, got %v", sent, describe(replies))
+    }
+    s.close()
+}
+
+// What the server says it can do should square with what it actually does: the message types it lists are the ones
+// it doesn't answer with MSG_NOT_IMPLEMENTED, and its limits are at least what the messages themselves allow for.
+func testCapabilities(t *testing.T, target Target) {
+    s := target.login(t)
+    replies := s.exchange(ptmp.Prep_Query_Capabilities())
+    if len(replies) != 1 || replies[0].Hdr.Msg_Type_ID != ptmp.CAPABILITIES_INFORMATION {
+        t.Fatalf("Expected Capabilities_Information, got %v", describe(replies))
+    }
+    caps := ptmp.DecodePayload[ptmp.Capabilities_Information](replies[0].Pld)
+    listed := map[byte]bool{}
+    for _, msg_type := range caps.Msg_Types {
+        listed[msg_type] = true
+    }
+    for _, msg_type := range []byte{ptmp.REQUEST_CONNECTION, ptmp.CLOSE_CONNECTION, ptmp.PING, ptmp.QUERY_CAPABILITIES, ptmp.CREATE_NEW_TASK, ptmp.QUERY_TASKS} {
+        if !listed[msg_type] {
+            t.Errorf("Capabilities didn't list message type %v, which the server does", msg_type)
+        }
+    }
+    for _, msg_type := range unimplementedTypes() {
+        if listed[msg_type] {
+            t.Errorf("Capabilities listed message type %v, which the server answers with MSG_NOT_IMPLEMENTED", msg_type)
+        }
+    }
+    for _, server_msg := range serverMessages() {
+        if listed[server_msg.Hdr.Msg_Type_ID] {
+            t.Errorf("Capabilities listed message type %v, which only a server sends", server_msg.Hdr.Msg_Type_ID)
+        }
+    }
+    current := false
+    for _, version := range caps.Protocol_Versions {
+        current = current || version == uint16(ptmp.CURR_PROTOCOL_VERSION)
+    }
+    if !current {
+        t.Errorf("Capabilities listed protocol versions %v, without the one we logged in with", caps.Protocol_Versions)
+    }
+    if caps.Max_Payload_Size == 0 || caps.Max_Title_Length == 0 || caps.Max_Description_Length == 0 {
+        t.Errorf("Capabilities gave limits that leave no room for a task: %+v", caps)
+    }
+    if int(caps.Length_of_Server_Version) != len(caps.Server_Version) || int(caps.Num_Msg_Types) != len(caps.Msg_Types) || int(caps.Num_Extensions) != len(caps.Extensions) {
+        t.Errorf("Capabilities counts don't match what came with them: %+v", caps)
+    }
+    s.close()
+}
+
+// Create a task with a title nobody else will have used and find out what reference number it got.
+func (s *session) createTask(completed bool) uint16 {
+    s.t.Helper()
+    title := fmt.Sprintf("conformance %v", time.Now().UnixNano())
+    reported, was_reported := s.expectCreated(ptmp.Prep_Create_New_Task(1, 1000, title, "Created by the conformance suite"))
+    for _, reply := range s.expectInfo(ptmp.Prep_Query_Tasks(0, 65535), ptmp.TASK_INFORMATION) {
+        for _, tinfo := range ptmp.DecodePayload[ptmp.Task_Information](reply.Pld).Task_Infos {
+            if string(tinfo.Task_Title) != title {
+                continue
+            }
+            if tinfo.Task_Priority_Value != 1000 || string(tinfo.Task_Description) != "Created by the conformance suite" || ptmp.Byte2Bool(tinfo.Completion_Status) {
+                s.t.Errorf("New task came back as %+v", tinfo)
+            }
+            if was_reported && reported != tinfo.Task_Reference_Number {
+                s.t.Errorf("The create was acknowledged with reference number %v, but the task has %v", reported, tinfo.Task_Reference_Number)
+            }
+            if completed {
+                s.expectAck(ptmp.Prep_Mark_Task_Completed(1, tinfo.Task_Reference_Number), ptmp.SINGULAR_MSG_SUCCESS)
+            }
+            return tinfo.Task_Reference_Number
+        }
+    }
+    s.t.Fatalf("Newly created task %q isn't in the results of Query_Tasks", title)
+    return 0
+}
+
+// Send a Create_New_Task that should work.  Sessions with detailed acks hear what reference number the new task
+// got (and that comes back, with true); the rest get a plain acknowledgment.
+func (s *session) expectCreated(msg ptmp.PTMP_Msg) (uint16, bool) {
+    s.t.Helper()
+    replies := s.exchange(msg)
+    if len(replies) == 1 && replies[0].Hdr.Msg_Type_ID == ptmp.DETAILED_ACKNOWLEDGMENT {
+        ack := ptmp.DecodePayload[ptmp.Detailed_Acknowledgment](replies[0].Pld)
+        if ack.Response_Code != ptmp.SINGULAR_MSG_SUCCESS || ack.ID_Responding_To != ptmp.CREATE_NEW_TASK || len(ack.Item_Results) != 1 ||
+           ack.Item_Results[0].Response_Code != ptmp.SINGULAR_MSG_SUCCESS {
+            s.t.Errorf("Expected a detailed ack naming the new task, got %v", describe(replies))
+            return 0, false
+        }
+        return ack.Item_Results[0].Task_Reference_Number, true
+    }
+    if len(replies) != 1 || replies[0].Hdr.Msg_Type_ID != ptmp.ACKNOWLEDGMENT || ptmp.DecodePayload[ptmp.Acknowledgment](replies[0].Pld).Response_Code != ptmp.SINGULAR_MSG_SUCCESS {
+        s.t.Errorf("Message type %v: expected an ack with code %v, got %v", msg.Hdr.Msg_Type_ID, ptmp.SINGULAR_MSG_SUCCESS, describe(replies))
+    }
+    return 0, false
+}
+
+// A reference number that isn't in use, which in a fresh server is anything past what we've created.
+const MISSING_REF uint16 = 65000
+
+func testTasks(t *testing.T, target Target) {
+    if target.Reset != nil {
+        target.Reset()
+    }
+    s := target.login(t)
+    if target.Reset != nil {
+        s.expectAck(ptmp.Prep_Query_Tasks(0, 65535), ptmp.UNABLE_TO_COMPLY)
+    }
+    s.expectAck(ptmp.Prep_Create_New_Task(2, 1000, "Wrong list", "List 2 doesn't exist"), ptmp.LIST_DOES_NOT_EXIST)
+    incomplete := s.createTask(false)
+    completed := s.createTask(true)
+
+    s.expectAck(ptmp.Prep_Mark_Task_Completed(2, incomplete), ptmp.LIST_DOES_NOT_EXIST)
+    s.expectAck(ptmp.Prep_Mark_Task_Completed(1, MISSING_REF), ptmp.TASK_DOES_NOT_EXIST)
+
+    s.expectAck(ptmp.Prep_Remove_Tasks(true, 2, []uint16{incomplete}), ptmp.LIST_DOES_NOT_EXIST)
+    s.expectAck(ptmp.Prep_Remove_Tasks(true, 1, []uint16{MISSING_REF}), ptmp.TASK_DOES_NOT_EXIST)
+    s.expectAck(ptmp.Prep_Remove_Tasks(false, 1, []uint16{incomplete}), ptmp.TASK_DOES_NOT_EXIST) // incomplete tasks need permission to be removed
+    s.expectAck(ptmp.Prep_Remove_Tasks(false, 1, []uint16{completed}), ptmp.SINGULAR_MSG_SUCCESS)
+    // without detailed acks, a removal that only partly worked is reported as the failure, but the rest is still done
+    s.expectAck(ptmp.Prep_Remove_Tasks(true, 1, []uint16{incomplete, MISSING_REF}), ptmp.TASK_DOES_NOT_EXIST)
+    if target.Reset != nil {
+        s.expectAck(ptmp.Prep_Query_Tasks(0, 65535), ptmp.UNABLE_TO_COMPLY)
+    }
+    s.close()
+}
+
+// Send a version 2 Query_Tasks, and collect the page of tasks that comes back along with the Task_Information that
+// ends it.
+func (s *session) queryPage(msg ptmp.PTMP_Msg) ([]ptmp.T_Inf, *ptmp.Task_Information) {
+    s.t.Helper()
+    replies := s.expectInfo(msg, ptmp.TASK_INFORMATION)
+    if len(replies) == 0 {
+        s.t.Fatalf("Expected a page of tasks in reply to a version 2 Query_Tasks")
+    }
+    tasks := []ptmp.T_Inf{}
+    for _, reply := range replies[:len(replies)-1] {
+        tasks = append(tasks, ptmp.DecodePayload[ptmp.Task_Information](reply.Pld).Task_Infos...)
+    }
+    end := ptmp.DecodePayload[ptmp.Task_Information](replies[len(replies)-1].Pld)
+    if len(end.Task_Infos) != 0 {
+        s.t.Errorf("The page ended with a Task_Information that had tasks in it: %+v", end)
+    }
+    return tasks, end
+}
+
+// Version 1 queries only get the tasks in their priority range.  Version 2 ones narrow things down by status and
+// search too, come back in the order they ask for, and page through the results with a cursor.
+func testTaskQueries(t *testing.T, target Target) {
+    s := target.login(t)
+    marker := fmt.Sprintf("query %v", time.Now().UnixNano())
+    created := []struct {
+        title string
+        description string
+        priority uint16
+        completed bool
+    }{
+        {marker + " alpha", "First", 40001, false},
+        {marker + " beta", "Second", 40003, false},
+        {marker + " gamma", "Third, and mentions " + strings.ToUpper(marker), 40002, true},
+    }
+    refs := map[string]uint16{}
+    completed := map[string]bool{}
+    for _, task := range created {
+        s.expectAck(ptmp.Prep_Create_New_Task(1, task.priority, task.title, task.description), ptmp.SINGULAR_MSG_SUCCESS)
+        completed[task.title] = task.completed
+    }
+    for _, reply := range s.expectInfo(ptmp.Prep_Query_Tasks(40001, 40001), ptmp.TASK_INFORMATION) {
+        for _, tinfo := range ptmp.DecodePayload[ptmp.Task_Information](reply.Pld).Task_Infos {
+            if tinfo.Task_Priority_Value != 40001 {
+                t.Errorf("A version 1 query for priority 40001 got a task with priority %v", tinfo.Task_Priority_Value)
+            }
+        }
+    }
+    all, _ := s.queryPage(ptmp.Prep_Query_Tasks_V2(40001, 40003, nil, ptmp.QUERY_ANY_STATUS, ptmp.SEARCH_IN_TITLE, marker, nil, 0, 0, nil))
+    for _, tinfo := range all {
+        refs[string(tinfo.Task_Title)] = tinfo.Task_Reference_Number
+        if completed[string(tinfo.Task_Title)] {
+            s.expectAck(ptmp.Prep_Mark_Task_Completed(1, tinfo.Task_Reference_Number), ptmp.SINGULAR_MSG_SUCCESS)
+        }
+    }
+    if len(refs) != len(created) {
+        t.Fatalf("Searching for %q found %v tasks, expected %v", marker, len(refs), len(created))
+    }
+
+    // a page at a time, by priority from the top, until the cursor runs out
+    by_priority := []ptmp.Sort_Key{{Key: ptmp.SORT_BY_PRIORITY, Descending: 1}}
+    got := []string{}
+    var cursor []byte
+    for pages := 0; pages < len(created); pages++ {
+        tasks, end := s.queryPage(ptmp.Prep_Query_Tasks_V2(0, 65535, []uint16{1}, ptmp.QUERY_ANY_STATUS, ptmp.SEARCH_IN_TITLE, marker, by_priority, 2, 0, cursor))
+        if end.Total_Matches != uint16(len(created)) {
+            t.Errorf("A page of the search said %v tasks matched, expected %v", end.Total_Matches, len(created))
+        }
+        for _, tinfo := range tasks {
+            got = append(got, string(tinfo.Task_Title))
+        }
+        if cursor = end.Next_Cursor; len(cursor) == 0 {
+            break
+        }
+    }
+    if expected := []string{marker + " beta", marker + " gamma", marker + " alpha"}; fmt.Sprint(got) != fmt.Sprint(expected) {
+        t.Errorf("Paging through the search by priority got %q, expected %q", got, expected)
+    }
+
+    // the completed one is left out, and so is the one whose title doesn't match (its description doesn't count)
+    open, _ := s.queryPage(ptmp.Prep_Query_Tasks_V2(0, 65535, nil, ptmp.QUERY_INCOMPLETE_ONLY, ptmp.SEARCH_IN_TITLE | ptmp.SEARCH_REGEX, "^" + marker + " (alpha|gamma)$", nil, 0, 0, nil))
+    if len(open) != 1 || string(open[0].Task_Title) != marker + " alpha" {
+        t.Errorf("A regular expression on the titles of open tasks got %v", open)
+    }
+    // and ignoring case, the description of the third one matches too
+    anywhere, _ := s.queryPage(ptmp.Prep_Query_Tasks_V2(0, 65535, nil, ptmp.QUERY_COMPLETED_ONLY, ptmp.SEARCH_IN_DESCRIPTION | ptmp.SEARCH_IGNORE_CASE, marker, nil, 0, 0, nil))
+    if len(anywhere) != 1 || string(anywhere[0].Task_Title) != marker + " gamma" {
+        t.Errorf("A search of the descriptions of completed tasks, ignoring case, got %v", anywhere)
+    }
+    nothing, end := s.queryPage(ptmp.Prep_Query_Tasks_V2(0, 65535, nil, ptmp.QUERY_ANY_STATUS, 0, marker + " delta", nil, 0, 0, nil))
+    if len(nothing) != 0 || end.Total_Matches != 0 || len(end.Next_Cursor) != 0 {
+        t.Errorf("A search that matches nothing got %v, ending with %+v", nothing, end)
+    }
+
+    s.expectAck(ptmp.Prep_Query_Tasks_V2(0, 65535, []uint16{1, 2}, ptmp.QUERY_ANY_STATUS, 0, "", nil, 0, 0, nil), ptmp.LIST_DOES_NOT_EXIST)
+    s.expectAck(ptmp.Prep_Query_Tasks_V2(0, 65535, nil, ptmp.QUERY_ANY_STATUS, ptmp.SEARCH_REGEX, "(unclosed", nil, 0, 0, nil), ptmp.SYNTAX_ERROR)
+    s.expectAck(ptmp.Prep_Query_Tasks_V2(0, 65535, nil, ptmp.QUERY_ANY_STATUS, 0, "", by_priority, 0, 0, []byte("not a cursor")), ptmp.SYNTAX_ERROR)
+
+    removals := []uint16{}
+    for _, ref := range refs {
+        removals = append(removals, ref)
+    }
+    s.expectAck(ptmp.Prep_Remove_Tasks(true, 1, removals), ptmp.SINGULAR_MSG_SUCCESS)
+    s.close()
+}
+
+func testTrash(t *testing.T, target Target) {
+    if target.Reset != nil {
+        target.Reset()
+    }
+    s := target.login(t)
+    s.expectAck(ptmp.Prep_Query_Trash(2), ptmp.LIST_DOES_NOT_EXIST)
+    if target.Reset != nil {
+        s.expectAck(ptmp.Prep_Query_Trash(1), ptmp.UNABLE_TO_COMPLY)
+    }
+    ref := s.createTask(true)
+    s.expectAck(ptmp.Prep_Remove_Tasks(false, 1, []uint16{ref}), ptmp.SINGULAR_MSG_SUCCESS)
+    found := false
+    for _, reply := range s.expectInfo(ptmp.Prep_Query_Trash(1), ptmp.TRASH_INFORMATION) {
+        for _, tt := range ptmp.DecodePayload[ptmp.Trash_Information](reply.Pld).Trashed_Tasks {
+            found = found || (tt.List_ID == 1 && tt.Task.Task_Reference_Number == ref)
+        }
+    }
+    if !found {
+        t.Errorf("Removed task %v isn't in the trash", ref)
+    }
+
+    s.expectAck(ptmp.Prep_Restore_Tasks(2, []uint16{ref}), ptmp.LIST_DOES_NOT_EXIST)
+    s.expectAck(ptmp.Prep_Restore_Tasks(1, []uint16{MISSING_REF}), ptmp.TASK_DOES_NOT_EXIST)
+    s.expectAck(ptmp.Prep_Restore_Tasks(1, []uint16{ref}), ptmp.SINGULAR_MSG_SUCCESS)
+    s.expectAck(ptmp.Prep_Restore_Tasks(1, []uint16{ref}), ptmp.TASK_DOES_NOT_EXIST) // it isn't in the trash anymore
+
+    s.expectAck(ptmp.Prep_Remove_Tasks(false, 1, []uint16{ref}), ptmp.SINGULAR_MSG_SUCCESS)
+    s.expectAck(ptmp.Prep_Purge_Trash(2, []uint16{}), ptmp.LIST_DOES_NOT_EXIST)
+    s.expectAck(ptmp.Prep_Purge_Trash(1, []uint16{MISSING_REF}), ptmp.TASK_DOES_NOT_EXIST)
+    s.expectAck(ptmp.Prep_Purge_Trash(1, []uint16{ref}), ptmp.SINGULAR_MSG_SUCCESS)
+    s.expectAck(ptmp.Prep_Restore_Tasks(1, []uint16{ref}), ptmp.TASK_DOES_NOT_EXIST) // purged for good
+    s.expectAck(ptmp.Prep_Purge_Trash(1, []uint16{}), ptmp.SINGULAR_MSG_SUCCESS) // emptying an empty trash is fine
+    if target.Reset != nil {
+        s.expectAck(ptmp.Prep_Query_Trash(1), ptmp.UNABLE_TO_COMPLY)
+    }
+    s.close()
+}
+
+func testHistory(t *testing.T, target Target) {
+    if target.Reset != nil {
+        target.Reset()
+    }
+    s := target.login(t)
+    s.expectAck(ptmp.Prep_Query_History(2, true, 0), ptmp.LIST_DOES_NOT_EXIST)
+    s.expectAck(ptmp.Prep_Query_History(1, false, MISSING_REF), ptmp.UNABLE_TO_COMPLY)
+    ref := s.createTask(true)
+    // created, then marked completed
+    changes := [][2]byte{}
+    for _, reply := range s.expectInfo(ptmp.Prep_Query_History(1, false, ref), ptmp.HISTORY_INFORMATION) {
+        for _, entry := range ptmp.DecodePayload[ptmp.History_Information](reply.Pld).Entries {
+            if entry.Task.Task_Reference_Number != ref || string(entry.Username) != target.Username {
+                t.Errorf("History of task %v includes %+v", ref, entry)
+            }
+            changes = append(changes, [2]byte{entry.Msg_Type_ID, entry.After_Location})
+        }
+    }
+    expected := [][2]byte{{ptmp.CREATE_NEW_TASK, ptmp.TASK_LOCATION_ACTIVE}, {ptmp.MARK_TASK_COMPLETED, ptmp.TASK_LOCATION_ACTIVE}}
+    if fmt.Sprint(changes) != fmt.Sprint(expected) {
+        t.Errorf("History of task %v is %v (message type, location after), expected %v", ref, changes, expected)
+    }
+    s.close()
+}
+
+// Send a transaction, checking that the Transaction and every change but the last are answered with
+// CONDITIONAL_SUCCESS, and return the reply to the last change.
+func (s *session) sendTransaction(changes ...ptmp.PTMP_Msg) []*ptmp.PTMP_Msg {
+    s.t.Helper()
+    s.expectAck(ptmp.Prep_Transaction(byte(len(changes))), ptmp.CONDITIONAL_SUCCESS)
+    for ii := range changes {
+        changes[ii].Hdr.Msgs_To_Follow = byte(len(changes)-1-ii)
+        if ii < len(changes)-1 {
+            s.expectAck(changes[ii], ptmp.CONDITIONAL_SUCCESS)
+        }
+    }
+    return s.exchange(changes[len(changes)-1])
+}
+
+func (s *session) expectTransactionFailure(replies []*ptmp.PTMP_Msg, failed_index uint16, failed_msg_type byte, response_code uint16) {
+    s.t.Helper()
+    if len(replies) != 1 || replies[0].Hdr.Msg_Type_ID != ptmp.TRANSACTION_FAILURE {
+        s.t.Errorf("Expected a Transaction_Failure, got %v", describe(replies))
+        return
+    }
+    failure := ptmp.DecodePayload[ptmp.Transaction_Failure](replies[0].Pld)
+    expected := ptmp.Transaction_Failure{Failed_Index: failed_index, Failed_Msg_Type: failed_msg_type, Response_Code: response_code}
+    if *failure != expected {
+        s.t.Errorf("Expected Transaction_Failure %+v, got %+v", expected, *failure)
+    }
+}
+
+// The active task with the given reference number, if there is one.
+func (s *session) findTask(ref uint16) (ptmp.T_Inf, bool) {
+    s.t.Helper()
+    for _, reply := range s.expectInfo(ptmp.Prep_Query_Tasks(0, 65535), ptmp.TASK_INFORMATION) {
+        for _, tinfo := range ptmp.DecodePayload[ptmp.Task_Information](reply.Pld).Task_Infos {
+            if tinfo.Task_Reference_Number == ref {
+                return tinfo, true
+            }
+        }
+    }
+    return ptmp.T_Inf{}, false
+}
+
+// The changes in a transaction are made all together, or not at all.
+func testTransactions(t *testing.T, target Target) {
+    if target.Reset != nil {
+        target.Reset()
+    }
+    s := target.login(t)
+    s.expectAck(ptmp.Prep_Transaction(0), ptmp.MSG_SERIES_SUCCESS) // nothing to do, so nothing to fail
+    mismatched := ptmp.Prep_Transaction(2)
+    mismatched.Hdr.Msgs_To_Follow = 1
+    s.expectAck(mismatched, ptmp.SYNTAX_ERROR)
+    ref := s.createTask(false) // (which also shows that the mismatched Transaction didn't start one)
+
+    // the first change would work on its own, but the second doesn't, so the first is undone
+    replies := s.sendTransaction(ptmp.Prep_Mark_Task_Completed(1, ref), ptmp.Prep_Remove_Tasks(true, 1, []uint16{ref}), ptmp.Prep_Mark_Task_Completed(1, MISSING_REF))
+    s.expectTransactionFailure(replies, 2, ptmp.MARK_TASK_COMPLETED, ptmp.TASK_DOES_NOT_EXIST)
+    if tinfo, found := s.findTask(ref); !found || ptmp.Byte2Bool(tinfo.Completion_Status) {
+        t.Errorf("Task %v was changed by a transaction that failed (still active: %v, %+v)", ref, found, tinfo)
+    }
+
+    // a query can't be part of a transaction, so it ends it there
+    s.expectAck(ptmp.Prep_Transaction(2), ptmp.CONDITIONAL_SUCCESS)
+    first := ptmp.Prep_Mark_Task_Completed(1, ref)
+    first.Hdr.Msgs_To_Follow = 1
+    s.expectAck(first, ptmp.CONDITIONAL_SUCCESS)
+    s.expectTransactionFailure(s.exchange(ptmp.Prep_Query_Tasks(0, 65535)), 1, ptmp.QUERY_TASKS, ptmp.MSG_CONTEXT_INVALID)
+    if tinfo, found := s.findTask(ref); !found || ptmp.Byte2Bool(tinfo.Completion_Status) {
+        t.Errorf("Task %v was changed by an aborted transaction (still active: %v, %+v)", ref, found, tinfo)
+    }
+
+    replies = s.sendTransaction(ptmp.Prep_Mark_Task_Completed(1, ref), ptmp.Prep_Remove_Tasks(false, 1, []uint16{ref}))
+    if len(replies) != 1 || replies[0].Hdr.Msg_Type_ID != ptmp.ACKNOWLEDGMENT || ptmp.DecodePayload[ptmp.Acknowledgment](replies[0].Pld).Response_Code != ptmp.MSG_SERIES_SUCCESS {
+        t.Errorf("Expected MSG_SERIES_SUCCESS for a transaction that should work, got %v", describe(replies))
+    }
+    s.expectAck(ptmp.Prep_Restore_Tasks(1, []uint16{ref}), ptmp.SINGULAR_MSG_SUCCESS) // it was completed, and then removed
+    s.close()
+}
+
+// Send a message that should be answered with a Detailed_Acknowledgment carrying the given code and item results.
+func (s *session) expectDetailedAck(msg ptmp.PTMP_Msg, response_code uint16, items ...ptmp.Item_Result) {
+    s.t.Helper()
+    replies := s.exchange(msg)
+    if len(replies) != 1 || replies[0].Hdr.Msg_Type_ID != ptmp.DETAILED_ACKNOWLEDGMENT {
+        s.t.Errorf("Message type %v: expected a detailed ack with code %v, got %v", msg.Hdr.Msg_Type_ID, response_code, describe(replies))
+        return
+    }
+    ack := ptmp.DecodePayload[ptmp.Detailed_Acknowledgment](replies[0].Pld)
+    if ack.Response_Code != response_code || ack.ID_Responding_To != msg.Hdr.Msg_Type_ID || ptmp.Byte2Bool(ack.Failures_Only) ||
+       int(ack.Num_Items) != len(items) || fmt.Sprint(ack.Item_Results) != fmt.Sprint(items) {
+        s.t.Errorf("Message type %v: expected a detailed ack with code %v and items %v, got %v", msg.Hdr.Msg_Type_ID, response_code, items, describe(replies))
+    }
+}
+
+// Sessions that asked for detailed acks hear how each task named in a removal, restore or purge went (and what
+// reference number a new task got), and the tasks that could be done are done even when others can't.  Servers don't have to do detailed acks, so this is
+// skipped for ones that don't agree to them.
+func testDetailedAcks(t *testing.T, target Target) {
+    if target.Reset != nil {
+        target.Reset()
+    }
+    s := target.connect(t)
+    rules := s.requestConnection(target.Username, target.Password, ptmp.EXT_DETAILED_ACKS, 9999)
+    if !ptmp.Byte2Bool(rules.Username_Ok) || !ptmp.Byte2Bool(rules.Password_Ok) {
+        t.Fatalf("The server didn't accept the target's username and password: %+v", rules)
+    }
+    for _, ext := range rules.Acceptable_Exts {
+        if ext != ptmp.EXT_DETAILED_ACKS {
+            t.Errorf("Server accepted extension %v, but only %v was offered (and 9999, which isn't one)", ext, ptmp.EXT_DETAILED_ACKS)
+        }
+    }
+    if len(rules.Acceptable_Exts) == 0 {
+        s.close()
+        t.Skip("The server doesn't do detailed acks")
+    }
+    item := func(ref uint16, response_code uint16) ptmp.Item_Result {
+        return ptmp.Item_Result{Task_Reference_Number: ref, Response_Code: response_code}
+    }
+    // a create says what reference number the new task got
+    if _, was_reported := s.expectCreated(ptmp.Prep_Create_New_Task(1, 1000, "Reported", "Created by the conformance suite")); !was_reported {
+        t.Errorf("A create wasn't answered with the new task's reference number")
+    }
+    completed := s.createTask(true)
+    incomplete := s.createTask(false)
+
+    s.expectDetailedAck(ptmp.Prep_Remove_Tasks(false, 2, []uint16{completed}), ptmp.LIST_DOES_NOT_EXIST)
+    s.expectDetailedAck(ptmp.Prep_Remove_Tasks(false, 1, []uint16{MISSING_REF, incomplete}), ptmp.TASK_DOES_NOT_EXIST,
+                        item(MISSING_REF, ptmp.TASK_DOES_NOT_EXIST), item(incomplete, ptmp.UNABLE_TO_COMPLY))
+    // the one that can be removed is, and the rest are reported
+    s.expectDetailedAck(ptmp.Prep_Remove_Tasks(false, 1, []uint16{incomplete, completed, MISSING_REF}), ptmp.CONDITIONAL_SUCCESS,
+                        item(incomplete, ptmp.UNABLE_TO_COMPLY), item(completed, ptmp.SINGULAR_MSG_SUCCESS), item(MISSING_REF, ptmp.TASK_DOES_NOT_EXIST))
+    if _, found := s.findTask(completed); found {
+        t.Errorf("Task %v is still active after a removal that reported it removed", completed)
+    }
+    s.expectDetailedAck(ptmp.Prep_Restore_Tasks(1, []uint16{completed, incomplete}), ptmp.CONDITIONAL_SUCCESS,
+                        item(completed, ptmp.SINGULAR_MSG_SUCCESS), item(incomplete, ptmp.TASK_DOES_NOT_EXIST))
+    s.expectDetailedAck(ptmp.Prep_Remove_Tasks(true, 1, []uint16{completed, incomplete}), ptmp.SINGULAR_MSG_SUCCESS,
+                        item(completed, ptmp.SINGULAR_MSG_SUCCESS), item(incomplete, ptmp.SINGULAR_MSG_SUCCESS))
+    s.expectDetailedAck(ptmp.Prep_Purge_Trash(1, []uint16{incomplete, incomplete}), ptmp.CONDITIONAL_SUCCESS,
+                        item(incomplete, ptmp.SINGULAR_MSG_SUCCESS), item(incomplete, ptmp.TASK_DOES_NOT_EXIST))
+
+    // a partial success isn't good enough for a transaction, which fails with whatever the first item failed with
+    replies := s.sendTransaction(ptmp.Prep_Restore_Tasks(1, []uint16{completed, MISSING_REF}))
+    s.expectTransactionFailure(replies, 0, ptmp.RESTORE_TASKS, ptmp.TASK_DOES_NOT_EXIST)
+
+    // and one that's made lists its changes' items in order, which for creates is the new tasks
+    replies = s.sendTransaction(ptmp.Prep_Create_New_Task(1, 1000, "First in a transaction", "Created by the conformance suite"),
+                                ptmp.Prep_Create_New_Task(1, 2000, "Second in a transaction", "Created by the conformance suite"))
+    if len(replies) != 1 || replies[0].Hdr.Msg_Type_ID != ptmp.DETAILED_ACKNOWLEDGMENT {
+        t.Fatalf("Expected a detailed ack for a transaction of creates, got %v", describe(replies))
+    }
+    ack := ptmp.DecodePayload[ptmp.Detailed_Acknowledgment](replies[0].Pld)
+    if ack.Response_Code != ptmp.MSG_SERIES_SUCCESS || len(ack.Item_Results) != 2 {
+        t.Fatalf("Expected MSG_SERIES_SUCCESS naming both new tasks, got %v", describe(replies))
+    }
+    for ii, title := range []string{"First in a transaction", "Second in a transaction"} {
+        if tinfo, found := s.findTask(ack.Item_Results[ii].Task_Reference_Number); !found || string(tinfo.Task_Title) != title {
+            t.Errorf("Item %v of the transaction's ack names %+v, expected %q", ii, tinfo, title)
+        }
+    }
+    s.close()
+}
+
+// A change sent again with the same idempotency key isn't made again, even from another connection, and gets the
+// same answer as the first time.  Skipped for servers that don't agree to idempotency keys.
+func testIdempotencyKeys(t *testing.T, target Target) {
+    if target.Reset != nil {
+        target.Reset()
+    }
+    s := target.connect(t)
+    rules := s.requestConnection(target.Username, target.Password, ptmp.EXT_IDEMPOTENCY_KEYS)
+    if !ptmp.Byte2Bool(rules.Username_Ok) || !ptmp.Byte2Bool(rules.Password_Ok) {
+        t.Fatalf("The server didn't accept the target's username and password: %+v", rules)
+    }
+    if len(rules.Acceptable_Exts) == 0 {
+        s.close()
+        t.Skip("The server doesn't do idempotency keys")
+    }
+    ref := s.createTask(false)
+    complete := ptmp.Prep_Mark_Task_Completed(1, ref)
+    complete.Hdr.Idempotency_Key = uint64(time.Now().UnixNano())
+    s.expectAck(complete, ptmp.SINGULAR_MSG_SUCCESS)
+    remove := ptmp.Prep_Remove_Tasks(false, 1, []uint16{ref})
+    remove.Hdr.Idempotency_Key = complete.Hdr.Idempotency_Key + 1
+    s.expectAck(remove, ptmp.SINGULAR_MSG_SUCCESS)
+    s.close()
+
+    s = target.connect(t)
+    s.requestConnection(target.Username, target.Password, ptmp.EXT_IDEMPOTENCY_KEYS)
+    s.expectAck(remove, ptmp.SINGULAR_MSG_SUCCESS) // not TASK_DOES_NOT_EXIST, which removing it again would get
+    s.expectAck(ptmp.Prep_Restore_Tasks(1, []uint16{ref}), ptmp.SINGULAR_MSG_SUCCESS)
+    s.expectAck(remove, ptmp.SINGULAR_MSG_SUCCESS) // still not removed again
+    if _, found := s.findTask(ref); !found {
+        t.Errorf("Task %v was removed again by a repeat of the same removal", ref)
+    }
+    // the same key on a different message is the client's mistake
+    reused := ptmp.Prep_Mark_Task_Completed(1, MISSING_REF)
+    reused.Hdr.Idempotency_Key = complete.Hdr.Idempotency_Key
+    s.expectAck(reused, ptmp.SYNTAX_ERROR)
+    s.close()
+}
+
+// A session whose connection drops can be picked back up on a new connection with the token from its
+// Connection_Rules instead of the password, once.  Skipped for servers that don't agree to session resumption.
+func testSessionResumption(t *testing.T, target Target) {
+    s := target.connect(t)
+    rules := s.requestConnection(target.Username, target.Password, ptmp.EXT_SESSION_RESUMPTION)
+    if !ptmp.Byte2Bool(rules.Username_Ok) || !ptmp.Byte2Bool(rules.Password_Ok) {
+        t.Fatalf("The server didn't accept the target's username and password: %+v", rules)
+    }
+    if len(rules.Acceptable_Exts) == 0 {
+        s.close()
+        t.Skip("The server doesn't do session resumption")
+    }
+    if rules.Session_Token == 0 {
+        t.Fatalf("The server agreed to session resumption, but didn't give out a token")
+    }
+    resume := ptmp.Prep_Resume_Session_V2(target.Username, rules.Session_Token, []uint16{uint16(ptmp.CURR_PROTOCOL_VERSION)}, []uint16{ptmp.EXT_SESSION_RESUMPTION}, 0)
+    s.conn.Close() // dropped, rather than closed
+
+    s = target.connect(t)
+    resumed := s.expectConnectionRules(resume)
+    if !ptmp.Byte2Bool(resumed.Username_Ok) || !ptmp.Byte2Bool(resumed.Password_Ok) {
+        t.Fatalf("The server didn't let the session be resumed: %+v", resumed)
+    }
+    if resumed.Session_Token == 0 || resumed.Session_Token == rules.Session_Token {
+        t.Errorf("The resumed session should have gotten a new token, got %v (the old one was %v)", resumed.Session_Token, rules.Session_Token)
+    }
+    s.expectAck(ptmp.Prep_Request_Connection_V2(target.Username, target.Password, 0, []uint16{uint16(ptmp.CURR_PROTOCOL_VERSION)}, []uint16{}, 0), ptmp.MSG_CONTEXT_INVALID)
+    s.conn.Close()
+
+    // (only the one refusal, since it counts as a failed login, and the handshake checks have already had a few)
+    s = target.connect(t)
+    s.expectAck(resume, ptmp.SESSION_TOKEN_INVALID)
+    s.login(target.Username, target.Password)
+    s.close()
+}
+
+// A Remove_Tasks with a payload of at least size bytes (and no more than a few over), naming a task that won't
+// exist over and over.
+func removalOfSize(size int) ptmp.PTMP_Msg {
+    refs := []uint16{}
+    removal := ptmp.Prep_Remove_Tasks(true, 1, refs)
+    for len(removal.Pld) < size {
+        for ii := 0; ii < (size - len(removal.Pld)) / 4 + 1; ii++ {
+            refs = append(refs, 65535) // (3 bytes apiece once gob has them, so this creeps up on size)
+        }
+        removal = ptmp.Prep_Remove_Tasks(true, 1, refs)
+    }
+    return removal
+}
+
+// A client that didn't propose a Max_Payload_Size is held to MAX_PAYLOAD_SIZE, even if it sends a compact message.
+// One that did gets no less than that, no more than it asked for, and can send anything up to what it got.  Payloads
+// over the limit are answered with PAYLOAD_TOO_LARGE, and the session carries on.
+func testPayloadSize(t *testing.T, target Target) {
+    s := target.login(t)
+    s.sendPacket(ptmp.REMOVE_TASK, ptmp.EncodeCompactPacket(removalOfSize(int(ptmp.MAX_PAYLOAD_SIZE)+1)))
+    s.expectAckTo(ptmp.REMOVE_TASK, ptmp.PAYLOAD_TOO_LARGE)
+    s.expectAck(removalOfSize(int(ptmp.MAX_PAYLOAD_SIZE)/2), ptmp.TASK_DOES_NOT_EXIST)
+    s.close()
+
+    s = target.connect(t)
+    rules := s.expectConnectionRules(ptmp.Prep_Request_Connection_V2(target.Username, target.Password, 0, []uint16{uint16(ptmp.CURR_PROTOCOL_VERSION)}, []uint16{}, PROPOSED_PAYLOAD_SIZE))
+    if !ptmp.Byte2Bool(rules.Username_Ok) || !ptmp.Byte2Bool(rules.Password_Ok) {
+        t.Fatalf("The server didn't accept the target's username and password: %+v", rules)
+    }
+    if rules.Max_Payload_Size < ptmp.MAX_PAYLOAD_SIZE || rules.Max_Payload_Size > PROPOSED_PAYLOAD_SIZE {
+        t.Fatalf("Proposing a Max_Payload_Size of %v got %v", PROPOSED_PAYLOAD_SIZE, rules.Max_Payload_Size)
+    }
+    s.max_payload = rules.Max_Payload_Size
+    s.expectAck(removalOfSize(int(rules.Max_Payload_Size)-8), ptmp.TASK_DOES_NOT_EXIST)
+    s.sendPacket(ptmp.REMOVE_TASK, ptmp.EncodeCompactPacket(removalOfSize(int(rules.Max_Payload_Size)+1)))
+    s.expectAckTo(ptmp.REMOVE_TASK, ptmp.PAYLOAD_TOO_LARGE)
+    s.close()
+}
+
+// A client that only speaks version 1 (with its fixed-size login) gets version 1, and everything after in it.  One
+// that speaks nothing the server does is turned away, and can try again.  In version 2, titles and descriptions have
+// to be UTF-8, and they're kept exactly as they were sent (a version 1 server would have cut them off at a NUL).
+func testProtocolVersions(t *testing.T, target Target) {
+    s := target.connect(t)
+    rules := s.expectConnectionRules(ptmp.Prep_Request_Connection(target.Username, target.Password, 0, []uint16{uint16(ptmp.PROTOCOL_VERSION_1)}, []uint16{}, 0))
+    if !ptmp.Byte2Bool(rules.Username_Ok) || !ptmp.Byte2Bool(rules.Password_Ok) {
+        t.Fatalf("The server didn't accept the target's username and password in version 1: %+v", rules)
+    }
+    if rules.Protocol_Version_To_Use != uint16(ptmp.PROTOCOL_VERSION_1) {
+        t.Errorf("Server chose protocol version %v, but only %v was offered", rules.Protocol_Version_To_Use, ptmp.PROTOCOL_VERSION_1)
+    }
+    s.expectInfo(ptmp.Prep_Query_Capabilities(), ptmp.CAPABILITIES_INFORMATION) // (with replies checked for version 1)
+    s.close()
+
+    s = target.connect(t)
+    s.expectAck(ptmp.Prep_Request_Connection_V2(target.Username, target.Password, 0, []uint16{99}, []uint16{}, 0), ptmp.PROTOCOL_VERSIONS_INCOMPATIBLE)
+    s.login(target.Username, target.Password)
+    if s.version != ptmp.CURR_PROTOCOL_VERSION {
+        t.Errorf("Server chose protocol version %v, but only %v was offered", s.version, ptmp.CURR_PROTOCOL_VERSION)
+    }
+    s.expectAck(ptmp.Prep_Create_New_Task(1, 1000, "Not \xff UTF-8", "Should never be created"), ptmp.INVALID_NAME)
+    s.expectAck(ptmp.Prep_Create_New_Task(1, 1000, "Conformance", "Not \xc3 UTF-8"), ptmp.INVALID_NAME)
+    title := fmt.Sprintf("conformance ✓ %v\x00", time.Now().UnixNano())
+    description := "Ünïcödé, with a NUL on the end of the title"
+    s.expectAck(ptmp.Prep_Create_New_Task(1, 1000, title, description), ptmp.SINGULAR_MSG_SUCCESS)
+    found := false
+    for _, reply := range s.expectInfo(ptmp.Prep_Query_Tasks(0, 65535), ptmp.TASK_INFORMATION) {
+        for _, tinfo := range ptmp.DecodePayload[ptmp.Task_Information](reply.Pld).Task_Infos {
+            if string(tinfo.Task_Title) == title && string(tinfo.Task_Description) == description {
+                found = true
+                s.expectAck(ptmp.Prep_Remove_Tasks(true, 1, []uint16{tinfo.Task_Reference_Number}), ptmp.SINGULAR_MSG_SUCCESS)
+            }
+        }
+    }
+    if !found {
+        t.Errorf("Task %q didn't come back exactly as it was created", title)
+    }
+    s.close()
+}
+
+func testClose(t *testing.T, target Target) {
+    t.Run("AwaitingAck", func(t *testing.T) {
+        s := target.login(t)
+        s.expectAck(ptmp.Prep_Close_Connection(true), ptmp.SINGULAR_MSG_SUCCESS)
+        s.expectClosed()
+    })
+    t.Run("NotAwaitingAck", func(t *testing.T) {
+        s := target.login(t)
+        s.send(ptmp.Prep_Close_Connection(false))
+        s.expectClosed()
+    })
+    t.Run("BeforeHandshake", func(t *testing.T) {
+        // there's no connection to close yet, so this is just as out of context as anything else
+        s := target.connect(t)
+        s.expectAck(ptmp.Prep_Close_Connection(true), ptmp.MSG_CONTEXT_INVALID)
+        s.expectAck(ptmp.Prep_Query_Tasks(0, 65535), ptmp.MSG_CONTEXT_INVALID)
+        s.login(target.Username, target.Password)
+        s.close()
+    })
+    t.Run("NewConnectionStartsOver", func(t *testing.T) {
+        s := target.login(t)
+        s.close()
+        s = target.connect(t)
+        s.expectAck(ptmp.Prep_Query_Tasks(0, 65535), ptmp.MSG_CONTEXT_INVALID)
+        s.login(target.Username, target.Password)
+        s.close()
+    })
+}
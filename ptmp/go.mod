@@ -1,3 +1,3 @@
 module ajb497/ptmp
 
-go 1.20
+go 1.21
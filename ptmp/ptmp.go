@@ -1,10 +1,14 @@
 package ptmp
 
 import (
+    "bufio"
     "fmt"
     "encoding/gob"
+    "errors"
     "bytes"
+    "io"
     "reflect"
+    "unicode/utf8"
 )
 
 const (
@@ -14,6 +18,11 @@ const (
     CONNECTION_RULES byte = 1
     CLOSE_CONNECTION byte = 2
     ACKNOWLEDGMENT byte = 3
+    TRANSACTION byte = 4 // the start of a series of changes that the server makes all-or-nothing
+    TRANSACTION_FAILURE byte = 5 // the server's answer to a transaction it didn't make, saying which change it fell over on
+    DETAILED_ACKNOWLEDGMENT byte = 6 // an Acknowledgment with how each item of a multi-item message went, for sessions that negotiated EXT_DETAILED_ACKS
+    PING byte = 7 // checks the connection is alive (and keeps it from timing out) without touching any tasks
+    PONG byte = 8 // the server's answer to a Ping
 
     // 10 Series - list management
     CREATE_NEW_LIST byte = 10
@@ -26,9 +35,21 @@ const (
     CREATE_NEW_TASK byte = 20
     TASK_INFORMATION byte = 21
     QUERY_TASKS byte = 22
+    QUERY_TRASH byte = 23
     REMOVE_TASK byte = 24
+    RESTORE_TASKS byte = 25
     MARK_TASK_COMPLETED byte = 26
-    
+    PURGE_TRASH byte = 27
+    TRASH_INFORMATION byte = 28
+
+    // 30 Series - auditing
+    QUERY_HISTORY byte = 30
+    HISTORY_INFORMATION byte = 31
+
+    // 40 Series - discovery
+    QUERY_CAPABILITIES byte = 40 // asks what the server can do, instead of finding out by being told MSG_NOT_IMPLEMENTED
+    CAPABILITIES_INFORMATION byte = 41
+
 
     // RESPONSE CODES
     // 200 series - postive definite
@@ -46,6 +67,11 @@ const (
     TIMEOUT_WARNING_INACTIVE uint16 = 404
     CONDITIONAL_ORDER_FAILURE uint16 = 405
     INVALID_NAME uint16 = 406
+    RATE_LIMITED uint16 = 407 // the session is sending messages faster than the server allows; slow down and send it again
+    LOGIN_THROTTLED uint16 = 408 // too many failed logins for that user or from that address, so no logins until the lockout runs out
+    TOO_MANY_SESSIONS uint16 = 409 // the server, or that user, already has as many sessions going as it allows
+    SESSION_TOKEN_INVALID uint16 = 410 // the token given to resume a session with is unknown, used up or ran out; log in with credentials instead
+    PAYLOAD_TOO_LARGE uint16 = 411 // the message's payload is bigger than the maximum agreed in the handshake (MAX_PAYLOAD_SIZE if none was)
     TEAPOT uint16 = 418
 
 
@@ -56,13 +82,53 @@ const (
     MSG_CONTEXT_INVALID uint16 = 503
 
 
-    MAX_PAYLOAD_SIZE uint16 = 1024
+    MAX_PAYLOAD_SIZE uint16 = 1024 // the payload size of the original fixed framing, and the limit until a handshake agrees on another
+    LARGEST_PAYLOAD_SIZE uint16 = 65535 // the most a handshake can agree on, since it's as far as the header's Payload_Byte_Length goes
     USERNAME_SIZE uint16 = 32
     PASSWORD_SIZE uint16 = 32
+    CREDENTIAL_MAX_LENGTH uint16 = 255 // for the length-prefixed username and password of Request_Connection_V2, in bytes
     TITLE_MAX_LENGTH uint16 = 255
     DESCRIPTION_MAX_LENGTH uint16 = 511
+    DIAGNOSTIC_MAX_LENGTH uint16 = 255
+
+    // PROTOCOL VERSIONS
+    // Version 2 sends the username and password as length-prefixed strings (Request_Connection_V2) rather than
+    // fixed arrays, so every string in every message is length-prefixed.  Strings are UTF-8 (the server answers any
+    // that aren't with INVALID_NAME) and are taken exactly as they were sent, without any padding to trim off.
+    // Which version a session uses is settled in its handshake, and the header of every message after that says so.
+    PROTOCOL_VERSION_1 byte = 1
+    PROTOCOL_VERSION_2 byte = 2
+    CURR_PROTOCOL_VERSION  byte = PROTOCOL_VERSION_2
+
+    // EXTENSIONS
+    // Offered by the client in Request_Connection's Extensions_Supported, and only in use if the server lists it
+    // back in Connection_Rules' Acceptable_Exts.
+    EXT_DETAILED_ACKS uint16 = 1 // the server answers with a Detailed_Acknowledgment wherever it has more to say than a response code
+    EXT_IDEMPOTENCY_KEYS uint16 = 2 // the server remembers the Idempotency_Keys in message headers, and doesn't make the same change twice
+    EXT_SESSION_RESUMPTION uint16 = 3 // Connection_Rules carries a Session_Token, which a Request_Connection on a new connection can log back in with
+
+    // What a version 2 Query_Tasks can ask for.  Completion_Filter is one of the QUERY_ ones, Search_Flags is any of
+    // the SEARCH_ ones together (with neither SEARCH_IN_ meaning both), and each Sort_Key is one of the SORT_BY_ ones.
+    QUERY_ANY_STATUS byte = 0
+    QUERY_INCOMPLETE_ONLY byte = 1
+    QUERY_COMPLETED_ONLY byte = 2
+    SEARCH_IN_TITLE byte = 1
+    SEARCH_IN_DESCRIPTION byte = 2
+    SEARCH_IGNORE_CASE byte = 4
+    SEARCH_REGEX byte = 8 // the search is a regular expression (RE2 syntax, as in Go's regexp package) rather than a substring
+    SORT_BY_REFERENCE byte = 0
+    SORT_BY_PRIORITY byte = 1
+    SORT_BY_TITLE byte = 2
+    SORT_BY_STATUS byte = 3 // incomplete before completed
+    QUERY_MAX_LISTS uint16 = 64
+    QUERY_MAX_SORT_KEYS byte = 4
+    SEARCH_MAX_LENGTH uint16 = 255
+    CURSOR_MAX_LENGTH uint16 = 400
 
-    CURR_PROTOCOL_VERSION  byte = 1
+    // Where a task was sitting before/after a change recorded in its history
+    TASK_LOCATION_NONE byte = 0 // didn't exist yet, or has been permanently deleted
+    TASK_LOCATION_ACTIVE byte = 1
+    TASK_LOCATION_TRASH byte = 2
 )
 
 // This struct goes on top of all PTMP Msgs and is used to determine how the payload should be decoded.
@@ -71,6 +137,11 @@ type PTMP_Header struct {
     Msg_Type_ID byte
     Msgs_To_Follow byte
     Payload_Byte_Length uint16
+    // Optional, and 0 when not in use.  A client that wants to be able to safely send a change again (because the
+    // answer to it got lost along with the connection, say) picks a random key for it and sends the same key every
+    // time it sends that change.  A server that agreed to EXT_IDEMPOTENCY_KEYS only makes the change the first time,
+    // and answers any repeats with whatever it answered the first one with.
+    Idempotency_Key uint64
 }
 
 // The following structs are direct implementations of the tables of section 2.2 of my design paper
@@ -83,6 +154,30 @@ type Request_Connection struct {
     Client_Protocol_Versions_Supported []uint16
     Number_Extensions_Supported uint16
     Extensions_Supported []uint16
+    // 0 for a normal login.  Otherwise it's the Session_Token from the Connection_Rules of an earlier session (see
+    // EXT_SESSION_RESUMPTION), and it's checked instead of the Password, which is left empty.
+    Session_Token uint64
+    // The largest payload the client can take (and would like to send).  0 means the client only knows the
+    // original fixed framing, with every payload padded out to MAX_PAYLOAD_SIZE.
+    Max_Payload_Size uint16
+}
+
+// The version 2 Request_Connection (the header's Protocol_Version says which one a message carries).  The username
+// and password can be up to CREDENTIAL_MAX_LENGTH bytes of UTF-8 each, and everything else is the same as version 1.
+// A version 1 server doesn't know these fields, so it sees an empty username and answers with version 1 in its
+// Connection_Rules, and the client can log in again with a Request_Connection.
+type Request_Connection_V2 struct {
+    Length_of_Username byte
+    Username []byte
+    Length_of_Password byte
+    Password []byte
+    Timeout_Rule_Request uint16
+    Client_Number_Versions_Supported uint16
+    Client_Protocol_Versions_Supported []uint16
+    Number_Extensions_Supported uint16
+    Extensions_Supported []uint16
+    Session_Token uint64
+    Max_Payload_Size uint16
 }
 
 type Connection_Rules struct {
@@ -91,6 +186,13 @@ type Connection_Rules struct {
     Protocol_Version_To_Use uint16
     Number_Acceptable_Exts uint16
     Acceptable_Exts []uint16
+    // Only given out to clients that agreed to EXT_SESSION_RESUMPTION (0 otherwise).  It's good for one resumption,
+    // which gets a new token of its own.
+    Session_Token uint64
+    // The largest payload either side can send for the rest of the session: what the client asked for, capped at
+    // what the server allows, but never less than MAX_PAYLOAD_SIZE.  0 if the client didn't ask, in which case the
+    // session stays on the original fixed framing.  Only settled once the login is accepted.
+    Max_Payload_Size uint16
 }
 
 type Acknowledgment struct {
@@ -98,10 +200,89 @@ type Acknowledgment struct {
     ID_Responding_To byte
 }
 
+// How one of the items (task reference numbers, so far) named in a multi-item message went.
+type Item_Result struct {
+    Task_Reference_Number uint16
+    Response_Code uint16
+}
+
+// Sent in place of an Acknowledgment to sessions that negotiated EXT_DETAILED_ACKS, when the server has more to say
+// than the response code.  Item_Results has one entry per item the message named, in the order they were named,
+// unless they wouldn't all fit in the payload, in which case Failures_Only is set and only the items that didn't
+// succeed are listed (so anything missing from the list succeeded).  The Diagnostic is a human-readable explanation
+// for people, and programs shouldn't go by what it says.
+//
+// A Create_New_Task that worked has the one item: the reference number the new task got.  A transaction that was
+// made ends with one whose items are those of each of its changes' own Detailed_Acknowledgments, one after another
+// in the order the changes were sent (so a transaction of creates lists the new tasks' reference numbers in order).
+type Detailed_Acknowledgment struct {
+    Response_Code uint16
+    ID_Responding_To byte
+    Failures_Only byte
+    Num_Items uint16
+    Item_Results []Item_Result
+    Length_of_Diagnostic uint16
+    Diagnostic []byte
+}
+
 type Close_Connection struct {
     Will_Await_Ack byte
 }
 
+// Sent with Msgs_To_Follow set to the number of changes coming after it (which is also what Num_Changes says, as a
+// check), and followed by those changes (Create_New_Task, Remove_Tasks, Mark_Task_Completed, Restore_Tasks and
+// Purge_Trash), each with Msgs_To_Follow counting down to 0.  The server answers the Transaction and each change
+// but the last with CONDITIONAL_SUCCESS, since nothing is actually done until the last one gets there.  Then it
+// makes every change in order, and either answers the last one with MSG_SERIES_SUCCESS, or undoes whatever it had
+// done and answers with a Transaction_Failure.
+type Transaction struct {
+    Num_Changes uint16
+}
+
+// Nothing in the transaction was made, because the change at Failed_Index (counting from 0 for the first change
+// after the Transaction) was answered with Response_Code.  This is also what a message that can't be part of a
+// transaction gets if it's sent in the middle of one, which ends the transaction there.
+type Transaction_Failure struct {
+    Failed_Index uint16
+    Failed_Msg_Type byte
+    Response_Code uint16
+}
+
+// A client can send one of these whenever it's logged in and not in the middle of a series, and the server answers
+// straight away with a Pong.  Any message resets the server's idle timer, but this is the one that doesn't do
+// anything else.
+type Ping struct {
+    Timestamp int64 // when the client sent it, in Unix nanoseconds (only the client reads it, so it's up to the client)
+}
+
+type Pong struct {
+    Timestamp int64 // echoed back from the Ping, so the client can work out the round trip without keeping track of it
+    Idle_Timeout_Seconds uint32 // how long the server lets a session go without sending anything (0 for forever)
+}
+
+// The answer to a QUERY_CAPABILITIES (which has no payload of its own).  Msg_Types is every message type the
+// server will actually do something with, so a client can leave out whatever isn't there rather than send it and
+// get MSG_NOT_IMPLEMENTED back.  Extensions is everything the server offers, whether or not this session asked for
+// it.  The limits are in bytes, and Max_Tasks_Per_List is 0 when the only limit is what the reference numbers allow.
+// Max_Payload_Size is the one this session agreed to in its handshake (MAX_PAYLOAD_SIZE if it didn't ask).  The
+// _Chars limits count characters rather than bytes, and a title or description has to keep to both.
+type Capabilities_Information struct {
+    Length_of_Server_Version byte
+    Server_Version []byte
+    Num_Protocol_Versions uint16
+    Protocol_Versions []uint16
+    Num_Msg_Types uint16
+    Msg_Types []byte
+    Num_Extensions uint16
+    Extensions []uint16
+    Max_Payload_Size uint16
+    Max_Title_Length uint16
+    Max_Description_Length uint16
+    Max_Tasks_Per_List uint16
+    Max_Title_Chars uint16
+    Max_Description_Chars uint16
+}
+
 type Create_New_Task struct {
     Associated_List_ID uint16
     Priority_Value uint16
@@ -124,13 +305,51 @@ type T_Inf struct {
 type Task_Information struct {
     Number_of_Tasks uint16
     Task_Infos []T_Inf
+    // Only in the answer to a version 2 Query_Tasks, which ends with a Task_Information that has no tasks in it and
+    // says how many tasks matched the query in all (however many pages that takes), and what to send as the Cursor
+    // to get the next page (nothing if this was the last one).
+    Total_Matches uint16
+    Length_of_Cursor uint16
+    Next_Cursor []byte
 }
 
+// Version 1 of Query_Tasks, which gets every task with a priority in the range, all in one go.
 type Query_Tasks struct {
     Minimum_Priority uint16
     Maximum_Priority uint16
 }
 
+type Sort_Key struct {
+    Key byte
+    Descending byte
+}
+
+// The version 2 Query_Tasks (the header's Protocol_Version says which one a message carries), which narrows down
+// which tasks come back, puts them in order and pages through them:
+//   - List_IDs are the lists to look in (none for every list).
+//   - Search is matched against the title, the description or both, as a substring or a regular expression.
+//   - Tasks are sorted by each of the Sort_Keys in turn, then by reference number, so the order is always the same.
+//   - Offset skips that many tasks, and Limit is the most to send (0, or more than the server sends at once, for
+//     as many as the server sends at once).
+//   - Cursor is the Next_Cursor from the end of the last page (empty for the first page), and picks up after the
+//     last task on it, even if tasks have been added or removed since.  It's only good for the same query.
+type Query_Tasks_V2 struct {
+    Minimum_Priority uint16
+    Maximum_Priority uint16
+    Number_of_Lists uint16
+    List_IDs []uint16
+    Completion_Filter byte
+    Search_Flags byte
+    Length_of_Search uint16
+    Search []byte
+    Number_of_Sort_Keys byte
+    Sort_Keys []Sort_Key
+    Limit uint16
+    Offset uint16
+    Length_of_Cursor uint16
+    Cursor []byte
+}
+
 type Remove_Tasks struct {
     Permit_Remove_Incomplete byte
     List_ID uint16
@@ -143,6 +362,66 @@ type Mark_Task_Completed struct {
     Task_To_Mark uint16
 }
 
+// Removed tasks aren't gone right away, they sit in the trash of the list they were removed from
+// until the server's retention period runs out (or someone purges them), so these messages let a
+// client look in the trash and pull things back out of it.
+type Query_Trash struct {
+    List_ID uint16
+}
+
+type Trashed_T_Inf struct {
+    List_ID uint16
+    Seconds_Until_Purge uint32
+    Task T_Inf
+}
+
+type Trash_Information struct {
+    Number_of_Tasks uint16
+    Trashed_Tasks []Trashed_T_Inf
+}
+
+type Restore_Tasks struct {
+    List_ID uint16
+    Num_Tasks_Restore uint16
+    Tasks_To_Restore []uint16
+}
+
+type Purge_Trash struct {
+    List_ID uint16
+    Num_Tasks_Purge uint16 // 0 means purge everything in the list's trash
+    Tasks_To_Purge []uint16
+}
+
+// Asks for the recorded history of either a single task or everything that has happened in a list.
+type Query_History struct {
+    List_ID uint16
+    Whole_List byte // if set, Task_Reference_Number is ignored
+    Task_Reference_Number uint16
+}
+
+// One recorded change to one task.  Since none of the messages change the title or description of a task,
+// only the fields that can actually change (completion and whether it's active/trashed/gone) are carried as
+// before/after values, with the task's contents given once in Task.
+type Audit_Entry struct {
+    Timestamp int64 // unix seconds
+    Length_of_Username byte
+    Username []byte
+    Session_ID uint32
+    Msg_Type_ID byte
+    Response_Code uint16
+    List_ID uint16
+    Before_Location byte
+    Before_Completion_Status byte
+    After_Location byte
+    After_Completion_Status byte
+    Task T_Inf
+}
+
+type History_Information struct {
+    Number_of_Entries uint16
+    Entries []Audit_Entry
+}
+
 func GetFixedBytes(b *bytes.Buffer, required_size uint16) [MAX_PAYLOAD_SIZE]byte {
     // Copy the contents of the buffer into a fixed-size byte array that
     // can then be put into the Pld slot of a PTMP_Msg
@@ -163,14 +442,28 @@ func GetFixedBytes(b *bytes.Buffer, required_size uint16) [MAX_PAYLOAD_SIZE]byte
 // rather than requiring an individual encoder/decoder for each message payload type.
 type PAYLOADS interface {
     Request_Connection |
+    Request_Connection_V2 |
     Connection_Rules |
     Acknowledgment |
     Close_Connection |
+    Transaction |
+    Transaction_Failure |
+    Detailed_Acknowledgment |
+    Ping |
+    Pong |
+    Capabilities_Information |
     Create_New_Task |
     Task_Information |
     Query_Tasks |
+    Query_Tasks_V2 |
     Remove_Tasks |
-    Mark_Task_Completed
+    Mark_Task_Completed |
+    Query_Trash |
+    Trash_Information |
+    Restore_Tasks |
+    Purge_Trash |
+    Query_History |
+    History_Information
 }
 
 // Something I've learned during the implementation stage in go is that there is an annoying distinction
@@ -186,17 +479,26 @@ type STR_ARRAYS interface {
 // The encode/decode functions follow the example of the goquic repo in using gob functions to get the byte-array representations of the structures.
 // I would have preferred to use unions for this kind of thing, but as far as I can tell, go doesn't have a concept of unions, so using gob was the most straightforward way of getting the []byte representations of the structs.
 
-// This takes any of the message payload types and converts them into a
-// byte array of exactly MAX_PAYLOAD_SIZE to be put into the
-// payload slot of a PTMP_Msg
-func EncodePayload[V PAYLOADS](msg V) [MAX_PAYLOAD_SIZE]byte {
+// This takes any of the message payload types and converts them into the
+// bytes to be put into the payload slot of a PTMP_Msg.  They're only padded out
+// (or cut short) to MAX_PAYLOAD_SIZE if the message goes out in the fixed framing.
+func EncodePayload[V PAYLOADS](msg V) []byte {
+    buff_temp := bytes.Buffer{}
+    data_encoder := gob.NewEncoder(&buff_temp)
+    data_encoder.Encode(msg)
+    return buff_temp.Bytes()
+}
+
+// How many bytes a payload takes up once it's encoded, to check it'll fit in MAX_PAYLOAD_SIZE (which every
+// session can take) before sending it.
+func PayloadSize[V PAYLOADS](msg V) int {
     buff_temp := bytes.Buffer{}
     data_encoder := gob.NewEncoder(&buff_temp)
     data_encoder.Encode(msg)
-    return GetFixedBytes(&buff_temp, MAX_PAYLOAD_SIZE)
+    return buff_temp.Len()
 }
 
-func DecodePayload[V PAYLOADS](bytes_in [MAX_PAYLOAD_SIZE]byte) *V {
+func DecodePayload[V PAYLOADS](bytes_in []byte) *V {
     // This function takes in a byte array sized for the message payload,
     // and then converts it to a pointer to a struct of the type specified
     // by the input.  I couldn't figure out a way to let the function
@@ -221,6 +523,7 @@ func arrayify[X STR_ARRAYS](in_str string) X {
     // fixed-length arrays wherever possible)
     temp_obj := reflect.New(reflect.TypeOf((*X)(nil)).Elem()) // determines the appropriate type of fixed-size byte array to create and makes a pointer to an object matching that type
     out_arr := temp_obj.Interface().(*X)
+    in_str = trunc(in_str, uint16(len(*out_arr))) // (so that a character that doesn't fit is left out entirely)
     for ii := 0; ii < len(*out_arr); ii++ {
         // Loop through each spot in our output array, and if there is something from the string to
         // put into that spot, do so, otherwise, set to 0.
@@ -233,19 +536,62 @@ func arrayify[X STR_ARRAYS](in_str string) X {
     return *out_arr
 }
 
-// All PTMP_Msgs consist of a common header and a payload converted into a plain byte-array.
+// All PTMP_Msgs consist of a common header and a payload converted into a plain byte-array.  How much of the payload
+// goes over the wire depends on the framing the handshake settled on (see EncodePacketFor).
 type PTMP_Msg struct {
+    Hdr PTMP_Header
+    Pld []byte
+}
+
+// The original framing, with the payload zero-padded out to MAX_PAYLOAD_SIZE.  Everyone can read it, so it's what
+// gets sent until a handshake agrees on a Max_Payload_Size.
+type fixed_msg struct {
+    Hdr PTMP_Header
+    Pld [MAX_PAYLOAD_SIZE]byte
+}
+
+// The variable-length framing, with only as much payload as there actually is.  Its payload has a different name
+// than the fixed framing's, since gob matches fields up by name and won't decode a slice into an array (or the
+// other way around), and this way a message in either framing can be decoded into a received_msg.
+type compact_msg struct {
+    Hdr PTMP_Header
+    Payload []byte
+}
+
+type received_msg struct {
     Hdr PTMP_Header
     Pld [MAX_PAYLOAD_SIZE]byte
+    Payload []byte
 }
 
-// Forces a string to be no longer than the specified length.
+// Room for the header and gob's own bookkeeping on top of the payload, when working out how much to read for one
+// message before giving up on it.  It's generous because gob writes each byte of a fixed payload on its own, which
+// takes two bytes for anything over 127.
+const FRAMING_OVERHEAD int = 2048
+
+// A message's payload was bigger than the Max_Payload_Size agreed in the handshake.
+var ErrPayloadTooLarge = errors.New("ptmp: payload is larger than the agreed maximum")
+
+// Forces a string to be no longer than the specified length (in bytes), without cutting a character in half.
 // This is used for the username and password fields that I naively specified as being fixed-length arrays.
 func trunc(inStr string, max_length uint16) string {
     if uint16(len(inStr)) <= max_length {
         return inStr
     }
-    return inStr[:max_length]
+    cut := int(max_length)
+    for cut > 0 && !utf8.RuneStart(inStr[cut]) {
+        cut--
+    }
+    return inStr[:cut]
+}
+
+// Whether a string is fit to go in a message: valid UTF-8, no longer than max_bytes, and no more than max_chars
+// characters (0 for no limit on characters beyond the bytes).
+func ValidText(text string, max_bytes uint16, max_chars uint16) bool {
+    if len(text) > int(max_bytes) || !utf8.ValidString(text) {
+        return false
+    }
+    return max_chars == 0 || utf8.RuneCountInString(text) <= int(max_chars)
 }
 
 func Bool2Byte(b_in bool) byte {
@@ -263,16 +609,42 @@ func Byte2Bool(b_in byte) bool {
     return b_in != 0
 }
 
-// Encode the full PTMP_Msg into a byte array to go out over QUIC.
+// Encode the full PTMP_Msg into a byte array to go out over QUIC, in the original fixed framing (so a payload
+// longer than MAX_PAYLOAD_SIZE gets the end chopped off of it).
 func EncodePacket(the_msg PTMP_Msg) []byte {
 
     // Note: this function is distinct form the payload encoding function because this always operates
     // on just the one type of input: the PTMP_Msg.  The payload has already been encoded at this point
     // and is located in the .Pld field of the "the_msg" parameter.
 
+    return encodeFramed(fixed_msg{Hdr: the_msg.Hdr, Pld: GetFixedBytes(bytes.NewBuffer(the_msg.Pld), MAX_PAYLOAD_SIZE)})
+}
+
+// Encode the full PTMP_Msg with only as much payload as it has, for peers that agreed to a Max_Payload_Size.
+func EncodeCompactPacket(the_msg PTMP_Msg) []byte {
+    return encodeFramed(compact_msg{Hdr: the_msg.Hdr, Payload: the_msg.Pld})
+}
+
+// Encode a message for a peer that agreed to max_payload_size in the handshake: compact if they agreed to anything,
+// and fixed if they didn't (0).  A payload too big for that comes back as ErrPayloadTooLarge rather than being
+// cut short.
+func EncodePacketFor(the_msg PTMP_Msg, max_payload_size uint16) ([]byte, error) {
+    if max_payload_size == 0 {
+        if len(the_msg.Pld) > int(MAX_PAYLOAD_SIZE) {
+            return nil, ErrPayloadTooLarge
+        }
+        return EncodePacket(the_msg), nil
+    }
+    if len(the_msg.Pld) > int(max_payload_size) {
+        return nil, ErrPayloadTooLarge
+    }
+    return EncodeCompactPacket(the_msg), nil
+}
+
+func encodeFramed[F fixed_msg | compact_msg](framed F) []byte {
     buff_temp := bytes.Buffer{} // create the buffer where we're going to put the encoded version
     data_encoder := gob.NewEncoder(&buff_temp) // link the encoder to the buffer location
-    err_status := data_encoder.Encode(the_msg) // take the message and put its bytes into the buffer
+    err_status := data_encoder.Encode(framed) // take the message and put its bytes into the buffer
     if err_status != nil {
         fmt.Printf("Encoder error: \n\t%+v\n",err_status)
     }
@@ -286,15 +658,78 @@ func EncodePacket(the_msg PTMP_Msg) []byte {
 // recipient to take the appropriate action for the message).
 func DecodePacket(bytes_in []byte) *PTMP_Msg {
     temp_buff := bytes.NewBuffer(bytes_in) // define a buffer for the byte array
-    data_decoder := gob.NewDecoder(temp_buff) // link the decoder object to the buffer
-    msg_out := &PTMP_Msg{} // get our output type ready
-    err_status := data_decoder.Decode(msg_out) // map those input bytes into the PTMP_Msg object
+    msg_out, err_status := decodeFramed(temp_buff) // map those input bytes into the PTMP_Msg object
     if err_status != nil {
         fmt.Printf("Error when decoding:\n\t%+v\n\n",err_status)
     }
     return msg_out
 }
 
+// Decode one message, in whichever framing it came in.  The reader has to be an io.ByteReader so that gob doesn't
+// buffer up (and lose) whatever comes after the message.
+func decodeFramed(reader interface { io.Reader; io.ByteReader }) (*PTMP_Msg, error) {
+    received := received_msg{}
+    err_status := gob.NewDecoder(reader).Decode(&received)
+    msg_out := &PTMP_Msg{Hdr: received.Hdr, Pld: received.Payload}
+    if received.Payload == nil {
+        msg_out.Pld = received.Pld[:] // (a compact message with nothing in its payload ends up here too, which comes to the same thing)
+    }
+    return msg_out, err_status
+}
+
+// Stops a read once it's gone through as many bytes as one message can have.
+type limited_reader struct {
+    reader *bufio.Reader
+    remaining int
+    exceeded bool
+}
+
+func (lr *limited_reader) Read(p []byte) (int, error) {
+    if lr.remaining <= 0 {
+        lr.exceeded = true
+        return 0, ErrPayloadTooLarge
+    }
+    if len(p) > lr.remaining {
+        p = p[:lr.remaining]
+    }
+    num_bytes, err_status := lr.reader.Read(p)
+    lr.remaining -= num_bytes
+    return num_bytes, err_status
+}
+
+func (lr *limited_reader) ReadByte() (byte, error) {
+    if lr.remaining <= 0 {
+        lr.exceeded = true
+        return 0, ErrPayloadTooLarge
+    }
+    lr.remaining--
+    return lr.reader.ReadByte()
+}
+
+// Read the next message from a connection, however it was split up on the way, and in either framing.  The
+// bufio.Reader has to be kept for every read from the connection after this one, since it may already have some
+// of the next message in it.  max_payload_size is what the handshake agreed on (0 for MAX_PAYLOAD_SIZE).  A message
+// with more payload than that comes back along with ErrPayloadTooLarge, so that it can be answered.  One so big that
+// reading it was given up on partway comes back as nil with ErrPayloadTooLarge, and there's no telling where the
+// next message starts after it, so the connection is no good anymore.
+func ReadPacket(reader *bufio.Reader, max_payload_size uint16) (*PTMP_Msg, error) {
+    if max_payload_size == 0 {
+        max_payload_size = MAX_PAYLOAD_SIZE
+    }
+    limited := &limited_reader{reader: reader, remaining: int(max_payload_size) + FRAMING_OVERHEAD}
+    msg_out, err_status := decodeFramed(limited)
+    if limited.exceeded {
+        return nil, ErrPayloadTooLarge
+    }
+    if err_status != nil {
+        return nil, err_status
+    }
+    if len(msg_out.Pld) > int(max_payload_size) {
+        return msg_out, ErrPayloadTooLarge
+    }
+    return msg_out, nil
+}
+
 
 
 // Assembles the generic header message for all PTMP_Msgs.
@@ -318,14 +753,16 @@ func Prep_Request_Connection(username string,
                              password string, 
                              timeout_request uint16, 
                              versions_supported []uint16,
-                             extensions_supported []uint16) PTMP_Msg {
+                             extensions_supported []uint16,
+                             max_payload_size uint16) PTMP_Msg {
     req_conn := PTMP_Msg{}
     // I was looking into using something along the lines of "sizeof" such as "len" to get the size of the payloads,
     // but from what I read, it seems I would have run into issues with getting the size of the arrays contained
     // within the structs, so just doing this manual method with the knowledge of how the structures are defined
     // is my simple workaround to that.
-    pld_size := USERNAME_SIZE + PASSWORD_SIZE + 6 + uint16(2*len(versions_supported) + 2*len(extensions_supported))
+    pld_size := USERNAME_SIZE + PASSWORD_SIZE + 16 + uint16(2*len(versions_supported) + 2*len(extensions_supported))
     req_conn.Hdr = prepHdr(REQUEST_CONNECTION, 0, pld_size)
+    req_conn.Hdr.Protocol_Version = PROTOCOL_VERSION_1 // (the layout of the payload goes by the header's version)
     pld := Request_Connection{
         Username: arrayify[[USERNAME_SIZE]byte](username),
         Password: arrayify[[PASSWORD_SIZE]byte](password),
@@ -334,19 +771,102 @@ func Prep_Request_Connection(username string,
         Client_Protocol_Versions_Supported: versions_supported,
         Number_Extensions_Supported: uint16(len(extensions_supported)),
         Extensions_Supported: extensions_supported,
+        Max_Payload_Size: max_payload_size,
     }
     req_conn.Pld = EncodePayload(pld) // the payload of the final message is supposed to be a []byte, so we can't put the plain struct in as the payload.
 
     return req_conn
 }
 
+// Same concept as the other Prep_Msg_Name_Here functions, but for logging back in with the Session_Token of an earlier
+// session instead of a password (see EXT_SESSION_RESUMPTION).
+func Prep_Resume_Session(username string,
+                         session_token uint64,
+                         versions_supported []uint16,
+                         extensions_supported []uint16,
+                         max_payload_size uint16) PTMP_Msg {
+    req_conn := PTMP_Msg{}
+    pld_size := USERNAME_SIZE + PASSWORD_SIZE + 16 + uint16(2*len(versions_supported) + 2*len(extensions_supported))
+    req_conn.Hdr = prepHdr(REQUEST_CONNECTION, 0, pld_size)
+    req_conn.Hdr.Protocol_Version = PROTOCOL_VERSION_1
+    pld := Request_Connection{
+        Username: arrayify[[USERNAME_SIZE]byte](username),
+        Client_Number_Versions_Supported: uint16(len(versions_supported)),
+        Client_Protocol_Versions_Supported: versions_supported,
+        Number_Extensions_Supported: uint16(len(extensions_supported)),
+        Extensions_Supported: extensions_supported,
+        Session_Token: session_token,
+        Max_Payload_Size: max_payload_size,
+    }
+    req_conn.Pld = EncodePayload(pld)
+    return req_conn
+}
+
+// Same concept as the other Prep_Msg_Name_Here functions, but for a version 2 login (Request_Connection_V2).  The
+// username and password are cut short at CREDENTIAL_MAX_LENGTH, so check them first.
+func Prep_Request_Connection_V2(username string,
+                                password string,
+                                timeout_request uint16,
+                                versions_supported []uint16,
+                                extensions_supported []uint16,
+                                max_payload_size uint16) PTMP_Msg {
+    req_conn := PTMP_Msg{}
+    username = trunc(username, CREDENTIAL_MAX_LENGTH)
+    password = trunc(password, CREDENTIAL_MAX_LENGTH)
+    pld_size := 1 + len(username) + 1 + len(password) + 16 + 2*len(versions_supported) + 2*len(extensions_supported)
+    req_conn.Hdr = prepHdr(REQUEST_CONNECTION, 0, uint16(pld_size))
+    req_conn.Hdr.Protocol_Version = PROTOCOL_VERSION_2
+    pld := Request_Connection_V2{
+        Length_of_Username: byte(len(username)),
+        Username: []byte(username),
+        Length_of_Password: byte(len(password)),
+        Password: []byte(password),
+        Timeout_Rule_Request: timeout_request,
+        Client_Number_Versions_Supported: uint16(len(versions_supported)),
+        Client_Protocol_Versions_Supported: versions_supported,
+        Number_Extensions_Supported: uint16(len(extensions_supported)),
+        Extensions_Supported: extensions_supported,
+        Max_Payload_Size: max_payload_size,
+    }
+    req_conn.Pld = EncodePayload(pld)
+    return req_conn
+}
+
+// Same concept as the other Prep_Msg_Name_Here functions, for resuming a session with a version 2 login.
+func Prep_Resume_Session_V2(username string,
+                            session_token uint64,
+                            versions_supported []uint16,
+                            extensions_supported []uint16,
+                            max_payload_size uint16) PTMP_Msg {
+    req_conn := PTMP_Msg{}
+    username = trunc(username, CREDENTIAL_MAX_LENGTH)
+    pld_size := 1 + len(username) + 1 + 16 + 2*len(versions_supported) + 2*len(extensions_supported)
+    req_conn.Hdr = prepHdr(REQUEST_CONNECTION, 0, uint16(pld_size))
+    req_conn.Hdr.Protocol_Version = PROTOCOL_VERSION_2
+    pld := Request_Connection_V2{
+        Length_of_Username: byte(len(username)),
+        Username: []byte(username),
+        Password: []byte{},
+        Client_Number_Versions_Supported: uint16(len(versions_supported)),
+        Client_Protocol_Versions_Supported: versions_supported,
+        Number_Extensions_Supported: uint16(len(extensions_supported)),
+        Extensions_Supported: extensions_supported,
+        Session_Token: session_token,
+        Max_Payload_Size: max_payload_size,
+    }
+    req_conn.Pld = EncodePayload(pld)
+    return req_conn
+}
+
 // Same concept as the other Prep_Msg_Name_Here functions, generates a fully prepped PTMP_Msg based on the input parameters.
 func Prep_Connection_Rules(uname_ok bool,
                            pw_ok bool,
                            proto_ver uint16,
-                           acceptable_exts []uint16) PTMP_Msg {
+                           acceptable_exts []uint16,
+                           session_token uint64,
+                           max_payload_size uint16) PTMP_Msg {
     conn_rules := PTMP_Msg{}
-    pld_size := 6 + len(acceptable_exts) * 2
+    pld_size := 16 + len(acceptable_exts) * 2
     conn_rules.Hdr = prepHdr(CONNECTION_RULES, 0, uint16(pld_size))
     pld := Connection_Rules{
                             Username_Ok: Bool2Byte(uname_ok),
@@ -354,6 +874,8 @@ func Prep_Connection_Rules(uname_ok bool,
                             Protocol_Version_To_Use: proto_ver,
                             Number_Acceptable_Exts: uint16(len(acceptable_exts)),
                             Acceptable_Exts: acceptable_exts,
+                            Session_Token: session_token,
+                            Max_Payload_Size: max_payload_size,
                             }
     conn_rules.Pld = EncodePayload(pld)
     return conn_rules
@@ -374,6 +896,48 @@ func Prep_Acknowledgment(resp_code uint16,
     return ack
 }
 
+// Same concept as the other Prep_Msg_Name_Here functions, generates a fully prepped PTMP_Msg based on the input parameters.
+// The diagnostic gets cut off at DIAGNOSTIC_MAX_LENGTH.  If everything won't fit in the payload, the items that
+// succeeded are left out first (setting Failures_Only), then the diagnostic, and then as many failures as it takes.
+func Prep_Detailed_Acknowledgment(resp_code uint16,
+                                  msg_responding_to byte,
+                                  items []Item_Result,
+                                  diagnostic string) PTMP_Msg {
+    detailed := PTMP_Msg{}
+    diagnostic = trunc(diagnostic, DIAGNOSTIC_MAX_LENGTH)
+    pld := Detailed_Acknowledgment{
+                                   Response_Code: resp_code,
+                                   ID_Responding_To: msg_responding_to,
+                                   Num_Items: uint16(len(items)),
+                                   Item_Results: items,
+                                   Length_of_Diagnostic: uint16(len(diagnostic)),
+                                   Diagnostic: []byte(diagnostic),
+                                  }
+    if PayloadSize(pld) > int(MAX_PAYLOAD_SIZE) {
+        failures := []Item_Result{}
+        for _, item := range items {
+            if item.Response_Code != SINGULAR_MSG_SUCCESS {
+                failures = append(failures, item)
+            }
+        }
+        pld.Failures_Only = Bool2Byte(true)
+        pld.Item_Results = failures
+        pld.Num_Items = uint16(len(failures))
+    }
+    if PayloadSize(pld) > int(MAX_PAYLOAD_SIZE) {
+        pld.Length_of_Diagnostic = 0
+        pld.Diagnostic = []byte{}
+    }
+    for PayloadSize(pld) > int(MAX_PAYLOAD_SIZE) {
+        pld.Item_Results = pld.Item_Results[:len(pld.Item_Results)/2]
+        pld.Num_Items = uint16(len(pld.Item_Results))
+    }
+    pld_size := 2 + 1 + 1 + 2 + 4*int(pld.Num_Items) + 2 + int(pld.Length_of_Diagnostic)
+    detailed.Hdr = prepHdr(DETAILED_ACKNOWLEDGMENT, 0, uint16(pld_size))
+    detailed.Pld = EncodePayload(pld)
+    return detailed
+}
+
 // Same concept as the other Prep_Msg_Name_Here functions, generates a fully prepped PTMP_Msg based on the input parameters.
 func Prep_Close_Connection(will_await bool) PTMP_Msg {
     close_conn := PTMP_Msg{}
@@ -384,6 +948,95 @@ func Prep_Close_Connection(will_await bool) PTMP_Msg {
     return close_conn
 }
 
+// Same concept as the other Prep_Msg_Name_Here functions, generates a fully prepped PTMP_Msg based on the input parameters.
+// Msgs_To_Follow is only a byte, so a transaction can't have more than 255 changes in it.
+func Prep_Transaction(num_changes byte) PTMP_Msg {
+    transaction := PTMP_Msg{}
+    pld_size := 2
+    transaction.Hdr = prepHdr(TRANSACTION, num_changes, uint16(pld_size))
+    pld := Transaction{Num_Changes: uint16(num_changes)}
+    transaction.Pld = EncodePayload(pld)
+    return transaction
+}
+
+// Same concept as the other Prep_Msg_Name_Here functions, generates a fully prepped PTMP_Msg based on the input parameters.
+func Prep_Ping(timestamp int64) PTMP_Msg {
+    ping := PTMP_Msg{}
+    ping.Hdr = prepHdr(PING, 0, 8)
+    ping.Pld = EncodePayload(Ping{Timestamp: timestamp})
+    return ping
+}
+
+// Same concept as the other Prep_Msg_Name_Here functions, generates a fully prepped PTMP_Msg based on the input parameters.
+func Prep_Pong(timestamp int64, idle_timeout_seconds uint32) PTMP_Msg {
+    pong := PTMP_Msg{}
+    pong.Hdr = prepHdr(PONG, 0, 12)
+    pong.Pld = EncodePayload(Pong{Timestamp: timestamp, Idle_Timeout_Seconds: idle_timeout_seconds})
+    return pong
+}
+
+// Same concept as the other Prep_Msg_Name_Here functions, generates a fully prepped PTMP_Msg based on the input parameters.
+// There's nothing to say in a capabilities query, so it's all header.
+func Prep_Query_Capabilities() PTMP_Msg {
+    query := PTMP_Msg{}
+    query.Hdr = prepHdr(QUERY_CAPABILITIES, 0, 0)
+    return query
+}
+
+// Same concept as the other Prep_Msg_Name_Here functions, generates a fully prepped PTMP_Msg based on the input parameters.
+// A server version too long for its length byte is cut short.
+func Prep_Capabilities_Information(server_version string,
+                                   protocol_versions []uint16,
+                                   msg_types []byte,
+                                   extensions []uint16,
+                                   max_payload_size uint16,
+                                   max_title_length uint16,
+                                   max_description_length uint16,
+                                   max_tasks_per_list uint16,
+                                   max_title_chars uint16,
+                                   max_description_chars uint16) PTMP_Msg {
+    server_version = trunc(server_version, 255)
+    info := PTMP_Msg{}
+    pld_size := 1 + len(server_version) +
+                2 + 2*len(protocol_versions) +
+                2 + len(msg_types) +
+                2 + 2*len(extensions) +
+                6*2 // the limits
+    info.Hdr = prepHdr(CAPABILITIES_INFORMATION, 0, uint16(pld_size))
+    pld := Capabilities_Information{
+                                    Length_of_Server_Version: byte(len(server_version)),
+                                    Server_Version: []byte(server_version),
+                                    Num_Protocol_Versions: uint16(len(protocol_versions)),
+                                    Protocol_Versions: protocol_versions,
+                                    Num_Msg_Types: uint16(len(msg_types)),
+                                    Msg_Types: msg_types,
+                                    Num_Extensions: uint16(len(extensions)),
+                                    Extensions: extensions,
+                                    Max_Payload_Size: max_payload_size,
+                                    Max_Title_Length: max_title_length,
+                                    Max_Description_Length: max_description_length,
+                                    Max_Tasks_Per_List: max_tasks_per_list,
+                                    Max_Title_Chars: max_title_chars,
+                                    Max_Description_Chars: max_description_chars,
+                                   }
+    info.Pld = EncodePayload(pld)
+    return info
+}
+
+// Same concept as the other Prep_Msg_Name_Here functions, generates a fully prepped PTMP_Msg based on the input parameters.
+func Prep_Transaction_Failure(failed_index uint16, failed_msg_type byte, resp_code uint16) PTMP_Msg {
+    failure := PTMP_Msg{}
+    pld_size := 5 // 2x uint16 + 1 byte
+    failure.Hdr = prepHdr(TRANSACTION_FAILURE, 0, uint16(pld_size))
+    pld := Transaction_Failure{
+                               Failed_Index: failed_index,
+                               Failed_Msg_Type: failed_msg_type,
+                               Response_Code: resp_code,
+                              }
+    failure.Pld = EncodePayload(pld)
+    return failure
+}
+
 // Same concept as the other Prep_Msg_Name_Here functions, generates a fully prepped PTMP_Msg based on the input parameters.
 func Prep_Create_New_Task(list_id uint16,
                           priority uint16,
@@ -421,6 +1074,7 @@ func Prep_Query_Tasks(min_priority uint16,
     query := PTMP_Msg{}
     pld_size := 4 // 2x uint16s
     query.Hdr = prepHdr(QUERY_TASKS, 0, uint16(pld_size))
+    query.Hdr.Protocol_Version = PROTOCOL_VERSION_1 // (the payload layout goes by the header's version)
     pld := Query_Tasks{
                         Maximum_Priority: max_priority,
                         Minimum_Priority: min_priority,
@@ -429,6 +1083,45 @@ func Prep_Query_Tasks(min_priority uint16,
     return query
 }
 
+// Same concept as the other Prep_Msg_Name_Here functions, but for a version 2 query (Query_Tasks_V2).  Like
+// Prep_Create_New_Task, it panics if anything is too long for the message, so check first.
+func Prep_Query_Tasks_V2(min_priority uint16,
+                         max_priority uint16,
+                         list_ids []uint16,
+                         completion_filter byte,
+                         search_flags byte,
+                         search string,
+                         sort_keys []Sort_Key,
+                         limit uint16,
+                         offset uint16,
+                         cursor []byte) PTMP_Msg {
+    if len(list_ids) > int(QUERY_MAX_LISTS) || len(search) > int(SEARCH_MAX_LENGTH) || len(sort_keys) > int(QUERY_MAX_SORT_KEYS) || len(cursor) > int(CURSOR_MAX_LENGTH) {
+        panic(fmt.Errorf("Query has more than %v lists, %v bytes of search, %v sort keys or %v bytes of cursor.", QUERY_MAX_LISTS, SEARCH_MAX_LENGTH, QUERY_MAX_SORT_KEYS, CURSOR_MAX_LENGTH))
+    }
+    query := PTMP_Msg{}
+    pld_size := 2+2 + 2 + 2*len(list_ids) + 1+1 + 2 + len(search) + 1 + 2*len(sort_keys) + 2+2 + 2 + len(cursor)
+    query.Hdr = prepHdr(QUERY_TASKS, 0, uint16(pld_size))
+    query.Hdr.Protocol_Version = PROTOCOL_VERSION_2
+    pld := Query_Tasks_V2{
+                          Minimum_Priority: min_priority,
+                          Maximum_Priority: max_priority,
+                          Number_of_Lists: uint16(len(list_ids)),
+                          List_IDs: list_ids,
+                          Completion_Filter: completion_filter,
+                          Search_Flags: search_flags,
+                          Length_of_Search: uint16(len(search)),
+                          Search: []byte(search),
+                          Number_of_Sort_Keys: byte(len(sort_keys)),
+                          Sort_Keys: sort_keys,
+                          Limit: limit,
+                          Offset: offset,
+                          Length_of_Cursor: uint16(len(cursor)),
+                          Cursor: cursor,
+                         }
+    query.Pld = EncodePayload(pld)
+    return query
+}
+
 // Same concept as the other Prep_Msg_Name_Here functions, generates a fully prepped PTMP_Msg based on the input parameters.
 // This is the only one of my prep functions that is intended to be called repeatedly, so as part of that repetition, it needs
 // to know the number of additional calls that will be made, and it uses that to fill the header's field for number of messages to follow.
@@ -447,6 +1140,22 @@ func Prep_Task_Information(tasks []T_Inf, num_subsequent byte) PTMP_Msg {
     return info
 }
 
+// Same concept as the other Prep_Msg_Name_Here functions, for the Task_Information that ends the answer to a
+// version 2 Query_Tasks (so it's always the last message, and has no tasks of its own).
+func Prep_Task_Page_End(total_matches uint16, next_cursor []byte) PTMP_Msg {
+    info := PTMP_Msg{}
+    pld_size := 2 + 2 + 2 + len(next_cursor)
+    info.Hdr = prepHdr(TASK_INFORMATION, 0, uint16(pld_size))
+    pld := Task_Information{
+                            Task_Infos: []T_Inf{},
+                            Total_Matches: total_matches,
+                            Length_of_Cursor: uint16(len(next_cursor)),
+                            Next_Cursor: next_cursor,
+                            }
+    info.Pld = EncodePayload(pld)
+    return info
+}
+
 // Same concept as the other Prep_Msg_Name_Here functions, generates a fully prepped PTMP_Msg based on the input parameters.
 func Prep_Remove_Tasks(permit_incomplete bool,
                        listID uint16,
@@ -476,3 +1185,89 @@ func Prep_Mark_Task_Completed(listID uint16, taskID uint16) PTMP_Msg {
     completed.Pld = EncodePayload(pld)
     return completed
 }
+
+// Same concept as the other Prep_Msg_Name_Here functions, generates a fully prepped PTMP_Msg based on the input parameters.
+func Prep_Query_Trash(listID uint16) PTMP_Msg {
+    query := PTMP_Msg{}
+    pld_size := uint16(2)
+    query.Hdr = prepHdr(QUERY_TRASH, 0, pld_size)
+    pld := Query_Trash{List_ID: listID}
+    query.Pld = EncodePayload(pld)
+    return query
+}
+
+// Same concept as Prep_Task_Information - one trashed task per message, with the header saying how many more are coming.
+func Prep_Trash_Information(tasks []Trashed_T_Inf, num_subsequent byte) PTMP_Msg {
+    info := PTMP_Msg{}
+    pld_size := uint16(2 + len(tasks) * (2+4+2+2+1+2+1))
+    for ii := 0; ii < len(tasks); ii++ {
+        pld_size += uint16(tasks[ii].Task.Length_of_Title) + tasks[ii].Task.Description_Length
+    }
+    info.Hdr = prepHdr(TRASH_INFORMATION, num_subsequent, pld_size)
+    pld := Trash_Information{
+                             Number_of_Tasks: uint16(len(tasks)),
+                             Trashed_Tasks: tasks,
+                             }
+    info.Pld = EncodePayload(pld)
+    return info
+}
+
+// Same concept as the other Prep_Msg_Name_Here functions, generates a fully prepped PTMP_Msg based on the input parameters.
+func Prep_Restore_Tasks(listID uint16, tasksToRestore []uint16) PTMP_Msg {
+    restore := PTMP_Msg{}
+    pld_size := uint16(4 + 2*len(tasksToRestore))
+    restore.Hdr = prepHdr(RESTORE_TASKS, 0, pld_size)
+    pld := Restore_Tasks{
+                         List_ID: listID,
+                         Num_Tasks_Restore: uint16(len(tasksToRestore)),
+                         Tasks_To_Restore: tasksToRestore,
+                         }
+    restore.Pld = EncodePayload(pld)
+    return restore
+}
+
+// Same concept as the other Prep_Msg_Name_Here functions, generates a fully prepped PTMP_Msg based on the input parameters.
+// Passing an empty tasksToPurge empties out the whole trash for that list.
+func Prep_Purge_Trash(listID uint16, tasksToPurge []uint16) PTMP_Msg {
+    purge := PTMP_Msg{}
+    pld_size := uint16(4 + 2*len(tasksToPurge))
+    purge.Hdr = prepHdr(PURGE_TRASH, 0, pld_size)
+    pld := Purge_Trash{
+                       List_ID: listID,
+                       Num_Tasks_Purge: uint16(len(tasksToPurge)),
+                       Tasks_To_Purge: tasksToPurge,
+                       }
+    purge.Pld = EncodePayload(pld)
+    return purge
+}
+
+// Same concept as the other Prep_Msg_Name_Here functions, generates a fully prepped PTMP_Msg based on the input parameters.
+func Prep_Query_History(listID uint16, whole_list bool, taskID uint16) PTMP_Msg {
+    query := PTMP_Msg{}
+    pld_size := uint16(5)
+    query.Hdr = prepHdr(QUERY_HISTORY, 0, pld_size)
+    pld := Query_History{
+                         List_ID: listID,
+                         Whole_List: Bool2Byte(whole_list),
+                         Task_Reference_Number: taskID,
+                         }
+    query.Pld = EncodePayload(pld)
+    return query
+}
+
+// Same concept as Prep_Task_Information - one history entry per message, with the header saying how many more are coming.
+func Prep_History_Information(entries []Audit_Entry, num_subsequent byte) PTMP_Msg {
+    info := PTMP_Msg{}
+    pld_size := uint16(2)
+    for ii := 0; ii < len(entries); ii++ {
+        pld_size += uint16(8+1+4+1+2+2+4 + len(entries[ii].Username)) +
+                    uint16(2+2+1+2+1) + uint16(entries[ii].Task.Length_of_Title) + entries[ii].Task.Description_Length
+    }
+    info.Hdr = prepHdr(HISTORY_INFORMATION, num_subsequent, pld_size)
+    pld := History_Information{
+                               Number_of_Entries: uint16(len(entries)),
+                               Entries: entries,
+                               }
+    info.Pld = EncodePayload(pld)
+    return info
+}
@@ -0,0 +1,150 @@
+package ptmpclient
+
+import (
+    "context"
+    "fmt"
+    "ajb497/ptmp"
+)
+
+// The most changes one transaction can have, since the header counts the messages still to follow in a byte.
+const MAX_BATCH_CHANGES int = 255
+
+// A set of changes for the server to make all-or-nothing: either it makes every one of them, in order, or none of
+// them.  Build one up and hand it to Client.Commit, e.g.
+//
+//     batch := &ptmpclient.Batch{}
+//     batch.CompleteTask(1, 3).RemoveTasks(1, []uint16{3}, false).CreateTask(1, 1000, "Grade the next one", "Same again")
+//     err = client.Commit(ctx, batch)
+type Batch struct {
+    changes []ptmp.PTMP_Msg
+    err error // the first change that couldn't be added, reported by Commit instead of sending anything
+}
+
+// How many changes are in the batch so far.
+func (b *Batch) Len() int {
+    return len(b.changes)
+}
+
+func (b *Batch) add(msg ptmp.PTMP_Msg) *Batch {
+    if b.err == nil && len(b.changes) >= MAX_BATCH_CHANGES {
+        b.err = fmt.Errorf("ptmpclient: a batch can have at most %v changes", MAX_BATCH_CHANGES)
+    }
+    b.changes = append(b.changes, msg)
+    return b
+}
+
+// Titles and descriptions that are too long (or empty, or not UTF-8) are caught here, like Client.CreateTask does, and make
+// Commit fail without sending anything.  (Commit checks them against the server's own limits too.)
+func (b *Batch) CreateTask(list_id uint16, priority uint16, title string, description string) *Batch {
+    if err_status := checkTaskText(nil, title, description); err_status != nil {
+        if b.err == nil {
+            b.err = err_status
+        }
+        return b
+    }
+    return b.add(ptmp.Prep_Create_New_Task(list_id, priority, title, description))
+}
+
+func (b *Batch) CompleteTask(list_id uint16, ref uint16) *Batch {
+    return b.add(ptmp.Prep_Mark_Task_Completed(list_id, ref))
+}
+
+func (b *Batch) RemoveTasks(list_id uint16, refs []uint16, permit_incomplete bool) *Batch {
+    return b.add(ptmp.Prep_Remove_Tasks(permit_incomplete, list_id, refs))
+}
+
+func (b *Batch) RestoreTasks(list_id uint16, refs []uint16) *Batch {
+    return b.add(ptmp.Prep_Restore_Tasks(list_id, refs))
+}
+
+// Like Client.PurgeTrash, no refs means everything in the list's trash.
+func (b *Batch) PurgeTrash(list_id uint16, refs []uint16) *Batch {
+    if refs == nil {
+        refs = []uint16{}
+    }
+    return b.add(ptmp.Prep_Purge_Trash(list_id, refs))
+}
+
+// Returned by Commit when the server didn't make a transaction because one of its changes failed.  None of the
+// changes were made.  It unwraps to the *ResponseError for the change that failed, so errors.Is(err,
+// ErrTaskDoesNotExist) and the like work on it.
+type TransactionError struct {
+    Index int // which change failed, counting from 0 in the order they were added to the Batch
+    Msg_Type_ID byte
+    Response_Code uint16
+}
+
+func (e *TransactionError) Error() string {
+    return fmt.Sprintf("ptmpclient: transaction not made, change %v (message type %v) failed with %v (%v)", e.Index, e.Msg_Type_ID, ResponseCodeName(e.Response_Code), e.Response_Code)
+}
+
+func (e *TransactionError) Unwrap() error {
+    return &ResponseError{Response_Code: e.Response_Code, Msg_Type_ID: e.Msg_Type_ID}
+}
+
+// Send a batch to the server as one transaction.  Nil means every change in it was made, and a *TransactionError
+// means none of them were.  The Client is held on to for the whole transaction, since anything else sent in the
+// middle of it would end it.  If the server turns away one of the messages themselves partway through (with
+// RATE_LIMITED, say), the transaction is abandoned, nothing is made, and that error comes back.  A batch with
+// anything in it the server's capabilities say it can't do (including transactions themselves) isn't sent at all.
+func (c *Client) Commit(ctx context.Context, batch *Batch) error {
+    _, err_status := c.CommitResults(ctx, batch)
+    return err_status
+}
+
+// Like Commit, but a transaction that was made also comes back with how each change's items went, if the server
+// does detailed acks: the items of each change one after another, in the order they were added to the Batch.  For a
+// CreateTask, that's the one item with the reference number the new task got.  Nil if the server didn't say (or
+// couldn't fit them all in).
+func (c *Client) CommitResults(ctx context.Context, batch *Batch) ([]ItemResult, error) {
+    if batch.err != nil {
+        return nil, batch.err
+    }
+    msgs := []ptmp.PTMP_Msg{ptmp.Prep_Transaction(byte(len(batch.changes)))}
+    for ii, change := range batch.changes {
+        change.Hdr.Msgs_To_Follow = byte(len(batch.changes)-1-ii)
+        msgs = append(msgs, change)
+    }
+
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    // (before the Transaction goes out, since asking the server anything in the middle of one would end it)
+    if err_status := c.checkImplemented(ctx, msgs...); err_status != nil {
+        return nil, err_status
+    }
+    for ii, msg := range msgs {
+        replies, err_status := c.exchange(ctx, msg)
+        if err_status != nil {
+            return nil, err_status
+        }
+        last := ii == len(msgs)-1
+        err_status = ErrUnexpectedReply
+        if len(replies) == 1 && replies[0].Hdr.Msg_Type_ID == ptmp.TRANSACTION_FAILURE {
+            failure := ptmp.DecodePayload[ptmp.Transaction_Failure](replies[0].Pld)
+            return nil, &TransactionError{Index: int(failure.Failed_Index), Msg_Type_ID: failure.Failed_Msg_Type, Response_Code: failure.Response_Code}
+        }
+        if last && len(replies) == 1 && replies[0].Hdr.Msg_Type_ID == ptmp.DETAILED_ACKNOWLEDGMENT {
+            if ack := ptmp.DecodePayload[ptmp.Detailed_Acknowledgment](replies[0].Pld); ack.Response_Code == ptmp.MSG_SERIES_SUCCESS {
+                return ackItems(replies[0]), nil
+            }
+            err_status = ackReplyToError(replies)
+        }
+        if len(replies) == 1 && replies[0].Hdr.Msg_Type_ID == ptmp.ACKNOWLEDGMENT {
+            ack := ptmp.DecodePayload[ptmp.Acknowledgment](replies[0].Pld)
+            switch {
+                case last && ack.Response_Code == ptmp.MSG_SERIES_SUCCESS:
+                    return nil, nil
+                case !last && ack.Response_Code == ptmp.CONDITIONAL_SUCCESS:
+                    continue
+                case ack.Response_Code != ptmp.SINGULAR_MSG_SUCCESS && ack.Response_Code != ptmp.MSG_SERIES_SUCCESS:
+                    err_status = ackToError(ack)
+            }
+        }
+        if ii > 0 {
+            // The server is still waiting for the rest of it, and another Transaction in the middle of one ends it.
+            c.exchange(ctx, ptmp.Prep_Transaction(0))
+        }
+        return nil, err_status
+    }
+    return nil, nil
+}
@@ -0,0 +1,159 @@
+package ptmpclient
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "ajb497/ptmp"
+)
+
+// What the server says it can do (see ptmp.Capabilities_Information).  The lengths are in bytes, the Chars in
+// characters (0 if the server didn't say), and Max_Tasks_Per_List is 0 if there's no limit.
+type Capabilities struct {
+    Server_Version string
+    Protocol_Versions []uint16
+    Msg_Types []byte // nil if the server is too old to say, in which case everything is assumed to be there
+    Extensions []uint16 // everything the server offers (HasExtension says what this session actually agreed to)
+    Max_Payload_Size uint16
+    Max_Title_Length uint16
+    Max_Description_Length uint16
+    Max_Tasks_Per_List uint16
+    Max_Title_Chars uint16
+    Max_Description_Chars uint16
+}
+
+// Whether the server does anything with a message type, rather than answering it with MSG_NOT_IMPLEMENTED.
+func (caps *Capabilities) Implements(msg_type byte) bool {
+    if caps.Msg_Types == nil {
+        return true
+    }
+    for _, implemented := range caps.Msg_Types {
+        if implemented == msg_type {
+            return true
+        }
+    }
+    return false
+}
+
+// What we assume about a server that doesn't answer capability queries: everything the messages allow for, and
+// whatever payload size it agreed to when we logged in.
+func defaultCapabilities(max_payload uint16) *Capabilities {
+    if max_payload == 0 {
+        max_payload = ptmp.MAX_PAYLOAD_SIZE
+    }
+    return &Capabilities{
+                         Protocol_Versions: []uint16{uint16(ptmp.PROTOCOL_VERSION_1)},
+                         Max_Payload_Size: max_payload,
+                         Max_Title_Length: ptmp.TITLE_MAX_LENGTH,
+                         Max_Description_Length: ptmp.DESCRIPTION_MAX_LENGTH,
+                        }
+}
+
+// Ask the server what it can do.  The answer is kept for as long as the connection lasts (a new connection could
+// be to a server that's been upgraded), so only the first call goes to the server.  A server that doesn't answer
+// capability queries gets the defaults: every message type and the longest titles and descriptions the messages
+// allow.  The Client checks these itself before sending anything, and turns away whatever the server can't do
+// without bothering it.
+func (c *Client) Capabilities(ctx context.Context) (*Capabilities, error) {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    caps, err_status := c.capabilities(ctx)
+    if err_status != nil {
+        return nil, err_status
+    }
+    copied := *caps
+    return &copied, nil
+}
+
+// Capabilities, for callers that already have the lock.
+func (c *Client) capabilities(ctx context.Context) (*Capabilities, error) {
+    if c.server_capabilities != nil {
+        return c.server_capabilities, nil
+    }
+    replies, err_status := c.exchangeResuming(ctx, ptmp.Prep_Query_Capabilities(), func(error) bool { return true })
+    if err_status != nil {
+        return nil, err_status
+    }
+    if len(replies) == 1 && replies[0].Hdr.Msg_Type_ID == ptmp.ACKNOWLEDGMENT {
+        err_status = ackToError(ptmp.DecodePayload[ptmp.Acknowledgment](replies[0].Pld))
+        if errors.Is(err_status, ErrMsgNotImplemented) {
+            c.server_capabilities = defaultCapabilities(c.max_payload)
+            return c.server_capabilities, nil
+        }
+        if err_status != nil {
+            return nil, err_status // most likely MSG_CONTEXT_INVALID, from not being logged in yet
+        }
+    }
+    if len(replies) != 1 || replies[0].Hdr.Msg_Type_ID != ptmp.CAPABILITIES_INFORMATION {
+        return nil, ErrUnexpectedReply
+    }
+    info := ptmp.DecodePayload[ptmp.Capabilities_Information](replies[0].Pld)
+    c.server_capabilities = &Capabilities{
+                                          Server_Version: string(info.Server_Version),
+                                          Protocol_Versions: info.Protocol_Versions,
+                                          Msg_Types: info.Msg_Types,
+                                          Extensions: info.Extensions,
+                                          Max_Payload_Size: info.Max_Payload_Size,
+                                          Max_Title_Length: info.Max_Title_Length,
+                                          Max_Description_Length: info.Max_Description_Length,
+                                          Max_Tasks_Per_List: info.Max_Tasks_Per_List,
+                                          Max_Title_Chars: info.Max_Title_Chars,
+                                          Max_Description_Chars: info.Max_Description_Chars,
+                                         }
+    if c.server_capabilities.Msg_Types == nil {
+        c.server_capabilities.Msg_Types = []byte{} // (a server that really does nothing, rather than one that didn't say)
+    }
+    return c.server_capabilities, nil
+}
+
+// Check that the server does something with each of the message types before any of them are sent, so that a
+// message it would only answer with MSG_NOT_IMPLEMENTED comes back with that error without going anywhere.  The
+// Client has to be locked.
+func (c *Client) checkImplemented(ctx context.Context, msgs ...ptmp.PTMP_Msg) error {
+    caps, err_status := c.capabilities(ctx)
+    if err_status != nil {
+        return err_status
+    }
+    for _, msg := range msgs {
+        if !caps.Implements(msg.Hdr.Msg_Type_ID) {
+            return &ResponseError{Response_Code: ptmp.MSG_NOT_IMPLEMENTED, Msg_Type_ID: msg.Hdr.Msg_Type_ID, Diagnostic: "not in the server's capabilities, so it wasn't sent"}
+        }
+        if msg.Hdr.Msg_Type_ID == ptmp.CREATE_NEW_TASK {
+            creation := ptmp.DecodePayload[ptmp.Create_New_Task](msg.Pld)
+            if err_status = checkTaskText(caps, string(creation.Task_Title), string(creation.Task_Description)); err_status != nil {
+                return err_status
+            }
+        }
+    }
+    return nil
+}
+
+// Titles and descriptions have to be there, in UTF-8, and no longer than the server takes (which is never longer
+// than the messages have room for), in bytes or in characters.
+func checkTaskText(caps *Capabilities, title string, description string) error {
+    max_title, max_description := ptmp.TITLE_MAX_LENGTH, ptmp.DESCRIPTION_MAX_LENGTH
+    var max_title_chars, max_description_chars uint16
+    if caps != nil {
+        if caps.Max_Title_Length > 0 && caps.Max_Title_Length < max_title {
+            max_title = caps.Max_Title_Length
+        }
+        if caps.Max_Description_Length > 0 && caps.Max_Description_Length < max_description {
+            max_description = caps.Max_Description_Length
+        }
+        max_title_chars, max_description_chars = caps.Max_Title_Chars, caps.Max_Description_Chars
+    }
+    if len(title) < 1 || !ptmp.ValidText(title, max_title, max_title_chars) {
+        return fmt.Errorf("ptmpclient: title must be UTF-8, between 1 and %v bytes long%v", max_title, charLimit(max_title_chars))
+    }
+    if len(description) < 1 || !ptmp.ValidText(description, max_description, max_description_chars) {
+        return fmt.Errorf("ptmpclient: description must be UTF-8, between 1 and %v bytes long%v", max_description, charLimit(max_description_chars))
+    }
+    return nil
+}
+
+func charLimit(max_chars uint16) string {
+    if max_chars == 0 {
+        return ""
+    }
+    return fmt.Sprintf(" and no more than %v characters", max_chars)
+}
@@ -0,0 +1,194 @@
+package ptmpclient
+
+import (
+    "errors"
+    "fmt"
+    "ajb497/ptmp"
+)
+
+// Returned when a method is called on a Client whose connection has already been closed.
+var ErrClosed = errors.New("ptmpclient: connection is closed")
+
+// Returned when the server closes the connection from its end (because it's shutting down) instead of answering,
+// and the Client couldn't connect again (see Client.Reconnect_Backoff).  The Client is closed after that, so a new
+// one has to be dialed once the server is back.
+var ErrServerClosed = errors.New("ptmpclient: the server closed the connection")
+
+// Returned (without anything being sent) for a message whose payload is bigger than the Max_Payload_Size agreed
+// when logging in, and when the server sends back something bigger than that.
+var ErrPayloadTooLarge = ptmp.ErrPayloadTooLarge
+
+// Returned (without anything being sent) when the last exchange was given up on before its answer had all come in,
+// since the rest of it would be taken for the answer to the next one.  The Client connects again and picks the
+// session back up before sending anything else, if it can (see Client.Reconnect_Backoff).
+var ErrDropped = errors.New("ptmpclient: the connection was dropped when an answer was given up on")
+
+// Returned when the server answers with a message that doesn't make sense for what was sent to it.
+var ErrUnexpectedReply = errors.New("ptmpclient: unexpected reply from server")
+
+// Any acknowledgment that isn't a success comes back from the Client's methods as a *ResponseError carrying the
+// response code.  The sentinels below can be used with errors.Is to check for a particular code, e.g.
+//
+//     if errors.Is(err, ptmpclient.ErrTaskDoesNotExist) { ... }
+//
+// When the server sends a detailed acknowledgment (see ptmp.EXT_DETAILED_ACKS, which the Client always asks for),
+// the error also says how each task named in the message went, and why, in the server's words.  Removing,
+// restoring and purging several tasks at once does as many of them as it can, so a *ResponseError with
+// ErrPartialSuccess's code means some of them were done, and Failed says which weren't.
+type ResponseError struct {
+    Response_Code uint16
+    Msg_Type_ID byte // the message type the server was responding to
+    Items []ItemResult // how each task went, in the order they were sent (nil if the server didn't say)
+    Failures_Only bool // Items only lists the tasks that weren't done, since the server couldn't fit them all in
+    Diagnostic string // the server's explanation, meant for people rather than programs
+}
+
+// How one of the tasks named in a message went.
+type ItemResult struct {
+    Ref uint16
+    Response_Code uint16
+}
+
+// The items that weren't done.
+func (e *ResponseError) Failed() []ItemResult {
+    failed := []ItemResult{}
+    for _, item := range e.Items {
+        if item.Response_Code != ptmp.SINGULAR_MSG_SUCCESS {
+            failed = append(failed, item)
+        }
+    }
+    return failed
+}
+
+var (
+    ErrPartialSuccess = &ResponseError{Response_Code: ptmp.CONDITIONAL_SUCCESS}
+    ErrUnableToComply = &ResponseError{Response_Code: ptmp.UNABLE_TO_COMPLY}
+    ErrListDoesNotExist = &ResponseError{Response_Code: ptmp.LIST_DOES_NOT_EXIST}
+    ErrTaskDoesNotExist = &ResponseError{Response_Code: ptmp.TASK_DOES_NOT_EXIST}
+    ErrConditionalOrderFailure = &ResponseError{Response_Code: ptmp.CONDITIONAL_ORDER_FAILURE}
+    ErrInvalidName = &ResponseError{Response_Code: ptmp.INVALID_NAME}
+    ErrRateLimited = &ResponseError{Response_Code: ptmp.RATE_LIMITED}
+    ErrLoginThrottled = &ResponseError{Response_Code: ptmp.LOGIN_THROTTLED}
+    ErrTooManySessions = &ResponseError{Response_Code: ptmp.TOO_MANY_SESSIONS}
+    ErrSessionTokenInvalid = &ResponseError{Response_Code: ptmp.SESSION_TOKEN_INVALID}
+    ErrPayloadRejected = &ResponseError{Response_Code: ptmp.PAYLOAD_TOO_LARGE} // (the server's answer, see ErrPayloadTooLarge for ours)
+    ErrTeapot = &ResponseError{Response_Code: ptmp.TEAPOT}
+    ErrSyntax = &ResponseError{Response_Code: ptmp.SYNTAX_ERROR}
+    ErrProtocolVersionsIncompatible = &ResponseError{Response_Code: ptmp.PROTOCOL_VERSIONS_INCOMPATIBLE}
+    ErrMsgNotImplemented = &ResponseError{Response_Code: ptmp.MSG_NOT_IMPLEMENTED}
+    ErrMsgContextInvalid = &ResponseError{Response_Code: ptmp.MSG_CONTEXT_INVALID}
+)
+
+var response_code_names = map[uint16]string{
+    ptmp.SINGULAR_MSG_SUCCESS: "SINGULAR_MSG_SUCCESS",
+    ptmp.MSG_SERIES_SUCCESS: "MSG_SERIES_SUCCESS",
+    ptmp.CONDITIONAL_SUCCESS: "CONDITIONAL_SUCCESS",
+    ptmp.UNABLE_TO_COMPLY: "UNABLE_TO_COMPLY",
+    ptmp.LIST_DOES_NOT_EXIST: "LIST_DOES_NOT_EXIST",
+    ptmp.TASK_DOES_NOT_EXIST: "TASK_DOES_NOT_EXIST",
+    ptmp.TIMEOUT_WARNING_ADDITIONAL_MSGS: "TIMEOUT_WARNING_ADDITIONAL_MSGS",
+    ptmp.TIMEOUT_WARNING_INACTIVE: "TIMEOUT_WARNING_INACTIVE",
+    ptmp.CONDITIONAL_ORDER_FAILURE: "CONDITIONAL_ORDER_FAILURE",
+    ptmp.INVALID_NAME: "INVALID_NAME",
+    ptmp.RATE_LIMITED: "RATE_LIMITED",
+    ptmp.LOGIN_THROTTLED: "LOGIN_THROTTLED",
+    ptmp.TOO_MANY_SESSIONS: "TOO_MANY_SESSIONS",
+    ptmp.SESSION_TOKEN_INVALID: "SESSION_TOKEN_INVALID",
+    ptmp.PAYLOAD_TOO_LARGE: "PAYLOAD_TOO_LARGE",
+    ptmp.TEAPOT: "TEAPOT",
+    ptmp.SYNTAX_ERROR: "SYNTAX_ERROR",
+    ptmp.PROTOCOL_VERSIONS_INCOMPATIBLE: "PROTOCOL_VERSIONS_INCOMPATIBLE",
+    ptmp.MSG_NOT_IMPLEMENTED: "MSG_NOT_IMPLEMENTED",
+    ptmp.MSG_CONTEXT_INVALID: "MSG_CONTEXT_INVALID",
+}
+
+// The name of a response code, for printing.
+func ResponseCodeName(response_code uint16) string {
+    if name, known := response_code_names[response_code]; known {
+        return name
+    }
+    return fmt.Sprintf("response code %v", response_code)
+}
+
+func (e *ResponseError) Error() string {
+    if e.Diagnostic != "" {
+        return fmt.Sprintf("ptmpclient: server answered message type %v with %v (%v): %v", e.Msg_Type_ID, ResponseCodeName(e.Response_Code), e.Response_Code, e.Diagnostic)
+    }
+    return fmt.Sprintf("ptmpclient: server answered message type %v with %v (%v)", e.Msg_Type_ID, ResponseCodeName(e.Response_Code), e.Response_Code)
+}
+
+// Two ResponseErrors match if they have the same response code, regardless of which message they were responding to.
+func (e *ResponseError) Is(target error) bool {
+    other, is_response_error := target.(*ResponseError)
+    return is_response_error && other.Response_Code == e.Response_Code
+}
+
+// Returned by Login when the server turns down the username and/or password.  errors.Is(err, ErrBadCredentials) matches it.
+type LoginError struct {
+    Username_Ok bool
+    Password_Ok bool
+    Protocol_Version uint16 // the one the server would have used
+}
+
+var ErrBadCredentials = &LoginError{}
+
+func (e *LoginError) Error() string {
+    return fmt.Sprintf("ptmpclient: login refused (username ok: %v, password ok: %v)", e.Username_Ok, e.Password_Ok)
+}
+
+func (e *LoginError) Is(target error) bool {
+    _, is_login_error := target.(*LoginError)
+    return is_login_error
+}
+
+// Turn an acknowledgment into an error (or nil if it was a success).
+func ackToError(ack *ptmp.Acknowledgment) error {
+    if ack.Response_Code == ptmp.SINGULAR_MSG_SUCCESS || ack.Response_Code == ptmp.MSG_SERIES_SUCCESS {
+        return nil
+    }
+    return &ResponseError{Response_Code: ack.Response_Code, Msg_Type_ID: ack.ID_Responding_To}
+}
+
+// Turn a detailed acknowledgment into an error (or nil if it was a success), keeping the details.
+func detailedAckToError(ack *ptmp.Detailed_Acknowledgment) error {
+    if ack.Response_Code == ptmp.SINGULAR_MSG_SUCCESS || ack.Response_Code == ptmp.MSG_SERIES_SUCCESS {
+        return nil
+    }
+    response_error := &ResponseError{
+                                     Response_Code: ack.Response_Code,
+                                     Msg_Type_ID: ack.ID_Responding_To,
+                                     Failures_Only: ptmp.Byte2Bool(ack.Failures_Only),
+                                     Diagnostic: string(ack.Diagnostic),
+                                    }
+    for _, item := range ack.Item_Results {
+        response_error.Items = append(response_error.Items, ItemResult{Ref: item.Task_Reference_Number, Response_Code: item.Response_Code})
+    }
+    return response_error
+}
+
+// The item results of an acknowledgment that was a success: every one of them, for a detailed one (nil for a plain
+// one, or a detailed one that only had room for the failures).
+func ackItems(reply *ptmp.PTMP_Msg) []ItemResult {
+    if reply.Hdr.Msg_Type_ID != ptmp.DETAILED_ACKNOWLEDGMENT {
+        return nil
+    }
+    ack := ptmp.DecodePayload[ptmp.Detailed_Acknowledgment](reply.Pld)
+    if ptmp.Byte2Bool(ack.Failures_Only) {
+        return nil
+    }
+    items := []ItemResult{}
+    for _, item := range ack.Item_Results {
+        items = append(items, ItemResult{Ref: item.Task_Reference_Number, Response_Code: item.Response_Code})
+    }
+    return items
+}
+
+// The response code with the given name (the reverse of ResponseCodeName), for reading codes back in from text.
+func ResponseCodeFromName(name string) (uint16, bool) {
+    for response_code, code_name := range response_code_names {
+        if code_name == name {
+            return response_code, true
+        }
+    }
+    return 0, false
+}
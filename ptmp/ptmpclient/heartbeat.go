@@ -0,0 +1,110 @@
+package ptmpclient
+
+import (
+    "context"
+    "ajb497/ptmp"
+    "time"
+)
+
+// How often StartHeartbeats pings when it's given 0, unless the server's idle timeout calls for more often.
+const DEFAULT_HEARTBEAT_INTERVAL time.Duration = 30*time.Second
+
+// Check that the server is still there, and how long it takes to hear back from it.  If the connection has gone
+// away, the Client connects again first (a ping can always be sent again).  The round trip also becomes Latency.
+func (c *Client) Ping(ctx context.Context) (time.Duration, error) {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    return c.ping(ctx)
+}
+
+// Ping, for callers that already have the lock.
+func (c *Client) ping(ctx context.Context) (time.Duration, error) {
+    replies, err_status := c.exchangeResuming(ctx, ptmp.Prep_Ping(time.Now().UnixNano()), func(error) bool { return true })
+    if err_status != nil {
+        return 0, err_status
+    }
+    if len(replies) == 1 && replies[0].Hdr.Msg_Type_ID == ptmp.ACKNOWLEDGMENT {
+        // most likely RATE_LIMITED, or MSG_NOT_IMPLEMENTED from a server that doesn't know about pings
+        if err_status = ackToError(ptmp.DecodePayload[ptmp.Acknowledgment](replies[0].Pld)); err_status != nil {
+            return 0, err_status
+        }
+    }
+    if len(replies) != 1 || replies[0].Hdr.Msg_Type_ID != ptmp.PONG {
+        return 0, ErrUnexpectedReply
+    }
+    // The timestamp that comes back is the one that was sent the last time the ping went out, so a ping that had
+    // to be sent again after reconnecting is timed from the second try.
+    pong := ptmp.DecodePayload[ptmp.Pong](replies[0].Pld)
+    c.latency = time.Since(time.Unix(0, pong.Timestamp))
+    c.server_idle_timeout = time.Duration(pong.Idle_Timeout_Seconds) * time.Second
+    if c.Logger != nil {
+        c.Logger.DebugContext(ctx, "Heard back from the server", "latency", c.latency, "idle_timeout", c.server_idle_timeout)
+    }
+    return c.latency, nil
+}
+
+// The round trip time of the last Ping (0 if there hasn't been one yet).
+func (c *Client) Latency() time.Duration {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    return c.latency
+}
+
+// Ping the server whenever nothing else has been sent for interval (DEFAULT_HEARTBEAT_INTERVAL if it's 0), or for
+// half of the server's idle timeout if that's shorter, until the Client is closed.  That keeps a session that's
+// just waiting on its user from being timed out, notices a dropped connection (and connects again) before anything
+// needs it, and keeps Latency current.  Starting heartbeats again replaces the old ones.
+func (c *Client) StartHeartbeats(interval time.Duration) {
+    if interval <= 0 {
+        interval = DEFAULT_HEARTBEAT_INTERVAL
+    }
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    c.stopHeartbeats()
+    stop := make(chan struct{})
+    c.heartbeat_stop = stop
+    go c.heartbeats(interval, stop)
+}
+
+// The Client has to be locked.
+func (c *Client) stopHeartbeats() {
+    if c.heartbeat_stop != nil {
+        close(c.heartbeat_stop)
+        c.heartbeat_stop = nil
+    }
+}
+
+func (c *Client) heartbeats(interval time.Duration, stop chan struct{}) {
+    for {
+        c.lock.Lock()
+        if c.closed {
+            c.lock.Unlock()
+            return
+        }
+        due := interval
+        if c.server_idle_timeout > 0 && c.server_idle_timeout / 2 < due {
+            due = c.server_idle_timeout / 2
+        }
+        // (the first one goes out straight away, to find out what the server's idle timeout is)
+        wait := due - time.Since(c.last_exchange)
+        if wait <= 0 || c.latency == 0 {
+            ctx, cancel := context.WithTimeout(context.Background(), interval)
+            if _, err_status := c.ping(ctx); err_status != nil && c.Logger != nil {
+                c.Logger.WarnContext(ctx, "Heartbeat failed", "error", err_status)
+            }
+            cancel()
+            wait = due
+            if c.server_idle_timeout > 0 && c.server_idle_timeout / 2 < wait {
+                wait = c.server_idle_timeout / 2
+            }
+        }
+        c.lock.Unlock()
+        timer := time.NewTimer(wait)
+        select {
+            case <-stop:
+                timer.Stop()
+                return
+            case <-timer.C:
+        }
+    }
+}
@@ -0,0 +1,543 @@
+// Package ptmpclient is a client library for talking to a PTMP server.  It takes care of the message exchanges
+// so that callers get Go values and errors back instead of PTMP_Msgs, e.g.
+//
+//     client, err := ptmpclient.Dial(ctx, "localhost:10101")
+//     err = client.Login(ctx, "Ed Ucational", "p@55w0rd")
+//     err = client.CreateTask(ctx, 1, 1000, "Grade this assignment", "Give it an A")
+//     tasks, err := client.QueryTasks(ctx, 0, 65535)
+//     err = client.Commit(ctx, (&ptmpclient.Batch{}).CompleteTask(1, 0).RemoveTasks(1, []uint16{0}, false))
+//     err = client.Close()
+//
+// Every method takes a context, and its deadline (or cancellation) applies to the whole exchange with the server.
+// A Client can be shared between goroutines; exchanges with the server happen one at a time.
+// If the connection drops, the Client connects again (see Reconnect_Backoff), picks the session back up, and sends
+// again whatever it was waiting on an answer to, as long as that can't make a change twice.
+package ptmpclient
+
+import (
+    "bufio"
+    "context"
+    "errors"
+    "fmt"
+    "ajb497/ptmp"
+    "ajb497/ptmp/ptmplog"
+    "log/slog"
+    "net"
+    "os"
+    "sync"
+    "time"
+)
+
+const BASE_PROTO string = "tcp"
+
+// The protocol versions the Client speaks, and offers when it logs in.
+var PROTOCOL_VERSIONS_SUPPORTED = []uint16{uint16(ptmp.PROTOCOL_VERSION_1), uint16(ptmp.PROTOCOL_VERSION_2)}
+
+// The protocol extensions the Client asks the server for when it logs in.  It can cope with the server turning any of
+// them down.
+var EXTENSIONS_SUPPORTED = []uint16{ptmp.EXT_DETAILED_ACKS, ptmp.EXT_IDEMPOTENCY_KEYS, ptmp.EXT_SESSION_RESUMPTION}
+
+// Everything about a task that the server tells us.
+type Task struct {
+    Ref uint16 `json:"ref"`
+    Priority uint16 `json:"priority"`
+    Title string `json:"title"`
+    Description string `json:"description"`
+    Completed bool `json:"completed"`
+}
+
+type TrashedTask struct {
+    List_ID uint16
+    Until_Purge time.Duration
+    Task Task
+}
+
+// Where a task was before/after a change in its history.  Location is one of the ptmp.TASK_LOCATION_* values.
+type TaskState struct {
+    Location byte
+    Completed bool
+}
+
+type HistoryEntry struct {
+    Time time.Time
+    User string
+    Session_ID uint32
+    Msg_Type_ID byte
+    Response_Code uint16
+    List_ID uint16
+    Before TaskState
+    After TaskState
+    Task *Task // nil when the entry is for a message that didn't change any task
+}
+
+type Client struct {
+    conn net.Conn
+    reader *bufio.Reader // over conn, and kept for as long as it is, since it can have the start of the next message in it
+    lock sync.Mutex
+    closed bool
+    extensions []uint16 // what the server agreed to at login
+    username string // kept from a successful Login, for logging back in on a new connection
+    password string
+    token uint64 // from the last Connection_Rules, for resuming the session without the password (0 if the server doesn't do that)
+    last_exchange time.Time // when we last heard back from the server, so heartbeats only go out when nothing else has
+    latency time.Duration // the round trip of the last Ping
+    server_idle_timeout time.Duration // from the last Pong (0 for none, or not known yet)
+    heartbeat_stop chan struct{} // closed to stop the heartbeats (nil if they aren't running)
+    server_capabilities *Capabilities // what the server said it can do, once something's asked (nil until then)
+    max_payload uint16 // what the server agreed to at login (0 until then, which means the fixed framing)
+    version uint16 // the protocol version the server chose at login (0 until then)
+    dropped bool // an answer was given up on partway through, so the connection can't be used again (see ErrDropped)
+
+    // If set, every message sent and received gets logged through it at debug level, payload and all (with the
+    // login password redacted), for anyone who wants to watch the traffic.
+    Logger *slog.Logger
+    // Opens a new connection to the same server, for when the connection goes away in the middle of an exchange.
+    // Dial sets it; Clients made with NewClient don't reconnect unless it's set.
+    Redial func(ctx context.Context) (net.Conn, error)
+    // How long to wait between tries at Redialing (DEFAULT_BACKOFF unless it's changed).
+    Reconnect_Backoff Backoff
+    // The largest payload to ask the server for when logging in (ptmp.LARGEST_PAYLOAD_SIZE unless it's changed).
+    // The server may agree to less, but never less than ptmp.MAX_PAYLOAD_SIZE.  0 asks for nothing, and keeps to the
+    // original fixed framing, for servers too old to know about any other.
+    Max_Payload_Size uint16
+}
+
+// Connect to a PTMP server.  This only opens the connection, Login still needs to be called before the server will
+// accept anything else.
+func Dial(ctx context.Context, addr string) (*Client, error) {
+    dialer := net.Dialer{}
+    conn, err_status := dialer.DialContext(ctx, BASE_PROTO, addr)
+    if err_status != nil {
+        return nil, err_status
+    }
+    new_client := NewClient(conn)
+    new_client.Redial = func(ctx context.Context) (net.Conn, error) {
+        return dialer.DialContext(ctx, BASE_PROTO, addr)
+    }
+    return new_client, nil
+}
+
+// Dial, but if the server isn't there (yet), keep trying, waiting longer each time as the backoff says, until it
+// answers, the backoff runs out of attempts, or the context is done.  The error from the last try comes back if
+// none of them worked.
+func DialWithBackoff(ctx context.Context, addr string, backoff Backoff) (*Client, error) {
+    var new_client *Client
+    err_status := backoff.retry(ctx, func() error {
+        var dial_err error
+        new_client, dial_err = Dial(ctx, addr)
+        return dial_err
+    })
+    if err_status != nil {
+        return nil, err_status
+    }
+    new_client.Reconnect_Backoff = backoff
+    return new_client, nil
+}
+
+// Wrap a connection that's already been opened (handy for tests, or for running PTMP over something other than plain TCP).
+func NewClient(conn net.Conn) *Client {
+    return &Client{conn: conn, reader: bufio.NewReader(conn), Reconnect_Backoff: DEFAULT_BACKOFF, Max_Payload_Size: ptmp.LARGEST_PAYLOAD_SIZE}
+}
+
+func TaskFromTInf(tinfo ptmp.T_Inf) Task {
+    return Task{
+                Ref: tinfo.Task_Reference_Number,
+                Priority: tinfo.Task_Priority_Value,
+                Title: string(tinfo.Task_Title),
+                Description: string(tinfo.Task_Description),
+                Completed: ptmp.Byte2Bool(tinfo.Completion_Status),
+               }
+}
+
+func (c *Client) logMsg(ctx context.Context, what string, msg *ptmp.PTMP_Msg) {
+    if c.Logger != nil && c.Logger.Enabled(ctx, slog.LevelDebug) {
+        c.Logger.DebugContext(ctx, what, ptmplog.Msg(msg))
+    }
+}
+
+// Send a message and collect the full reply (following Msgs_To_Follow until the server says it's done).  This is the
+// building block for all of the other methods, and is exported for anyone who needs to send something that doesn't
+// have a method of its own.  A Close_Connection that doesn't await an ack gets no reply, and returns an empty slice.
+// If the server closes the connection from its end (it's shutting down), the Client is closed and ErrServerClosed
+// comes back.  A message bigger than the Max_Payload_Size the server agreed to isn't sent, and ErrPayloadTooLarge
+// comes back instead.
+func (c *Client) Do(ctx context.Context, msg ptmp.PTMP_Msg) ([]*ptmp.PTMP_Msg, error) {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    return c.exchange(ctx, msg)
+}
+
+// Do, for callers that already have the lock (to send several messages without anything getting in between them).
+func (c *Client) exchange(ctx context.Context, msg ptmp.PTMP_Msg) ([]*ptmp.PTMP_Msg, error) {
+    if c.closed {
+        return nil, ErrClosed
+    }
+    if err_status := ctx.Err(); err_status != nil {
+        return nil, err_status // (nothing gets sent for a context that's already done)
+    }
+    if c.dropped {
+        return nil, ErrDropped
+    }
+
+    // The context's deadline becomes the connection's deadline, and if the context gets cancelled partway through,
+    // the deadline gets pulled in to now so that whatever read/write is in progress gives up.
+    deadline, has_deadline := ctx.Deadline()
+    if !has_deadline {
+        deadline = time.Time{}
+    }
+    c.conn.SetDeadline(deadline)
+    finished := make(chan struct{})
+    defer close(finished)
+    conn := c.conn // (this exchange's, since a reconnect can swap c.conn out before this goroutine notices it's finished)
+    go func() {
+        select {
+            case <-ctx.Done():
+                conn.SetDeadline(time.Unix(1, 0))
+            case <-finished:
+        }
+    }()
+
+    expect_response := true
+    if msg.Hdr.Msg_Type_ID == ptmp.CLOSE_CONNECTION {
+        expect_response = ptmp.Byte2Bool(ptmp.DecodePayload[ptmp.Close_Connection](msg.Pld).Will_Await_Ack)
+    }
+
+    packet, err_status := ptmp.EncodePacketFor(msg, c.max_payload)
+    if err_status != nil {
+        return nil, err_status
+    }
+    if _, err_status = c.conn.Write(packet); err_status != nil {
+        return nil, c.contextError(ctx, err_status)
+    }
+    c.logMsg(ctx, "Sent a message to the server", &msg)
+
+    replies := []*ptmp.PTMP_Msg{}
+    oversized := false
+    for num_to_follow := 1; expect_response && num_to_follow > 0; {
+        reply, err_status := ptmp.ReadPacket(c.reader, c.max_payload)
+        if reply == nil && errors.Is(err_status, ptmp.ErrPayloadTooLarge) {
+            // we gave up partway through it, so there's no telling where the next message starts
+            c.closed = true
+            c.conn.Close()
+            return replies, err_status
+        }
+        if reply == nil {
+            err_status = c.contextError(ctx, err_status)
+            if ctx.Err() != nil || errors.Is(err_status, context.DeadlineExceeded) {
+                // the rest of the answer is still on its way, and would be taken for the answer to whatever's sent next
+                c.dropped = true
+                c.conn.Close()
+            }
+            return replies, err_status
+        }
+        // one that was too big, but read in full, still gets counted so that the rest of the series is read
+        oversized = oversized || err_status != nil
+        c.logMsg(ctx, "Received a message from the server", reply)
+        if reply.Hdr.Msg_Type_ID == ptmp.CLOSE_CONNECTION {
+            // The server is shutting down and hung up on us (whatever we just sent wasn't handled).
+            c.closed = true
+            c.conn.Close()
+            return replies, ErrServerClosed
+        }
+        replies = append(replies, reply)
+        num_to_follow = int(reply.Hdr.Msgs_To_Follow)
+    }
+    c.last_exchange = time.Now()
+    if oversized {
+        return replies, ErrPayloadTooLarge
+    }
+    return replies, nil
+}
+
+// If an I/O error happened because the context ran out, report the context's error instead since that's the real reason.
+// The connection's deadline is the context's own, and it can go off a moment before the context notices it's done.
+func (c *Client) contextError(ctx context.Context, err_status error) error {
+    if ctx.Err() != nil {
+        return ctx.Err()
+    }
+    if deadline, has_deadline := ctx.Deadline(); has_deadline && errors.Is(err_status, os.ErrDeadlineExceeded) && !time.Now().Before(deadline) {
+        return context.DeadlineExceeded
+    }
+    return err_status
+}
+
+// For messages that are only ever answered with an acknowledgment.
+func (c *Client) doAck(ctx context.Context, msg ptmp.PTMP_Msg) error {
+    replies, err_status := c.Do(ctx, msg)
+    if err_status != nil {
+        return err_status
+    }
+    return ackReplyToError(replies)
+}
+
+// Turn the reply to a message that's only ever answered with an acknowledgment (plain or detailed) into an error.
+func ackReplyToError(replies []*ptmp.PTMP_Msg) error {
+    if len(replies) == 1 && replies[0].Hdr.Msg_Type_ID == ptmp.DETAILED_ACKNOWLEDGMENT {
+        return detailedAckToError(ptmp.DecodePayload[ptmp.Detailed_Acknowledgment](replies[0].Pld))
+    }
+    if len(replies) != 1 || replies[0].Hdr.Msg_Type_ID != ptmp.ACKNOWLEDGMENT {
+        return ErrUnexpectedReply
+    }
+    return ackToError(ptmp.DecodePayload[ptmp.Acknowledgment](replies[0].Pld))
+}
+
+// For the query messages, which are answered with a series of info messages of the given type, or a lone
+// acknowledgment.  If the connection goes away partway through, the query is sent again on a new one.  UNABLE_TO_COMPLY
+// is how the server says there was nothing to send, so that's an empty result rather than an error.  A query the
+// server's capabilities don't list isn't sent at all.
+func (c *Client) doQuery(ctx context.Context, msg ptmp.PTMP_Msg, info_type byte) ([]*ptmp.PTMP_Msg, error) {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    if err_status := c.checkImplemented(ctx, msg); err_status != nil {
+        return nil, err_status
+    }
+    replies, err_status := c.exchangeResuming(ctx, msg, func(error) bool { return true }) // asking again doesn't change anything
+    if err_status != nil {
+        return nil, err_status
+    }
+    if len(replies) == 1 && replies[0].Hdr.Msg_Type_ID == ptmp.DETAILED_ACKNOWLEDGMENT {
+        if err_status = detailedAckToError(ptmp.DecodePayload[ptmp.Detailed_Acknowledgment](replies[0].Pld)); err_status != nil {
+            return nil, err_status
+        }
+        return nil, ErrUnexpectedReply
+    }
+    if len(replies) == 1 && replies[0].Hdr.Msg_Type_ID == ptmp.ACKNOWLEDGMENT {
+        ack := ptmp.DecodePayload[ptmp.Acknowledgment](replies[0].Pld)
+        if ack.Response_Code == ptmp.UNABLE_TO_COMPLY {
+            return nil, nil
+        }
+        if err_status = ackToError(ack); err_status != nil {
+            return nil, err_status
+        }
+        return nil, ErrUnexpectedReply
+    }
+    for _, reply := range replies {
+        if reply.Hdr.Msg_Type_ID != info_type {
+            return nil, ErrUnexpectedReply
+        }
+    }
+    return replies, nil
+}
+
+// Send our credentials.  A *LoginError comes back if the server doesn't like them, and the connection stays
+// open so that Login can be tried again.  They go out the protocol version 2 way, as UTF-8 strings of up to
+// ptmp.CREDENTIAL_MAX_LENGTH bytes, and if the server turns them down and says it only speaks version 1 (it
+// couldn't have read them), they're sent again the version 1 way, which only has room for ptmp.USERNAME_SIZE and
+// ptmp.PASSWORD_SIZE bytes.
+func (c *Client) Login(ctx context.Context, username string, password string) error {
+    if !ptmp.ValidText(username, ptmp.CREDENTIAL_MAX_LENGTH, 0) || !ptmp.ValidText(password, ptmp.CREDENTIAL_MAX_LENGTH, 0) {
+        return fmt.Errorf("ptmpclient: username and password have to be UTF-8, and can be at most %v bytes long", ptmp.CREDENTIAL_MAX_LENGTH)
+    }
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    return c.login(ctx, username, password)
+}
+
+// Login, for callers that already have the lock.
+func (c *Client) login(ctx context.Context, username string, password string) error {
+    err_status := c.handshake(ctx, ptmp.Prep_Request_Connection_V2(username, password, 0, PROTOCOL_VERSIONS_SUPPORTED, EXTENSIONS_SUPPORTED, c.Max_Payload_Size))
+    var login_err *LoginError
+    if errors.As(err_status, &login_err) && login_err.Protocol_Version < uint16(ptmp.PROTOCOL_VERSION_2) {
+        if len(username) > int(ptmp.USERNAME_SIZE) || len(password) > int(ptmp.PASSWORD_SIZE) {
+            return fmt.Errorf("ptmpclient: the server only speaks protocol version 1, where the username and password can be at most %v and %v bytes long", ptmp.USERNAME_SIZE, ptmp.PASSWORD_SIZE)
+        }
+        err_status = c.handshake(ctx, ptmp.Prep_Request_Connection(username, password, 0, PROTOCOL_VERSIONS_SUPPORTED, EXTENSIONS_SUPPORTED, c.Max_Payload_Size))
+    }
+    if err_status == nil {
+        c.username, c.password = username, password
+    }
+    return err_status
+}
+
+// Send a Request_Connection (logging in, or resuming a session) and take in the Connection_Rules that answers it.
+func (c *Client) handshake(ctx context.Context, msg ptmp.PTMP_Msg) error {
+    replies, err_status := c.exchange(ctx, msg)
+    if err_status != nil {
+        return err_status
+    }
+    if len(replies) != 1 {
+        return ErrUnexpectedReply
+    }
+    switch replies[0].Hdr.Msg_Type_ID {
+        case ptmp.CONNECTION_RULES:
+            rules := ptmp.DecodePayload[ptmp.Connection_Rules](replies[0].Pld)
+            if !ptmp.Byte2Bool(rules.Username_Ok) || !ptmp.Byte2Bool(rules.Password_Ok) {
+                return &LoginError{Username_Ok: ptmp.Byte2Bool(rules.Username_Ok), Password_Ok: ptmp.Byte2Bool(rules.Password_Ok), Protocol_Version: rules.Protocol_Version_To_Use}
+            }
+            c.extensions = rules.Acceptable_Exts
+            c.token = rules.Session_Token
+            c.max_payload = rules.Max_Payload_Size
+            c.version = rules.Protocol_Version_To_Use
+            return nil
+        case ptmp.ACKNOWLEDGMENT:
+            // most likely MSG_CONTEXT_INVALID from already being logged in, or SESSION_TOKEN_INVALID for a resumption
+            if err_status = ackToError(ptmp.DecodePayload[ptmp.Acknowledgment](replies[0].Pld)); err_status != nil {
+                return err_status
+            }
+    }
+    return ErrUnexpectedReply
+}
+
+// The protocol version the server chose when we logged in (0 if we haven't yet).
+func (c *Client) ProtocolVersion() uint16 {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    return c.version
+}
+
+// The largest payload the server agreed to when we logged in: ptmp.MAX_PAYLOAD_SIZE if it didn't agree to anything
+// else (or we haven't logged in yet).
+func (c *Client) MaxPayloadSize() uint16 {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    if c.max_payload == 0 {
+        return ptmp.MAX_PAYLOAD_SIZE
+    }
+    return c.max_payload
+}
+
+// Whether the server agreed to use a protocol extension (ptmp.EXT_*) when we logged in.
+func (c *Client) HasExtension(ext uint16) bool {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    return c.hasExtension(ext)
+}
+
+func (c *Client) hasExtension(ext uint16) bool {
+    for _, agreed := range c.extensions {
+        if agreed == ext {
+            return true
+        }
+    }
+    return false
+}
+
+// Tell the server we're done and close the connection, without waiting to hear back.
+func (c *Client) Close() error {
+    _, send_err := c.Do(context.Background(), ptmp.Prep_Close_Connection(false))
+    return c.closeConn(send_err)
+}
+
+// Tell the server we're done, wait for it to acknowledge that, and then close the connection.
+func (c *Client) CloseAndWait(ctx context.Context) error {
+    return c.closeConn(c.doAck(ctx, ptmp.Prep_Close_Connection(true)))
+}
+
+func (c *Client) closeConn(send_err error) error {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    c.stopHeartbeats()
+    if c.closed {
+        return ErrClosed
+    }
+    c.closed = true
+    close_err := c.conn.Close()
+    if send_err != nil && !errors.Is(send_err, ErrClosed) {
+        return send_err
+    }
+    return close_err
+}
+
+// Add a task to a list.  Titles and descriptions that are too long (or empty, or not UTF-8) are turned away before
+// anything is sent, going by the server's capabilities when it has tighter limits than the messages do.
+func (c *Client) CreateTask(ctx context.Context, list_id uint16, priority uint16, title string, description string) error {
+    if err_status := checkTaskText(nil, title, description); err_status != nil {
+        return err_status
+    }
+    return c.doChange(ctx, ptmp.Prep_Create_New_Task(list_id, priority, title, description))
+}
+
+// Like CreateTask, but also says what reference number the new task got.  Only servers that do detailed acks (see
+// ptmp.EXT_DETAILED_ACKS) say, so with any other, known comes back false even though the task was made.
+func (c *Client) CreateTaskRef(ctx context.Context, list_id uint16, priority uint16, title string, description string) (uint16, bool, error) {
+    if err_status := checkTaskText(nil, title, description); err_status != nil {
+        return 0, false, err_status
+    }
+    items, err_status := c.doChangeItems(ctx, ptmp.Prep_Create_New_Task(list_id, priority, title, description))
+    if err_status != nil || len(items) != 1 {
+        return 0, false, err_status
+    }
+    return items[0].Ref, true, nil
+}
+
+// Get the tasks on the server with priorities in the given range.
+func (c *Client) QueryTasks(ctx context.Context, min_priority uint16, max_priority uint16) ([]Task, error) {
+    replies, err_status := c.doQuery(ctx, ptmp.Prep_Query_Tasks(min_priority, max_priority), ptmp.TASK_INFORMATION)
+    if err_status != nil {
+        return nil, err_status
+    }
+    tasks := []Task{}
+    for _, reply := range replies {
+        for _, tinfo := range ptmp.DecodePayload[ptmp.Task_Information](reply.Pld).Task_Infos {
+            tasks = append(tasks, TaskFromTInf(tinfo))
+        }
+    }
+    return tasks, nil
+}
+
+func (c *Client) CompleteTask(ctx context.Context, list_id uint16, ref uint16) error {
+    return c.doChange(ctx, ptmp.Prep_Mark_Task_Completed(list_id, ref))
+}
+
+// Move tasks into the list's trash.  Incomplete tasks are only removed if permit_incomplete is set.  Whatever can be
+// removed is, even if some of the others can't be, so an error with ErrPartialSuccess's code means some were removed
+// (the *ResponseError's Failed says which weren't).  Servers that don't do detailed acks answer TASK_DOES_NOT_EXIST
+// whether or not the rest were removed.
+func (c *Client) RemoveTasks(ctx context.Context, list_id uint16, refs []uint16, permit_incomplete bool) error {
+    return c.doChange(ctx, ptmp.Prep_Remove_Tasks(permit_incomplete, list_id, refs))
+}
+
+func (c *Client) QueryTrash(ctx context.Context, list_id uint16) ([]TrashedTask, error) {
+    replies, err_status := c.doQuery(ctx, ptmp.Prep_Query_Trash(list_id), ptmp.TRASH_INFORMATION)
+    if err_status != nil {
+        return nil, err_status
+    }
+    trashed := []TrashedTask{}
+    for _, reply := range replies {
+        for _, tt := range ptmp.DecodePayload[ptmp.Trash_Information](reply.Pld).Trashed_Tasks {
+            trashed = append(trashed, TrashedTask{List_ID: tt.List_ID, Until_Purge: time.Duration(tt.Seconds_Until_Purge) * time.Second, Task: TaskFromTInf(tt.Task)})
+        }
+    }
+    return trashed, nil
+}
+
+func (c *Client) RestoreTasks(ctx context.Context, list_id uint16, refs []uint16) error {
+    return c.doChange(ctx, ptmp.Prep_Restore_Tasks(list_id, refs))
+}
+
+// Permanently delete tasks from a list's trash, or everything in it if no refs are given.
+func (c *Client) PurgeTrash(ctx context.Context, list_id uint16, refs []uint16) error {
+    if refs == nil {
+        refs = []uint16{}
+    }
+    return c.doChange(ctx, ptmp.Prep_Purge_Trash(list_id, refs))
+}
+
+// Get the recorded history of a whole list (whole_list set) or just one task in it.
+func (c *Client) QueryHistory(ctx context.Context, list_id uint16, whole_list bool, ref uint16) ([]HistoryEntry, error) {
+    replies, err_status := c.doQuery(ctx, ptmp.Prep_Query_History(list_id, whole_list, ref), ptmp.HISTORY_INFORMATION)
+    if err_status != nil {
+        return nil, err_status
+    }
+    entries := []HistoryEntry{}
+    for _, reply := range replies {
+        for _, entry := range ptmp.DecodePayload[ptmp.History_Information](reply.Pld).Entries {
+            out := HistoryEntry{
+                                Time: time.Unix(entry.Timestamp, 0),
+                                User: string(entry.Username),
+                                Session_ID: entry.Session_ID,
+                                Msg_Type_ID: entry.Msg_Type_ID,
+                                Response_Code: entry.Response_Code,
+                                List_ID: entry.List_ID,
+                                Before: TaskState{Location: entry.Before_Location, Completed: ptmp.Byte2Bool(entry.Before_Completion_Status)},
+                                After: TaskState{Location: entry.After_Location, Completed: ptmp.Byte2Bool(entry.After_Completion_Status)},
+                               }
+            if entry.Before_Location != ptmp.TASK_LOCATION_NONE || entry.After_Location != ptmp.TASK_LOCATION_NONE {
+                task := TaskFromTInf(entry.Task)
+                out.Task = &task
+            }
+            entries = append(entries, out)
+        }
+    }
+    return entries, nil
+}
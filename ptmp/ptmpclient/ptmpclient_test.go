@@ -0,0 +1,337 @@
+package ptmpclient
+
+import (
+    "context"
+    "errors"
+    "ajb497/ptmp"
+    "ajb497/ptmp/ptmpserver"
+    "net"
+    "sync"
+    "sync/atomic"
+    "testing"
+    "time"
+)
+
+const TEST_UNAME string = "Ed Ucational"
+const TEST_PW string = "p@55w0rd"
+
+// A server with list 1 in memory, put together from ptmpserver the same way the real one is (idempotency keys,
+// session resumption and all), for the Client to talk to over loopback.  Creating a task with the same title as
+// one that's already there is turned away with UNABLE_TO_COMPLY, so that a change made twice shows.  Query_Trash
+// takes a while to answer, for running contexts out.
+type test_server struct {
+    addr string
+    lock sync.Mutex
+    tasks []ptmp.T_Inf
+    next_ref uint16
+    received map[byte]int
+    resumed int // logins that picked a session back up with its token
+    logins atomic.Int32 // password checks, which resuming a session doesn't need
+    idempotency *ptmpserver.IdempotencyCache
+    cut_create atomic.Bool // the next task created doesn't get its acknowledgment, the connection is cut instead
+    cut_reply atomic.Bool
+}
+
+const TEST_SLOW_REPLY time.Duration = 500*time.Millisecond
+
+func startTestServer(t *testing.T) *test_server {
+    t.Helper()
+    ts := &test_server{received: map[byte]int{}}
+    ts.idempotency = ptmpserver.NewIdempotencyCache(func() ptmpserver.IdempotencyPolicy {
+        return ptmpserver.IdempotencyPolicy{Max_Keys_Per_User: 100, TTL: time.Minute}
+    })
+    ts.serve(t)
+    return ts
+}
+
+// Start a server in front of the tasks, and point addr at it.  Starting another one is like the server restarting
+// with the same tasks (and idempotency keys, as if they'd been kept somewhere that survives a restart), but none of
+// the sessions: it has session tokens of its own.
+func (ts *test_server) serve(t *testing.T) {
+    t.Helper()
+    srv := ptmpserver.NewServer(func(username string, password string) (bool, bool) {
+        ts.logins.Add(1)
+        return username == TEST_UNAME, password == TEST_PW
+    })
+    srv.Reply_Pacing = 0
+    srv.Extensions = EXTENSIONS_SUPPORTED
+    srv.Session_Tokens = ptmpserver.NewSessionTokens(func() ptmpserver.ResumptionPolicy {
+        return ptmpserver.ResumptionPolicy{TTL: time.Minute}
+    })
+    counted := func(next ptmpserver.Handler) ptmpserver.Handler {
+        return ptmpserver.HandlerFunc(func(w ptmpserver.ResponseWriter, r *ptmpserver.Request) {
+            ts.lock.Lock()
+            ts.received[r.Msg.Hdr.Msg_Type_ID]++
+            if r.Msg.Hdr.Msg_Type_ID == ptmp.REQUEST_CONNECTION && r.Msg.Hdr.Protocol_Version >= ptmp.PROTOCOL_VERSION_2 && ptmp.DecodePayload[ptmp.Request_Connection_V2](r.Msg.Pld).Session_Token != 0 {
+                ts.resumed++
+            }
+            ts.lock.Unlock()
+            next.ServePTMP(w, r)
+        })
+    }
+    with_store := func(next ptmpserver.Handler) ptmpserver.Handler {
+        return ptmpserver.HandlerFunc(func(w ptmpserver.ResponseWriter, r *ptmpserver.Request) {
+            ts.lock.Lock()
+            defer ts.lock.Unlock()
+            next.ServePTMP(w, r)
+        })
+    }
+    srv.Use(counted, ptmpserver.RequireLogin, ts.idempotency.Middleware, with_store)
+    srv.HandleFunc(ptmp.CREATE_NEW_TASK, ts.create)
+    srv.HandleFunc(ptmp.MARK_TASK_COMPLETED, ts.complete)
+    srv.HandleFunc(ptmp.QUERY_TASKS, ts.query)
+    srv.HandleFunc(ptmp.QUERY_TRASH, func(w ptmpserver.ResponseWriter, r *ptmpserver.Request) {
+        time.Sleep(TEST_SLOW_REPLY)
+        w.Ack(ptmp.UNABLE_TO_COMPLY)
+    })
+
+    listener, err_status := net.Listen(BASE_PROTO, "127.0.0.1:0")
+    if err_status != nil {
+        t.Fatal(err_status)
+    }
+    t.Cleanup(func() { listener.Close() })
+    go srv.Serve(cutting_listener{Listener: listener, ts: ts})
+    ts.addr = listener.Addr().String()
+}
+
+// Hands the server connections that can be cut just as it goes to answer (see test_server.cut_create).
+type cutting_listener struct {
+    net.Listener
+    ts *test_server
+}
+
+func (cl cutting_listener) Accept() (net.Conn, error) {
+    conn, err_status := cl.Listener.Accept()
+    if err_status != nil {
+        return nil, err_status
+    }
+    return cutting_conn{Conn: conn, ts: cl.ts}, nil
+}
+
+type cutting_conn struct {
+    net.Conn
+    ts *test_server
+}
+
+func (cc cutting_conn) Write(packet []byte) (int, error) {
+    if cc.ts.cut_reply.CompareAndSwap(true, false) {
+        cc.Conn.Close()
+        return 0, net.ErrClosed
+    }
+    return cc.Conn.Write(packet)
+}
+
+func (ts *test_server) create(w ptmpserver.ResponseWriter, r *ptmpserver.Request) {
+    creation := ptmp.DecodePayload[ptmp.Create_New_Task](r.Msg.Pld)
+    if creation.Associated_List_ID != 1 {
+        w.Ack(ptmp.LIST_DOES_NOT_EXIST)
+        return
+    }
+    for _, task := range ts.tasks {
+        if string(task.Task_Title) == string(creation.Task_Title) {
+            w.Ack(ptmp.UNABLE_TO_COMPLY)
+            return
+        }
+    }
+    ts.tasks = append(ts.tasks, ptmp.T_Inf{
+                                           Task_Reference_Number: ts.next_ref,
+                                           Task_Priority_Value: creation.Priority_Value,
+                                           Length_of_Title: byte(len(creation.Task_Title)),
+                                           Task_Title: creation.Task_Title,
+                                           Description_Length: uint16(len(creation.Task_Description)),
+                                           Task_Description: creation.Task_Description,
+                                          })
+    ts.next_ref++
+    if ts.cut_create.CompareAndSwap(true, false) {
+        ts.cut_reply.Store(true) // (the task's been made, and the server's about to say so)
+    }
+    w.Ack(ptmp.SINGULAR_MSG_SUCCESS)
+}
+
+func (ts *test_server) complete(w ptmpserver.ResponseWriter, r *ptmpserver.Request) {
+    marking := ptmp.DecodePayload[ptmp.Mark_Task_Completed](r.Msg.Pld)
+    if marking.List_ID != 1 {
+        w.Ack(ptmp.LIST_DOES_NOT_EXIST)
+        return
+    }
+    for ii := range ts.tasks {
+        if ts.tasks[ii].Task_Reference_Number == marking.Task_To_Mark {
+            ts.tasks[ii].Completion_Status = ptmp.Bool2Byte(true)
+            w.Ack(ptmp.SINGULAR_MSG_SUCCESS)
+            return
+        }
+    }
+    w.Ack(ptmp.TASK_DOES_NOT_EXIST)
+}
+
+func (ts *test_server) query(w ptmpserver.ResponseWriter, r *ptmpserver.Request) {
+    if len(ts.tasks) == 0 {
+        w.Ack(ptmp.UNABLE_TO_COMPLY)
+        return
+    }
+    for ii := range ts.tasks {
+        w.Send(ptmp.Prep_Task_Information(ts.tasks[ii:ii+1], byte(len(ts.tasks)-1-ii)))
+    }
+}
+
+// How many of a message type the server has been sent, and how many tasks it's holding.
+func (ts *test_server) counts(msg_type byte) (int, int) {
+    ts.lock.Lock()
+    defer ts.lock.Unlock()
+    return ts.received[msg_type], len(ts.tasks)
+}
+
+// A Client for the server, logged in, and closed when the test is done.
+func (ts *test_server) login(t *testing.T) *Client {
+    t.Helper()
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+    client, err_status := Dial(ctx, ts.addr)
+    if err_status != nil {
+        t.Fatal(err_status)
+    }
+    if err_status = client.Login(ctx, TEST_UNAME, TEST_PW); err_status != nil {
+        t.Fatal(err_status)
+    }
+    t.Cleanup(func() { client.Close() })
+    return client
+}
+
+func TestDialLoginClose(t *testing.T) {
+    ts := startTestServer(t)
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+    client, err_status := Dial(ctx, ts.addr)
+    if err_status != nil {
+        t.Fatal(err_status)
+    }
+    if err_status = client.Login(ctx, TEST_UNAME, TEST_PW); err_status != nil {
+        t.Fatalf("Login failed: %v", err_status)
+    }
+    if client.ProtocolVersion() != uint16(ptmp.PROTOCOL_VERSION_2) || !client.HasExtension(ptmp.EXT_IDEMPOTENCY_KEYS) {
+        t.Errorf("Logged in on version %v with extensions %v", client.ProtocolVersion(), client.extensions)
+    }
+
+    tasks, err_status := client.QueryTasks(ctx, 0, 65535)
+    if err_status != nil || len(tasks) != 0 {
+        t.Errorf("An empty list came back as %v, %v", tasks, err_status)
+    }
+    if err_status = client.CreateTask(ctx, 1, 9000, "Grade this assignment", "Give it an A"); err_status != nil {
+        t.Fatalf("CreateTask failed: %v", err_status)
+    }
+    if err_status = client.CompleteTask(ctx, 1, 0); err_status != nil {
+        t.Fatalf("CompleteTask failed: %v", err_status)
+    }
+    tasks, err_status = client.QueryTasks(ctx, 0, 65535)
+    want := Task{Ref: 0, Priority: 9000, Title: "Grade this assignment", Description: "Give it an A", Completed: true}
+    if err_status != nil || len(tasks) != 1 || tasks[0] != want {
+        t.Errorf("QueryTasks got %+v, %v, expected [%+v]", tasks, err_status, want)
+    }
+
+    if err_status = client.Close(); err_status != nil {
+        t.Errorf("Close failed: %v", err_status)
+    }
+    if err_status = client.CreateTask(ctx, 1, 1, "Too late", "Closed"); !errors.Is(err_status, ErrClosed) {
+        t.Errorf("CreateTask after Close got %v, expected ErrClosed", err_status)
+    }
+    if err_status = client.Close(); !errors.Is(err_status, ErrClosed) {
+        t.Errorf("Closing twice got %v, expected ErrClosed", err_status)
+    }
+}
+
+func TestLoginErrors(t *testing.T) {
+    ts := startTestServer(t)
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+    client, err_status := Dial(ctx, ts.addr)
+    if err_status != nil {
+        t.Fatal(err_status)
+    }
+    defer client.Close()
+
+    err_status = client.Login(ctx, TEST_UNAME, "wrong")
+    var login_err *LoginError
+    if !errors.As(err_status, &login_err) || !login_err.Username_Ok || login_err.Password_Ok || !errors.Is(err_status, ErrBadCredentials) {
+        t.Errorf("A bad password got %#v", err_status)
+    }
+    if err_status = client.CreateTask(ctx, 1, 1, "Not yet", "Not logged in"); !errors.Is(err_status, ErrMsgContextInvalid) {
+        t.Errorf("CreateTask before logging in got %v, expected MSG_CONTEXT_INVALID", err_status)
+    }
+    if err_status = client.Login(ctx, TEST_UNAME, TEST_PW); err_status != nil {
+        t.Errorf("Logging in on the same connection after a bad password failed: %v", err_status)
+    }
+}
+
+func TestResponseErrors(t *testing.T) {
+    client := startTestServer(t).login(t)
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    for _, test := range []struct {
+        name string
+        err_status error
+        sentinel error
+        msg_type byte
+    }{
+        {"completing a task that isn't there", client.CompleteTask(ctx, 1, 99), ErrTaskDoesNotExist, ptmp.MARK_TASK_COMPLETED},
+        {"creating a task in list 7", client.CreateTask(ctx, 7, 1, "Nowhere", "List 7 isn't there"), ErrListDoesNotExist, ptmp.CREATE_NEW_TASK},
+        {"completing a task in list 7", client.CompleteTask(ctx, 7, 0), ErrListDoesNotExist, ptmp.MARK_TASK_COMPLETED},
+    } {
+        var response_err *ResponseError
+        if !errors.Is(test.err_status, test.sentinel) || !errors.As(test.err_status, &response_err) || response_err.Msg_Type_ID != test.msg_type {
+            t.Errorf("%v got %v, expected %v for message type %v", test.name, test.err_status, test.sentinel, test.msg_type)
+        }
+        if errors.Is(test.err_status, ErrUnableToComply) {
+            t.Errorf("%v matched a different response code", test.name)
+        }
+    }
+    if err_status := client.CreateTask(ctx, 1, 1, "", "No title"); err_status == nil || errors.As(err_status, new(*ResponseError)) {
+        t.Errorf("A task without a title got %v, expected it turned away before it was sent", err_status)
+    }
+}
+
+func TestContextErrors(t *testing.T) {
+    ts := startTestServer(t)
+    client := ts.login(t)
+
+    expired, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+    defer cancel()
+    if err_status := client.CreateTask(expired, 1, 1, "Never sent", "The context is already done"); !errors.Is(err_status, context.DeadlineExceeded) {
+        t.Errorf("CreateTask with an expired context got %v", err_status)
+    }
+    if _, tasks := ts.counts(ptmp.CREATE_NEW_TASK); tasks != 0 {
+        t.Errorf("A task was created with an expired context")
+    }
+
+    ctx, cancel_ctx := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel_ctx()
+    if err_status := client.CreateTask(ctx, 1, 1, "Sent", "The context has plenty of time"); err_status != nil {
+        t.Fatal(err_status)
+    }
+
+    // (and one that runs out while the server is still working on it, which isn't sent again)
+    short, cancel_short := context.WithTimeout(context.Background(), TEST_SLOW_REPLY/5)
+    defer cancel_short()
+    if _, err_status := client.QueryTrash(short, 1); !errors.Is(err_status, context.DeadlineExceeded) {
+        t.Errorf("A query that took longer than its context got %v", err_status)
+    }
+    if sent, _ := ts.counts(ptmp.QUERY_TRASH); sent != 1 {
+        t.Errorf("The query was sent %v times", sent)
+    }
+
+    cancelled, cancel_now := context.WithCancel(context.Background())
+    cancel_now()
+    if _, err_status := client.QueryTasks(cancelled, 0, 65535); !errors.Is(err_status, context.Canceled) {
+        t.Errorf("QueryTasks with a cancelled context got %v", err_status)
+    }
+
+    // The answer to the query that ran out is still on its way, so the Client goes on with a new connection (picking
+    // the session back up rather than logging in again) instead of taking it for the answer to the next one.
+    logins := ts.logins.Load()
+    if tasks, err_status := client.QueryTasks(ctx, 0, 65535); err_status != nil || len(tasks) != 1 {
+        t.Errorf("QueryTasks after a query ran out got %v, %v", tasks, err_status)
+    }
+    if ts.logins.Load() != logins {
+        t.Errorf("The Client logged in again instead of resuming its session")
+    }
+}
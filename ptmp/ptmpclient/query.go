@@ -0,0 +1,75 @@
+package ptmpclient
+
+import (
+    "context"
+    "fmt"
+    "ajb497/ptmp"
+    "unicode/utf8"
+)
+
+// What SearchTasks asks the server for (see ptmp.Query_Tasks_V2).  The zero value asks for every task, as many as
+// the server sends at once.
+type TaskQuery struct {
+    // Priorities to look between, inclusive (both 0 for every priority).
+    Min_Priority uint16
+    Max_Priority uint16
+    Lists []uint16 // nil for every list
+    Status byte // one of the ptmp.QUERY_ ones
+    Search string // "" for no search
+    Search_Flags byte // any of the ptmp.SEARCH_ ones, for where to look for Search and how to match it
+    Sort []ptmp.Sort_Key // tasks are sorted by reference number after these (or just by that, if there aren't any)
+    Limit uint16 // 0 for as many as the server sends at once
+    Offset uint16
+    Cursor []byte // the Next_Cursor of the page before (nil for the first page)
+}
+
+// One page of the tasks a TaskQuery matched.  Total is how many matched in all, and Next_Cursor is what to put in
+// the query's Cursor to get the next page (nil if this is the last one).
+type TaskPage struct {
+    Tasks []Task
+    Total uint16
+    Next_Cursor []byte
+}
+
+// Look for tasks, narrowing them down by list, status and priority, and by a substring or regular expression in
+// their titles or descriptions, sorted however the query says, a page at a time.  Only servers that speak protocol
+// version 2 know these queries, so a session on version 1 gets an error with PROTOCOL_VERSIONS_INCOMPATIBLE's code
+// without anything being sent (QueryTasks still works there).  Whatever's too long for the message is turned away
+// before anything is sent too.
+func (c *Client) SearchTasks(ctx context.Context, query TaskQuery) (*TaskPage, error) {
+    if len(query.Lists) > int(ptmp.QUERY_MAX_LISTS) || len(query.Sort) > int(ptmp.QUERY_MAX_SORT_KEYS) || len(query.Cursor) > int(ptmp.CURSOR_MAX_LENGTH) {
+        return nil, fmt.Errorf("ptmpclient: a query can have at most %v lists, %v sort keys and a %v byte cursor", ptmp.QUERY_MAX_LISTS, ptmp.QUERY_MAX_SORT_KEYS, ptmp.CURSOR_MAX_LENGTH)
+    }
+    if len(query.Search) > int(ptmp.SEARCH_MAX_LENGTH) || !utf8.ValidString(query.Search) {
+        return nil, fmt.Errorf("ptmpclient: the search has to be UTF-8, and can be at most %v bytes long", ptmp.SEARCH_MAX_LENGTH)
+    }
+    if version := c.ProtocolVersion(); version != 0 && version < uint16(ptmp.PROTOCOL_VERSION_2) {
+        return nil, &ResponseError{Response_Code: ptmp.PROTOCOL_VERSIONS_INCOMPATIBLE, Msg_Type_ID: ptmp.QUERY_TASKS, Diagnostic: "the server only speaks protocol version 1, so it can only query by priority, and it wasn't sent"}
+    }
+    if query.Min_Priority == 0 && query.Max_Priority == 0 {
+        query.Max_Priority = 65535
+    }
+    msg := ptmp.Prep_Query_Tasks_V2(query.Min_Priority, query.Max_Priority, query.Lists, query.Status, query.Search_Flags, query.Search, query.Sort, query.Limit, query.Offset, query.Cursor)
+    replies, err_status := c.doQuery(ctx, msg, ptmp.TASK_INFORMATION)
+    if err_status != nil {
+        return nil, err_status
+    }
+    // (the last one is always the end of the page, with no tasks of its own)
+    if len(replies) == 0 {
+        return nil, ErrUnexpectedReply
+    }
+    page := &TaskPage{Tasks: []Task{}}
+    for _, reply := range replies {
+        info := ptmp.DecodePayload[ptmp.Task_Information](reply.Pld)
+        for _, tinfo := range info.Task_Infos {
+            page.Tasks = append(page.Tasks, TaskFromTInf(tinfo))
+        }
+        if reply.Hdr.Msgs_To_Follow == 0 {
+            page.Total = info.Total_Matches
+            if len(info.Next_Cursor) > 0 {
+                page.Next_Cursor = info.Next_Cursor
+            }
+        }
+    }
+    return page, nil
+}
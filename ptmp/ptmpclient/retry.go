@@ -0,0 +1,169 @@
+package ptmpclient
+
+import (
+    "bufio"
+    "context"
+    "errors"
+    "ajb497/ptmp"
+    "ajb497/ptmp/ptmplog"
+    "math/rand"
+    "net"
+    "time"
+)
+
+// How long to wait between tries at connecting: Initial after the first one fails, doubling each time up to Max,
+// with up to half as long again added at random so that clients cut off at the same moment don't all come back at
+// the same moment too.  Attempts is how many tries to make in all (0 for as many as the context allows).
+type Backoff struct {
+    Initial time.Duration
+    Max time.Duration
+    Attempts int
+}
+
+// A bit over a minute of trying, which is enough to ride out the server restarting.
+var DEFAULT_BACKOFF = Backoff{Initial: 250*time.Millisecond, Max: 15*time.Second, Attempts: 10}
+
+// Keep calling try until it works, the attempts run out or the context is done, and return what the last try did.
+func (b Backoff) retry(ctx context.Context, try func() error) error {
+    wait := b.Initial
+    for attempt := 1; ; attempt++ {
+        err_status := try()
+        if err_status == nil || (b.Attempts > 0 && attempt >= b.Attempts) || ctx.Err() != nil {
+            return err_status
+        }
+        timer := time.NewTimer(wait + time.Duration(rand.Int63n(int64(wait)/2 + 1)))
+        select {
+            case <-timer.C:
+            case <-ctx.Done():
+                timer.Stop()
+                return err_status
+        }
+        wait *= 2
+        if b.Max > 0 && wait > b.Max {
+            wait = b.Max
+        }
+    }
+}
+
+// A fresh idempotency key for a change (never 0, which means no key).
+func newIdempotencyKey() uint64 {
+    for {
+        if key := rand.Uint64(); key != 0 {
+            return key
+        }
+    }
+}
+
+// For the changes (creating, completing, removing, restoring and purging tasks), which are answered with an
+// acknowledgment.  If the server agreed to ptmp.EXT_IDEMPOTENCY_KEYS, the change gets a key, so that if the
+// connection goes away before the answer comes back, the very same change (key and all) can be sent again on a new
+// one.  The server only makes it if the first one never got to it, and either way we get the answer the change got.
+// Without the extension, the connection's error comes back as it is, since there'd be no telling whether sending it
+// again would make it twice (unless the server hung up on us to shut down, which it only does between messages).
+// A change the server's capabilities say it can't make isn't sent at all.
+func (c *Client) doChange(ctx context.Context, msg ptmp.PTMP_Msg) error {
+    _, err_status := c.doChangeItems(ctx, msg)
+    return err_status
+}
+
+// Like doChange, but also hands back the item results of a change that worked, if the server said (see ackItems).
+func (c *Client) doChangeItems(ctx context.Context, msg ptmp.PTMP_Msg) ([]ItemResult, error) {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    if err_status := c.checkImplemented(ctx, msg); err_status != nil {
+        return nil, err_status
+    }
+    if c.hasExtension(ptmp.EXT_IDEMPOTENCY_KEYS) {
+        msg.Hdr.Idempotency_Key = newIdempotencyKey()
+    }
+    replies, err_status := c.exchangeResuming(ctx, msg, func(exchange_err error) bool {
+        // whatever we're talking to now has to know the key, or it wouldn't know it was a repeat
+        return errors.Is(exchange_err, ErrServerClosed) || (msg.Hdr.Idempotency_Key != 0 && c.hasExtension(ptmp.EXT_IDEMPOTENCY_KEYS))
+    })
+    if err_status != nil {
+        return nil, err_status
+    }
+    if err_status = ackReplyToError(replies); err_status != nil {
+        return nil, err_status
+    }
+    return ackItems(replies[0]), nil
+}
+
+// Exchange a message, and if the connection goes away before the answer comes back, connect again (see reconnect),
+// and send the message that never got answered once more, as long as replayable says that's safe.  It's asked after
+// reconnecting, so that it can look at what the new session agreed to.  Either way, the Client is left connected
+// and logged in if it could be, so that whatever's sent next doesn't have to deal with it.  The Client has to be locked.
+func (c *Client) exchangeResuming(ctx context.Context, msg ptmp.PTMP_Msg, replayable func(exchange_err error) bool) ([]*ptmp.PTMP_Msg, error) {
+    replies, err_status := c.exchange(ctx, msg)
+    if err_status == nil || !c.canRetry(ctx, err_status) {
+        return replies, err_status
+    }
+    if reconnect_err := c.reconnect(ctx); reconnect_err != nil {
+        if c.Logger != nil {
+            c.Logger.WarnContext(ctx, "Lost the connection, and couldn't connect again", "error", err_status, "reconnect_error", reconnect_err)
+        }
+        return replies, err_status
+    }
+    if !errors.Is(err_status, ErrDropped) && !replayable(err_status) { // (a message that was never sent is always safe to send)
+        return replies, err_status
+    }
+    if c.Logger != nil {
+        c.Logger.InfoContext(ctx, "Reconnected, sending the unanswered message again", "msg_type", ptmplog.MsgTypeName(msg.Hdr.Msg_Type_ID), "idempotency_key", msg.Hdr.Idempotency_Key, "error", err_status)
+    }
+    return c.exchange(ctx, msg)
+}
+
+// Whether an error from an exchange means the connection went away (rather than us giving up on it, or it being
+// closed on purpose), and we can connect again.
+func (c *Client) canRetry(ctx context.Context, err_status error) bool {
+    return ctx.Err() == nil && !errors.Is(err_status, context.DeadlineExceeded) && !errors.Is(err_status, ErrClosed) && !errors.Is(err_status, ErrPayloadTooLarge) && c.Redial != nil && c.username != ""
+}
+
+// Replace the connection with a new one (trying as often as Reconnect_Backoff allows), and pick the session back up
+// on it: with the session token if the server gave us one (see ptmp.EXT_SESSION_RESUMPTION), or by logging in with
+// the credentials from the last Login if it didn't, or the token is no good anymore.  The Client has to be locked.
+func (c *Client) reconnect(ctx context.Context) error {
+    var conn net.Conn
+    err_status := c.Reconnect_Backoff.retry(ctx, func() error {
+        var dial_err error
+        conn, dial_err = c.Redial(ctx)
+        if dial_err != nil && c.Logger != nil {
+            c.Logger.DebugContext(ctx, "Couldn't connect again yet", "error", dial_err)
+        }
+        return dial_err
+    })
+    if err_status != nil {
+        return err_status
+    }
+    c.conn.Close()
+    c.conn = conn
+    c.reader = bufio.NewReader(conn)
+    c.closed = false
+    c.dropped = false
+    c.extensions = nil
+    c.max_payload = 0 // (the new connection starts out on the fixed framing, until the handshake says otherwise)
+    c.server_capabilities = nil // (it may not be the same server anymore)
+    if c.token != 0 {
+        // (in whichever version the last login worked in, since it's most likely the same server)
+        resume := ptmp.Prep_Resume_Session_V2(c.username, c.token, PROTOCOL_VERSIONS_SUPPORTED, EXTENSIONS_SUPPORTED, c.Max_Payload_Size)
+        if c.version < uint16(ptmp.PROTOCOL_VERSION_2) {
+            resume = ptmp.Prep_Resume_Session(c.username, c.token, PROTOCOL_VERSIONS_SUPPORTED, EXTENSIONS_SUPPORTED, c.Max_Payload_Size)
+        }
+        err_status = c.handshake(ctx, resume)
+        if !errors.Is(err_status, ErrSessionTokenInvalid) {
+            return c.closeUnlessLoggedIn(err_status)
+        }
+        // (it ran out, or the server restarted and forgot it)
+        c.token = 0
+    }
+    return c.closeUnlessLoggedIn(c.login(ctx, c.username, c.password))
+}
+
+// No use keeping a connection we couldn't log in on.
+func (c *Client) closeUnlessLoggedIn(err_status error) error {
+    if err_status != nil {
+        c.closed = true
+        c.conn.Close()
+    }
+    return err_status
+}
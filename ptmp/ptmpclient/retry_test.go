@@ -0,0 +1,123 @@
+package ptmpclient
+
+import (
+    "context"
+    "errors"
+    "ajb497/ptmp"
+    "net"
+    "testing"
+    "time"
+)
+
+var TEST_BACKOFF = Backoff{Initial: time.Millisecond, Max: 10*time.Millisecond, Attempts: 5}
+
+// Logins that picked a session back up with its token, and password checks.
+func (ts *test_server) sessionCounts() (int, int) {
+    ts.lock.Lock()
+    defer ts.lock.Unlock()
+    return ts.resumed, int(ts.logins.Load())
+}
+
+// Cut the connection after the server has made a change but before its acknowledgment gets back, and check that
+// the Client sends the change again on a new connection (key and all), that the server only makes it the once,
+// and that what comes back is the answer the first one got.  (Making it again would be UNABLE_TO_COMPLY, since
+// the test server won't take two tasks with the same title.)
+func cutAndReplay(t *testing.T, ts *test_server, client *Client) {
+    t.Helper()
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+    if err_status := client.CreateTask(ctx, 1, 10, "Made before", "On the first connection"); err_status != nil {
+        t.Fatal(err_status)
+    }
+    creates_before, _ := ts.counts(ptmp.CREATE_NEW_TASK)
+
+    ts.cut_create.Store(true)
+    if err_status := client.CreateTask(ctx, 1, 20, "Cut off", "The acknowledgment never makes it back"); err_status != nil {
+        t.Errorf("The change that was cut off came back with %v, expected the success the first one got", err_status)
+    }
+    creates, tasks := ts.counts(ptmp.CREATE_NEW_TASK)
+    if creates != creates_before + 2 || tasks != 2 {
+        t.Errorf("The server got %v creates after the cut and is holding %v tasks, expected 2 and 2", creates - creates_before, tasks)
+    }
+    if listed, err_status := client.QueryTasks(ctx, 0, 65535); err_status != nil || len(listed) != 2 {
+        t.Errorf("The session wasn't usable after the replay: %v, %v", listed, err_status)
+    }
+}
+
+func TestReplayResumingSession(t *testing.T) {
+    ts := startTestServer(t)
+    client := ts.login(t)
+    client.Reconnect_Backoff = TEST_BACKOFF
+    resumed_before, logins_before := ts.sessionCounts()
+
+    cutAndReplay(t, ts, client)
+    // (with its token, in version 2 since that's what the first login settled on, and without the password)
+    if resumed, logins := ts.sessionCounts(); resumed != resumed_before + 1 || logins != logins_before {
+        t.Errorf("Reconnecting resumed %v sessions and checked %v passwords, expected 1 and 0", resumed - resumed_before, logins - logins_before)
+    }
+    if client.ProtocolVersion() != uint16(ptmp.PROTOCOL_VERSION_2) || client.token == 0 {
+        t.Errorf("After resuming, the Client is on version %v with token %v", client.ProtocolVersion(), client.token)
+    }
+}
+
+func TestReplayAfterRestart(t *testing.T) {
+    ts := startTestServer(t)
+    client := ts.login(t)
+    client.Reconnect_Backoff = TEST_BACKOFF
+    // the connection gets cut, and the server that answers next has never heard of the session
+    ts.serve(t)
+    restarted := ts.addr
+    client.Redial = func(ctx context.Context) (net.Conn, error) {
+        return (&net.Dialer{}).DialContext(ctx, BASE_PROTO, restarted)
+    }
+    resumed_before, logins_before := ts.sessionCounts()
+
+    cutAndReplay(t, ts, client)
+    // (it tried the token first, and when that was turned away with SESSION_TOKEN_INVALID, logged in again)
+    if resumed, logins := ts.sessionCounts(); resumed != resumed_before + 1 || logins != logins_before + 1 {
+        t.Errorf("Reconnecting tried %v resumptions and checked %v passwords, expected 1 and 1", resumed - resumed_before, logins - logins_before)
+    }
+}
+
+func TestNoReplayWithoutReconnecting(t *testing.T) {
+    ts := startTestServer(t)
+    client := ts.login(t)
+    client.Redial = nil // (like a Client made with NewClient)
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    ts.cut_create.Store(true)
+    if err_status := client.CreateTask(ctx, 1, 20, "Cut off", "Nothing to reconnect with"); err_status == nil || errors.As(err_status, new(*ResponseError)) {
+        t.Errorf("A change cut off without a way to reconnect got %v, expected the connection's error", err_status)
+    }
+    if creates, tasks := ts.counts(ptmp.CREATE_NEW_TASK); creates != 1 || tasks != 1 {
+        t.Errorf("The server got %v creates and is holding %v tasks, expected 1 and 1", creates, tasks)
+    }
+}
+
+func TestBackoffRetry(t *testing.T) {
+    failure := errors.New("not yet")
+    tries := 0
+    try_until := func(works_on int) func() error {
+        tries = 0
+        return func() error {
+            tries++
+            if tries < works_on {
+                return failure
+            }
+            return nil
+        }
+    }
+
+    if err_status := TEST_BACKOFF.retry(context.Background(), try_until(3)); err_status != nil || tries != 3 {
+        t.Errorf("Working on the third try got %v after %v tries", err_status, tries)
+    }
+    if err_status := TEST_BACKOFF.retry(context.Background(), try_until(99)); err_status != failure || tries != TEST_BACKOFF.Attempts {
+        t.Errorf("Never working got %v after %v tries, expected the last failure after %v", err_status, tries, TEST_BACKOFF.Attempts)
+    }
+    cancelled, cancel := context.WithCancel(context.Background())
+    cancel()
+    if err_status := (Backoff{Initial: time.Hour}).retry(cancelled, try_until(99)); err_status != failure || tries != 1 {
+        t.Errorf("A cancelled context got %v after %v tries, expected the first failure", err_status, tries)
+    }
+}
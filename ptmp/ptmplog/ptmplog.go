@@ -0,0 +1,229 @@
+// Package ptmplog is the logging shared by the PTMP server and client: log/slog handlers in text or JSON that
+// never let a credential through, and attributes for logging PTMP messages (including what's in their payloads).
+//
+// Anything logged under a key that looks like a credential (password, token, authorization, ...) comes out as
+// REDACTED, whether it's a top-level attribute, inside a group, or a field of a logged payload, so a
+// Request_Connection can be logged like any other message.
+package ptmplog
+
+import (
+    "fmt"
+    "io"
+    "ajb497/ptmp"
+    "log/slog"
+    "reflect"
+    "strconv"
+    "strings"
+)
+
+const REDACTED string = "[REDACTED]"
+
+const (
+    FORMAT_TEXT string = "text"
+    FORMAT_JSON string = "json"
+)
+
+// Key fragments that mark an attribute as a credential.  Matching is on the lowercased key, so "Password",
+// "auth_password" and "Authorization" are all caught.
+var credential_keys = []string{"password", "passwd", "secret", "token", "authorization", "credential"}
+
+func IsCredentialKey(key string) bool {
+    key = strings.ToLower(key)
+    if strings.HasSuffix(key, "_ok") {
+        return false // whether a password was any good (Connection_Rules) isn't a secret
+    }
+    for _, fragment := range credential_keys {
+        if strings.Contains(key, fragment) {
+            return true
+        }
+    }
+    return false
+}
+
+// For slog.HandlerOptions.ReplaceAttr: blanks out the value of anything with a credential-looking key.
+func RedactAttr(groups []string, a slog.Attr) slog.Attr {
+    if IsCredentialKey(a.Key) {
+        return slog.String(a.Key, REDACTED)
+    }
+    return a
+}
+
+// A handler writing to w in the given format ("text" or "json", with "" meaning text), logging at level and up,
+// with credentials redacted.
+func NewHandler(w io.Writer, format string, level slog.Leveler) (slog.Handler, error) {
+    options := &slog.HandlerOptions{Level: level, ReplaceAttr: RedactAttr}
+    switch format {
+        case FORMAT_TEXT, "":
+            return slog.NewTextHandler(w, options), nil
+        case FORMAT_JSON:
+            return slog.NewJSONHandler(w, options), nil
+    }
+    return nil, fmt.Errorf("log format %q isn't one of %v or %v", format, FORMAT_TEXT, FORMAT_JSON)
+}
+
+// Turn a log level name (debug, info, warn or error) into a slog.Level.
+func ParseLevel(name string) (slog.Level, error) {
+    level := slog.LevelInfo
+    err_status := level.UnmarshalText([]byte(name))
+    return level, err_status
+}
+
+// A logger that throws everything away, for when nobody asked for logging.
+func Discard() *slog.Logger {
+    return slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{Level: slog.LevelError + 1}))
+}
+
+var msg_type_names = map[byte]string{
+    ptmp.REQUEST_CONNECTION: "REQUEST_CONNECTION",
+    ptmp.CONNECTION_RULES: "CONNECTION_RULES",
+    ptmp.CLOSE_CONNECTION: "CLOSE_CONNECTION",
+    ptmp.ACKNOWLEDGMENT: "ACKNOWLEDGMENT",
+    ptmp.TRANSACTION: "TRANSACTION",
+    ptmp.TRANSACTION_FAILURE: "TRANSACTION_FAILURE",
+    ptmp.DETAILED_ACKNOWLEDGMENT: "DETAILED_ACKNOWLEDGMENT",
+    ptmp.PING: "PING",
+    ptmp.PONG: "PONG",
+    ptmp.CREATE_NEW_LIST: "CREATE_NEW_LIST",
+    ptmp.LIST_INFORMATION: "LIST_INFORMATION",
+    ptmp.QUERY_LISTS: "QUERY_LISTS",
+    ptmp.REMOVE_LIST: "REMOVE_LIST",
+    ptmp.CREATE_NEW_TASK: "CREATE_NEW_TASK",
+    ptmp.TASK_INFORMATION: "TASK_INFORMATION",
+    ptmp.QUERY_TASKS: "QUERY_TASKS",
+    ptmp.QUERY_TRASH: "QUERY_TRASH",
+    ptmp.REMOVE_TASK: "REMOVE_TASK",
+    ptmp.RESTORE_TASKS: "RESTORE_TASKS",
+    ptmp.MARK_TASK_COMPLETED: "MARK_TASK_COMPLETED",
+    ptmp.PURGE_TRASH: "PURGE_TRASH",
+    ptmp.TRASH_INFORMATION: "TRASH_INFORMATION",
+    ptmp.QUERY_HISTORY: "QUERY_HISTORY",
+    ptmp.HISTORY_INFORMATION: "HISTORY_INFORMATION",
+    ptmp.QUERY_CAPABILITIES: "QUERY_CAPABILITIES",
+    ptmp.CAPABILITIES_INFORMATION: "CAPABILITIES_INFORMATION",
+}
+
+// A readable name for a message type.  Types we don't have a name for come out as their number.
+func MsgTypeName(msg_type byte) string {
+    if name, known := msg_type_names[msg_type]; known {
+        return name
+    }
+    return fmt.Sprintf("type %v", msg_type)
+}
+
+// Decode a message's payload into whichever struct its type says it is (nil for types we don't know).
+func decodedPayload(msg *ptmp.PTMP_Msg) interface{} {
+    switch msg.Hdr.Msg_Type_ID {
+        case ptmp.REQUEST_CONNECTION:
+            if msg.Hdr.Protocol_Version >= ptmp.PROTOCOL_VERSION_2 {
+                return ptmp.DecodePayload[ptmp.Request_Connection_V2](msg.Pld)
+            }
+            return ptmp.DecodePayload[ptmp.Request_Connection](msg.Pld)
+        case ptmp.CONNECTION_RULES:
+            return ptmp.DecodePayload[ptmp.Connection_Rules](msg.Pld)
+        case ptmp.CLOSE_CONNECTION:
+            return ptmp.DecodePayload[ptmp.Close_Connection](msg.Pld)
+        case ptmp.ACKNOWLEDGMENT:
+            return ptmp.DecodePayload[ptmp.Acknowledgment](msg.Pld)
+        case ptmp.TRANSACTION:
+            return ptmp.DecodePayload[ptmp.Transaction](msg.Pld)
+        case ptmp.TRANSACTION_FAILURE:
+            return ptmp.DecodePayload[ptmp.Transaction_Failure](msg.Pld)
+        case ptmp.DETAILED_ACKNOWLEDGMENT:
+            return ptmp.DecodePayload[ptmp.Detailed_Acknowledgment](msg.Pld)
+        case ptmp.PING:
+            return ptmp.DecodePayload[ptmp.Ping](msg.Pld)
+        case ptmp.PONG:
+            return ptmp.DecodePayload[ptmp.Pong](msg.Pld)
+        case ptmp.CREATE_NEW_TASK:
+            return ptmp.DecodePayload[ptmp.Create_New_Task](msg.Pld)
+        case ptmp.TASK_INFORMATION:
+            return ptmp.DecodePayload[ptmp.Task_Information](msg.Pld)
+        case ptmp.QUERY_TASKS:
+            if msg.Hdr.Protocol_Version >= ptmp.PROTOCOL_VERSION_2 {
+                return ptmp.DecodePayload[ptmp.Query_Tasks_V2](msg.Pld)
+            }
+            return ptmp.DecodePayload[ptmp.Query_Tasks](msg.Pld)
+        case ptmp.REMOVE_TASK:
+            return ptmp.DecodePayload[ptmp.Remove_Tasks](msg.Pld)
+        case ptmp.MARK_TASK_COMPLETED:
+            return ptmp.DecodePayload[ptmp.Mark_Task_Completed](msg.Pld)
+        case ptmp.QUERY_TRASH:
+            return ptmp.DecodePayload[ptmp.Query_Trash](msg.Pld)
+        case ptmp.TRASH_INFORMATION:
+            return ptmp.DecodePayload[ptmp.Trash_Information](msg.Pld)
+        case ptmp.RESTORE_TASKS:
+            return ptmp.DecodePayload[ptmp.Restore_Tasks](msg.Pld)
+        case ptmp.PURGE_TRASH:
+            return ptmp.DecodePayload[ptmp.Purge_Trash](msg.Pld)
+        case ptmp.QUERY_HISTORY:
+            return ptmp.DecodePayload[ptmp.Query_History](msg.Pld)
+        case ptmp.HISTORY_INFORMATION:
+            return ptmp.DecodePayload[ptmp.History_Information](msg.Pld)
+        case ptmp.CAPABILITIES_INFORMATION:
+            return ptmp.DecodePayload[ptmp.Capabilities_Information](msg.Pld)
+    }
+    return nil
+}
+
+// A group attribute ("msg") describing a message: its type, how many more are to follow, its idempotency key (if it
+// has one), and every field of its payload.  Decoding the payload is only worth doing if the line is actually going
+// to be logged, so this is meant for debug-level logging, and a payload that doesn't decode just gets left out.
+func Msg(msg *ptmp.PTMP_Msg) slog.Attr {
+    attrs := []interface{}{slog.String("type", MsgTypeName(msg.Hdr.Msg_Type_ID)), slog.Int("to_follow", int(msg.Hdr.Msgs_To_Follow))}
+    if msg.Hdr.Idempotency_Key != 0 {
+        attrs = append(attrs, slog.Uint64("idempotency_key", msg.Hdr.Idempotency_Key))
+    }
+    payload := func() (payload interface{}) {
+        defer func() {
+            if recover() != nil {
+                payload = nil // DecodePayload panics on payloads that aren't what their type says
+            }
+        }()
+        return decodedPayload(msg)
+    }()
+    if payload != nil {
+        attrs = append(attrs, slog.Group("payload", structAttrs(reflect.ValueOf(payload).Elem())...))
+    }
+    return slog.Group("msg", attrs...)
+}
+
+// Every exported field of a payload struct as an attribute.  Byte arrays and slices (the strings on the wire) come
+// out as strings, nested structs and slices of them as groups, and credentials as REDACTED no matter what handler
+// the attributes end up at.
+func structAttrs(value reflect.Value) []interface{} {
+    attrs := []interface{}{}
+    for ii := 0; ii < value.NumField(); ii++ {
+        field := value.Type().Field(ii)
+        if !field.IsExported() {
+            continue
+        }
+        key := strings.ToLower(field.Name)
+        if IsCredentialKey(key) {
+            attrs = append(attrs, slog.String(key, REDACTED))
+            continue
+        }
+        attrs = append(attrs, valueAttr(key, value.Field(ii)))
+    }
+    return attrs
+}
+
+func valueAttr(key string, value reflect.Value) slog.Attr {
+    switch value.Kind() {
+        case reflect.Struct:
+            return slog.Group(key, structAttrs(value)...)
+        case reflect.Array, reflect.Slice:
+            if value.Type().Elem().Kind() == reflect.Uint8 {
+                raw := make([]byte, value.Len())
+                reflect.Copy(reflect.ValueOf(raw), value)
+                return slog.String(key, strings.TrimRight(string(raw), "\x00"))
+            }
+            if value.Type().Elem().Kind() == reflect.Struct {
+                items := []interface{}{}
+                for ii := 0; ii < value.Len(); ii++ {
+                    items = append(items, slog.Group(strconv.Itoa(ii), structAttrs(value.Index(ii))...))
+                }
+                return slog.Group(key, items...)
+            }
+    }
+    return slog.Any(key, value.Interface())
+}
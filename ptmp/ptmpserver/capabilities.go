@@ -0,0 +1,66 @@
+package ptmpserver
+
+import (
+    "ajb497/ptmp"
+)
+
+// The limits a server tells clients about when they ask for its capabilities.  Zero for the title or description
+// length means the most the messages allow for (ptmp.TITLE_MAX_LENGTH and ptmp.DESCRIPTION_MAX_LENGTH bytes), zero
+// for the _Chars limits means as many characters as fit in that, and zero for Max_Tasks_Per_List means there's no limit.
+type TaskLimits struct {
+    Max_Title_Length uint16
+    Max_Description_Length uint16
+    Max_Tasks_Per_List uint16
+    Max_Title_Chars uint16
+    Max_Description_Chars uint16
+}
+
+// The message types a client can send that the server will actually do something with.  That's whatever has a
+// handler, other than transactions when there's nothing to make them all-or-nothing (they're answered with
+// MSG_NOT_IMPLEMENTED).
+func (s *Server) implementedMsgTypes() []byte {
+    implemented := []byte{}
+    for _, msg_type := range s.mux.MsgTypes() {
+        if msg_type == ptmp.TRANSACTION && s.Atomically == nil {
+            continue
+        }
+        implemented = append(implemented, msg_type)
+    }
+    return implemented
+}
+
+// Tell the client what we can do, so that it doesn't have to find out by trying things.  Everything comes from the
+// server's own settings and handlers, so a server with message types of its own lists those too.
+func (s *Server) capabilities(w ResponseWriter, r *Request) {
+    limits := TaskLimits{}
+    if s.Task_Limits != nil {
+        limits = s.Task_Limits()
+    }
+    if limits.Max_Title_Length == 0 || limits.Max_Title_Length > ptmp.TITLE_MAX_LENGTH {
+        limits.Max_Title_Length = ptmp.TITLE_MAX_LENGTH
+    }
+    if limits.Max_Description_Length == 0 || limits.Max_Description_Length > ptmp.DESCRIPTION_MAX_LENGTH {
+        limits.Max_Description_Length = ptmp.DESCRIPTION_MAX_LENGTH
+    }
+    // (a character is at least a byte, so there can't be more of them than the byte limit)
+    if limits.Max_Title_Chars == 0 || limits.Max_Title_Chars > limits.Max_Title_Length {
+        limits.Max_Title_Chars = limits.Max_Title_Length
+    }
+    if limits.Max_Description_Chars == 0 || limits.Max_Description_Chars > limits.Max_Description_Length {
+        limits.Max_Description_Chars = limits.Max_Description_Length
+    }
+    versions := []uint16{}
+    for version := uint16(ptmp.PROTOCOL_VERSION_1); version <= s.Protocol_Version; version++ {
+        versions = append(versions, version)
+    }
+    extensions := s.Extensions
+    if extensions == nil {
+        extensions = []uint16{}
+    }
+    max_payload := r.Session.Max_Payload_Size
+    if max_payload == 0 {
+        max_payload = ptmp.MAX_PAYLOAD_SIZE
+    }
+    w.Send(ptmp.Prep_Capabilities_Information(s.Version, versions, s.implementedMsgTypes(), extensions, max_payload, limits.Max_Title_Length,
+                                              limits.Max_Description_Length, limits.Max_Tasks_Per_List, limits.Max_Title_Chars, limits.Max_Description_Chars))
+}
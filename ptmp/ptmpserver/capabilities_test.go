@@ -0,0 +1,55 @@
+package ptmpserver
+
+import (
+    "ajb497/ptmp"
+    "bytes"
+    "testing"
+    "time"
+)
+
+func TestCapabilitiesListWhatTheServerActuallyDoes(t *testing.T) {
+    srv := NewServer(func(username string, password string) (bool, bool) { return true, true })
+    srv.Version = "test server 1.0"
+    srv.Extensions = []uint16{ptmp.EXT_DETAILED_ACKS}
+    srv.HandleFunc(ptmp.QUERY_TASKS, func(w ResponseWriter, r *Request) { w.Ack(ptmp.UNABLE_TO_COMPLY) })
+    capabilities := func() *ptmp.Capabilities_Information {
+        rec := NewRecorder(ptmp.QUERY_CAPABILITIES)
+        msg := ptmp.Prep_Query_Capabilities()
+        srv.ServeMessage(rec, &Request{Msg: &msg, Session: &Session{State: STATE_ESTABLISHED}, Received: time.Now()})
+        if len(rec.Replies) != 1 || rec.Replies[0].Hdr.Msg_Type_ID != ptmp.CAPABILITIES_INFORMATION {
+            t.Fatalf("Asking for capabilities got %v", rec.Replies)
+        }
+        return ptmp.DecodePayload[ptmp.Capabilities_Information](rec.Replies[0].Pld)
+    }
+
+    caps := capabilities()
+    expected := []byte{ptmp.REQUEST_CONNECTION, ptmp.CLOSE_CONNECTION, ptmp.PING, ptmp.QUERY_TASKS, ptmp.QUERY_CAPABILITIES}
+    if !bytes.Equal(caps.Msg_Types, expected) {
+        t.Errorf("A server without transactions listed message types %v, expected %v", caps.Msg_Types, expected)
+    }
+    if string(caps.Server_Version) != srv.Version || len(caps.Extensions) != 1 || caps.Extensions[0] != ptmp.EXT_DETAILED_ACKS {
+        t.Errorf("Capabilities gave version %q and extensions %v", caps.Server_Version, caps.Extensions)
+    }
+    if caps.Max_Title_Length != ptmp.TITLE_MAX_LENGTH || caps.Max_Description_Length != ptmp.DESCRIPTION_MAX_LENGTH || caps.Max_Tasks_Per_List != 0 ||
+       caps.Max_Title_Chars != ptmp.TITLE_MAX_LENGTH || caps.Max_Description_Chars != ptmp.DESCRIPTION_MAX_LENGTH {
+        t.Errorf("A server without limits of its own gave %+v", caps)
+    }
+    if len(caps.Protocol_Versions) != 2 || caps.Protocol_Versions[0] != 1 || caps.Protocol_Versions[1] != 2 {
+        t.Errorf("A version 2 server listed protocol versions %v", caps.Protocol_Versions)
+    }
+
+    srv.Atomically = func(apply func() bool) { apply() }
+    srv.Task_Limits = func() TaskLimits {
+        return TaskLimits{Max_Title_Length: 40, Max_Description_Length: 1000, Max_Tasks_Per_List: 50, Max_Title_Chars: 100, Max_Description_Chars: 200}
+    }
+    caps = capabilities()
+    if bytes.IndexByte(caps.Msg_Types, ptmp.TRANSACTION) < 0 {
+        t.Errorf("A server that makes transactions didn't list them: %v", caps.Msg_Types)
+    }
+    // (descriptions can't be any longer than the message has room for, whatever the server says)
+    // (and there can't be more characters than bytes)
+    if caps.Max_Title_Length != 40 || caps.Max_Description_Length != ptmp.DESCRIPTION_MAX_LENGTH || caps.Max_Tasks_Per_List != 50 ||
+       caps.Max_Title_Chars != 40 || caps.Max_Description_Chars != 200 {
+        t.Errorf("A server with limits of its own gave %+v", caps)
+    }
+}
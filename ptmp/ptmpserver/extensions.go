@@ -0,0 +1,61 @@
+package ptmpserver
+
+import (
+    "ajb497/ptmp"
+)
+
+// The extensions a session gets: the ones its client offered that the server is willing to use, in the order the
+// server lists them.
+func (s *Server) negotiateExtensions(offered []uint16) []uint16 {
+    agreed := []uint16{}
+    for _, ext := range s.Extensions {
+        for _, offer := range offered {
+            if offer == ext {
+                agreed = append(agreed, ext)
+                break
+            }
+        }
+    }
+    return agreed
+}
+
+// Whether the session agreed on an extension (ptmp.EXT_*) when it logged in.
+func (s *Session) HasExtension(ext uint16) bool {
+    for _, agreed := range s.Extensions {
+        if agreed == ext {
+            return true
+        }
+    }
+    return false
+}
+
+// Answer a message with how each of its items went and an explanation for whoever is reading, as a
+// Detailed_Acknowledgment if the session agreed on ptmp.EXT_DETAILED_ACKS, or a plain Acknowledgment with just the
+// response code if it didn't.
+func AckDetailed(w ResponseWriter, r *Request, response_code uint16, items []ptmp.Item_Result, diagnostic string) error {
+    if r.Session == nil || !r.Session.HasExtension(ptmp.EXT_DETAILED_ACKS) {
+        return w.Ack(response_code)
+    }
+    return w.Send(ptmp.Prep_Detailed_Acknowledgment(response_code, r.Msg.Hdr.Msg_Type_ID, items, diagnostic))
+}
+
+// The response code that sums up a set of item results, for a message whose items are each done if they can be
+// (rather than all or nothing): SINGULAR_MSG_SUCCESS if every item succeeded.  Otherwise it's failure_code, unless
+// the session agreed on ptmp.EXT_DETAILED_ACKS and at least one item did succeed, in which case it's
+// CONDITIONAL_SUCCESS (the Detailed_Acknowledgment it goes out in says which ones didn't).  Clients that didn't ask
+// for detailed acks keep getting the failure they always have.
+func ItemsResponseCode(r *Request, items []ptmp.Item_Result, failure_code uint16) uint16 {
+    succeeded := 0
+    for _, item := range items {
+        if item.Response_Code == ptmp.SINGULAR_MSG_SUCCESS {
+            succeeded++
+        }
+    }
+    switch {
+        case succeeded == len(items):
+            return ptmp.SINGULAR_MSG_SUCCESS
+        case succeeded > 0 && r.Session != nil && r.Session.HasExtension(ptmp.EXT_DETAILED_ACKS):
+            return ptmp.CONDITIONAL_SUCCESS
+    }
+    return failure_code
+}
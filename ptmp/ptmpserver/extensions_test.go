@@ -0,0 +1,76 @@
+package ptmpserver
+
+import (
+    "ajb497/ptmp"
+    "testing"
+    "time"
+)
+
+func TestExtensionsAreOnlyUsedWhenBothSidesWantThem(t *testing.T) {
+    srv := NewServer(func(username string, password string) (bool, bool) { return true, true })
+    srv.Extensions = []uint16{ptmp.EXT_DETAILED_ACKS}
+    login := func(offered ...uint16) *Session {
+        session := &Session{State: STATE_AWAITING_HANDSHAKE}
+        rec := NewRecorder(ptmp.REQUEST_CONNECTION)
+        msg := loginMessage("someone", "anything", offered...)
+        srv.ServeMessage(rec, &Request{Msg: &msg, Session: session, Received: time.Now()})
+        rules := ptmp.DecodePayload[ptmp.Connection_Rules](rec.Replies[0].Pld)
+        if len(rules.Acceptable_Exts) != len(session.Extensions) {
+            t.Errorf("Connection_Rules accepted %v, but the session has %v", rules.Acceptable_Exts, session.Extensions)
+        }
+        return session
+    }
+    if session := login(); session.HasExtension(ptmp.EXT_DETAILED_ACKS) {
+        t.Errorf("A client that didn't ask for detailed acks got them")
+    }
+    if session := login(9999, ptmp.EXT_DETAILED_ACKS); !session.HasExtension(ptmp.EXT_DETAILED_ACKS) || len(session.Extensions) != 1 {
+        t.Errorf("A client that asked for detailed acks (and something unknown) ended up with %v", session.Extensions)
+    }
+}
+
+func TestAckDetailed(t *testing.T) {
+    items := []ptmp.Item_Result{{Task_Reference_Number: 1, Response_Code: ptmp.SINGULAR_MSG_SUCCESS}, {Task_Reference_Number: 2, Response_Code: ptmp.TASK_DOES_NOT_EXIST}}
+    msg := ptmp.Prep_Remove_Tasks(true, 1, []uint16{1, 2})
+    plain := &Request{Msg: &msg, Session: &Session{State: STATE_ESTABLISHED}}
+    detailed := &Request{Msg: &msg, Session: &Session{State: STATE_ESTABLISHED, Extensions: []uint16{ptmp.EXT_DETAILED_ACKS}}}
+
+    if code := ItemsResponseCode(plain, items, ptmp.TASK_DOES_NOT_EXIST); code != ptmp.TASK_DOES_NOT_EXIST {
+        t.Errorf("A partial success without detailed acks came out as %v", code)
+    }
+    if code := ItemsResponseCode(detailed, items, ptmp.TASK_DOES_NOT_EXIST); code != ptmp.CONDITIONAL_SUCCESS {
+        t.Errorf("A partial success with detailed acks came out as %v", code)
+    }
+    if code := ItemsResponseCode(detailed, items[1:], ptmp.TASK_DOES_NOT_EXIST); code != ptmp.TASK_DOES_NOT_EXIST {
+        t.Errorf("Nothing succeeding with detailed acks came out as %v", code)
+    }
+
+    rec := NewRecorder(msg.Hdr.Msg_Type_ID)
+    AckDetailed(rec, plain, ptmp.TASK_DOES_NOT_EXIST, items, "task 2 doesn't exist")
+    if rec.Replies[0].Hdr.Msg_Type_ID != ptmp.ACKNOWLEDGMENT || rec.ResponseCode() != ptmp.TASK_DOES_NOT_EXIST {
+        t.Errorf("A session without detailed acks got message type %v with %v", rec.Replies[0].Hdr.Msg_Type_ID, rec.ResponseCode())
+    }
+    rec = NewRecorder(msg.Hdr.Msg_Type_ID)
+    AckDetailed(rec, detailed, ptmp.CONDITIONAL_SUCCESS, items, "task 2 doesn't exist")
+    ack := ptmp.DecodePayload[ptmp.Detailed_Acknowledgment](rec.Replies[0].Pld)
+    if rec.Replies[0].Hdr.Msg_Type_ID != ptmp.DETAILED_ACKNOWLEDGMENT || rec.ResponseCode() != ptmp.CONDITIONAL_SUCCESS ||
+       ack.ID_Responding_To != ptmp.REMOVE_TASK || len(ack.Item_Results) != 2 || string(ack.Diagnostic) != "task 2 doesn't exist" {
+        t.Errorf("A session with detailed acks got message type %v with %+v", rec.Replies[0].Hdr.Msg_Type_ID, ack)
+    }
+}
+
+// Too many items for the payload leaves out the ones that succeeded, rather than getting chopped off partway through.
+func TestDetailedAckFitsInThePayload(t *testing.T) {
+    items := []ptmp.Item_Result{}
+    for ref := uint16(1000); ref < 1400; ref++ {
+        code := ptmp.SINGULAR_MSG_SUCCESS
+        if ref % 50 == 0 {
+            code = ptmp.TASK_DOES_NOT_EXIST
+        }
+        items = append(items, ptmp.Item_Result{Task_Reference_Number: ref, Response_Code: code})
+    }
+    msg := ptmp.Prep_Detailed_Acknowledgment(ptmp.CONDITIONAL_SUCCESS, ptmp.REMOVE_TASK, items, "some of them")
+    ack := ptmp.DecodePayload[ptmp.Detailed_Acknowledgment](msg.Pld)
+    if !ptmp.Byte2Bool(ack.Failures_Only) || len(ack.Item_Results) != 8 || ack.Item_Results[0].Task_Reference_Number != 1000 || string(ack.Diagnostic) != "some of them" {
+        t.Errorf("Expected just the 8 failures and the diagnostic, got %+v", ack)
+    }
+}
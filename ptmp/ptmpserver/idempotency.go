@@ -0,0 +1,195 @@
+package ptmpserver
+
+import (
+    "ajb497/ptmp"
+    "bytes"
+    "sync"
+    "time"
+)
+
+// How many idempotency keys are remembered for each user, and for how long.  Once a user has Max_Keys_Per_User
+// keys remembered, the oldest one that's been answered is forgotten to make room for the next.  Keys whose first
+// message is still being handled are never forgotten (a retry of one would get made a second time), so while all of
+// a user's keys are like that, a message with a new key is turned away with RATE_LIMITED.
+type IdempotencyPolicy struct {
+    Max_Keys_Per_User int
+    TTL time.Duration
+}
+
+// What a message with an idempotency key was answered with, so that repeats of it get the same answer.
+type idempotent_result struct {
+    msg_type byte
+    payload []byte // to tell a repeat apart from a different message that reused the key (without the fixed framing's padding)
+    stored time.Time
+    done chan struct{} // closed once the first one has been handled
+    replies []ptmp.PTMP_Msg // nil if it never finished being handled (its handler panicked), so the repeat gets handled instead
+}
+
+type key_history struct {
+    results map[uint64]*idempotent_result
+    order []uint64 // oldest first
+}
+
+// Remembers the answers to recent messages that came with an idempotency key (ptmp.PTMP_Header.Idempotency_Key),
+// for each user, so that a client that sends a change again (because it never heard back about it) doesn't get the
+// change made twice.  The repeat gets whatever the first one got, without going anywhere near its handler.  Keys
+// are per user rather than per session, since the repeat usually comes in on a new connection.
+type IdempotencyCache struct {
+    policy func() IdempotencyPolicy
+    lock sync.Mutex
+    users map[string]*key_history
+}
+
+// A cache that looks its policy up every time it's used, so that the policy can change while the server is running.
+func NewIdempotencyCache(policy func() IdempotencyPolicy) *IdempotencyCache {
+    return &IdempotencyCache{policy: policy, users: make(map[string]*key_history)}
+}
+
+// Middleware that answers repeats of messages from the cache.  Keys are only looked at on messages sent on their
+// own by a logged in session (not in a series or transaction, and not the connection management messages), so it
+// belongs inside RequireLogin, and inside rate limiting too (so that a message turned away for going too fast
+// doesn't get remembered as having been answered that way).  Servers using it should list
+// ptmp.EXT_IDEMPOTENCY_KEYS in their Extensions, so that clients know their keys are being looked at.
+func (ic *IdempotencyCache) Middleware(next Handler) Handler {
+    return HandlerFunc(func(w ResponseWriter, r *Request) {
+        key := r.Msg.Hdr.Idempotency_Key
+        if key == 0 || r.Session.User == "" || r.Session.State != STATE_ESTABLISHED || r.Msg.Hdr.Msgs_To_Follow != 0 ||
+           r.Msg.Hdr.Msg_Type_ID < ptmp.CREATE_NEW_LIST { // (the 0 series)
+            next.ServePTMP(w, r)
+            return
+        }
+        var gone <-chan struct{}
+        if r.Context != nil {
+            gone = r.Context.Done()
+        }
+        for {
+            result, first := ic.claim(r.Session.User, key, r.Msg)
+            if result == nil {
+                r.Logger().Warn("No room for another idempotency key, every one remembered for the user is still being handled", "idempotency_key", key)
+                w.Ack(ptmp.RATE_LIMITED)
+                return
+            }
+            if first {
+                ic.handle(next, w, r, key, result)
+                return
+            }
+            if result.msg_type != r.Msg.Hdr.Msg_Type_ID || !bytes.Equal(result.payload, bytes.TrimRight(r.Msg.Pld, "\x00")) {
+                r.Logger().Warn("Idempotency key reused for a different message", "idempotency_key", key, "first_msg_type", MsgTypeName(result.msg_type))
+                w.Ack(ptmp.SYNTAX_ERROR)
+                return
+            }
+            select {
+                case <-result.done:
+                case <-gone:
+                    return // the connection went away while we waited for the first one to finish
+            }
+            if result.replies == nil {
+                continue // the first one never got answered, so it's up to this one now
+            }
+            r.Logger().Info("Answered a repeated message with the result of the first", "idempotency_key", key, "age", time.Since(result.stored))
+            for _, reply := range result.replies {
+                w.Send(reply)
+            }
+            return
+        }
+    })
+}
+
+// Run the first message with a key through the handler, keeping what it gets answered with.
+func (ic *IdempotencyCache) handle(next Handler, w ResponseWriter, r *Request, key uint64, result *idempotent_result) {
+    rec := &recording_writer{ResponseWriter: w, responding_to: r.Msg.Hdr.Msg_Type_ID}
+    defer func() {
+        ic.lock.Lock()
+        if rec.replies != nil {
+            result.replies = rec.replies
+        } else {
+            ic.forget(r.Session.User, key) // (its handler panicked, or didn't answer at all)
+        }
+        ic.lock.Unlock()
+        close(result.done)
+    }()
+    next.ServePTMP(rec, r)
+}
+
+// Find what the user's key was answered with, or if it's new, make a place for its answer to go (and say so).  A new
+// key gets nil if there's no room for it.
+func (ic *IdempotencyCache) claim(user string, key uint64, msg *ptmp.PTMP_Msg) (*idempotent_result, bool) {
+    policy := ic.policy()
+    ic.lock.Lock()
+    defer ic.lock.Unlock()
+    history, found := ic.users[user]
+    if !found {
+        history = &key_history{results: make(map[uint64]*idempotent_result)}
+        ic.users[user] = history
+    }
+    // A key that's already remembered doesn't need room making for it (and mustn't be what gets forgotten to make it).
+    now := time.Now()
+    if result, found := history.results[key]; found && (!result.finished() || now.Sub(result.stored) < policy.TTL) {
+        return result, false
+    }
+    // Forget the keys that are too old or over the limit, oldest first (which is the order they're kept in), skipping
+    // any that are still being handled.
+    over := len(history.order) - policy.Max_Keys_Per_User + 1 // how many have to go to make room for one more
+    kept := []uint64{}
+    for _, old_key := range history.order {
+        old := history.results[old_key]
+        if old.finished() && (over > 0 || now.Sub(old.stored) >= policy.TTL) {
+            delete(history.results, old_key)
+            over--
+            continue
+        }
+        kept = append(kept, old_key)
+    }
+    history.order = kept
+    if len(history.order) >= policy.Max_Keys_Per_User {
+        return nil, false
+    }
+    result := &idempotent_result{msg_type: msg.Hdr.Msg_Type_ID, payload: bytes.TrimRight(msg.Pld, "\x00"), stored: now, done: make(chan struct{})}
+    history.results[key] = result
+    history.order = append(history.order, key)
+    return result, true
+}
+
+// Whether the first message with the key has been handled yet.
+func (result *idempotent_result) finished() bool {
+    select {
+        case <-result.done:
+            return true
+        default:
+            return false
+    }
+}
+
+// Drop a key that was claimed but never answered.  The cache has to be locked.
+func (ic *IdempotencyCache) forget(user string, key uint64) {
+    history, found := ic.users[user]
+    if !found {
+        return
+    }
+    delete(history.results, key)
+    for ii, kept := range history.order {
+        if kept == key {
+            history.order = append(history.order[:ii], history.order[ii+1:]...)
+            break
+        }
+    }
+    if len(history.order) == 0 {
+        delete(ic.users, user)
+    }
+}
+
+// Passes replies along to the client, keeping a copy of each.
+type recording_writer struct {
+    ResponseWriter
+    responding_to byte
+    replies []ptmp.PTMP_Msg
+}
+
+func (rw *recording_writer) Send(msg ptmp.PTMP_Msg) error {
+    rw.replies = append(rw.replies, msg)
+    return rw.ResponseWriter.Send(msg)
+}
+
+func (rw *recording_writer) Ack(response_code uint16) error {
+    return rw.Send(ptmp.Prep_Acknowledgment(response_code, rw.responding_to))
+}
@@ -0,0 +1,144 @@
+package ptmpserver
+
+import (
+    "ajb497/ptmp"
+    "sync"
+    "testing"
+    "time"
+)
+
+func TestIdempotencyKeysAnswerRepeatsFromTheCache(t *testing.T) {
+    srv := NewServer(nil)
+    cache := NewIdempotencyCache(func() IdempotencyPolicy { return IdempotencyPolicy{Max_Keys_Per_User: 2, TTL: time.Hour} })
+    srv.Use(cache.Middleware)
+    made := 0
+    srv.HandleFunc(ptmp.CREATE_NEW_TASK, func(w ResponseWriter, r *Request) {
+        made++
+        if made > 1 {
+            w.Ack(ptmp.UNABLE_TO_COMPLY) // so that a repeat that got handled again would stand out
+            return
+        }
+        w.Ack(ptmp.SINGULAR_MSG_SUCCESS)
+    })
+    create := func(key uint64, title string) ptmp.PTMP_Msg {
+        msg := ptmp.Prep_Create_New_Task(1, 1, title, "with a key")
+        msg.Hdr.Idempotency_Key = key
+        return msg
+    }
+
+    first := &Session{State: STATE_ESTABLISHED, User: "someone"}
+    if code := serveOne(srv, first, create(7, "once")); code != ptmp.SINGULAR_MSG_SUCCESS || made != 1 {
+        t.Fatalf("First message with a key got %v, and was made %v times", code, made)
+    }
+    // the repeat usually comes in on a new connection
+    second := &Session{State: STATE_ESTABLISHED, User: "someone"}
+    if code := serveOne(srv, second, create(7, "once")); code != ptmp.SINGULAR_MSG_SUCCESS || made != 1 {
+        t.Errorf("Repeat got %v, and was made %v times", code, made)
+    }
+    if code := serveOne(srv, second, create(7, "something else")); code != ptmp.SYNTAX_ERROR || made != 1 {
+        t.Errorf("A different message reusing the key got %v, and was made %v times", code, made)
+    }
+    if code := serveOne(srv, &Session{State: STATE_ESTABLISHED, User: "someone else"}, create(7, "once")); code != ptmp.UNABLE_TO_COMPLY || made != 2 {
+        t.Errorf("Another user's key got %v, and was made %v times", code, made)
+    }
+
+    // only the last two keys are remembered
+    serveOne(srv, first, create(8, "twice"))
+    serveOne(srv, first, create(9, "thrice"))
+    if code := serveOne(srv, first, create(7, "once")); code != ptmp.UNABLE_TO_COMPLY || made != 5 {
+        t.Errorf("A forgotten key got %v, and was made %v times", code, made)
+    }
+}
+
+func TestIdempotencyKeyOfAPanicIsForgotten(t *testing.T) {
+    srv := NewServer(nil)
+    cache := NewIdempotencyCache(func() IdempotencyPolicy { return IdempotencyPolicy{Max_Keys_Per_User: 10, TTL: time.Hour} })
+    srv.Use(Recover, cache.Middleware)
+    calls := 0
+    srv.HandleFunc(ptmp.MARK_TASK_COMPLETED, func(w ResponseWriter, r *Request) {
+        calls++
+        if calls == 1 {
+            panic("not this time")
+        }
+        w.Ack(ptmp.SINGULAR_MSG_SUCCESS)
+    })
+    msg := ptmp.Prep_Mark_Task_Completed(1, 1)
+    msg.Hdr.Idempotency_Key = 42
+    session := &Session{State: STATE_ESTABLISHED, User: "someone"}
+    if code := serveOne(srv, session, msg); code != ptmp.SYNTAX_ERROR {
+        t.Errorf("A panicking handler got %v", code)
+    }
+    if code := serveOne(srv, session, msg); code != ptmp.SINGULAR_MSG_SUCCESS || calls != 2 {
+        t.Errorf("The retry of a message whose handler panicked got %v after %v calls", code, calls)
+    }
+}
+
+// Forgetting a key whose first message is still being handled would let a retry of it be made again alongside the
+// first, so a full cache forgets the oldest answered key instead, and turns new keys away while none have been.
+func TestIdempotencyKeysInFlightAreKept(t *testing.T) {
+    srv := NewServer(nil)
+    cache := NewIdempotencyCache(func() IdempotencyPolicy { return IdempotencyPolicy{Max_Keys_Per_User: 2, TTL: time.Hour} })
+    srv.Use(cache.Middleware)
+    lock := sync.Mutex{}
+    made := map[string]int{}
+    started := make(chan string)
+    release := map[string]chan struct{}{"slow": make(chan struct{}), "slower": make(chan struct{})}
+    srv.HandleFunc(ptmp.CREATE_NEW_TASK, func(w ResponseWriter, r *Request) {
+        title := string(ptmp.DecodePayload[ptmp.Create_New_Task](r.Msg.Pld).Task_Title)
+        lock.Lock()
+        made[title]++
+        times := made[title]
+        lock.Unlock()
+        if wait, found := release[title]; found && times == 1 { // (made again, it shows in the counts rather than hanging)
+            started <- title
+            <-wait
+        }
+        w.Ack(ptmp.SINGULAR_MSG_SUCCESS)
+    })
+    create := func(key uint64, title string) ptmp.PTMP_Msg {
+        msg := ptmp.Prep_Create_New_Task(1, 1, title, "with a key")
+        msg.Hdr.Idempotency_Key = key
+        return msg
+    }
+    codes := make(chan uint16, 2)
+    inFlight := func(key uint64, title string) {
+        go func() { codes <- serveOne(srv, &Session{State: STATE_ESTABLISHED, User: "someone"}, create(key, title)) }()
+        <-started
+    }
+    session := &Session{State: STATE_ESTABLISHED, User: "someone"}
+
+    // the oldest key is still being handled, so the answered one after it is what makes room
+    inFlight(1, "slow")
+    serveOne(srv, session, create(2, "quick"))
+    if code := serveOne(srv, session, create(3, "another")); code != ptmp.SINGULAR_MSG_SUCCESS {
+        t.Errorf("A new key with an answered one to make room got %v", code)
+    }
+
+    // and once both remembered keys are still being handled, there's no room for another
+    inFlight(4, "slower")
+    if code := serveOne(srv, session, create(5, "turned away")); code != ptmp.RATE_LIMITED {
+        t.Errorf("A new key while every remembered one was being handled got %v", code)
+    }
+    close(release["slow"])
+    close(release["slower"])
+    for ii := 0; ii < 2; ii++ {
+        if code := <-codes; code != ptmp.SINGULAR_MSG_SUCCESS {
+            t.Errorf("A slow message got %v", code)
+        }
+    }
+
+    // the slow message's key was kept the whole time, so its retry gets the answer rather than being made again
+    if code := serveOne(srv, session, create(1, "slow")); code != ptmp.SINGULAR_MSG_SUCCESS {
+        t.Errorf("The retry of the slow message got %v", code)
+    }
+    if code := serveOne(srv, session, create(5, "turned away")); code != ptmp.SINGULAR_MSG_SUCCESS {
+        t.Errorf("A new key once there was room again got %v", code)
+    }
+    lock.Lock()
+    defer lock.Unlock()
+    for title, times := range map[string]int{"slow": 1, "quick": 1, "another": 1, "slower": 1, "turned away": 1} {
+        if made[title] != times {
+            t.Errorf("%v was made %v times, expected %v", title, made[title], times)
+        }
+    }
+}
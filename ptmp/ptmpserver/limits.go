@@ -0,0 +1,165 @@
+package ptmpserver
+
+import (
+    "math"
+    "net"
+    "sync"
+    "time"
+)
+
+// How hard failed logins are clamped down on.  After Max_Failures failed logins in a row for a user (or from an
+// address), every further one locks out logins for that user (or from that address) for Lockout, doubling each
+// time up to Max_Lockout.  Failures are forgotten once there hasn't been one for Max_Lockout.
+type ThrottlePolicy struct {
+    Max_Failures int
+    Lockout time.Duration
+    Max_Lockout time.Duration
+}
+
+type throttle_entry struct {
+    failures int
+    last_failure time.Time
+    locked_until time.Time
+}
+
+// Keeps track of failed logins by username and by source address, so that guessing passwords gets slower and
+// slower.  Logins for a user or from an address that's locked out are refused without the credentials even being
+// looked at.  A successful login clears the user's failures, but not the address's (otherwise anyone with an
+// account could keep resetting the clock between guesses at someone else's).
+type LoginThrottle struct {
+    policy func() ThrottlePolicy
+    lock sync.Mutex
+    entries map[string]*throttle_entry
+}
+
+// A throttle that looks its policy up every time it's used, so that the policy can change while the server is running.
+func NewLoginThrottle(policy func() ThrottlePolicy) *LoginThrottle {
+    return &LoginThrottle{policy: policy, entries: make(map[string]*throttle_entry)}
+}
+
+func userKey(username string) string {
+    return "user:" + username
+}
+
+// Addresses come with whatever port the client happened to connect from, which doesn't say anything about who it is.
+func sourceKey(remote_addr string) string {
+    if host, _, err_status := net.SplitHostPort(remote_addr); err_status == nil {
+        return "addr:" + host
+    }
+    return "addr:" + remote_addr
+}
+
+// How much longer logins for this user from this address are locked out for (0 if they aren't).
+func (lt *LoginThrottle) LockedOut(username string, remote_addr string) time.Duration {
+    lt.lock.Lock()
+    defer lt.lock.Unlock()
+    now := time.Now()
+    remaining := time.Duration(0)
+    for _, key := range []string{userKey(username), sourceKey(remote_addr)} {
+        if entry, found := lt.entries[key]; found && entry.locked_until.Sub(now) > remaining {
+            remaining = entry.locked_until.Sub(now)
+        }
+    }
+    return remaining
+}
+
+// Count a failed login against both the user and the address.
+func (lt *LoginThrottle) Failed(username string, remote_addr string) {
+    policy := lt.policy()
+    lt.lock.Lock()
+    defer lt.lock.Unlock()
+    now := time.Now()
+    lt.forget(now, policy)
+    for _, key := range []string{userKey(username), sourceKey(remote_addr)} {
+        entry, found := lt.entries[key]
+        if !found {
+            entry = &throttle_entry{}
+            lt.entries[key] = entry
+        }
+        entry.failures++
+        entry.last_failure = now
+        if over := entry.failures - policy.Max_Failures; over > 0 {
+            lockout := time.Duration(float64(policy.Lockout) * math.Pow(2, float64(over-1)))
+            if lockout > policy.Max_Lockout || lockout <= 0 {
+                lockout = policy.Max_Lockout // (or it overflowed)
+            }
+            entry.locked_until = now.Add(lockout)
+        }
+    }
+}
+
+func (lt *LoginThrottle) Succeeded(username string) {
+    lt.lock.Lock()
+    defer lt.lock.Unlock()
+    delete(lt.entries, userKey(username))
+}
+
+// Drop the entries nobody has failed a login for in long enough that they'd be starting over anyway, so that the
+// map doesn't grow forever with every address that ever typoed a password.
+func (lt *LoginThrottle) forget(now time.Time, policy ThrottlePolicy) {
+    for key, entry := range lt.entries {
+        if now.After(entry.locked_until) && now.Sub(entry.last_failure) >= policy.Max_Lockout {
+            delete(lt.entries, key)
+        }
+    }
+}
+
+// How many client connections a server takes at once, and how many sessions one user can have logged in at once.
+// Zero means no limit.
+type SessionLimits struct {
+    Max_Sessions int
+    Max_Sessions_Per_User int
+}
+
+// Counts the connections being served and the sessions each user has logged in, against the server's limits.
+type session_counter struct {
+    lock sync.Mutex
+    connections int
+    per_user map[string]int
+}
+
+func (s *Server) sessionLimits() SessionLimits {
+    if s.Session_Limits == nil {
+        return SessionLimits{}
+    }
+    return s.Session_Limits()
+}
+
+// Take a connection slot, if there's one free.
+func (s *Server) admitConnection() bool {
+    limit := s.sessionLimits().Max_Sessions
+    s.sessions.lock.Lock()
+    defer s.sessions.lock.Unlock()
+    if limit > 0 && s.sessions.connections >= limit {
+        return false
+    }
+    s.sessions.connections++
+    return true
+}
+
+func (s *Server) releaseConnection() {
+    s.sessions.lock.Lock()
+    defer s.sessions.lock.Unlock()
+    s.sessions.connections--
+}
+
+// Take one of a user's session slots, if they have one free.
+func (s *Server) admitUser(username string) bool {
+    limit := s.sessionLimits().Max_Sessions_Per_User
+    s.sessions.lock.Lock()
+    defer s.sessions.lock.Unlock()
+    if limit > 0 && s.sessions.per_user[username] >= limit {
+        return false
+    }
+    s.sessions.per_user[username]++
+    return true
+}
+
+func (s *Server) releaseUser(username string) {
+    s.sessions.lock.Lock()
+    defer s.sessions.lock.Unlock()
+    s.sessions.per_user[username]--
+    if s.sessions.per_user[username] <= 0 {
+        delete(s.sessions.per_user, username)
+    }
+}
@@ -0,0 +1,167 @@
+package ptmpserver
+
+import (
+    "ajb497/ptmp"
+    "bufio"
+    "net"
+    "testing"
+    "time"
+)
+
+func loginMessage(username string, password string, extensions ...uint16) ptmp.PTMP_Msg {
+    if extensions == nil {
+        extensions = []uint16{}
+    }
+    return ptmp.Prep_Request_Connection(username, password, 0, []uint16{1}, extensions, 0)
+}
+
+// Read the one reply the server has for whatever was last sent on conn.
+func readReply(t *testing.T, conn net.Conn) *ptmp.PTMP_Msg {
+    t.Helper()
+    reply, err_status := ptmp.ReadPacket(bufio.NewReader(conn), 0)
+    if err_status != nil {
+        t.Fatalf("No reply from the server: %v", err_status)
+    }
+    return reply
+}
+
+func TestLoginThrottle(t *testing.T) {
+    srv := NewServer(func(username string, password string) (bool, bool) { return true, password == "right" })
+    srv.Login_Throttle = NewLoginThrottle(func() ThrottlePolicy {
+        return ThrottlePolicy{Max_Failures: 2, Lockout: time.Hour, Max_Lockout: 2*time.Hour}
+    })
+    login := func(username string, password string, remote_addr string) uint16 {
+        return serveOne(srv, &Session{State: STATE_AWAITING_HANDSHAKE, Remote_Addr: remote_addr}, loginMessage(username, password))
+    }
+
+    // the first couple of failures are free (and are answered with Connection_Rules, not an ack)
+    for ii := 0; ii < 2; ii++ {
+        if code := login("someone", "wrong", "192.0.2.1:1000"); code != 0 {
+            t.Fatalf("Failed login %v got %v", ii+1, code)
+        }
+    }
+    login("someone", "wrong", "192.0.2.1:1001") // the one that locks them out
+    if code := login("someone", "right", "192.0.2.2:1000"); code != ptmp.LOGIN_THROTTLED {
+        t.Errorf("The right password for a locked out user got %v instead of LOGIN_THROTTLED", code)
+    }
+    if code := login("someone else", "right", "192.0.2.1:1002"); code != ptmp.LOGIN_THROTTLED {
+        t.Errorf("Another user from a locked out address got %v instead of LOGIN_THROTTLED", code)
+    }
+    if code := login("someone else", "right", "192.0.2.3:1000"); code != 0 {
+        t.Errorf("A user who isn't locked out, from somewhere else, got %v", code)
+    }
+}
+
+// Connect and log in, returning the response code to the login (0 for Connection_Rules).
+func dialAndLogin(t *testing.T, addr string, username string) (net.Conn, uint16) {
+    t.Helper()
+    conn, err_status := net.Dial(BASE_PROTO, addr)
+    if err_status != nil {
+        t.Fatal(err_status)
+    }
+    conn.SetDeadline(time.Now().Add(5*time.Second))
+    if _, err_status = conn.Write(ptmp.EncodePacket(loginMessage(username, "right"))); err_status != nil {
+        t.Fatal(err_status)
+    }
+    reply := readReply(t, conn)
+    if reply.Hdr.Msg_Type_ID == ptmp.ACKNOWLEDGMENT {
+        return conn, ptmp.DecodePayload[ptmp.Acknowledgment](reply.Pld).Response_Code
+    }
+    return conn, 0
+}
+
+func TestSessionLimits(t *testing.T) {
+    srv := NewServer(func(username string, password string) (bool, bool) { return true, true })
+    srv.Session_Limits = func() SessionLimits { return SessionLimits{Max_Sessions: 2, Max_Sessions_Per_User: 1} }
+    listener, err_status := net.Listen(BASE_PROTO, "127.0.0.1:0")
+    if err_status != nil {
+        t.Fatal(err_status)
+    }
+    defer listener.Close()
+    go srv.Serve(listener)
+    addr := listener.Addr().String()
+
+    first, code := dialAndLogin(t, addr, "someone")
+    defer first.Close()
+    if code != 0 {
+        t.Fatalf("The first session got %v", code)
+    }
+    second, code := dialAndLogin(t, addr, "someone")
+    if code != ptmp.TOO_MANY_SESSIONS {
+        t.Errorf("A second session for the same user got %v instead of TOO_MANY_SESSIONS", code)
+    }
+    // that one is still connected though, and can log in as someone else
+    second.Write(ptmp.EncodePacket(loginMessage("someone else", "right")))
+    readReply(t, second)
+    defer second.Close()
+    third, code := dialAndLogin(t, addr, "a third person")
+    third.Close()
+    if code != ptmp.TOO_MANY_SESSIONS {
+        t.Errorf("A connection over the server's limit got %v instead of TOO_MANY_SESSIONS", code)
+    }
+}
+
+func TestMaxPayloadSize(t *testing.T) {
+    srv := NewServer(func(username string, password string) (bool, bool) { return true, true })
+    if agreed := srv.negotiatePayloadSize(60000); agreed != ptmp.MAX_PAYLOAD_SIZE {
+        t.Errorf("A server without a Max_Payload_Size agreed to %v", agreed)
+    }
+    srv.Max_Payload_Size = func() uint16 { return 2048 }
+    for proposed, expected := range map[uint16]uint16{0: 0, 100: ptmp.MAX_PAYLOAD_SIZE, 1500: 1500, 60000: 2048} {
+        if agreed := srv.negotiatePayloadSize(proposed); agreed != expected {
+            t.Errorf("Proposing %v got %v instead of %v", proposed, agreed, expected)
+        }
+    }
+
+    listener, err_status := net.Listen(BASE_PROTO, "127.0.0.1:0")
+    if err_status != nil {
+        t.Fatal(err_status)
+    }
+    defer listener.Close()
+    go srv.Serve(listener)
+    conn, err_status := net.Dial(BASE_PROTO, listener.Addr().String())
+    if err_status != nil {
+        t.Fatal(err_status)
+    }
+    defer conn.Close()
+    conn.SetDeadline(time.Now().Add(5*time.Second))
+    reader := bufio.NewReader(conn)
+    exchange := func(packet []byte) *ptmp.PTMP_Msg {
+        t.Helper()
+        if _, err_status := conn.Write(packet); err_status != nil {
+            t.Fatal(err_status)
+        }
+        reply, err_status := ptmp.ReadPacket(reader, 2048)
+        if err_status != nil {
+            t.Fatalf("No reply from the server: %v", err_status)
+        }
+        return reply
+    }
+    removal := func(num_refs int) []byte {
+        refs := make([]uint16, num_refs)
+        for ii := range refs {
+            refs[ii] = 65535 // (3 bytes each)
+        }
+        return ptmp.EncodeCompactPacket(ptmp.Prep_Remove_Tasks(true, 1, refs))
+    }
+    code := func(reply *ptmp.PTMP_Msg) uint16 {
+        return ptmp.DecodePayload[ptmp.Acknowledgment](reply.Pld).Response_Code
+    }
+
+    login := ptmp.Prep_Request_Connection("someone", "anything", 0, []uint16{1}, []uint16{}, 4096)
+    if rules := ptmp.DecodePayload[ptmp.Connection_Rules](exchange(ptmp.EncodePacket(login)).Pld); rules.Max_Payload_Size != 2048 {
+        t.Fatalf("Proposing 4096 got %v", rules.Max_Payload_Size)
+    }
+    // nothing handles removals here, so anything that gets through to the mux isn't implemented
+    if reply := exchange(removal(500)); code(reply) != ptmp.MSG_NOT_IMPLEMENTED {
+        t.Errorf("A payload bigger than MAX_PAYLOAD_SIZE but within what was agreed got %v", code(reply))
+    }
+    if reply := exchange(removal(1000)); code(reply) != ptmp.PAYLOAD_TOO_LARGE {
+        t.Errorf("A payload bigger than what was agreed got %v", code(reply))
+    }
+    // and one too big to even read in full gets the connection closed on it
+    conn.Write(removal(20000))
+    if _, err_status = ptmp.ReadPacket(reader, 2048); err_status == nil {
+        t.Errorf("The server was still answering after a payload far bigger than what was agreed")
+    }
+}
@@ -0,0 +1,184 @@
+package ptmpserver
+
+import (
+    "ajb497/ptmp"
+    "fmt"
+    "io"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+)
+
+// The upper bounds (in seconds) of the handler latency histogram's buckets.  Most messages are answered in well
+// under a millisecond, so the buckets are packed in at that end, with a few out past a second for a store that's
+// struggling to save.
+var LATENCY_BUCKETS = []float64{0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5}
+
+// How many messages of one type were answered with one response code (0 for ones answered with information
+// messages rather than an ack), and how long they took altogether.
+type MetricSample struct {
+    Msg_Type byte
+    Response_Code uint16
+    Count uint64
+    Total_Time time.Duration
+}
+
+// How long handling one type of message has taken: Buckets[ii] counts the ones that took no more than
+// LATENCY_BUCKETS[ii] seconds (and isn't cumulative; the Prometheus output adds them up).
+type latency_histogram struct {
+    Buckets []uint64
+    Count uint64
+    Sum time.Duration
+}
+
+// Everything the server counts about itself.  Its Middleware counts messages by type and response code, handler
+// latency and failed logins; a Server with Metrics set counts sessions and bytes on the wire into it too.
+// Snapshot reads the message counts back, and WritePrometheus writes the lot out for Prometheus to scrape.
+type Metrics struct {
+    lock sync.Mutex
+    samples map[[2]uint16]*MetricSample
+    latencies map[byte]*latency_histogram
+    active_sessions int64
+    sessions_total uint64
+    handshake_failures uint64
+    bytes_in uint64
+    bytes_out uint64
+}
+
+func NewMetrics() *Metrics {
+    return &Metrics{samples: make(map[[2]uint16]*MetricSample), latencies: make(map[byte]*latency_histogram)}
+}
+
+func (m *Metrics) Middleware(next Handler) Handler {
+    return HandlerFunc(func(w ResponseWriter, r *Request) {
+        started := time.Now()
+        next.ServePTMP(w, r)
+        elapsed := time.Since(started)
+
+        m.lock.Lock()
+        defer m.lock.Unlock()
+        key := [2]uint16{uint16(r.Msg.Hdr.Msg_Type_ID), w.ResponseCode()}
+        sample, found := m.samples[key]
+        if !found {
+            sample = &MetricSample{Msg_Type: r.Msg.Hdr.Msg_Type_ID, Response_Code: w.ResponseCode()}
+            m.samples[key] = sample
+        }
+        sample.Count++
+        sample.Total_Time += elapsed
+
+        histogram, found := m.latencies[r.Msg.Hdr.Msg_Type_ID]
+        if !found {
+            histogram = &latency_histogram{Buckets: make([]uint64, len(LATENCY_BUCKETS))}
+            m.latencies[r.Msg.Hdr.Msg_Type_ID] = histogram
+        }
+        for ii, bound := range LATENCY_BUCKETS {
+            if elapsed.Seconds() <= bound {
+                histogram.Buckets[ii]++
+                break
+            }
+        }
+        histogram.Count++
+        histogram.Sum += elapsed
+
+        // the handshake handler only names the session's user once the credentials check out
+        if r.Msg.Hdr.Msg_Type_ID == ptmp.REQUEST_CONNECTION && r.Session.User == "" {
+            m.handshake_failures++
+        }
+    })
+}
+
+func (m *Metrics) sessionStarted() {
+    m.lock.Lock()
+    defer m.lock.Unlock()
+    m.active_sessions++
+    m.sessions_total++
+}
+
+func (m *Metrics) sessionEnded() {
+    m.lock.Lock()
+    defer m.lock.Unlock()
+    m.active_sessions--
+}
+
+func (m *Metrics) countBytes(in int, out int) {
+    m.lock.Lock()
+    defer m.lock.Unlock()
+    m.bytes_in += uint64(in)
+    m.bytes_out += uint64(out)
+}
+
+// How many client connections are being served right now.
+func (m *Metrics) ActiveSessions() int64 {
+    m.lock.Lock()
+    defer m.lock.Unlock()
+    return m.active_sessions
+}
+
+// Every count so far, ordered by message type and then response code.
+func (m *Metrics) Snapshot() []MetricSample {
+    m.lock.Lock()
+    defer m.lock.Unlock()
+    samples := make([]MetricSample, 0, len(m.samples))
+    for _, sample := range m.samples {
+        samples = append(samples, *sample)
+    }
+    sort.Slice(samples, func(ii, jj int) bool {
+        if samples[ii].Msg_Type != samples[jj].Msg_Type {
+            return samples[ii].Msg_Type < samples[jj].Msg_Type
+        }
+        return samples[ii].Response_Code < samples[jj].Response_Code
+    })
+    return samples
+}
+
+// Write every metric out in the Prometheus text exposition format, each named with the given prefix (e.g. "ptmp_").
+func (m *Metrics) WritePrometheus(w io.Writer, prefix string) error {
+    samples := m.Snapshot()
+    m.lock.Lock()
+    msg_types := make([]byte, 0, len(m.latencies))
+    latencies := make(map[byte]latency_histogram, len(m.latencies))
+    for msg_type, histogram := range m.latencies {
+        msg_types = append(msg_types, msg_type)
+        latencies[msg_type] = latency_histogram{Buckets: append([]uint64{}, histogram.Buckets...), Count: histogram.Count, Sum: histogram.Sum}
+    }
+    active_sessions, sessions_total, handshake_failures, bytes_in, bytes_out := m.active_sessions, m.sessions_total, m.handshake_failures, m.bytes_in, m.bytes_out
+    m.lock.Unlock()
+    sort.Slice(msg_types, func(ii, jj int) bool { return msg_types[ii] < msg_types[jj] })
+
+    var out strings.Builder
+    WritePrometheusMetric(&out, prefix + "active_sessions", "gauge", "Client connections being served right now.", float64(active_sessions))
+    WritePrometheusMetric(&out, prefix + "sessions_total", "counter", "Client connections served since the server started.", float64(sessions_total))
+    WritePrometheusMetric(&out, prefix + "handshake_failures_total", "counter", "Logins refused for a bad username or password.", float64(handshake_failures))
+    WritePrometheusMetric(&out, prefix + "received_bytes_total", "counter", "Bytes read from client connections.", float64(bytes_in))
+    WritePrometheusMetric(&out, prefix + "sent_bytes_total", "counter", "Bytes written to client connections.", float64(bytes_out))
+
+    fmt.Fprintf(&out, "# HELP %vmessages_total Messages handled, by type and the response code they were answered with (0 for no ack).\n", prefix)
+    fmt.Fprintf(&out, "# TYPE %vmessages_total counter\n", prefix)
+    for _, sample := range samples {
+        fmt.Fprintf(&out, "%vmessages_total{msg_type=%q,response_code=\"%v\"} %v\n", prefix, MsgTypeName(sample.Msg_Type), sample.Response_Code, sample.Count)
+    }
+
+    fmt.Fprintf(&out, "# HELP %vhandler_duration_seconds How long messages took to handle, by type.\n", prefix)
+    fmt.Fprintf(&out, "# TYPE %vhandler_duration_seconds histogram\n", prefix)
+    for _, msg_type := range msg_types {
+        histogram := latencies[msg_type]
+        name := MsgTypeName(msg_type)
+        cumulative := uint64(0)
+        for ii, bound := range LATENCY_BUCKETS {
+            cumulative += histogram.Buckets[ii]
+            fmt.Fprintf(&out, "%vhandler_duration_seconds_bucket{msg_type=%q,le=\"%v\"} %v\n", prefix, name, bound, cumulative)
+        }
+        fmt.Fprintf(&out, "%vhandler_duration_seconds_bucket{msg_type=%q,le=\"+Inf\"} %v\n", prefix, name, histogram.Count)
+        fmt.Fprintf(&out, "%vhandler_duration_seconds_sum{msg_type=%q} %v\n", prefix, name, histogram.Sum.Seconds())
+        fmt.Fprintf(&out, "%vhandler_duration_seconds_count{msg_type=%q} %v\n", prefix, name, histogram.Count)
+    }
+    _, err_status := io.WriteString(w, out.String())
+    return err_status
+}
+
+// Write a single unlabeled gauge or counter in the Prometheus text format, for programs embedding the server that
+// have numbers of their own to add after WritePrometheus.
+func WritePrometheusMetric(w io.Writer, name string, metric_type string, help string, value float64) {
+    fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v %v\n%v %v\n", name, help, name, metric_type, name, value)
+}
@@ -0,0 +1,124 @@
+package ptmpserver
+
+import (
+    "context"
+    "fmt"
+    "ajb497/ptmp"
+    "log/slog"
+    "runtime/debug"
+    "sync"
+    "time"
+)
+
+// Turns a panic in a handler into a SYNTAX_ERROR ack (almost always a payload that didn't decode into what its
+// message type said it was), so that one bad message can't take the whole server down.  The panic and where it
+// happened get logged through the request's logger.
+func Recover(next Handler) Handler {
+    return HandlerFunc(func(w ResponseWriter, r *Request) {
+        defer func() {
+            if recovered := recover(); recovered != nil {
+                r.Logger().Error("Recovered from a panic in a handler", "panic", fmt.Sprint(recovered), "stack", string(debug.Stack()))
+                w.Ack(ptmp.SYNTAX_ERROR)
+            }
+        }()
+        next.ServePTMP(w, r)
+    })
+}
+
+// Writes one access log line for every message: what it was, who sent it, how it was answered and how long that
+// took.  It goes to its own logger so that the access log can be kept apart from everything else.
+func AccessLog(logger *slog.Logger) Middleware {
+    return func(next Handler) Handler {
+        return HandlerFunc(func(w ResponseWriter, r *Request) {
+            next.ServePTMP(w, r)
+            level := slog.LevelInfo
+            if r.Msg.Hdr.Msg_Type_ID == ptmp.PING {
+                level = slog.LevelDebug // heartbeats would drown out everything else
+            }
+            logger.LogAttrs(context.Background(), level, "access", sessionAttrs(r.Session),
+                            slog.String("msg_type", MsgTypeName(r.Msg.Hdr.Msg_Type_ID)),
+                            slog.Int("to_follow", int(r.Msg.Hdr.Msgs_To_Follow)),
+                            slog.Int("response_code", int(w.ResponseCode())),
+                            slog.Duration("duration", time.Since(r.Received)),
+                            slog.String("state", r.Session.State.String()))
+        })
+    }
+}
+
+// Rejects anything but a Request_Connection from a session that hasn't logged in.  A Server's transition table
+// already does this for messages coming in on a connection, but handlers can also be reached by running messages
+// through a Mux directly, and this keeps them behind a login either way.
+func RequireLogin(next Handler) Handler {
+    return HandlerFunc(func(w ResponseWriter, r *Request) {
+        if r.Msg.Hdr.Msg_Type_ID != ptmp.REQUEST_CONNECTION && !r.Session.LoggedIn() {
+            w.Ack(ptmp.MSG_CONTEXT_INVALID)
+            return
+        }
+        next.ServePTMP(w, r)
+    })
+}
+
+// How often RateLimitFunc looks through its buckets for ones it can forget.
+const RATE_LIMIT_SWEEP_INTERVAL time.Duration = time.Minute
+
+// Limits how many messages a session can send, as a token bucket: a session can send burst messages at once,
+// and then rate messages a second after that.  Messages over the limit are answered with RATE_LIMITED
+// without being handled.  Sessions with the same Rate_Limit_Key share a bucket.
+func RateLimit(rate float64, burst int) Middleware {
+    return RateLimitFunc(func() (float64, int) { return rate, burst })
+}
+
+// Like RateLimit, but the rate and burst are looked up for every message, so that they can change while the
+// server is running.
+func RateLimitFunc(limits func() (float64, int)) Middleware {
+    type bucket struct {
+        tokens float64
+        last time.Time
+    }
+    lock := sync.Mutex{}
+    buckets := make(map[interface{}]*bucket) // keyed by the *Session, or by its Rate_Limit_Key if it has one
+    last_sweep := time.Now()
+    return func(next Handler) Handler {
+        return HandlerFunc(func(w ResponseWriter, r *Request) {
+            var key interface{} = r.Session
+            if r.Session.Rate_Limit_Key != "" {
+                key = r.Session.Rate_Limit_Key
+            }
+            rate, burst := limits()
+            lock.Lock()
+            now := time.Now()
+            b, found := buckets[key]
+            if !found {
+                b = &bucket{tokens: float64(burst), last: now}
+                buckets[key] = b
+            }
+            b.tokens += now.Sub(b.last).Seconds() * rate
+            if b.tokens > float64(burst) {
+                b.tokens = float64(burst)
+            }
+            b.last = now
+            allowed := b.tokens >= 1
+            if allowed {
+                b.tokens--
+            }
+            // Every so often, forget about the buckets that have been quiet long enough to be full again anyway
+            // (which includes every session that's gone).  Doing it on every message would mean walking all of
+            // them, under the lock, for each one.
+            if now.Sub(last_sweep) >= RATE_LIMIT_SWEEP_INTERVAL {
+                for other_key, other := range buckets {
+                    if now.Sub(other.last).Seconds()*rate >= float64(burst) {
+                        delete(buckets, other_key)
+                    }
+                }
+                last_sweep = now
+            }
+            lock.Unlock()
+
+            if !allowed {
+                w.Ack(ptmp.RATE_LIMITED)
+                return
+            }
+            next.ServePTMP(w, r)
+        })
+    }
+}
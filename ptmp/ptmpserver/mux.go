@@ -0,0 +1,162 @@
+package ptmpserver
+
+import (
+    "context"
+    "ajb497/ptmp"
+    "ajb497/ptmp/ptmplog"
+    "log/slog"
+    "sort"
+    "sync"
+    "time"
+)
+
+// One message from a client, along with the session it came in on.
+type Request struct {
+    Msg *ptmp.PTMP_Msg
+    Session *Session
+    Received time.Time
+    Context context.Context // cancelled when the connection goes away; middleware can hang values off of it for the handlers inside
+    Log *slog.Logger // with the session and message type already attached, for handlers to log through
+    // On the last change of a transaction, every change in it (this one included), which the server has just made
+    // (or not) all together.  Middleware that wants to know what a message did should look here.
+    Transaction []*ptmp.PTMP_Msg
+}
+
+// The request's logger, or one that throws everything away if it doesn't have one.
+func (r *Request) Logger() *slog.Logger {
+    if r.Log == nil {
+        return ptmplog.Discard()
+    }
+    return r.Log
+}
+
+// How a handler answers a message.  Ack sends an Acknowledgment responding to the request's message type, and
+// ResponseCode reports the code of the last one sent (0 if there hasn't been one, e.g. a query answered with
+// information messages), which is what middleware like logging and metrics go by.  A Detailed_Acknowledgment
+// counts the same as an Acknowledgment, and a Transaction_Failure counts as CONDITIONAL_ORDER_FAILURE, since that's
+// what happened to the transaction as a whole.
+type ResponseWriter interface {
+    Send(msg ptmp.PTMP_Msg) error
+    Ack(response_code uint16) error
+    ResponseCode() uint16
+}
+
+// Handles one type of message.  Handlers for queries send information messages (following Msgs_To_Follow like the
+// client expects), and everything else answers with an ack.
+type Handler interface {
+    ServePTMP(w ResponseWriter, r *Request)
+}
+
+// Lets a plain function be used as a Handler.
+type HandlerFunc func(w ResponseWriter, r *Request)
+
+func (f HandlerFunc) ServePTMP(w ResponseWriter, r *Request) {
+    f(w, r)
+}
+
+// Wraps a handler with something that happens around every message (logging, metrics, rate limiting, ...).
+type Middleware func(next Handler) Handler
+
+// Wrap a handler in middleware, with the first one given ending up outermost (so it sees the message first and the
+// reply last).
+func Chain(handler Handler, middleware ...Middleware) Handler {
+    for ii := len(middleware)-1; ii >= 0; ii-- {
+        handler = middleware[ii](handler)
+    }
+    return handler
+}
+
+// Sends each message to the handler registered for its type.  Message types nobody registered are answered with
+// MSG_NOT_IMPLEMENTED.
+type Mux struct {
+    lock sync.RWMutex
+    handlers map[byte]Handler
+}
+
+func NewMux() *Mux {
+    return &Mux{handlers: make(map[byte]Handler)}
+}
+
+// Register the handler for a message type, replacing whatever was registered for it before.
+func (m *Mux) Handle(msg_type byte, handler Handler) {
+    m.lock.Lock()
+    defer m.lock.Unlock()
+    m.handlers[msg_type] = handler
+}
+
+func (m *Mux) HandleFunc(msg_type byte, handler func(w ResponseWriter, r *Request)) {
+    m.Handle(msg_type, HandlerFunc(handler))
+}
+
+// The handler registered for a message type, if there is one.
+func (m *Mux) Handler(msg_type byte) (Handler, bool) {
+    m.lock.RLock()
+    defer m.lock.RUnlock()
+    handler, found := m.handlers[msg_type]
+    return handler, found
+}
+
+// The message types that have a handler registered, in order.
+func (m *Mux) MsgTypes() []byte {
+    m.lock.RLock()
+    defer m.lock.RUnlock()
+    msg_types := make([]byte, 0, len(m.handlers))
+    for msg_type := range m.handlers {
+        msg_types = append(msg_types, msg_type)
+    }
+    sort.Slice(msg_types, func(ii, jj int) bool { return msg_types[ii] < msg_types[jj] })
+    return msg_types
+}
+
+func (m *Mux) ServePTMP(w ResponseWriter, r *Request) {
+    handler, found := m.Handler(r.Msg.Hdr.Msg_Type_ID)
+    if !found {
+        w.Ack(ptmp.MSG_NOT_IMPLEMENTED)
+        return
+    }
+    handler.ServePTMP(w, r)
+}
+
+// A ResponseWriter that keeps the replies instead of sending them anywhere, for running messages through a server
+// from somewhere other than a client connection (the HTTP gateway, tests).
+type Recorder struct {
+    Replies []*ptmp.PTMP_Msg
+    responding_to byte
+    response_code uint16
+}
+
+// A recorder for the replies to a message of the given type (which is what its acks will say they're responding to).
+func NewRecorder(responding_to byte) *Recorder {
+    return &Recorder{responding_to: responding_to}
+}
+
+func (rec *Recorder) Send(msg ptmp.PTMP_Msg) error {
+    if response_code, has_code := responseCodeOf(&msg); has_code {
+        rec.response_code = response_code
+    }
+    rec.Replies = append(rec.Replies, &msg)
+    return nil
+}
+
+func (rec *Recorder) Ack(response_code uint16) error {
+    return rec.Send(ptmp.Prep_Acknowledgment(response_code, rec.responding_to))
+}
+
+func (rec *Recorder) ResponseCode() uint16 {
+    return rec.response_code
+}
+
+// The response code a reply carries, for the replies that carry one.
+func responseCodeOf(msg *ptmp.PTMP_Msg) (uint16, bool) {
+    switch msg.Hdr.Msg_Type_ID {
+        case ptmp.ACKNOWLEDGMENT:
+            return ptmp.DecodePayload[ptmp.Acknowledgment](msg.Pld).Response_Code, true
+        case ptmp.DETAILED_ACKNOWLEDGMENT:
+            return ptmp.DecodePayload[ptmp.Detailed_Acknowledgment](msg.Pld).Response_Code, true
+        case ptmp.TRANSACTION_FAILURE:
+            return ptmp.CONDITIONAL_ORDER_FAILURE, true
+        case ptmp.PONG:
+            return ptmp.SINGULAR_MSG_SUCCESS, true // (so that the access log doesn't make it look like pings went unanswered)
+    }
+    return 0, false
+}
@@ -0,0 +1,100 @@
+package ptmpserver
+
+import (
+    "ajb497/ptmp"
+    "testing"
+    "time"
+)
+
+const CUSTOM_MSG_TYPE byte = 99
+
+// Run a message through a server the way a connection would, and return the response code it was answered with.
+func serveOne(srv *Server, session *Session, msg ptmp.PTMP_Msg) uint16 {
+    recorder := NewRecorder(msg.Hdr.Msg_Type_ID)
+    srv.ServeMessage(recorder, &Request{Msg: &msg, Session: session, Received: time.Now()})
+    return recorder.ResponseCode()
+}
+
+func customMessage() ptmp.PTMP_Msg {
+    msg := ptmp.PTMP_Msg{}
+    msg.Hdr.Protocol_Version = 1
+    msg.Hdr.Msg_Type_ID = CUSTOM_MSG_TYPE
+    return msg
+}
+
+func TestCustomMessageTypes(t *testing.T) {
+    srv := NewServer(func(username string, password string) (bool, bool) { return true, true })
+    unregistered := customMessage()
+    if code := serveOne(srv, &Session{State: STATE_ESTABLISHED}, unregistered); code != ptmp.MSG_NOT_IMPLEMENTED {
+        t.Errorf("An unregistered message type got %v instead of MSG_NOT_IMPLEMENTED", code)
+    }
+
+    srv.HandleFunc(CUSTOM_MSG_TYPE, func(w ResponseWriter, r *Request) {
+        w.Ack(ptmp.TEAPOT)
+    })
+    if code := serveOne(srv, &Session{State: STATE_ESTABLISHED}, customMessage()); code != ptmp.TEAPOT {
+        t.Errorf("A registered custom message type got %v instead of its handler's TEAPOT", code)
+    }
+    // registering it put it in the table, so now it's a message we know but not before logging in
+    if code := serveOne(srv, &Session{State: STATE_AWAITING_HANDSHAKE}, customMessage()); code != ptmp.MSG_CONTEXT_INVALID {
+        t.Errorf("A custom message type before logging in got %v instead of MSG_CONTEXT_INVALID", code)
+    }
+}
+
+func TestMiddlewareOrder(t *testing.T) {
+    order := []string{}
+    tag := func(name string) Middleware {
+        return func(next Handler) Handler {
+            return HandlerFunc(func(w ResponseWriter, r *Request) {
+                order = append(order, name)
+                next.ServePTMP(w, r)
+            })
+        }
+    }
+    handler := Chain(HandlerFunc(func(w ResponseWriter, r *Request) { order = append(order, "handler") }), tag("outer"), tag("inner"))
+    msg := customMessage()
+    handler.ServePTMP(NewRecorder(CUSTOM_MSG_TYPE), &Request{Msg: &msg, Session: &Session{}})
+    if len(order) != 3 || order[0] != "outer" || order[1] != "inner" || order[2] != "handler" {
+        t.Errorf("Middleware ran in the order %v", order)
+    }
+}
+
+func TestRecoverAndRateLimit(t *testing.T) {
+    srv := NewServer(nil)
+    srv.Use(Recover, RateLimit(0, 2))
+    srv.HandleFunc(CUSTOM_MSG_TYPE, func(w ResponseWriter, r *Request) {
+        panic("handler fell over")
+    })
+    session := &Session{State: STATE_ESTABLISHED}
+    if code := serveOne(srv, session, customMessage()); code != ptmp.SYNTAX_ERROR {
+        t.Errorf("A panicking handler got %v instead of SYNTAX_ERROR", code)
+    }
+    serveOne(srv, session, customMessage())
+    if code := serveOne(srv, session, customMessage()); code != ptmp.RATE_LIMITED {
+        t.Errorf("The message over the rate limit got %v instead of RATE_LIMITED", code)
+    }
+    if code := serveOne(srv, &Session{State: STATE_ESTABLISHED}, customMessage()); code != ptmp.SYNTAX_ERROR {
+        t.Errorf("Another session was rate limited along with the first one (got %v)", code)
+    }
+}
+
+func TestRateLimitSharedKey(t *testing.T) {
+    srv := NewServer(nil)
+    srv.Use(RateLimit(0, 2))
+    srv.HandleFunc(CUSTOM_MSG_TYPE, func(w ResponseWriter, r *Request) {
+        w.Ack(ptmp.SINGULAR_MSG_SUCCESS)
+    })
+    // (a fresh Session for every message, the way the HTTP gateway makes them)
+    shared := func() *Session { return &Session{State: STATE_ESTABLISHED, Rate_Limit_Key: "gateway Ed"} }
+    for ii := 0; ii < 2; ii++ {
+        if code := serveOne(srv, shared(), customMessage()); code != ptmp.SINGULAR_MSG_SUCCESS {
+            t.Errorf("Message %v within the burst got %v", ii, code)
+        }
+    }
+    if code := serveOne(srv, shared(), customMessage()); code != ptmp.RATE_LIMITED {
+        t.Errorf("A third session with the same key got %v instead of RATE_LIMITED", code)
+    }
+    if code := serveOne(srv, &Session{State: STATE_ESTABLISHED, Rate_Limit_Key: "gateway Al"}, customMessage()); code != ptmp.SINGULAR_MSG_SUCCESS {
+        t.Errorf("A session with another key was rate limited along with them (got %v)", code)
+    }
+}
@@ -0,0 +1,565 @@
+// Package ptmpserver is the protocol side of a PTMP server: it accepts connections, keeps track of where each
+// session is in the protocol's DFA, handles logging in and closing, and hands every other message to the handler
+// registered for its type.  What the messages actually do (keeping task lists, in our case) is up to the handlers,
+// so the same server can be embedded in other programs and given message types of its own:
+//
+//	srv := ptmpserver.NewServer(func(username string, password string) (bool, bool) {
+//	    return username == "someone", password == "their password"
+//	})
+//	srv.Logger = slog.Default()
+//	srv.Use(ptmpserver.Recover, ptmpserver.AccessLog(slog.Default()), ptmpserver.RequireLogin)
+//	srv.HandleFunc(ptmp.QUERY_TASKS, func(w ptmpserver.ResponseWriter, r *ptmpserver.Request) {
+//	    w.Ack(ptmp.UNABLE_TO_COMPLY) // nothing to see here
+//	})
+//	srv.Login_Throttle = ptmpserver.NewLoginThrottle(func() ptmpserver.ThrottlePolicy {
+//	    return ptmpserver.ThrottlePolicy{Max_Failures: 5, Lockout: time.Second, Max_Lockout: 15*time.Minute}
+//	})
+//	listener, _ := net.Listen("tcp", "localhost:10101")
+//	srv.Serve(listener)
+package ptmpserver
+
+import (
+    "bufio"
+    "context"
+    "errors"
+    "ajb497/ptmp"
+    "ajb497/ptmp/ptmplog"
+    "log/slog"
+    "math/rand"
+    "net"
+    "strings"
+    "sync"
+    "time"
+    "unicode/utf8"
+)
+
+const BASE_PROTO string = "tcp"
+// Slow down between the messages of a multi-message response, since the client reads each one with a single Read.
+const DEFAULT_REPLY_PACING time.Duration = 250*time.Millisecond
+
+type Server struct {
+    // Checks a username and password from a Request_Connection, saying whether each of them was any good.
+    Authenticate func(username string, password string) (bool, bool)
+    // The newest protocol version the server speaks (it speaks every one from 1 up to it).  Each session gets the
+    // newest one that its client offered too.
+    Protocol_Version uint16
+    // What the server calls itself (name and version, say) when a client asks for its capabilities.
+    Version string
+    // The limits on tasks that clients are told about when they ask for the server's capabilities, looked up every
+    // time they ask (so they can change while the server is running).  The server doesn't enforce them itself,
+    // that's up to the handlers.  Nil means the most the messages allow for, and no limit on tasks.
+    Task_Limits func() TaskLimits
+    // The largest payload a client can agree to in its handshake, looked up at every login (so it can change while
+    // the server is running, for sessions that log in afterwards).  Nil means MAX_PAYLOAD_SIZE, so that clients
+    // only get the variable-length framing and not any more room.
+    Max_Payload_Size func() uint16
+    // The protocol extensions (ptmp.EXT_*) the server is willing to use.  Each session gets whichever of these its
+    // client offered when it logged in.
+    Extensions []uint16
+    // Which messages are allowed in which session state.  Handle adds an edge for any message type it hasn't
+    // seen before, so this only needs changing for messages that should be allowed somewhere other than once
+    // the session is established.
+    Transitions []Transition
+    Reply_Pacing time.Duration
+    Idle_Timeout time.Duration // a session that sends nothing for this long gets disconnected (0 for never)
+    // Connections coming and going, every message sent and received (at debug level), and anything else the server
+    // has to say.  Nil means nothing gets logged.
+    Logger *slog.Logger
+    // If set, sessions and bytes sent and received get counted into it.  (Messages only get counted if its
+    // Middleware is in use too.)
+    Metrics *Metrics
+    // If set, failed logins lock the user and the address they came from out for longer and longer.
+    Login_Throttle *LoginThrottle
+    // How many connections and sessions per user to allow at once, looked up whenever a client connects or logs
+    // in (so it can change while the server is running).  Nil means no limits.
+    Session_Limits func() SessionLimits
+    // If set, sessions that agree to ptmp.EXT_SESSION_RESUMPTION get a token in their Connection_Rules that lets
+    // them log back in on a new connection without sending their password again.  Servers using it should list
+    // the extension in Extensions.
+    Session_Tokens *SessionTokens
+    // Makes the changes of a transaction all-or-nothing.  It's given a function that runs each change through its
+    // handler, and has to undo whatever that did if it returns false (or panics).  It's called from inside the
+    // middleware for the last change of the transaction, so anything the middleware holds (a lock on the store,
+    // say) is held for the whole transaction.  Nil means the server doesn't take transactions, and answers them
+    // with MSG_NOT_IMPLEMENTED.
+    Atomically func(apply func() bool)
+
+    lock sync.Mutex
+    sessions session_counter
+    tracker conn_tracker
+    mux *Mux
+    middleware []Middleware
+    handler Handler
+}
+
+// A server that answers logins with authenticate and closes connections when asked, and doesn't do anything else
+// until it's given handlers.
+func NewServer(authenticate func(username string, password string) (bool, bool)) *Server {
+    s := &Server{
+                 Authenticate: authenticate,
+                 Protocol_Version: uint16(ptmp.CURR_PROTOCOL_VERSION),
+                 Transitions: DefaultTransitions(),
+                 Reply_Pacing: DEFAULT_REPLY_PACING,
+                 mux: NewMux(),
+                 sessions: session_counter{per_user: make(map[string]int)},
+                }
+    s.mux.HandleFunc(ptmp.REQUEST_CONNECTION, s.handshake)
+    s.mux.HandleFunc(ptmp.CLOSE_CONNECTION, closeConnection)
+    s.mux.HandleFunc(ptmp.PING, s.pong)
+    s.mux.HandleFunc(ptmp.QUERY_CAPABILITIES, s.capabilities)
+    s.mux.HandleFunc(ptmp.TRANSACTION, s.beginTransaction)
+    s.handler = HandlerFunc(s.dispatch)
+    return s
+}
+
+// Register the handler for a message type.  A type the transition table doesn't know about yet is allowed once
+// the session is established (and doesn't change its state), which is what custom message types usually want.
+func (s *Server) Handle(msg_type byte, handler Handler) {
+    s.lock.Lock()
+    defer s.lock.Unlock()
+    if !knownMsgType(s.Transitions, msg_type) {
+        s.Transitions = append(s.Transitions, Transition{From: STATE_ESTABLISHED, Msg_Type: msg_type, To: STATE_ESTABLISHED})
+    }
+    s.mux.Handle(msg_type, handler)
+}
+
+func (s *Server) HandleFunc(msg_type byte, handler func(w ResponseWriter, r *Request)) {
+    s.Handle(msg_type, HandlerFunc(handler))
+}
+
+// Add middleware around every message the server handles (including logins, closes and messages the session
+// isn't allowed to send, so that things like logging and rate limiting see those too).  The first middleware
+// added is the outermost.
+func (s *Server) Use(middleware ...Middleware) {
+    s.lock.Lock()
+    defer s.lock.Unlock()
+    s.middleware = append(s.middleware, middleware...)
+    s.handler = Chain(HandlerFunc(s.dispatch), s.middleware...)
+}
+
+func (s *Server) logger() *slog.Logger {
+    if s.Logger == nil {
+        return ptmplog.Discard()
+    }
+    return s.Logger
+}
+
+// Run one message through the middleware, the DFA and its handler.  Replies go to w, and the session is moved
+// along to whatever state the message leaves it in.  If the request doesn't have a logger of its own yet, it gets
+// the server's, with who the message is from and what it is attached.
+func (s *Server) ServeMessage(w ResponseWriter, r *Request) {
+    if r.Log == nil {
+        r.Log = s.logger().With(sessionAttrs(r.Session), slog.String("msg_type", MsgTypeName(r.Msg.Hdr.Msg_Type_ID)))
+    }
+    s.lock.Lock()
+    handler := s.handler
+    s.lock.Unlock()
+    handler.ServePTMP(w, r)
+}
+
+// The innermost handler: check the message against the transition table, hand it to the mux, and follow the edge.
+func (s *Server) dispatch(w ResponseWriter, r *Request) {
+    s.lock.Lock()
+    table := s.Transitions
+    s.lock.Unlock()
+
+    msg_type := r.Msg.Hdr.Msg_Type_ID
+    next_state, permitted := r.Session.nextState(table, r.Msg)
+    if !permitted && r.Session.State == STATE_TRANSACTION_IN_PROGRESS {
+        s.abortTransaction(w, r, table, r.Session.rejectionFor(table, msg_type))
+        return
+    }
+    if !permitted {
+        // Either you sent a message with an ID in the header that I do not yet have a server implementation to handle, or
+        // it's one we know but not in this state (e.g. anything other than a Request_Connection before the handshake is done).
+        w.Ack(r.Session.rejectionFor(table, msg_type))
+        return
+    }
+    if r.Session.State == STATE_TRANSACTION_IN_PROGRESS {
+        s.stageChange(w, r, table, next_state)
+        return
+    }
+    s.mux.ServePTMP(w, r)
+
+    // The login handler only fills in the user once the credentials check out.
+    if msg_type == ptmp.REQUEST_CONNECTION && r.Session.User != "" {
+        next_state = STATE_ESTABLISHED
+    }
+    // And a transaction only gets started if the server takes them, and the Transaction made sense.
+    if msg_type == ptmp.TRANSACTION && w.ResponseCode() != ptmp.CONDITIONAL_SUCCESS {
+        next_state = STATE_ESTABLISHED
+    }
+    if !r.Session.moveTo(table, msg_type, false, next_state) {
+        r.Log.Error("The session state table has no transition for this message", "from", r.Session.State, "to", next_state)
+    }
+    if r.Session.State == STATE_CLOSING {
+        // any ack the client wanted has gone out by now, so we're done with this connection
+        r.Session.moveTo(table, msg_type, true, STATE_CLOSED)
+    }
+}
+
+func byteArray2Str(in_bytes []byte) string {
+    // Used for handling the fixed arrays of a version 1 Request_Connection as strings, and removes the null bytes they were padded out with.
+    return strings.TrimRight(string(in_bytes[:]), "\x00")
+}
+
+// A Request_Connection in whichever version its header says it is, as a Request_Connection_V2 (with the padding
+// of the version 1 fixed arrays trimmed off).
+func loginContents(msg *ptmp.PTMP_Msg) *ptmp.Request_Connection_V2 {
+    if msg.Hdr.Protocol_Version >= ptmp.PROTOCOL_VERSION_2 {
+        return ptmp.DecodePayload[ptmp.Request_Connection_V2](msg.Pld)
+    }
+    v1 := ptmp.DecodePayload[ptmp.Request_Connection](msg.Pld)
+    username, password := byteArray2Str(v1.Username[:]), byteArray2Str(v1.Password[:])
+    return &ptmp.Request_Connection_V2{
+                                       Length_of_Username: byte(len(username)),
+                                       Username: []byte(username),
+                                       Length_of_Password: byte(len(password)),
+                                       Password: []byte(password),
+                                       Timeout_Rule_Request: v1.Timeout_Rule_Request,
+                                       Client_Number_Versions_Supported: v1.Client_Number_Versions_Supported,
+                                       Client_Protocol_Versions_Supported: v1.Client_Protocol_Versions_Supported,
+                                       Number_Extensions_Supported: v1.Number_Extensions_Supported,
+                                       Extensions_Supported: v1.Extensions_Supported,
+                                       Session_Token: v1.Session_Token,
+                                       Max_Payload_Size: v1.Max_Payload_Size,
+                                      }
+}
+
+// The newest protocol version that the client offered and the server speaks (0 if there isn't one).  A client that
+// didn't offer any is from before there was more than one, and speaks version 1.
+func (s *Server) negotiateVersion(offered []uint16) uint16 {
+    if len(offered) == 0 {
+        return uint16(ptmp.PROTOCOL_VERSION_1)
+    }
+    chosen := uint16(0)
+    for _, version := range offered {
+        if version >= uint16(ptmp.PROTOCOL_VERSION_1) && version <= s.Protocol_Version && version > chosen {
+            chosen = version
+        }
+    }
+    return chosen
+}
+
+// We still send a connection rules message in response even if the username and password are not valid, but we do
+// note that fact in the response message.  The connection is only considered established once the username and
+// password combo checks-out, otherwise, the client will need to send another connection request and retry.  A
+// request with a Session_Token in it is resuming a session instead, and the token is checked rather than the password.
+// Credentials that aren't UTF-8 are answered with INVALID_NAME, and a client that doesn't speak any of the same
+// protocol versions as us with PROTOCOL_VERSIONS_INCOMPATIBLE, neither of which counts as a failed login.
+func (s *Server) handshake(w ResponseWriter, r *Request) {
+    incoming_contents := loginContents(r.Msg)
+    the_uname := string(incoming_contents.Username)
+    the_pw := string(incoming_contents.Password)
+    if !utf8.ValidString(the_uname) || !utf8.ValidString(the_pw) {
+        r.Logger().Warn("Refused a login with credentials that aren't UTF-8")
+        w.Ack(ptmp.INVALID_NAME)
+        return
+    }
+    version := s.negotiateVersion(incoming_contents.Client_Protocol_Versions_Supported)
+    if version == 0 {
+        r.Logger().Warn("Refused a login, the client doesn't speak any protocol version we do", "offered", incoming_contents.Client_Protocol_Versions_Supported)
+        w.Ack(ptmp.PROTOCOL_VERSIONS_INCOMPATIBLE)
+        return
+    }
+    if s.Login_Throttle != nil {
+        // A locked out login doesn't get its credentials checked at all, so guessing is no faster than the lockout.
+        if remaining := s.Login_Throttle.LockedOut(the_uname, r.Session.Remote_Addr); remaining > 0 {
+            r.Logger().Warn("Refused a login during a lockout", "username", the_uname, "remaining", remaining)
+            w.Ack(ptmp.LOGIN_THROTTLED)
+            return
+        }
+    }
+    resuming, resumed_id := incoming_contents.Session_Token != 0, uint32(0)
+    uname_good, pw_good := false, false
+    if resuming {
+        token_good := false
+        if s.Session_Tokens != nil {
+            resumed_id, token_good = s.Session_Tokens.check(incoming_contents.Session_Token, the_uname)
+        }
+        if !token_good {
+            // a made up token counts the same as a wrong password
+            if s.Login_Throttle != nil {
+                s.Login_Throttle.Failed(the_uname, r.Session.Remote_Addr)
+            }
+            r.Logger().Warn("Refused to resume a session, the token isn't any good", "username", the_uname)
+            w.Ack(ptmp.SESSION_TOKEN_INVALID)
+            return
+        }
+        uname_good, pw_good = true, true
+    } else if s.Authenticate != nil {
+        uname_good, pw_good = s.Authenticate(the_uname, the_pw)
+    }
+    if !uname_good || !pw_good {
+        if s.Login_Throttle != nil {
+            s.Login_Throttle.Failed(the_uname, r.Session.Remote_Addr)
+        }
+        w.Send(ptmp.Prep_Connection_Rules(uname_good, pw_good, version, []uint16{}, 0, 0))
+        return
+    }
+    if s.Login_Throttle != nil {
+        s.Login_Throttle.Succeeded(the_uname)
+    }
+    if !s.admitUser(the_uname) {
+        r.Logger().Warn("Refused a login, the user has too many sessions already", "username", the_uname)
+        w.Ack(ptmp.TOO_MANY_SESSIONS)
+        return
+    }
+    r.Session.Extensions = s.negotiateExtensions(incoming_contents.Extensions_Supported)
+    r.Session.User = the_uname
+    r.Session.ID = rand.Uint32()
+    if resuming {
+        s.Session_Tokens.revoke(incoming_contents.Session_Token) // each one is only good once
+        r.Session.ID = resumed_id
+        r.Logger().Info("Resumed a session", "username", the_uname, "session_id", resumed_id)
+    }
+    if s.Session_Tokens != nil && r.Session.HasExtension(ptmp.EXT_SESSION_RESUMPTION) {
+        r.Session.token = s.Session_Tokens.issue(the_uname, r.Session.ID)
+    }
+    // The Connection_Rules already goes out in whatever framing this settles on, since the client reads either.
+    r.Session.Max_Payload_Size = s.negotiatePayloadSize(incoming_contents.Max_Payload_Size)
+    r.Session.Protocol_Version = version
+    w.Send(ptmp.Prep_Connection_Rules(uname_good, pw_good, version, r.Session.Extensions, r.Session.token, r.Session.Max_Payload_Size))
+}
+
+// What a client that asked for a Max_Payload_Size of proposed gets: no more than the server allows, and no less
+// than MAX_PAYLOAD_SIZE, which everyone could always send.  A client that didn't ask (0) stays on the fixed framing.
+func (s *Server) negotiatePayloadSize(proposed uint16) uint16 {
+    if proposed == 0 {
+        return 0
+    }
+    allowed := ptmp.MAX_PAYLOAD_SIZE
+    if s.Max_Payload_Size != nil {
+        allowed = s.Max_Payload_Size()
+    }
+    if proposed > allowed {
+        proposed = allowed
+    }
+    if proposed < ptmp.MAX_PAYLOAD_SIZE {
+        proposed = ptmp.MAX_PAYLOAD_SIZE
+    }
+    return proposed
+}
+
+// We'll only bother sending the ACK if the client said they cared about waiting for it.
+func closeConnection(w ResponseWriter, r *Request) {
+    incoming_contents := ptmp.DecodePayload[ptmp.Close_Connection](r.Msg.Pld)
+    if ptmp.Byte2Bool(incoming_contents.Will_Await_Ack) {
+        w.Ack(ptmp.SINGULAR_MSG_SUCCESS)
+    }
+}
+
+// Pings don't do anything other than get answered, since just getting here has already reset the session's idle
+// timer.  The Pong says how long that timer is, so that the client knows how often it needs to ping to keep the
+// session alive while its user is away.
+func (s *Server) pong(w ResponseWriter, r *Request) {
+    incoming_contents := ptmp.DecodePayload[ptmp.Ping](r.Msg.Pld)
+    idle_seconds := uint32(s.Idle_Timeout / time.Second)
+    if idle_seconds == 0 && s.Idle_Timeout > 0 {
+        idle_seconds = 1 // (0 would mean there's no timeout at all)
+    }
+    w.Send(ptmp.Prep_Pong(incoming_contents.Timestamp, idle_seconds))
+}
+
+// Writes replies straight to the client's connection, framed for whatever its session agreed to.
+type conn_writer struct {
+    conn net.Conn
+    session *Session
+    log *slog.Logger
+    metrics *Metrics
+    pacing time.Duration
+    responding_to byte
+    response_code uint16
+}
+
+func (cw *conn_writer) Send(msg ptmp.PTMP_Msg) error {
+    if cw.session.Protocol_Version != 0 {
+        msg.Hdr.Protocol_Version = byte(cw.session.Protocol_Version) // (everything after the handshake is in the version it settled on)
+    }
+    if response_code, has_code := responseCodeOf(&msg); has_code {
+        cw.response_code = response_code
+    }
+    if cw.log.Enabled(context.Background(), slog.LevelDebug) {
+        cw.log.Debug("Sending a message", ptmplog.Msg(&msg))
+    }
+    packet, err_status := ptmp.EncodePacketFor(msg, cw.session.Max_Payload_Size)
+    if err_status != nil {
+        // (the handlers keep to MAX_PAYLOAD_SIZE, so this is a bug, and the client will be left waiting on its reply)
+        cw.log.Error("Refused to send a message bigger than the session's Max_Payload_Size", "payload_size", len(msg.Pld), "max_payload_size", cw.session.Max_Payload_Size)
+        return err_status
+    }
+    num_bytes_out, err_status := cw.conn.Write(packet)
+    if cw.metrics != nil {
+        cw.metrics.countBytes(0, num_bytes_out)
+    }
+    if err_status != nil {
+        return err_status
+    }
+    if msg.Hdr.Msgs_To_Follow > 0 {
+        // Testing has made me concerned about each side sending messages too quickly and the receiver could end up missing something
+        time.Sleep(cw.pacing)
+    }
+    return nil
+}
+
+func (cw *conn_writer) Ack(response_code uint16) error {
+    return cw.Send(ptmp.Prep_Acknowledgment(response_code, cw.responding_to))
+}
+
+func (cw *conn_writer) ResponseCode() uint16 {
+    return cw.response_code
+}
+
+// Talk to one client until it closes the connection (or goes away).  Returns nil if the client closed it properly,
+// and ErrServerClosed if the server closed it for a Shutdown.
+func (s *Server) ServeConn(conn net.Conn) error {
+    defer conn.Close()
+    s.trackConn(conn, true)
+    defer s.trackConn(conn, false)
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+    session := &Session{State: STATE_AWAITING_HANDSHAKE, Remote_Addr: conn.RemoteAddr().String()}
+    log := s.logger()
+    reader := bufio.NewReader(counting_reader{conn: conn, metrics: s.Metrics})
+    if s.Metrics != nil {
+        s.Metrics.sessionStarted()
+        defer s.Metrics.sessionEnded()
+    }
+    defer func() {
+        if session.User != "" {
+            s.releaseUser(session.User) // it was taken when the session logged in
+        }
+        if session.token != 0 {
+            s.Session_Tokens.ended(session.token) // (a no-op if the client closed it properly)
+        }
+    }()
+
+    // Continuously look for incoming messages.
+    for session.State != STATE_CLOSED {
+        read_deadline := time.Time{}
+        if s.Idle_Timeout > 0 {
+            read_deadline = time.Now().Add(s.Idle_Timeout)
+        }
+        conn.SetReadDeadline(read_deadline)
+        // Checked after setting the deadline, so that a Shutdown can't slip its wake-up call in before we overwrite it.
+        if s.ShuttingDown() {
+            if !session.InSeries() {
+                s.closeForShutdown(conn, session, log)
+                return ErrServerClosed
+            }
+            conn.SetReadDeadline(s.drainDeadline()) // let the client finish the series it's in the middle of
+        }
+        msg, err_status := ptmp.ReadPacket(reader, session.Max_Payload_Size)
+        var net_err net.Error
+        if err_status != nil && s.ShuttingDown() && errors.As(err_status, &net_err) && net_err.Timeout() && s.drainTimeLeft() {
+            continue // woken up by Shutdown rather than having timed out, so go around and see what to do about it
+        }
+        if errors.Is(err_status, ptmp.ErrPayloadTooLarge) && msg == nil {
+            // we gave up partway through it, so there's no finding where the next message starts
+            log.Warn("Disconnecting a client that sent a message far bigger than its Max_Payload_Size", sessionAttrs(session), "max_payload_size", session.Max_Payload_Size)
+            return err_status
+        }
+        if err_status != nil && !errors.Is(err_status, ptmp.ErrPayloadTooLarge) {
+            return err_status
+        }
+        req_log := log.With(sessionAttrs(session), slog.String("msg_type", MsgTypeName(msg.Hdr.Msg_Type_ID)))
+        w := &conn_writer{conn: conn, session: session, log: req_log, metrics: s.Metrics, pacing: s.Reply_Pacing, responding_to: msg.Hdr.Msg_Type_ID}
+        if err_status != nil {
+            // It was read in full, so the client can just be told, and the session carries on as if it was never sent.
+            req_log.Warn("Refused a message bigger than the session's Max_Payload_Size", "payload_size", len(msg.Pld), "max_payload_size", session.Max_Payload_Size)
+            w.Ack(ptmp.PAYLOAD_TOO_LARGE)
+            continue
+        }
+        if req_log.Enabled(ctx, slog.LevelDebug) {
+            req_log.Debug("Received a message", ptmplog.Msg(msg)) // credentials in the payload get redacted
+        }
+        s.ServeMessage(w, &Request{Msg: msg, Session: session, Received: time.Now(), Context: ctx, Log: req_log})
+    }
+    if session.token != 0 {
+        s.Session_Tokens.revoke(session.token) // the client said it was done, so there's nothing to come back to
+    }
+    return nil
+}
+
+// Every client gets a goroutine of its own, as long as the server isn't already serving as many as its session
+// limits allow (clients over the limit are told TOO_MANY_SESSIONS and disconnected).  Only returns once the
+// listener is closed (with nil, or ErrServerClosed if it was closed by Shutdown) or fails some other way that
+// isn't going to get better by trying again.
+func (s *Server) Serve(listener net.Listener) error {
+    if !s.trackListener(listener, true) {
+        listener.Close()
+        return ErrServerClosed
+    }
+    defer s.trackListener(listener, false)
+    for {
+        conn, err_status := listener.Accept()
+        if s.ShuttingDown() {
+            if err_status == nil {
+                conn.Close()
+            }
+            return ErrServerClosed
+        }
+        if errors.Is(err_status, net.ErrClosed) {
+            return nil
+        }
+        if err_status != nil {
+            var net_err net.Error
+            if errors.As(err_status, &net_err) && net_err.Timeout() {
+                continue
+            }
+            return err_status
+        }
+        log := s.logger().With("remote", conn.RemoteAddr().String())
+        if !s.admitConnection() {
+            log.Warn("Turning away a connection, the server has as many sessions as it allows")
+            go s.turnAway(conn)
+            continue
+        }
+        log.Info("Accepted a connection")
+        go func() {
+            defer s.releaseConnection()
+            if err_status := s.ServeConn(conn); errors.Is(err_status, ErrServerClosed) {
+                log.Info("Connection closed for the shutdown")
+            } else if err_status != nil {
+                log.Info("Connection ended", "error", err_status)
+            } else {
+                log.Info("Connection closed by the client")
+            }
+        }()
+    }
+}
+
+// How long a connection that's being turned away gets to send its first message (so that it can be told why).
+const TURN_AWAY_WAIT time.Duration = 5*time.Second
+
+// Answer whatever a connection sends first with TOO_MANY_SESSIONS, and hang up.
+func (s *Server) turnAway(conn net.Conn) {
+    defer conn.Close()
+    conn.SetDeadline(time.Now().Add(TURN_AWAY_WAIT))
+    msg, err_status := ptmp.ReadPacket(bufio.NewReader(conn), 0)
+    if msg == nil {
+        log := s.logger().With("remote", conn.RemoteAddr().String())
+        log.Debug("A connection being turned away didn't send anything we could answer", "error", err_status)
+        return
+    }
+    conn.Write(ptmp.EncodePacket(ptmp.Prep_Acknowledgment(ptmp.TOO_MANY_SESSIONS, msg.Hdr.Msg_Type_ID)))
+}
+
+// Counts the bytes read from a connection into the metrics as they come in (nil metrics count nothing).
+type counting_reader struct {
+    conn net.Conn
+    metrics *Metrics
+}
+
+func (cr counting_reader) Read(p []byte) (int, error) {
+    num_bytes_in, err_status := cr.conn.Read(p)
+    if cr.metrics != nil {
+        cr.metrics.countBytes(num_bytes_in, 0)
+    }
+    return num_bytes_in, err_status
+}
+
+// The attributes that say which session something happened in.
+func sessionAttrs(session *Session) slog.Attr {
+    return slog.Group("session", slog.String("remote", session.Remote_Addr), slog.String("user", session.User), slog.Uint64("id", uint64(session.ID)))
+}
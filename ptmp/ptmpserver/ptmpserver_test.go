@@ -0,0 +1,44 @@
+package ptmpserver
+
+import (
+    "ajb497/ptmp"
+    "testing"
+    "time"
+)
+
+func TestSessionsGetTheNewestProtocolVersionBothSidesSpeak(t *testing.T) {
+    srv := NewServer(func(username string, password string) (bool, bool) { return username == "zoë", password == "pässwörd" })
+    handshake := func(msg ptmp.PTMP_Msg) (*Session, *Recorder) {
+        session := &Session{State: STATE_AWAITING_HANDSHAKE}
+        rec := NewRecorder(ptmp.REQUEST_CONNECTION)
+        srv.ServeMessage(rec, &Request{Msg: &msg, Session: session, Received: time.Now()})
+        return session, rec
+    }
+    rulesFrom := func(rec *Recorder) *ptmp.Connection_Rules {
+        if len(rec.Replies) != 1 || rec.Replies[0].Hdr.Msg_Type_ID != ptmp.CONNECTION_RULES {
+            t.Fatalf("Expected Connection_Rules, got response code %v", rec.ResponseCode())
+        }
+        return ptmp.DecodePayload[ptmp.Connection_Rules](rec.Replies[0].Pld)
+    }
+
+    session, rec := handshake(ptmp.Prep_Request_Connection_V2("zoë", "pässwörd", 0, []uint16{1, 2}, []uint16{}, 0))
+    if rules := rulesFrom(rec); rules.Protocol_Version_To_Use != 2 || !ptmp.Byte2Bool(rules.Password_Ok) || session.Protocol_Version != 2 {
+        t.Errorf("A version 2 login got %+v, leaving the session on version %v", rules, session.Protocol_Version)
+    }
+    // a version 1 client gets version 1, and its fixed arrays are read without their padding
+    session, rec = handshake(ptmp.Prep_Request_Connection("zoë", "pässwörd", 0, []uint16{1}, []uint16{}, 0))
+    if rules := rulesFrom(rec); rules.Protocol_Version_To_Use != 1 || !ptmp.Byte2Bool(rules.Password_Ok) || session.Protocol_Version != 1 {
+        t.Errorf("A version 1 login got %+v, leaving the session on version %v", rules, session.Protocol_Version)
+    }
+    if _, rec = handshake(ptmp.Prep_Request_Connection_V2("zoë", "pässwörd", 0, []uint16{3}, []uint16{}, 0)); rec.ResponseCode() != ptmp.PROTOCOL_VERSIONS_INCOMPATIBLE {
+        t.Errorf("A client that only speaks version 3 got %v", rec.ResponseCode())
+    }
+    if _, rec = handshake(ptmp.Prep_Request_Connection_V2("zo\xeb", "pässwörd", 0, []uint16{2}, []uint16{}, 0)); rec.ResponseCode() != ptmp.INVALID_NAME {
+        t.Errorf("A username that isn't UTF-8 got %v", rec.ResponseCode())
+    }
+    // a server that only speaks version 1 can still read a version 2 login, and says which version to use instead
+    srv.Protocol_Version = 1
+    if _, rec = handshake(ptmp.Prep_Request_Connection_V2("zoë", "pässwörd", 0, []uint16{1, 2}, []uint16{}, 0)); rulesFrom(rec).Protocol_Version_To_Use != 1 {
+        t.Errorf("A version 1 server chose version %v", rulesFrom(rec).Protocol_Version_To_Use)
+    }
+}
@@ -0,0 +1,96 @@
+package ptmpserver
+
+import (
+    "crypto/rand"
+    "encoding/binary"
+    "sync"
+    "time"
+)
+
+// How long a session can be picked back up for after its connection goes away.  (A session whose connection is
+// still open can always be picked up, since the server may not have noticed yet that the client is gone.)
+type ResumptionPolicy struct {
+    TTL time.Duration
+}
+
+type resumable_session struct {
+    user string
+    id uint32
+    live bool // its connection hasn't ended yet
+    expires time.Time // only counts once it isn't live
+}
+
+// The session tokens handed out in Connection_Rules to clients that agreed to ptmp.EXT_SESSION_RESUMPTION.  A client
+// whose connection goes away can connect again and send its token instead of its password, and it gets the same
+// user and session ID back (and a new token, since each one is only good once).  A session that's closed properly
+// can't be resumed.  Tokens are only kept in memory, so none of them survive the server restarting, and clients
+// fall back on their credentials.
+type SessionTokens struct {
+    policy func() ResumptionPolicy
+    lock sync.Mutex
+    sessions map[uint64]*resumable_session
+}
+
+// Tokens that look their policy up every time they're used, so that the policy can change while the server is running.
+func NewSessionTokens(policy func() ResumptionPolicy) *SessionTokens {
+    return &SessionTokens{policy: policy, sessions: make(map[uint64]*resumable_session)}
+}
+
+// A token nobody could guess, unlike the math/rand ones that are good enough for session IDs.
+func newSessionToken() uint64 {
+    for {
+        var raw [8]byte
+        if _, err_status := rand.Read(raw[:]); err_status != nil {
+            panic(err_status) // crypto/rand doesn't fail on any system we'd run on
+        }
+        if token := binary.BigEndian.Uint64(raw[:]); token != 0 {
+            return token
+        }
+    }
+}
+
+// Hand out a token for a session that just logged in (or was resumed).
+func (st *SessionTokens) issue(user string, id uint32) uint64 {
+    st.lock.Lock()
+    defer st.lock.Unlock()
+    // Forget the ones that have run out while we're here, so that clients that never came back don't pile up.
+    now := time.Now()
+    for token, session := range st.sessions {
+        if !session.live && now.After(session.expires) {
+            delete(st.sessions, token)
+        }
+    }
+    token := newSessionToken()
+    st.sessions[token] = &resumable_session{user: user, id: id, live: true}
+    return token
+}
+
+// The session ID a token resumes, if it's one we gave the user and it hasn't run out.  It stays good until it's
+// revoked, so that a resumption that gets turned away for some other reason (too many sessions) can be tried again.
+func (st *SessionTokens) check(token uint64, user string) (uint32, bool) {
+    st.lock.Lock()
+    defer st.lock.Unlock()
+    session, found := st.sessions[token]
+    if !found || session.user != user || (!session.live && time.Now().After(session.expires)) {
+        return 0, false
+    }
+    return session.id, true
+}
+
+// The token's connection went away without being closed, so the clock starts on how long it can be resumed for.
+func (st *SessionTokens) ended(token uint64) {
+    policy := st.policy()
+    st.lock.Lock()
+    defer st.lock.Unlock()
+    if session, found := st.sessions[token]; found {
+        session.live = false
+        session.expires = time.Now().Add(policy.TTL)
+    }
+}
+
+// The token has been used, or its session was closed properly.
+func (st *SessionTokens) revoke(token uint64) {
+    st.lock.Lock()
+    defer st.lock.Unlock()
+    delete(st.sessions, token)
+}
@@ -0,0 +1,65 @@
+package ptmpserver
+
+import (
+    "ajb497/ptmp"
+    "testing"
+    "time"
+)
+
+func TestSessionsResumeOnceWithTheirToken(t *testing.T) {
+    srv := NewServer(func(username string, password string) (bool, bool) { return username == "someone", password == "anything" })
+    srv.Extensions = []uint16{ptmp.EXT_SESSION_RESUMPTION}
+    srv.Session_Tokens = NewSessionTokens(func() ResumptionPolicy { return ResumptionPolicy{TTL: time.Hour} })
+    handshake := func(msg ptmp.PTMP_Msg) (*Session, *Recorder) {
+        session := &Session{State: STATE_AWAITING_HANDSHAKE}
+        rec := NewRecorder(ptmp.REQUEST_CONNECTION)
+        srv.ServeMessage(rec, &Request{Msg: &msg, Session: session, Received: time.Now()})
+        return session, rec
+    }
+    resume := func(username string, token uint64) ptmp.PTMP_Msg {
+        return ptmp.Prep_Resume_Session(username, token, []uint16{1}, []uint16{ptmp.EXT_SESSION_RESUMPTION}, 0)
+    }
+
+    first, rec := handshake(loginMessage("someone", "anything", ptmp.EXT_SESSION_RESUMPTION))
+    token := ptmp.DecodePayload[ptmp.Connection_Rules](rec.Replies[0].Pld).Session_Token
+    if token == 0 || first.State != STATE_ESTABLISHED {
+        t.Fatalf("Logging in got token %v and left the session %v", token, first.State)
+    }
+    if _, rec = handshake(loginMessage("someone", "anything")); ptmp.DecodePayload[ptmp.Connection_Rules](rec.Replies[0].Pld).Session_Token != 0 {
+        t.Errorf("A client that didn't ask for session resumption got a token")
+    }
+
+    if _, rec = handshake(resume("someone else", token)); rec.ResponseCode() != ptmp.SESSION_TOKEN_INVALID {
+        t.Errorf("Resuming someone else's session got %v", rec.ResponseCode())
+    }
+    second, rec := handshake(resume("someone", token))
+    new_token := ptmp.DecodePayload[ptmp.Connection_Rules](rec.Replies[0].Pld).Session_Token
+    if second.State != STATE_ESTABLISHED || second.User != "someone" || second.ID != first.ID || new_token == 0 || new_token == token {
+        t.Fatalf("Resuming the session left it %v as %q (ID %v, was %v) with token %v", second.State, second.User, second.ID, first.ID, new_token)
+    }
+    if _, rec = handshake(resume("someone", token)); rec.ResponseCode() != ptmp.SESSION_TOKEN_INVALID {
+        t.Errorf("Resuming with a token that was already used got %v", rec.ResponseCode())
+    }
+}
+
+func TestSessionTokensRunOutOnceTheirConnectionEnds(t *testing.T) {
+    tokens := NewSessionTokens(func() ResumptionPolicy { return ResumptionPolicy{TTL: 10*time.Millisecond} })
+    token := tokens.issue("someone", 7)
+    time.Sleep(20*time.Millisecond)
+    if id, found := tokens.check(token, "someone"); !found || id != 7 {
+        t.Errorf("The token of a session that's still connected got %v, %v", id, found)
+    }
+    tokens.ended(token)
+    if _, found := tokens.check(token, "someone"); !found {
+        t.Errorf("The token of a session that just lost its connection wasn't any good")
+    }
+    time.Sleep(20*time.Millisecond)
+    if _, found := tokens.check(token, "someone"); found {
+        t.Errorf("The token of a session that lost its connection a while ago was still good")
+    }
+    closed := tokens.issue("someone", 8)
+    tokens.revoke(closed)
+    if _, found := tokens.check(closed, "someone"); found {
+        t.Errorf("The token of a session that was closed was still good")
+    }
+}
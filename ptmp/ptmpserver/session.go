@@ -0,0 +1,239 @@
+package ptmpserver
+
+import (
+    "fmt"
+    "io"
+    "ajb497/ptmp"
+    "ajb497/ptmp/ptmplog"
+    "sort"
+    "strings"
+)
+
+// The states a connection with a client can be in, following the DFA from the protocol design document.
+type SessionState byte
+
+const (
+    STATE_AWAITING_HANDSHAKE SessionState = iota // connected, but hasn't logged in yet
+    STATE_ESTABLISHED // logged in, and not in the middle of anything
+    STATE_SERIES_IN_PROGRESS // the client has sent part of a series of messages (Msgs_To_Follow > 0) and there's more to come
+    STATE_TRANSACTION_IN_PROGRESS // like a series, but the changes are being held on to until the last one, and then made all-or-nothing
+    STATE_CLOSING // the client said it's done, and we're sending the ack if it wanted one
+    STATE_CLOSED // nothing more is read from the connection
+)
+
+var state_names = map[SessionState]string{
+    STATE_AWAITING_HANDSHAKE: "AWAITING_HANDSHAKE",
+    STATE_ESTABLISHED: "ESTABLISHED",
+    STATE_SERIES_IN_PROGRESS: "SERIES_IN_PROGRESS",
+    STATE_TRANSACTION_IN_PROGRESS: "TRANSACTION_IN_PROGRESS",
+    STATE_CLOSING: "CLOSING",
+    STATE_CLOSED: "CLOSED",
+}
+
+func (state SessionState) String() string {
+    return state_names[state]
+}
+
+// One edge of the DFA: receiving a message of the given type in the From state moves the session to the To state.
+// When says what has to be true for that edge to be the one taken, for messages that can go more than one way.
+// Internal transitions happen on their own once the server is done with something, rather than on receiving a message.
+type Transition struct {
+    From SessionState
+    Msg_Type byte
+    To SessionState
+    When string
+    Internal bool
+}
+
+const (
+    WHEN_ACCEPTED string = "credentials accepted"
+    WHEN_REFUSED string = "credentials refused"
+    WHEN_MORE_TO_FOLLOW string = "more to follow"
+    WHEN_LAST string = "last in series"
+    WHEN_SHUTTING_DOWN string = "server shutting down"
+    WHEN_ABORTED string = "transaction aborted"
+)
+
+// The messages that can be sent as part of a series (or a transaction), all of them ones that change tasks and are
+// answered with just an ack.  (The queries are answered with series of their own, so they have to be sent one at a time.)
+var series_msg_types = []byte{ptmp.CREATE_NEW_TASK, ptmp.REMOVE_TASK, ptmp.MARK_TASK_COMPLETED, ptmp.RESTORE_TASKS, ptmp.PURGE_TRASH}
+
+// The messages that only a server sends.  A client sending us one of them is always out of context.
+var server_msg_types = []byte{ptmp.CONNECTION_RULES, ptmp.ACKNOWLEDGMENT, ptmp.TRANSACTION_FAILURE, ptmp.DETAILED_ACKNOWLEDGMENT, ptmp.PONG, ptmp.CAPABILITIES_INFORMATION, ptmp.LIST_INFORMATION, ptmp.TASK_INFORMATION, ptmp.TRASH_INFORMATION, ptmp.HISTORY_INFORMATION}
+
+// What a message that isn't in the table for a state gets, when it isn't a message type that's in the table for
+// some other state (those get MSG_CONTEXT_INVALID).  Before the handshake, nothing but logging in is in context.
+var unlisted_responses = map[SessionState]uint16{
+    STATE_AWAITING_HANDSHAKE: ptmp.MSG_CONTEXT_INVALID,
+    STATE_ESTABLISHED: ptmp.MSG_NOT_IMPLEMENTED,
+    STATE_SERIES_IN_PROGRESS: ptmp.MSG_CONTEXT_INVALID,
+    STATE_TRANSACTION_IN_PROGRESS: ptmp.MSG_CONTEXT_INVALID,
+}
+
+// The transition table for the protocol as the design document lays it out.  Every call returns a fresh copy, so
+// a server that adds its own message types to its table doesn't change anyone else's.
+func DefaultTransitions() []Transition {
+    table := []Transition{
+        {From: STATE_AWAITING_HANDSHAKE, Msg_Type: ptmp.REQUEST_CONNECTION, To: STATE_ESTABLISHED, When: WHEN_ACCEPTED},
+        {From: STATE_AWAITING_HANDSHAKE, Msg_Type: ptmp.REQUEST_CONNECTION, To: STATE_AWAITING_HANDSHAKE, When: WHEN_REFUSED},
+        {From: STATE_ESTABLISHED, Msg_Type: ptmp.QUERY_TASKS, To: STATE_ESTABLISHED},
+        {From: STATE_ESTABLISHED, Msg_Type: ptmp.QUERY_TRASH, To: STATE_ESTABLISHED},
+        {From: STATE_ESTABLISHED, Msg_Type: ptmp.QUERY_HISTORY, To: STATE_ESTABLISHED},
+        {From: STATE_ESTABLISHED, Msg_Type: ptmp.PING, To: STATE_ESTABLISHED},
+        {From: STATE_ESTABLISHED, Msg_Type: ptmp.QUERY_CAPABILITIES, To: STATE_ESTABLISHED},
+        {From: STATE_ESTABLISHED, Msg_Type: ptmp.TRANSACTION, To: STATE_ESTABLISHED}, // nothing in it, or turned down
+        {From: STATE_ESTABLISHED, Msg_Type: ptmp.TRANSACTION, To: STATE_TRANSACTION_IN_PROGRESS, When: WHEN_MORE_TO_FOLLOW},
+        // anything that can't be part of a transaction ends it, without any of it being made
+        {From: STATE_TRANSACTION_IN_PROGRESS, To: STATE_ESTABLISHED, When: WHEN_ABORTED, Internal: true},
+        {From: STATE_ESTABLISHED, Msg_Type: ptmp.CLOSE_CONNECTION, To: STATE_CLOSING},
+        {From: STATE_CLOSING, To: STATE_CLOSED, When: "ack sent (if awaited)", Internal: true},
+        // the server sends the Close_Connection for these, once anything being handled is done
+        {From: STATE_AWAITING_HANDSHAKE, To: STATE_CLOSED, When: WHEN_SHUTTING_DOWN, Internal: true},
+        {From: STATE_ESTABLISHED, To: STATE_CLOSED, When: WHEN_SHUTTING_DOWN, Internal: true},
+        {From: STATE_SERIES_IN_PROGRESS, To: STATE_CLOSED, When: WHEN_SHUTTING_DOWN + " (series finished or out of time)", Internal: true},
+        {From: STATE_TRANSACTION_IN_PROGRESS, To: STATE_CLOSED, When: WHEN_SHUTTING_DOWN + " (out of time, nothing made)", Internal: true},
+    }
+    for _, msg_type := range series_msg_types {
+        table = append(table,
+                       Transition{From: STATE_ESTABLISHED, Msg_Type: msg_type, To: STATE_ESTABLISHED},
+                       Transition{From: STATE_ESTABLISHED, Msg_Type: msg_type, To: STATE_SERIES_IN_PROGRESS, When: WHEN_MORE_TO_FOLLOW},
+                       Transition{From: STATE_SERIES_IN_PROGRESS, Msg_Type: msg_type, To: STATE_SERIES_IN_PROGRESS, When: WHEN_MORE_TO_FOLLOW},
+                       Transition{From: STATE_SERIES_IN_PROGRESS, Msg_Type: msg_type, To: STATE_ESTABLISHED, When: WHEN_LAST},
+                       Transition{From: STATE_TRANSACTION_IN_PROGRESS, Msg_Type: msg_type, To: STATE_TRANSACTION_IN_PROGRESS, When: WHEN_MORE_TO_FOLLOW},
+                       Transition{From: STATE_TRANSACTION_IN_PROGRESS, Msg_Type: msg_type, To: STATE_ESTABLISHED, When: WHEN_LAST})
+    }
+    return table
+}
+
+// Whether the table has any edge for a message type at all, in any state.
+func knownMsgType(table []Transition, msg_type byte) bool {
+    for _, edge := range table {
+        if !edge.Internal && edge.Msg_Type == msg_type {
+            return true
+        }
+    }
+    return false
+}
+
+// Everything the server knows about one client connection.
+type Session struct {
+    State SessionState
+    User string // who the client logged in as; set by the login handler once the credentials check out
+    ID uint32
+    Remote_Addr string
+    Extensions []uint16 // the protocol extensions agreed on at login
+    Max_Payload_Size uint16 // agreed on at login; 0 if the client didn't ask for one, and gets the fixed framing
+    Protocol_Version uint16 // agreed on at login (0 until then)
+    Rate_Limit_Key string // sessions with the same key share one RateLimit bucket ("" for a bucket of its own)
+
+    token uint64 // for picking the session back up on a new connection (0 if it didn't agree to ptmp.EXT_SESSION_RESUMPTION)
+    staged []*ptmp.PTMP_Msg // the changes of the transaction in progress, waiting for the last one to get here
+}
+
+func (s *Session) LoggedIn() bool {
+    return s.State == STATE_ESTABLISHED || s.InSeries()
+}
+
+// Whether the client is partway through sending a series or a transaction.
+func (s *Session) InSeries() bool {
+    return s.State == STATE_SERIES_IN_PROGRESS || s.State == STATE_TRANSACTION_IN_PROGRESS
+}
+
+// Work out where a message would take the session, if the table has an edge for it at all.  Logins can go either
+// way depending on the credentials, so they get the edge for being refused here and the server moves the session
+// on to established afterwards if they checked out.
+func (s *Session) nextState(table []Transition, msg *ptmp.PTMP_Msg) (SessionState, bool) {
+    when := ""
+    switch {
+        case msg.Hdr.Msg_Type_ID == ptmp.REQUEST_CONNECTION:
+            when = WHEN_REFUSED
+        case msg.Hdr.Msgs_To_Follow > 0:
+            when = WHEN_MORE_TO_FOLLOW
+        case s.InSeries():
+            when = WHEN_LAST
+    }
+    for _, edge := range table {
+        if !edge.Internal && edge.From == s.State && edge.Msg_Type == msg.Hdr.Msg_Type_ID && edge.When == when {
+            return edge.To, true
+        }
+    }
+    return s.State, false
+}
+
+// The response code for a message the table doesn't allow in the current state.
+func (s *Session) rejectionFor(table []Transition, msg_type byte) uint16 {
+    for _, server_type := range server_msg_types {
+        if msg_type == server_type {
+            return ptmp.MSG_CONTEXT_INVALID
+        }
+    }
+    if knownMsgType(table, msg_type) {
+        return ptmp.MSG_CONTEXT_INVALID // we do know this message, just not here
+    }
+    return unlisted_responses[s.State]
+}
+
+// Follow an edge, as long as the table has it.  Returns false (leaving the session where it was) if it doesn't,
+// which is a bug in the server rather than anything the client did.
+func (s *Session) moveTo(table []Transition, msg_type byte, internal bool, to SessionState) bool {
+    for _, edge := range table {
+        if edge.From == s.State && edge.To == to && edge.Internal == internal && (internal || edge.Msg_Type == msg_type) {
+            s.State = to
+            return true
+        }
+    }
+    return false
+}
+
+// Write a transition table out as a Graphviz digraph (e.g. go run . -state-graph | dot -Tsvg > states.svg).
+// Edges between the same two states are merged into one, labeled with every message type that takes it.
+func WriteStateGraph(w io.Writer, table []Transition) error {
+    type edge_key struct {
+        from SessionState
+        to SessionState
+    }
+    labels := map[edge_key][]string{}
+    keys := []edge_key{}
+    for _, edge := range table {
+        key := edge_key{edge.From, edge.To}
+        if _, seen := labels[key]; !seen {
+            keys = append(keys, key)
+        }
+        label := MsgTypeName(edge.Msg_Type)
+        if edge.Internal {
+            label = "(internal)"
+        }
+        if edge.When != "" {
+            label += " [" + edge.When + "]"
+        }
+        labels[key] = append(labels[key], label)
+    }
+    sort.SliceStable(keys, func(ii, jj int) bool {
+        if keys[ii].from != keys[jj].from {
+            return keys[ii].from < keys[jj].from
+        }
+        return keys[ii].to < keys[jj].to
+    })
+
+    lines := []string{"digraph ptmp_session {", "    rankdir=LR;", "    node [shape=ellipse];",
+                      fmt.Sprintf("    %v [shape=doublecircle];", STATE_CLOSED), fmt.Sprintf("    start [shape=point]; start -> %v;", STATE_AWAITING_HANDSHAKE)}
+    for _, key := range keys {
+        lines = append(lines, fmt.Sprintf("    %v -> %v [label=%q];", key.from, key.to, strings.Join(labels[key], "\n")))
+    }
+    // Everything that isn't an edge is rejected without changing state, which is worth spelling out on the diagram too.
+    for _, state := range []SessionState{STATE_AWAITING_HANDSHAKE, STATE_ESTABLISHED, STATE_SERIES_IN_PROGRESS, STATE_TRANSACTION_IN_PROGRESS} {
+        label := "anything else [MSG_CONTEXT_INVALID]"
+        if unlisted_responses[state] != ptmp.MSG_CONTEXT_INVALID {
+            label = "other known types [MSG_CONTEXT_INVALID]\nunknown types [MSG_NOT_IMPLEMENTED]"
+        }
+        lines = append(lines, fmt.Sprintf("    %v -> %v [style=dashed, label=%q];", state, state, label))
+    }
+    lines = append(lines, "}")
+    _, err_status := fmt.Fprintln(w, strings.Join(lines, "\n"))
+    return err_status
+}
+
+// A readable name for a message type, for logs and diagrams.  Types we don't have a name for come out as their number.
+func MsgTypeName(msg_type byte) string {
+    return ptmplog.MsgTypeName(msg_type)
+}
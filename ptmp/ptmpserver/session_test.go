@@ -0,0 +1,100 @@
+package ptmpserver
+
+import (
+    "ajb497/ptmp"
+    "bytes"
+    "net"
+    "strings"
+    "testing"
+    "time"
+)
+
+// The DFA has to be deterministic: a state, message type and condition can only ever lead to one place.
+func TestTransitionTableIsDeterministic(t *testing.T) {
+    type edge_key struct {
+        from SessionState
+        msg_type byte
+        when string
+        internal bool
+    }
+    seen := map[edge_key]SessionState{}
+    for _, edge := range DefaultTransitions() {
+        key := edge_key{edge.From, edge.Msg_Type, edge.When, edge.Internal}
+        if to, duplicate := seen[key]; duplicate {
+            t.Errorf("%v on %v [%v] goes to both %v and %v", edge.From, MsgTypeName(edge.Msg_Type), edge.When, to, edge.To)
+        }
+        seen[key] = edge.To
+    }
+}
+
+func TestSeriesStaysInSeriesUntilTheLastMessage(t *testing.T) {
+    table := DefaultTransitions()
+    s := Session{State: STATE_ESTABLISHED}
+    msg := ptmp.Prep_Create_New_Task(1, 1, "first", "the first of two")
+    msg.Hdr.Msgs_To_Follow = 1
+    next_state, permitted := s.nextState(table, &msg)
+    if !permitted || next_state != STATE_SERIES_IN_PROGRESS {
+        t.Fatalf("Start of a series went to %v (permitted %v)", next_state, permitted)
+    }
+    s.moveTo(table, msg.Hdr.Msg_Type_ID, false, next_state)
+
+    // queries can't be slipped into the middle of a series
+    query := ptmp.Prep_Query_Tasks(0, 10)
+    if _, permitted := s.nextState(table, &query); permitted {
+        t.Errorf("Query_Tasks was permitted in the middle of a series")
+    }
+    if code := s.rejectionFor(table, query.Hdr.Msg_Type_ID); code != ptmp.MSG_CONTEXT_INVALID {
+        t.Errorf("Query_Tasks in the middle of a series got %v instead of MSG_CONTEXT_INVALID", code)
+    }
+
+    msg.Hdr.Msgs_To_Follow = 0
+    next_state, permitted = s.nextState(table, &msg)
+    if !permitted || next_state != STATE_ESTABLISHED {
+        t.Fatalf("End of a series went to %v (permitted %v)", next_state, permitted)
+    }
+}
+
+func TestStateGraphHasEveryState(t *testing.T) {
+    out := bytes.Buffer{}
+    if err_status := WriteStateGraph(&out, DefaultTransitions()); err_status != nil {
+        t.Fatal(err_status)
+    }
+    for _, name := range state_names {
+        if !strings.Contains(out.String(), name) {
+            t.Errorf("State %v is missing from the graph:\n%v", name, out.String())
+        }
+    }
+}
+
+// Pings reset the idle timer like any other message, so a client that keeps pinging keeps its session.
+func TestPingsKeepSessionsFromGoingIdle(t *testing.T) {
+    srv := NewServer(func(username string, password string) (bool, bool) { return true, true })
+    srv.Idle_Timeout = 200*time.Millisecond
+    listener, err_status := net.Listen(BASE_PROTO, "127.0.0.1:0")
+    if err_status != nil {
+        t.Fatal(err_status)
+    }
+    defer listener.Close()
+    go srv.Serve(listener)
+
+    conn, code := dialAndLogin(t, listener.Addr().String(), "someone")
+    defer conn.Close()
+    if code != 0 {
+        t.Fatalf("Logging in got %v", code)
+    }
+    for ii := 0; ii < 5; ii++ {
+        time.Sleep(100*time.Millisecond)
+        if _, err_status = conn.Write(ptmp.EncodePacket(ptmp.Prep_Ping(int64(ii)))); err_status != nil {
+            t.Fatalf("Ping %v couldn't be sent: %v", ii, err_status)
+        }
+        reply := readReply(t, conn)
+        pong := ptmp.DecodePayload[ptmp.Pong](reply.Pld)
+        if reply.Hdr.Msg_Type_ID != ptmp.PONG || pong.Timestamp != int64(ii) || pong.Idle_Timeout_Seconds != 1 {
+            t.Fatalf("Ping %v got message type %v with %+v", ii, reply.Hdr.Msg_Type_ID, pong)
+        }
+    }
+    // and once it stops, the session goes idle
+    if _, err_status = conn.Read(make([]byte, 1)); err_status == nil {
+        t.Errorf("The session was still there after it stopped pinging")
+    }
+}
@@ -0,0 +1,132 @@
+package ptmpserver
+
+import (
+    "ajb497/ptmp"
+    "context"
+    "errors"
+    "log/slog"
+    "net"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// Returned by Serve and ServeConn once Shutdown has been called.
+var ErrServerClosed = errors.New("ptmpserver: server closed")
+
+// How often Shutdown checks whether every connection is done yet.
+const SHUTDOWN_POLL_INTERVAL time.Duration = 20*time.Millisecond
+
+// The listeners and connections a server is serving, so that Shutdown can get at them.
+type conn_tracker struct {
+    shutting_down atomic.Bool
+    lock sync.Mutex
+    listeners map[net.Listener]struct{}
+    conns map[net.Conn]struct{}
+    drain_deadline time.Time // zero for no deadline
+}
+
+func (s *Server) trackListener(listener net.Listener, add bool) bool {
+    s.tracker.lock.Lock()
+    defer s.tracker.lock.Unlock()
+    if add && s.tracker.shutting_down.Load() {
+        return false
+    }
+    if s.tracker.listeners == nil {
+        s.tracker.listeners = make(map[net.Listener]struct{})
+    }
+    if add {
+        s.tracker.listeners[listener] = struct{}{}
+    } else {
+        delete(s.tracker.listeners, listener)
+    }
+    return true
+}
+
+func (s *Server) trackConn(conn net.Conn, add bool) {
+    s.tracker.lock.Lock()
+    defer s.tracker.lock.Unlock()
+    if s.tracker.conns == nil {
+        s.tracker.conns = make(map[net.Conn]struct{})
+    }
+    if add {
+        s.tracker.conns[conn] = struct{}{}
+        if s.tracker.shutting_down.Load() {
+            conn.SetReadDeadline(time.Now()) // it missed the wake-up call, so it gets one of its own
+        }
+    } else {
+        delete(s.tracker.conns, conn)
+    }
+}
+
+func (s *Server) activeConns() int {
+    s.tracker.lock.Lock()
+    defer s.tracker.lock.Unlock()
+    return len(s.tracker.conns)
+}
+
+func (s *Server) drainDeadline() time.Time {
+    s.tracker.lock.Lock()
+    defer s.tracker.lock.Unlock()
+    return s.tracker.drain_deadline
+}
+
+// Whether a Shutdown's deadline (if it has one) is still to come.
+func (s *Server) drainTimeLeft() bool {
+    deadline := s.drainDeadline()
+    return deadline.IsZero() || time.Now().Before(deadline)
+}
+
+// Whether Shutdown has been called.
+func (s *Server) ShuttingDown() bool {
+    return s.tracker.shutting_down.Load()
+}
+
+// Stop the server gracefully: stop accepting connections, let every message that's being handled finish, tell
+// each session the server is closing (with a Close_Connection from our end, not awaiting an ack) and wait for
+// all the connections to end.  Sessions in the middle of a series (or transaction) get to finish it first, as long as ctx allows.
+// If ctx runs out before everything is done, the connections that are left get cut off and ctx's error comes back.
+// Handlers that are still running after that keep running; it's up to whoever embeds the server to wait for
+// anything they do that matters (the task server takes its store lock before flushing, for instance).
+func (s *Server) Shutdown(ctx context.Context) error {
+    s.tracker.lock.Lock()
+    s.tracker.shutting_down.Store(true)
+    s.tracker.drain_deadline, _ = ctx.Deadline()
+    for listener := range s.tracker.listeners {
+        listener.Close()
+    }
+    // connections waiting on their next message wake up and see that we're shutting down; the ones in the middle
+    // of a message see it once they're done with it
+    for conn := range s.tracker.conns {
+        conn.SetReadDeadline(time.Now())
+    }
+    s.tracker.lock.Unlock()
+
+    ticker := time.NewTicker(SHUTDOWN_POLL_INTERVAL)
+    defer ticker.Stop()
+    for s.activeConns() > 0 {
+        select {
+            case <-ctx.Done():
+                s.tracker.lock.Lock()
+                for conn := range s.tracker.conns {
+                    conn.Close()
+                }
+                s.tracker.lock.Unlock()
+                return ctx.Err()
+            case <-ticker.C:
+        }
+    }
+    return nil
+}
+
+// Tell the client the server is going away and mark the session closed.  The client doesn't owe us an ack.
+func (s *Server) closeForShutdown(conn net.Conn, session *Session, log *slog.Logger) {
+    log.Info("Closing the session, the server is shutting down", sessionAttrs(session), "state", session.State)
+    s.lock.Lock()
+    table := s.Transitions
+    s.lock.Unlock()
+    session.moveTo(table, ptmp.CLOSE_CONNECTION, true, STATE_CLOSED)
+    w := &conn_writer{conn: conn, session: session, log: log, metrics: s.Metrics, responding_to: ptmp.CLOSE_CONNECTION}
+    conn.SetWriteDeadline(time.Now().Add(TURN_AWAY_WAIT))
+    w.Send(ptmp.Prep_Close_Connection(false))
+}
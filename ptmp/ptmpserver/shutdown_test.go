@@ -0,0 +1,42 @@
+package ptmpserver
+
+import (
+    "ajb497/ptmp"
+    "context"
+    "errors"
+    "net"
+    "testing"
+    "time"
+)
+
+func TestShutdownClosesIdleSessions(t *testing.T) {
+    srv := NewServer(func(username string, password string) (bool, bool) { return true, true })
+    listener, err_status := net.Listen(BASE_PROTO, "127.0.0.1:0")
+    if err_status != nil {
+        t.Fatal(err_status)
+    }
+    served := make(chan error, 1)
+    go func() { served <- srv.Serve(listener) }()
+
+    conn, code := dialAndLogin(t, listener.Addr().String(), "someone")
+    defer conn.Close()
+    if code != 0 {
+        t.Fatalf("Logging in got %v", code)
+    }
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+    if err_status = srv.Shutdown(ctx); err_status != nil {
+        t.Fatalf("Shutting down an idle server failed: %v", err_status)
+    }
+
+    // the client hears about it from us, rather than just having the connection drop out from under it
+    if reply := readReply(t, conn); reply.Hdr.Msg_Type_ID != ptmp.CLOSE_CONNECTION {
+        t.Errorf("Expected a Close_Connection, got message type %v", reply.Hdr.Msg_Type_ID)
+    }
+    if err_status = <-served; !errors.Is(err_status, ErrServerClosed) {
+        t.Errorf("Serve returned %v instead of ErrServerClosed", err_status)
+    }
+    if _, err_status = net.Dial(BASE_PROTO, listener.Addr().String()); err_status == nil {
+        t.Errorf("The server is still accepting connections after shutting down")
+    }
+}
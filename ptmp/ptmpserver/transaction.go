@@ -0,0 +1,102 @@
+package ptmpserver
+
+import (
+    "ajb497/ptmp"
+)
+
+// Start a transaction: the changes that follow get held on to (and answered with CONDITIONAL_SUCCESS) until the
+// last one gets here.  One with nothing in it is done as soon as it starts.
+func (s *Server) beginTransaction(w ResponseWriter, r *Request) {
+    if s.Atomically == nil {
+        w.Ack(ptmp.MSG_NOT_IMPLEMENTED)
+        return
+    }
+    incoming_contents := ptmp.DecodePayload[ptmp.Transaction](r.Msg.Pld)
+    if incoming_contents.Num_Changes != uint16(r.Msg.Hdr.Msgs_To_Follow) {
+        // we'd have no way of telling which of the two the client actually meant
+        w.Ack(ptmp.SYNTAX_ERROR)
+        return
+    }
+    if r.Msg.Hdr.Msgs_To_Follow == 0 {
+        w.Ack(ptmp.MSG_SERIES_SUCCESS)
+        return
+    }
+    r.Session.staged = nil
+    w.Ack(ptmp.CONDITIONAL_SUCCESS)
+}
+
+// Hold on to one change of the transaction in progress.  If it's the last one, the whole transaction gets made.
+// The session is moved along before anything is made, so that a handler blowing up partway through doesn't leave
+// it stuck in the transaction.
+func (s *Server) stageChange(w ResponseWriter, r *Request, table []Transition, next_state SessionState) {
+    r.Session.staged = append(r.Session.staged, r.Msg)
+    r.Session.moveTo(table, r.Msg.Hdr.Msg_Type_ID, false, next_state)
+    if next_state == STATE_TRANSACTION_IN_PROGRESS {
+        w.Ack(ptmp.CONDITIONAL_SUCCESS)
+        return
+    }
+    r.Transaction = r.Session.staged
+    r.Session.staged = nil
+    s.commitTransaction(w, r)
+}
+
+// Make every change in the transaction, in the order they were sent, stopping at the first one that doesn't
+// succeed.  Each one goes straight to its handler: the middleware has already seen each of them as they came in,
+// and is wrapped around this one (the last) as it's made.  If the changes had item results of their own (the new
+// reference number of a create, say), the transaction is answered with all of them, for sessions with detailed acks.
+func (s *Server) commitTransaction(w ResponseWriter, r *Request) {
+    failed_index, failed_code := -1, uint16(0)
+    items := []ptmp.Item_Result{}
+    s.Atomically(func() bool {
+        items = items[:0] // (in case whatever Atomically does has it go again)
+        for ii, change := range r.Transaction {
+            rec := NewRecorder(change.Hdr.Msg_Type_ID)
+            s.mux.ServePTMP(rec, &Request{Msg: change, Session: r.Session, Received: r.Received, Context: r.Context, Log: r.Log})
+            if rec.ResponseCode() != ptmp.SINGULAR_MSG_SUCCESS {
+                failed_index, failed_code = ii, changeFailureCode(rec)
+                return false
+            }
+            if last := len(rec.Replies) - 1; last >= 0 && rec.Replies[last].Hdr.Msg_Type_ID == ptmp.DETAILED_ACKNOWLEDGMENT {
+                items = append(items, ptmp.DecodePayload[ptmp.Detailed_Acknowledgment](rec.Replies[last].Pld).Item_Results...)
+            }
+        }
+        return true
+    })
+    if failed_index >= 0 {
+        r.Logger().Info("Transaction failed, none of it was made", "changes", len(r.Transaction), "failed_index", failed_index,
+                        "failed_msg_type", MsgTypeName(r.Transaction[failed_index].Hdr.Msg_Type_ID), "response_code", failed_code)
+        w.Send(ptmp.Prep_Transaction_Failure(uint16(failed_index), r.Transaction[failed_index].Hdr.Msg_Type_ID, failed_code))
+        return
+    }
+    if len(items) > 0 {
+        AckDetailed(w, r, ptmp.MSG_SERIES_SUCCESS, items, "")
+        return
+    }
+    w.Ack(ptmp.MSG_SERIES_SUCCESS)
+}
+
+// What a change that didn't succeed failed with.  Partial successes don't count as success in a transaction, and
+// it's the first of the items that failed that the transaction gets reported as failing with, since the
+// CONDITIONAL_SUCCESS the change got on its own wouldn't tell the client much.
+func changeFailureCode(rec *Recorder) uint16 {
+    code := rec.ResponseCode()
+    if code != ptmp.CONDITIONAL_SUCCESS || len(rec.Replies) == 0 || rec.Replies[len(rec.Replies)-1].Hdr.Msg_Type_ID != ptmp.DETAILED_ACKNOWLEDGMENT {
+        return code
+    }
+    for _, item := range ptmp.DecodePayload[ptmp.Detailed_Acknowledgment](rec.Replies[len(rec.Replies)-1].Pld).Item_Results {
+        if item.Response_Code != ptmp.SINGULAR_MSG_SUCCESS {
+            return item.Response_Code
+        }
+    }
+    return code
+}
+
+// Something that can't be part of a transaction was sent in the middle of one.  None of the transaction is made,
+// and the message that ended it is named as the one that failed.
+func (s *Server) abortTransaction(w ResponseWriter, r *Request, table []Transition, response_code uint16) {
+    failed_index := len(r.Session.staged)
+    r.Session.staged = nil
+    r.Session.moveTo(table, r.Msg.Hdr.Msg_Type_ID, true, STATE_ESTABLISHED)
+    r.Logger().Info("Transaction aborted by a message that can't be part of one", "failed_index", failed_index, "response_code", response_code)
+    w.Send(ptmp.Prep_Transaction_Failure(uint16(failed_index), r.Msg.Hdr.Msg_Type_ID, response_code))
+}
@@ -0,0 +1,99 @@
+package ptmpserver
+
+import (
+    "ajb497/ptmp"
+    "testing"
+    "time"
+)
+
+func TestTransactionsNeedAtomically(t *testing.T) {
+    srv := NewServer(nil)
+    session := &Session{State: STATE_ESTABLISHED}
+    if code := serveOne(srv, session, ptmp.Prep_Transaction(1)); code != ptmp.MSG_NOT_IMPLEMENTED || session.State != STATE_ESTABLISHED {
+        t.Errorf("A transaction on a server without Atomically got %v and left the session %v", code, session.State)
+    }
+}
+
+func TestTransactionIsAllOrNothing(t *testing.T) {
+    srv := NewServer(nil)
+    made := []uint16{}
+    srv.HandleFunc(ptmp.CREATE_NEW_TASK, func(w ResponseWriter, r *Request) {
+        list_id := ptmp.DecodePayload[ptmp.Create_New_Task](r.Msg.Pld).Associated_List_ID
+        if list_id != 1 {
+            w.Ack(ptmp.LIST_DOES_NOT_EXIST)
+            return
+        }
+        made = append(made, list_id)
+        w.Ack(ptmp.SINGULAR_MSG_SUCCESS)
+    })
+    undone := 0
+    srv.Atomically = func(apply func() bool) {
+        if !apply() {
+            made = nil
+            undone++
+        }
+    }
+    send := func(session *Session, list_ids ...uint16) uint16 {
+        if code := serveOne(srv, session, ptmp.Prep_Transaction(byte(len(list_ids)))); code != ptmp.CONDITIONAL_SUCCESS {
+            t.Fatalf("Transaction got %v", code)
+        }
+        code := uint16(0)
+        for ii, list_id := range list_ids {
+            change := ptmp.Prep_Create_New_Task(list_id, 1, "task", "in a transaction")
+            change.Hdr.Msgs_To_Follow = byte(len(list_ids)-1-ii)
+            code = serveOne(srv, session, change)
+            if ii < len(list_ids)-1 && code != ptmp.CONDITIONAL_SUCCESS {
+                t.Fatalf("Change %v got %v", ii, code)
+            }
+        }
+        return code
+    }
+
+    session := &Session{State: STATE_ESTABLISHED}
+    if code := send(session, 1, 2, 1); code != ptmp.CONDITIONAL_ORDER_FAILURE || undone != 1 || len(made) != 0 {
+        t.Errorf("A transaction with a bad change got %v, was undone %v times and left %v made", code, undone, made)
+    }
+    if session.State != STATE_ESTABLISHED {
+        t.Errorf("A failed transaction left the session %v", session.State)
+    }
+    if code := send(session, 1, 1); code != ptmp.MSG_SERIES_SUCCESS || undone != 1 || len(made) != 2 {
+        t.Errorf("A good transaction got %v, was undone %v times and left %v made", code, undone, made)
+    }
+}
+
+// A transaction that's made is answered with its changes' item results, one after another, for sessions with
+// detailed acks (so a client can tell what reference numbers its creates got), and a plain ack for the rest.
+func TestTransactionItems(t *testing.T) {
+    srv := NewServer(nil)
+    next_ref := uint16(10)
+    srv.HandleFunc(ptmp.CREATE_NEW_TASK, func(w ResponseWriter, r *Request) {
+        next_ref++
+        AckDetailed(w, r, ptmp.SINGULAR_MSG_SUCCESS, []ptmp.Item_Result{{Task_Reference_Number: next_ref, Response_Code: ptmp.SINGULAR_MSG_SUCCESS}}, "")
+    })
+    srv.Atomically = func(apply func() bool) { apply() }
+    commit := func(session *Session) *ptmp.PTMP_Msg {
+        serveOne(srv, session, ptmp.Prep_Transaction(2))
+        first := ptmp.Prep_Create_New_Task(1, 1, "first", "in a transaction")
+        first.Hdr.Msgs_To_Follow = 1
+        serveOne(srv, session, first)
+        last := ptmp.Prep_Create_New_Task(1, 1, "second", "in a transaction")
+        recorder := NewRecorder(last.Hdr.Msg_Type_ID)
+        srv.ServeMessage(recorder, &Request{Msg: &last, Session: session, Received: time.Now()})
+        if len(recorder.Replies) != 1 {
+            t.Fatalf("The transaction was answered with %v messages", len(recorder.Replies))
+        }
+        return recorder.Replies[0]
+    }
+
+    reply := commit(&Session{State: STATE_ESTABLISHED, Extensions: []uint16{ptmp.EXT_DETAILED_ACKS}})
+    if reply.Hdr.Msg_Type_ID != ptmp.DETAILED_ACKNOWLEDGMENT {
+        t.Fatalf("A session with detailed acks got message type %v", reply.Hdr.Msg_Type_ID)
+    }
+    ack := ptmp.DecodePayload[ptmp.Detailed_Acknowledgment](reply.Pld)
+    if ack.Response_Code != ptmp.MSG_SERIES_SUCCESS || len(ack.Item_Results) != 2 || ack.Item_Results[0].Task_Reference_Number != 11 || ack.Item_Results[1].Task_Reference_Number != 12 {
+        t.Errorf("A session with detailed acks got %+v, expected MSG_SERIES_SUCCESS naming 11 and 12", ack)
+    }
+    if reply = commit(&Session{State: STATE_ESTABLISHED}); reply.Hdr.Msg_Type_ID != ptmp.ACKNOWLEDGMENT {
+        t.Errorf("A session without detailed acks got message type %v", reply.Hdr.Msg_Type_ID)
+    }
+}
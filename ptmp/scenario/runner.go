@@ -0,0 +1,156 @@
+package scenario
+
+import (
+    "context"
+    "fmt"
+    "io"
+    "ajb497/ptmp/ptmpclient"
+    "ajb497/ptmp"
+    "strconv"
+)
+
+// How one step went.  Problems is empty when it passed.
+type StepResult struct {
+    Step *Step
+    Replies []*ptmp.PTMP_Msg
+    Problems []string
+}
+
+func (r StepResult) Passed() bool {
+    return len(r.Problems) == 0
+}
+
+type Result struct {
+    Steps []StepResult
+    Passed int
+    Failed int
+}
+
+// Send each step's message to the server and check what comes back, writing a PASS/FAIL line per step (and the
+// reasons for any failures) to report if it isn't nil.  Every step gets run even if earlier ones failed, so that
+// one failure doesn't hide the rest; only losing the connection stops a run early, in which case the error says why.
+func (s *Scenario) Run(ctx context.Context, client *ptmpclient.Client, report io.Writer) (Result, error) {
+    result := Result{}
+    for ii := range s.Steps {
+        step := &s.Steps[ii]
+        replies, err_status := client.Do(ctx, step.Msg)
+        step_result := StepResult{Step: step, Replies: replies}
+        if err_status != nil {
+            step_result.Problems = append(step_result.Problems, fmt.Sprintf("no reply from the server: %v", err_status))
+        } else {
+            step_result.Problems = checkReplies(step, replies)
+        }
+        result.Steps = append(result.Steps, step_result)
+        if step_result.Passed() {
+            result.Passed++
+        } else {
+            result.Failed++
+        }
+        if report != nil {
+            status := "PASS"
+            if !step_result.Passed() {
+                status = "FAIL"
+            }
+            fmt.Fprintf(report, "%v %v:%v: %v\n", status, s.Name, step.Line, step.Text)
+            for _, problem := range step_result.Problems {
+                fmt.Fprintf(report, "\t%v\n", problem)
+            }
+        }
+        if err_status != nil {
+            return result, err_status
+        }
+    }
+    if report != nil {
+        fmt.Fprintf(report, "%v: %v step(s) passed, %v failed\n", s.Name, result.Passed, result.Failed)
+    }
+    return result, nil
+}
+
+func checkReplies(step *Step, replies []*ptmp.PTMP_Msg) []string {
+    problems := []string{}
+    if len(step.Expect) == 0 {
+        return problems
+    }
+    if len(step.Expect) == 1 && step.Expect[0].Kind == "nothing" {
+        if len(replies) != 0 {
+            problems = append(problems, fmt.Sprintf("expected no reply, got %v message(s)", len(replies)))
+        }
+        return problems
+    }
+    for ii, expected := range step.Expect {
+        if ii >= len(replies) {
+            problems = append(problems, fmt.Sprintf("line %v: expected %v, but the server didn't send it", expected.Line, expected))
+            continue
+        }
+        kind, fields := replyFields(replies[ii])
+        actual := Expectation{Kind: kind, Fields: fields}
+        if !matches(expected, actual) {
+            problems = append(problems, fmt.Sprintf("line %v: expected %v, got %v", expected.Line, expected, actual))
+        }
+        if kind == "ack" {
+            // every acknowledgment should say it's answering what we just sent
+            ack := ptmp.DecodePayload[ptmp.Acknowledgment](replies[ii].Pld)
+            if ack.ID_Responding_To != step.Msg.Hdr.Msg_Type_ID {
+                problems = append(problems, fmt.Sprintf("line %v: acknowledgment is responding to message type %v instead of %v", expected.Line, ack.ID_Responding_To, step.Msg.Hdr.Msg_Type_ID))
+            }
+        }
+    }
+    for ii := len(step.Expect); ii < len(replies); ii++ {
+        kind, fields := replyFields(replies[ii])
+        problems = append(problems, fmt.Sprintf("unexpected extra reply: %v", Expectation{Kind: kind, Fields: fields}))
+    }
+    return problems
+}
+
+func matches(expected Expectation, actual Expectation) bool {
+    if expected.Kind != actual.Kind || len(expected.Fields) != len(actual.Fields) {
+        return false
+    }
+    for ii := range expected.Fields {
+        if expected.Fields[ii] != WILDCARD && expected.Fields[ii] != actual.Fields[ii] {
+            return false
+        }
+    }
+    return true
+}
+
+func taskFields(tinfo ptmp.T_Inf) []string {
+    task := ptmpclient.TaskFromTInf(tinfo)
+    return []string{strconv.Itoa(int(task.Ref)), strconv.Itoa(int(task.Priority)), strconv.FormatBool(task.Completed), task.Title, task.Description}
+}
+
+// Turn a reply into the same form as an expect line.  A message carrying more than one item (which our server
+// doesn't send, but others might) is shown with every item's fields one after the other, so it won't match.
+func replyFields(reply *ptmp.PTMP_Msg) (string, []string) {
+    fields := []string{}
+    switch reply.Hdr.Msg_Type_ID {
+        case ptmp.ACKNOWLEDGMENT:
+            ack := ptmp.DecodePayload[ptmp.Acknowledgment](reply.Pld)
+            return "ack", []string{ptmpclient.ResponseCodeName(ack.Response_Code)}
+        case ptmp.CONNECTION_RULES:
+            rules := ptmp.DecodePayload[ptmp.Connection_Rules](reply.Pld)
+            return "connection_rules", []string{strconv.FormatBool(ptmp.Byte2Bool(rules.Username_Ok)), strconv.FormatBool(ptmp.Byte2Bool(rules.Password_Ok))}
+        case ptmp.TASK_INFORMATION:
+            for _, tinfo := range ptmp.DecodePayload[ptmp.Task_Information](reply.Pld).Task_Infos {
+                fields = append(fields, taskFields(tinfo)...)
+            }
+            return "task", fields
+        case ptmp.TRASH_INFORMATION:
+            for _, tt := range ptmp.DecodePayload[ptmp.Trash_Information](reply.Pld).Trashed_Tasks {
+                fields = append(fields, strconv.Itoa(int(tt.List_ID)))
+                fields = append(fields, taskFields(tt.Task)...)
+            }
+            return "trash", fields
+        case ptmp.HISTORY_INFORMATION:
+            for _, entry := range ptmp.DecodePayload[ptmp.History_Information](reply.Pld).Entries {
+                ref := NO_TASK
+                if entry.Before_Location != ptmp.TASK_LOCATION_NONE || entry.After_Location != ptmp.TASK_LOCATION_NONE {
+                    ref = strconv.Itoa(int(entry.Task.Task_Reference_Number))
+                }
+                fields = append(fields, strconv.Itoa(int(entry.Msg_Type_ID)), ptmpclient.ResponseCodeName(entry.Response_Code), strconv.Itoa(int(entry.List_ID)),
+                                location_names[entry.Before_Location], location_names[entry.After_Location], ref)
+            }
+            return "history", fields
+    }
+    return fmt.Sprintf("message_type_%v", reply.Hdr.Msg_Type_ID), fields
+}
@@ -0,0 +1,382 @@
+// Package scenario reads scenario files, which script a conversation with a PTMP server: the messages to send and
+// the replies the server should answer each of them with.  Running a scenario against a server reports whether each
+// step got the replies it was supposed to.
+//
+// A scenario file is made of lines like these:
+//
+//     # lines starting with # are comments
+//     send request_connection "Ed Ucational" "p@55w0rd"
+//     expect connection_rules true true
+//     send create_new_task 1 1000 "Grade this assignment" "Give it an A"
+//     expect ack SINGULAR_MSG_SUCCESS
+//     send query_tasks 0 50000
+//     expect task 0 1000 false "Grade this assignment" *
+//
+// Each send line is a step.  Its arguments are the same as the ones for the matching ptmp.Prep_* function:
+//
+//     send request_connection USERNAME PASSWORD
+//     send close_connection WILL_AWAIT_ACK
+//     send create_new_task LIST PRIORITY TITLE DESCRIPTION
+//     send query_tasks MIN_PRIORITY MAX_PRIORITY
+//     send mark_task_completed LIST REF
+//     send remove_tasks PERMIT_INCOMPLETE LIST REF...
+//     send query_trash LIST
+//     send restore_tasks LIST REF...
+//     send purge_trash LIST [REF...]
+//     send query_history LIST WHOLE_LIST REF
+//
+// The expect lines after it are the replies the server should send back, in order, one line per message:
+//
+//     expect ack RESPONSE_CODE                                    (a name like TASK_DOES_NOT_EXIST, or a number)
+//     expect connection_rules USERNAME_OK PASSWORD_OK
+//     expect task REF PRIORITY COMPLETED TITLE DESCRIPTION
+//     expect trash LIST REF PRIORITY COMPLETED TITLE DESCRIPTION
+//     expect history MSG_TYPE RESPONSE_CODE LIST BEFORE AFTER REF  (BEFORE and AFTER are none, active or trash; REF is - for no task)
+//     expect nothing                                              (for a close_connection that doesn't await an ack)
+//
+// Strings with spaces in them go in double quotes (with Go's escapes), and * in place of any expected value matches anything.
+// A step with no expect lines passes as long as the server answers it at all.
+package scenario
+
+import (
+    "bufio"
+    "fmt"
+    "io"
+    "ajb497/ptmp/ptmpclient"
+    "ajb497/ptmp"
+    "os"
+    "strconv"
+    "strings"
+)
+
+const WILDCARD string = "*"
+const NO_TASK string = "-"
+
+type Scenario struct {
+    Name string
+    Steps []Step
+}
+
+// One message to send and what should come back.
+type Step struct {
+    Line int
+    Text string // the send line, for reporting
+    Msg ptmp.PTMP_Msg
+    Expect []Expectation
+}
+
+// One expected reply message.  Fields are kept in the same normalized text form that replies get turned into
+// (see replyFields), so checking a reply is just comparing strings.
+type Expectation struct {
+    Line int
+    Kind string
+    Fields []string
+}
+
+func (e Expectation) String() string {
+    return strings.Join(append([]string{e.Kind}, quoteFields(e.Fields)...), " ")
+}
+
+// What each kind of field in an expect line has to look like.
+const (
+    FIELD_NUMBER byte = iota
+    FIELD_BOOL
+    FIELD_CODE
+    FIELD_LOCATION
+    FIELD_REF
+    FIELD_STRING
+)
+
+var expectation_fields = map[string][]byte{
+    "ack": {FIELD_CODE},
+    "connection_rules": {FIELD_BOOL, FIELD_BOOL},
+    "task": {FIELD_NUMBER, FIELD_NUMBER, FIELD_BOOL, FIELD_STRING, FIELD_STRING},
+    "trash": {FIELD_NUMBER, FIELD_NUMBER, FIELD_NUMBER, FIELD_BOOL, FIELD_STRING, FIELD_STRING},
+    "history": {FIELD_NUMBER, FIELD_CODE, FIELD_NUMBER, FIELD_LOCATION, FIELD_LOCATION, FIELD_REF},
+    "nothing": {},
+}
+
+var location_names = map[byte]string{
+    ptmp.TASK_LOCATION_NONE: "none",
+    ptmp.TASK_LOCATION_ACTIVE: "active",
+    ptmp.TASK_LOCATION_TRASH: "trash",
+}
+
+func ParseFile(filename string) (*Scenario, error) {
+    fileHandle, err_status := os.Open(filename)
+    if err_status != nil {
+        return nil, err_status
+    }
+    defer fileHandle.Close()
+    return Parse(fileHandle, filename)
+}
+
+func Parse(r io.Reader, name string) (*Scenario, error) {
+    parsed := &Scenario{Name: name}
+    scanner := bufio.NewScanner(r)
+    for line_num := 1; scanner.Scan(); line_num++ {
+        line := strings.TrimSpace(scanner.Text())
+        if line == "" || strings.HasPrefix(line, "#") {
+            continue
+        }
+        fields, err_status := splitFields(line)
+        if err_status != nil {
+            return nil, fmt.Errorf("%v:%v: %v", name, line_num, err_status)
+        }
+        switch fields[0] {
+            case "send":
+                if len(fields) < 2 {
+                    return nil, fmt.Errorf("%v:%v: send needs a message type", name, line_num)
+                }
+                msg, err_status := prepMessage(fields[1], fields[2:])
+                if err_status != nil {
+                    return nil, fmt.Errorf("%v:%v: %v", name, line_num, err_status)
+                }
+                parsed.Steps = append(parsed.Steps, Step{Line: line_num, Text: line, Msg: msg})
+            case "expect":
+                if len(parsed.Steps) == 0 {
+                    return nil, fmt.Errorf("%v:%v: expect before anything has been sent", name, line_num)
+                }
+                expected, err_status := parseExpectation(fields[1:])
+                if err_status != nil {
+                    return nil, fmt.Errorf("%v:%v: %v", name, line_num, err_status)
+                }
+                expected.Line = line_num
+                step := &parsed.Steps[len(parsed.Steps)-1]
+                step.Expect = append(step.Expect, expected)
+            default:
+                return nil, fmt.Errorf("%v:%v: lines need to start with send or expect, not %q", name, line_num, fields[0])
+        }
+    }
+    if err_status := scanner.Err(); err_status != nil {
+        return nil, err_status
+    }
+    return parsed, nil
+}
+
+// Split a line up on spaces, keeping quoted strings together.
+func splitFields(line string) ([]string, error) {
+    fields := []string{}
+    for line = strings.TrimSpace(line); line != ""; line = strings.TrimSpace(line) {
+        if line[0] != '"' {
+            end := strings.IndexAny(line, " \t")
+            if end < 0 {
+                end = len(line)
+            }
+            fields = append(fields, line[:end])
+            line = line[end:]
+            continue
+        }
+        // find the closing quote, skipping over escaped ones
+        end := 1
+        for ; end < len(line) && line[end] != '"'; end++ {
+            if line[end] == '\\' {
+                end++
+            }
+        }
+        if end >= len(line) {
+            return nil, fmt.Errorf("unterminated string")
+        }
+        unquoted, err_status := strconv.Unquote(line[:end+1])
+        if err_status != nil {
+            return nil, fmt.Errorf("bad string %v: %v", line[:end+1], err_status)
+        }
+        fields = append(fields, unquoted)
+        line = line[end+1:]
+    }
+    return fields, nil
+}
+
+func quoteFields(fields []string) []string {
+    quoted := []string{}
+    for _, field := range fields {
+        if field == "" || strings.ContainsAny(field, " \t\"\\") || !strconv.CanBackquote(field) {
+            field = strconv.Quote(field)
+        }
+        quoted = append(quoted, field)
+    }
+    return quoted
+}
+
+func parseUint16(field string) (uint16, error) {
+    value, err_status := strconv.ParseUint(field, 10, 16)
+    if err_status != nil {
+        return 0, fmt.Errorf("%q isn't a number from 0 to 65535", field)
+    }
+    return uint16(value), nil
+}
+
+func parseRefs(fields []string) ([]uint16, error) {
+    refs := []uint16{}
+    for _, field := range fields {
+        ref, err_status := parseUint16(field)
+        if err_status != nil {
+            return nil, err_status
+        }
+        refs = append(refs, ref)
+    }
+    return refs, nil
+}
+
+// Build the message for a send line.  Bad lengths are caught here since some of the Prep_* functions panic on them.
+func prepMessage(msg_name string, args []string) (ptmp.PTMP_Msg, error) {
+    num_args := map[string]int{"request_connection": 2, "close_connection": 1, "create_new_task": 4, "query_tasks": 2, "mark_task_completed": 2,
+                               "remove_tasks": -3, "query_trash": 1, "restore_tasks": -2, "purge_trash": -1, "query_history": 3}
+    wanted, known := num_args[msg_name]
+    if !known {
+        return ptmp.PTMP_Msg{}, fmt.Errorf("unknown message type %q", msg_name)
+    }
+    if (wanted >= 0 && len(args) != wanted) || (wanted < 0 && len(args) < -wanted) {
+        return ptmp.PTMP_Msg{}, fmt.Errorf("wrong number of arguments for %v", msg_name)
+    }
+    // The first couple of arguments are numbers for most of the messages, so get those out of the way up front.
+    nums := []uint16{}
+    for _, arg := range args {
+        num, err_status := parseUint16(arg)
+        if err_status != nil {
+            break
+        }
+        nums = append(nums, num)
+    }
+    need_nums := func(count int) error {
+        if len(nums) < count {
+            return fmt.Errorf("%v needs %v number(s) to start with", msg_name, count)
+        }
+        return nil
+    }
+
+    switch msg_name {
+        case "request_connection":
+            if len(args[0]) > int(ptmp.USERNAME_SIZE) || len(args[1]) > int(ptmp.PASSWORD_SIZE) {
+                return ptmp.PTMP_Msg{}, fmt.Errorf("username or password too long")
+            }
+            return ptmp.Prep_Request_Connection(args[0], args[1], 0, []uint16{uint16(ptmp.CURR_PROTOCOL_VERSION)}, []uint16{}, 0), nil
+        case "close_connection":
+            await, err_status := strconv.ParseBool(args[0])
+            if err_status != nil {
+                return ptmp.PTMP_Msg{}, fmt.Errorf("%q isn't true or false", args[0])
+            }
+            return ptmp.Prep_Close_Connection(await), nil
+        case "create_new_task":
+            if err_status := need_nums(2); err_status != nil {
+                return ptmp.PTMP_Msg{}, err_status
+            }
+            if len(args[2]) < 1 || len(args[2]) > int(ptmp.TITLE_MAX_LENGTH) || len(args[3]) < 1 || len(args[3]) > int(ptmp.DESCRIPTION_MAX_LENGTH) {
+                return ptmp.PTMP_Msg{}, fmt.Errorf("title or description length out of bounds")
+            }
+            return ptmp.Prep_Create_New_Task(nums[0], nums[1], args[2], args[3]), nil
+        case "query_tasks":
+            if err_status := need_nums(2); err_status != nil {
+                return ptmp.PTMP_Msg{}, err_status
+            }
+            return ptmp.Prep_Query_Tasks(nums[0], nums[1]), nil
+        case "mark_task_completed":
+            if err_status := need_nums(2); err_status != nil {
+                return ptmp.PTMP_Msg{}, err_status
+            }
+            return ptmp.Prep_Mark_Task_Completed(nums[0], nums[1]), nil
+        case "remove_tasks":
+            permit_incomplete, err_status := strconv.ParseBool(args[0])
+            if err_status != nil {
+                return ptmp.PTMP_Msg{}, fmt.Errorf("%q isn't true or false", args[0])
+            }
+            refs, err_status := parseRefs(args[1:])
+            if err_status != nil {
+                return ptmp.PTMP_Msg{}, err_status
+            }
+            return ptmp.Prep_Remove_Tasks(permit_incomplete, refs[0], refs[1:]), nil
+        case "query_trash":
+            if err_status := need_nums(1); err_status != nil {
+                return ptmp.PTMP_Msg{}, err_status
+            }
+            return ptmp.Prep_Query_Trash(nums[0]), nil
+        case "restore_tasks", "purge_trash":
+            refs, err_status := parseRefs(args)
+            if err_status != nil {
+                return ptmp.PTMP_Msg{}, err_status
+            }
+            if msg_name == "restore_tasks" {
+                return ptmp.Prep_Restore_Tasks(refs[0], refs[1:]), nil
+            }
+            return ptmp.Prep_Purge_Trash(refs[0], refs[1:]), nil
+        case "query_history":
+            whole_list, err_status := strconv.ParseBool(args[1])
+            if err_status != nil {
+                return ptmp.PTMP_Msg{}, fmt.Errorf("%q isn't true or false", args[1])
+            }
+            list_id, err_status := parseUint16(args[0])
+            if err_status != nil {
+                return ptmp.PTMP_Msg{}, err_status
+            }
+            ref, err_status := parseUint16(args[2])
+            if err_status != nil {
+                return ptmp.PTMP_Msg{}, err_status
+            }
+            return ptmp.Prep_Query_History(list_id, whole_list, ref), nil
+    }
+    return ptmp.PTMP_Msg{}, fmt.Errorf("unknown message type %q", msg_name)
+}
+
+// Check the fields of an expect line and put them into normalized form (code numbers become names, true/false are
+// spelled out the same way every time, and so on).
+func parseExpectation(fields []string) (Expectation, error) {
+    if len(fields) == 0 {
+        return Expectation{}, fmt.Errorf("expect needs a reply type")
+    }
+    field_kinds, known := expectation_fields[fields[0]]
+    if !known {
+        return Expectation{}, fmt.Errorf("unknown reply type %q", fields[0])
+    }
+    if len(fields)-1 != len(field_kinds) {
+        return Expectation{}, fmt.Errorf("%v takes %v value(s)", fields[0], len(field_kinds))
+    }
+    expected := Expectation{Kind: fields[0], Fields: []string{}}
+    for ii, field := range fields[1:] {
+        if field == WILDCARD {
+            expected.Fields = append(expected.Fields, field)
+            continue
+        }
+        normalized, err_status := normalizeField(field_kinds[ii], field)
+        if err_status != nil {
+            return Expectation{}, err_status
+        }
+        expected.Fields = append(expected.Fields, normalized)
+    }
+    return expected, nil
+}
+
+func normalizeField(kind byte, field string) (string, error) {
+    switch kind {
+        case FIELD_NUMBER:
+            value, err_status := parseUint16(field)
+            return strconv.Itoa(int(value)), err_status
+        case FIELD_REF:
+            if field == NO_TASK {
+                return field, nil
+            }
+            value, err_status := parseUint16(field)
+            return strconv.Itoa(int(value)), err_status
+        case FIELD_BOOL:
+            value, err_status := strconv.ParseBool(field)
+            if err_status != nil {
+                return "", fmt.Errorf("%q isn't true or false", field)
+            }
+            return strconv.FormatBool(value), nil
+        case FIELD_CODE:
+            if code, err_status := parseUint16(field); err_status == nil {
+                return ptmpclient.ResponseCodeName(code), nil
+            }
+            if _, known := ptmpclient.ResponseCodeFromName(field); !known {
+                return "", fmt.Errorf("unknown response code %q", field)
+            }
+            return field, nil
+        case FIELD_LOCATION:
+            for _, name := range location_names {
+                if field == name {
+                    return field, nil
+                }
+            }
+            return "", fmt.Errorf("%q isn't none, active or trash", field)
+    }
+    return field, nil
+}
@@ -1,5 +1,5 @@
 cd ./server
-go run . &
+go run . -storage memory &
 cd ../client
 sleep 3
 go run .
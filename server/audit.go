@@ -0,0 +1,257 @@
+package main
+
+import (
+    "bufio"
+    "encoding/json"
+    "errors"
+    "io/fs"
+    "ajb497/ptmp"
+    "ajb497/ptmp/ptmpserver"
+    "os"
+    "path/filepath"
+    "time"
+)
+
+// The audit log is kept next to the store file, one JSON record per line, and only ever appended to.
+const AUDIT_FILENAME string = "audit.jsonl"
+const SWEEPER_USER string = "(trash sweeper)" // shows up as the user for deletions made by the sweeper rather than a client
+// Msgs_To_Follow is a single byte, so a history response can't be longer than this.  When there is more history
+// than that, the most recent entries are the ones that get sent.
+const MAX_HISTORY_ENTRIES_SENT int = 256
+
+// What a task looked like at one point in time, for the before/after values of an audit record.
+type audit_task_state struct {
+    List_ID uint16 `json:"list_id"`
+    Trashed bool `json:"trashed"`
+    Task stored_task `json:"task"`
+}
+
+// One change to one task (or one state-changing message that didn't end up changing anything, in which case
+// there is no task reference and no before/after).
+type audit_record struct {
+    Time time.Time `json:"time"`
+    User string `json:"user"`
+    Session uint32 `json:"session"`
+    Msg_Type byte `json:"msg_type"`
+    Response_Code uint16 `json:"response_code"`
+    List_ID uint16 `json:"list_id"`
+    Task_Ref *uint16 `json:"task_ref,omitempty"`
+    Before *audit_task_state `json:"before,omitempty"`
+    After *audit_task_state `json:"after,omitempty"`
+}
+
+var audit_log []audit_record
+
+// The message types that can change what's in the store.  Everything else is left out of the audit log.
+func isStateChanging(msg_type byte) bool {
+    switch msg_type {
+        case ptmp.CREATE_NEW_TASK, ptmp.REMOVE_TASK, ptmp.MARK_TASK_COMPLETED, ptmp.RESTORE_TASKS, ptmp.PURGE_TRASH:
+            return true
+    }
+    return false
+}
+
+// Pull the list ID out of whichever state-changing message we were sent.
+func requestedListID(msg *ptmp.PTMP_Msg) uint16 {
+    switch msg.Hdr.Msg_Type_ID {
+        case ptmp.CREATE_NEW_TASK:
+            return ptmp.DecodePayload[ptmp.Create_New_Task](msg.Pld).Associated_List_ID
+        case ptmp.REMOVE_TASK:
+            return ptmp.DecodePayload[ptmp.Remove_Tasks](msg.Pld).List_ID
+        case ptmp.MARK_TASK_COMPLETED:
+            return ptmp.DecodePayload[ptmp.Mark_Task_Completed](msg.Pld).List_ID
+        case ptmp.RESTORE_TASKS:
+            return ptmp.DecodePayload[ptmp.Restore_Tasks](msg.Pld).List_ID
+        case ptmp.PURGE_TRASH:
+            return ptmp.DecodePayload[ptmp.Purge_Trash](msg.Pld).List_ID
+    }
+    return 0
+}
+
+// Grab the current state of every task we know about (active or trashed), keyed by reference number.
+// Comparing one of these from before a message is handled against one from after is how we figure out
+// what the message actually changed, without every handler needing to report it themselves.
+func snapshotTaskStates() map[uint16]audit_task_state {
+    states := make(map[uint16]audit_task_state)
+    for _, task := range active_tasks {
+        states[task.Task_Reference_Number] = audit_task_state{List_ID: 1, Task: taskToStored(task)} // list 1 is the only list there is
+    }
+    for listId, list_trash := range trash {
+        for _, tt := range list_trash {
+            states[tt.info.Task_Reference_Number] = audit_task_state{List_ID: listId, Trashed: true, Task: taskToStored(tt.info)}
+        }
+    }
+    return states
+}
+
+// Called after a message has been handled, with how it was answered and the snapshot taken just before it was handled.
+// The changes of a transaction aren't made until the last one gets here, and then everything the transaction did
+// is recorded against the transaction as a whole.
+func auditMessage(r *ptmpserver.Request, response_code uint16, before map[uint16]audit_task_state) {
+    if !r.Session.LoggedIn() || !isStateChanging(r.Msg.Hdr.Msg_Type_ID) || r.Session.State == ptmpserver.STATE_TRANSACTION_IN_PROGRESS {
+        return
+    }
+    msg_type := r.Msg.Hdr.Msg_Type_ID
+    if r.Transaction != nil {
+        msg_type = ptmp.TRANSACTION
+    }
+    recordChanges(r.Session.User, r.Session.ID, msg_type, response_code, requestedListID(r.Msg), before)
+}
+
+// Work out which tasks changed between the before snapshot and now, and add a record for each of them to the
+// audit log (in memory and on disk).  If anything changed, the store gets saved too.
+func recordChanges(user string, session uint32, msg_type byte, response_code uint16, listId uint16, before map[uint16]audit_task_state) {
+    after := snapshotTaskStates()
+    now := time.Now()
+    new_records := []audit_record{}
+    for ref, old_state := range before {
+        new_state, still_there := after[ref]
+        if still_there && new_state == old_state {
+            continue
+        }
+        record := audit_record{Time: now, User: user, Session: session, Msg_Type: msg_type, Response_Code: response_code, List_ID: old_state.List_ID}
+        task_ref := ref
+        record.Task_Ref = &task_ref
+        old_copy := old_state
+        record.Before = &old_copy
+        if still_there {
+            new_copy := new_state
+            record.After = &new_copy
+        }
+        new_records = append(new_records, record)
+    }
+    for ref, new_state := range after {
+        if _, was_there := before[ref]; was_there {
+            continue
+        }
+        task_ref := ref
+        new_copy := new_state
+        new_records = append(new_records, audit_record{Time: now, User: user, Session: session, Msg_Type: msg_type, Response_Code: response_code,
+                                                       List_ID: new_state.List_ID, Task_Ref: &task_ref, After: &new_copy})
+    }
+    changed_store := len(new_records) > 0
+    if !changed_store {
+        // Nothing changed (the message was rejected), but it's still worth knowing that someone tried.
+        new_records = append(new_records, audit_record{Time: now, User: user, Session: session, Msg_Type: msg_type, Response_Code: response_code, List_ID: listId})
+    }
+
+    audit_log = append(audit_log, new_records...)
+    err_status := appendAuditRecords(new_records)
+    noteHealth(&audit_health, err_status)
+    if err_status != nil {
+        logger.Error("Unable to write to the audit log", "user", user, "session", session, "error", err_status)
+    }
+    if changed_store {
+        err_status := saveStore()
+        noteHealth(&store_health, err_status)
+        if err_status != nil {
+            logger.Error("Unable to save the task store", "error", err_status)
+        }
+    }
+}
+
+func appendAuditRecords(records []audit_record) error {
+    if STORAGE_BACKEND == STORAGE_MEMORY {
+        return nil
+    }
+    if err_status := os.MkdirAll(DATA_DIR, 0755); err_status != nil {
+        return err_status
+    }
+    fileHandle, err_status := os.OpenFile(filepath.Join(DATA_DIR, AUDIT_FILENAME), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+    if err_status != nil {
+        return err_status
+    }
+    defer fileHandle.Close()
+    encoder := json.NewEncoder(fileHandle) // Encode puts a newline after each record, which is exactly the one-record-per-line format we want
+    for _, record := range records {
+        if err_status = encoder.Encode(record); err_status != nil {
+            return err_status
+        }
+    }
+    return nil
+}
+
+// Read the audit log back in at startup so that history survives a restart along with the tasks themselves.
+func loadAuditLog() error {
+    if STORAGE_BACKEND == STORAGE_MEMORY {
+        return nil
+    }
+    fileHandle, err_status := os.Open(filepath.Join(DATA_DIR, AUDIT_FILENAME))
+    if errors.Is(err_status, fs.ErrNotExist) {
+        return nil
+    }
+    if err_status != nil {
+        return err_status
+    }
+    defer fileHandle.Close()
+    scanner := bufio.NewScanner(fileHandle)
+    scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+    audit_log = []audit_record{}
+    for scanner.Scan() {
+        record := audit_record{}
+        if err_status = json.Unmarshal(scanner.Bytes(), &record); err_status != nil {
+            return err_status
+        }
+        audit_log = append(audit_log, record)
+    }
+    return scanner.Err()
+}
+
+// Convert an audit record into the form it goes out over the wire in.
+func recordToEntry(record audit_record) ptmp.Audit_Entry {
+    entry := ptmp.Audit_Entry{
+                              Timestamp: record.Time.Unix(),
+                              Length_of_Username: byte(len(record.User)),
+                              Username: []byte(record.User),
+                              Session_ID: record.Session,
+                              Msg_Type_ID: record.Msg_Type,
+                              Response_Code: record.Response_Code,
+                              List_ID: record.List_ID,
+                             }
+    entry.Before_Location, entry.Before_Completion_Status = stateToLocation(record.Before)
+    entry.After_Location, entry.After_Completion_Status = stateToLocation(record.After)
+    if record.After != nil {
+        entry.Task = storedToTask(record.After.Task)
+    } else if record.Before != nil {
+        entry.Task = storedToTask(record.Before.Task)
+    }
+    return entry
+}
+
+func stateToLocation(state *audit_task_state) (byte, byte) {
+    if state == nil {
+        return ptmp.TASK_LOCATION_NONE, ptmp.Bool2Byte(false)
+    }
+    if state.Trashed {
+        return ptmp.TASK_LOCATION_TRASH, ptmp.Bool2Byte(state.Task.Completed)
+    }
+    return ptmp.TASK_LOCATION_ACTIVE, ptmp.Bool2Byte(state.Task.Completed)
+}
+
+// Answer a Query_History message with the matching audit records, oldest first, one per message.
+func sendHistory(w ptmpserver.ResponseWriter, query ptmp.Query_History) {
+    if query.List_ID != 1 {
+        w.Ack(ptmp.LIST_DOES_NOT_EXIST)
+        return
+    }
+    matching := []audit_record{}
+    for _, record := range audit_log {
+        if record.List_ID != query.List_ID {
+            continue
+        }
+        if ptmp.Byte2Bool(query.Whole_List) || (record.Task_Ref != nil && *record.Task_Ref == query.Task_Reference_Number) {
+            matching = append(matching, record)
+        }
+    }
+    if len(matching) == 0 {
+        w.Ack(ptmp.UNABLE_TO_COMPLY)
+        return
+    }
+    if len(matching) > MAX_HISTORY_ENTRIES_SENT {
+        matching = matching[len(matching)-MAX_HISTORY_ENTRIES_SENT:]
+    }
+    for ii := 0; ii < len(matching); ii++ {
+        info := ptmp.Prep_History_Information([]ptmp.Audit_Entry{recordToEntry(matching[ii])}, byte(len(matching)-1-ii))
+        w.Send(info)
+    }
+}
@@ -0,0 +1,515 @@
+package main
+
+import (
+    "bufio"
+    "crypto/sha256"
+    "crypto/subtle"
+    "crypto/tls"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "flag"
+    "fmt"
+    "io"
+    "io/fs"
+    "ajb497/ptmp"
+    "ajb497/ptmp/ptmplog"
+    "net"
+    "os"
+    "os/signal"
+    "strconv"
+    "strings"
+    "sync/atomic"
+    "syscall"
+    "time"
+)
+
+// The server reads its settings from a JSON config file (server.json in the directory it's started from, unless
+// -config says otherwise), then PTMP_SERVER_* environment variables, then command-line flags, with each one
+// overriding the ones before it.  Anything none of them mention keeps the default from defaultConfig.
+const DEFAULT_CONFIG_FILENAME string = "server.json"
+const ENV_PREFIX string = "PTMP_SERVER_"
+
+const (
+    STORAGE_FILE string = "file" // the store and audit log are kept in files in the storage path, and survive restarts
+    STORAGE_MEMORY string = "memory" // nothing is written to disk, everything is gone when the server stops
+)
+
+const (
+    AUTH_STATIC string = "static" // the one username and password in the config
+    AUTH_USERS_FILE string = "file" // a file of "username:sha256-of-password-in-hex" lines
+)
+
+var log_levels = []string{"debug", "info", "warn", "error"}
+
+// A time.Duration that reads and writes as a string like "90s" in the config file.
+type config_duration time.Duration
+
+func (d config_duration) MarshalJSON() ([]byte, error) {
+    return json.Marshal(time.Duration(d).String())
+}
+
+func (d *config_duration) UnmarshalJSON(raw []byte) error {
+    var in_str string
+    if err_status := json.Unmarshal(raw, &in_str); err_status != nil {
+        return err_status
+    }
+    parsed, err_status := time.ParseDuration(in_str)
+    *d = config_duration(parsed)
+    return err_status
+}
+
+type storage_config struct {
+    Backend string `json:"backend"`
+    Path string `json:"path"`
+}
+
+type auth_config struct {
+    Backend string `json:"backend"`
+    Username string `json:"username,omitempty"`
+    Password string `json:"password,omitempty"`
+    Users_File string `json:"users_file,omitempty"`
+}
+
+type timeouts_config struct {
+    Session_Idle config_duration `json:"session_idle"` // 0 means sessions never time out
+    Gateway_Read config_duration `json:"gateway_read"`
+    Gateway_Write config_duration `json:"gateway_write"`
+    Shutdown config_duration `json:"shutdown"` // how long sessions and gateway requests get to finish when the server is asked to stop
+}
+
+type tls_config struct {
+    Cert_File string `json:"cert_file,omitempty"`
+    Key_File string `json:"key_file,omitempty"`
+}
+
+type limits_config struct {
+    Message_Rate float64 `json:"message_rate"` // messages a second per session, once the burst is used up
+    Message_Burst int `json:"message_burst"`
+    Max_Sessions int `json:"max_sessions"` // connections served at once, logged in or not (0 for no limit)
+    Max_Sessions_Per_User int `json:"max_sessions_per_user"` // sessions one user can have logged in at once (0 for no limit)
+    Login_Max_Failures int `json:"login_max_failures"` // failed logins in a row for a user or from an address before it's locked out
+    Login_Lockout config_duration `json:"login_lockout"` // the first lockout, doubling with every failure after that
+    Login_Max_Lockout config_duration `json:"login_max_lockout"` // the longest lockout, and how long failures are remembered
+    Idempotency_Keys int `json:"idempotency_keys"` // how many idempotency keys (and what they were answered with) are remembered per user
+    Idempotency_TTL config_duration `json:"idempotency_ttl"` // and for how long
+    Resume_TTL config_duration `json:"resume_ttl"` // how long after its connection drops a session can be resumed with its token
+    Max_Tasks_Per_List int `json:"max_tasks_per_list"` // tasks a list can have on it before new ones are turned away (0 for no limit)
+    Max_Payload_Size int `json:"max_payload_size"` // the largest payload a client can agree to when it logs in
+    Max_Title_Chars int `json:"max_title_chars"` // characters a title can have (it can't be over 255 bytes either way)
+    Max_Description_Chars int `json:"max_description_chars"` // characters a description can have (it can't be over 511 bytes either way)
+    Max_Query_Results int `json:"max_query_results"` // tasks sent for one page of a version 2 query
+}
+
+type server_config struct {
+    Listen string `json:"listen"`
+    Gateway_Listen string `json:"gateway_listen"` // empty turns the HTTP gateway off
+    Metrics_Listen string `json:"metrics_listen"` // where /metrics, /healthz and /readyz are served (localhost only); empty for nowhere
+    Storage storage_config `json:"storage"`
+    Auth auth_config `json:"auth"`
+    Timeouts timeouts_config `json:"timeouts"`
+    TLS tls_config `json:"tls"`
+    Limits limits_config `json:"limits"`
+    Log_Level string `json:"log_level"`
+    Log_Format string `json:"log_format"` // text or json, for both the log and the access log
+    Access_Log string `json:"access_log"` // file the access log lines go to; empty sends them to the main log (on stderr)
+
+    users map[string][]byte // loaded from the users file when the auth backend is "file", password hashes keyed by username
+}
+
+// The config currently in effect.  Swapped out wholesale when the config is reloaded, so anything that needs more
+// than one setting should Load it once and use that.
+var current_config atomic.Pointer[server_config]
+
+func init() {
+    applyConfig(defaultConfig()) // so that there's always a config, even before main has loaded the real one (and in tests)
+}
+
+func defaultConfig() *server_config {
+    return &server_config{
+                          Listen: HOST,
+                          Gateway_Listen: GATEWAY_HOST,
+                          Storage: storage_config{Backend: STORAGE_FILE, Path: "data"},
+                          Auth: auth_config{Backend: AUTH_STATIC, Username: VALID_UNAME, Password: VALID_PW},
+                          Timeouts: timeouts_config{Gateway_Read: config_duration(10*time.Second), Gateway_Write: config_duration(30*time.Second), Shutdown: config_duration(SHUTDOWN_TIMEOUT)},
+                          Limits: limits_config{
+                                                Message_Rate: MESSAGE_RATE,
+                                                Message_Burst: MESSAGE_BURST,
+                                                Max_Sessions: MAX_SESSIONS,
+                                                Max_Sessions_Per_User: MAX_SESSIONS_PER_USER,
+                                                Login_Max_Failures: LOGIN_MAX_FAILURES,
+                                                Login_Lockout: config_duration(LOGIN_LOCKOUT),
+                                                Login_Max_Lockout: config_duration(LOGIN_MAX_LOCKOUT),
+                                                Idempotency_Keys: IDEMPOTENCY_KEYS,
+                                                Idempotency_TTL: config_duration(IDEMPOTENCY_TTL),
+                                                Resume_TTL: config_duration(RESUME_TTL),
+                                                Max_Tasks_Per_List: MAX_TASKS_PER_LIST,
+                                                Max_Payload_Size: MAX_PAYLOAD_SIZE,
+                                                Max_Title_Chars: MAX_TITLE_CHARS,
+                                                Max_Description_Chars: MAX_DESCRIPTION_CHARS,
+                                                Max_Query_Results: MAX_QUERY_RESULTS,
+                                               },
+                          Log_Level: "debug",
+                          Log_Format: ptmplog.FORMAT_TEXT,
+                         }
+}
+
+// Where each setting can be set from: its name in the environment (after ENV_PREFIX) and on the command line,
+// and how to put a string value for it into a config.
+type config_setting struct {
+    name string
+    usage string
+    apply func(cfg *server_config, value string) error
+}
+
+func stringSetting(field func(*server_config) *string) func(*server_config, string) error {
+    return func(cfg *server_config, value string) error {
+        *field(cfg) = value
+        return nil
+    }
+}
+
+func intSetting(field func(*server_config) *int) func(*server_config, string) error {
+    return func(cfg *server_config, value string) error {
+        parsed, err_status := strconv.Atoi(value)
+        *field(cfg) = parsed
+        return err_status
+    }
+}
+
+func durationSetting(field func(*server_config) *config_duration) func(*server_config, string) error {
+    return func(cfg *server_config, value string) error {
+        parsed, err_status := time.ParseDuration(value)
+        *field(cfg) = config_duration(parsed)
+        return err_status
+    }
+}
+
+var config_settings = []config_setting{
+    {"listen", "address to listen for PTMP clients on", stringSetting(func(cfg *server_config) *string { return &cfg.Listen })},
+    {"gateway-listen", "address for the HTTP gateway to listen on (empty to turn it off)", stringSetting(func(cfg *server_config) *string { return &cfg.Gateway_Listen })},
+    {"storage", "storage backend (file or memory)", stringSetting(func(cfg *server_config) *string { return &cfg.Storage.Backend })},
+    {"storage-path", "directory the file storage backend keeps the store and audit log in", stringSetting(func(cfg *server_config) *string { return &cfg.Storage.Path })},
+    {"auth", "auth backend (static or file)", stringSetting(func(cfg *server_config) *string { return &cfg.Auth.Backend })},
+    {"auth-username", "username for the static auth backend", stringSetting(func(cfg *server_config) *string { return &cfg.Auth.Username })},
+    {"auth-password", "password for the static auth backend", stringSetting(func(cfg *server_config) *string { return &cfg.Auth.Password })},
+    {"users-file", "users file for the file auth backend", stringSetting(func(cfg *server_config) *string { return &cfg.Auth.Users_File })},
+    {"shutdown-timeout", "how long to wait for sessions to finish when stopping on SIGINT or SIGTERM", durationSetting(func(cfg *server_config) *config_duration { return &cfg.Timeouts.Shutdown })},
+    {"session-idle-timeout", "disconnect sessions that send nothing for this long (0 for never)", durationSetting(func(cfg *server_config) *config_duration { return &cfg.Timeouts.Session_Idle })},
+    {"gateway-read-timeout", "how long the HTTP gateway waits for a request", durationSetting(func(cfg *server_config) *config_duration { return &cfg.Timeouts.Gateway_Read })},
+    {"gateway-write-timeout", "how long the HTTP gateway takes to answer a request before giving up", durationSetting(func(cfg *server_config) *config_duration { return &cfg.Timeouts.Gateway_Write })},
+    {"tls-cert", "TLS certificate file (with -tls-key, serves PTMP and the gateway over TLS)", stringSetting(func(cfg *server_config) *string { return &cfg.TLS.Cert_File })},
+    {"tls-key", "TLS private key file", stringSetting(func(cfg *server_config) *string { return &cfg.TLS.Key_File })},
+    {"message-rate", "messages a second each session can send once its burst is used up", func(cfg *server_config, value string) error {
+        parsed, err_status := strconv.ParseFloat(value, 64)
+        cfg.Limits.Message_Rate = parsed
+        return err_status
+    }},
+    {"message-burst", "messages each session can send in a row before being rate limited", intSetting(func(cfg *server_config) *int { return &cfg.Limits.Message_Burst })},
+    {"max-sessions", "connections to serve at once (0 for no limit)", intSetting(func(cfg *server_config) *int { return &cfg.Limits.Max_Sessions })},
+    {"max-sessions-per-user", "sessions one user can have logged in at once (0 for no limit)", intSetting(func(cfg *server_config) *int { return &cfg.Limits.Max_Sessions_Per_User })},
+    {"login-max-failures", "failed logins in a row for a user or from an address before logins are locked out", intSetting(func(cfg *server_config) *int { return &cfg.Limits.Login_Max_Failures })},
+    {"login-lockout", "how long the first lockout lasts (each one after that is twice as long)", durationSetting(func(cfg *server_config) *config_duration { return &cfg.Limits.Login_Lockout })},
+    {"login-max-lockout", "the longest a lockout gets, and how long failed logins are remembered", durationSetting(func(cfg *server_config) *config_duration { return &cfg.Limits.Login_Max_Lockout })},
+    {"idempotency-keys", "how many idempotency keys to remember per user, so retried changes aren't made twice", intSetting(func(cfg *server_config) *int { return &cfg.Limits.Idempotency_Keys })},
+    {"idempotency-ttl", "how long idempotency keys are remembered for", durationSetting(func(cfg *server_config) *config_duration { return &cfg.Limits.Idempotency_TTL })},
+    {"resume-ttl", "how long a client whose connection dropped can resume its session without logging in again", durationSetting(func(cfg *server_config) *config_duration { return &cfg.Limits.Resume_TTL })},
+    {"max-tasks-per-list", "tasks a list can have on it before new ones are turned away (0 for no limit)", intSetting(func(cfg *server_config) *int { return &cfg.Limits.Max_Tasks_Per_List })},
+    {"max-payload-size", "the largest payload (in bytes) a client can agree to when it logs in", intSetting(func(cfg *server_config) *int { return &cfg.Limits.Max_Payload_Size })},
+    {"max-title-chars", "characters a task title can have (it can't be over 255 bytes either way)", intSetting(func(cfg *server_config) *int { return &cfg.Limits.Max_Title_Chars })},
+    {"max-description-chars", "characters a task description can have (it can't be over 511 bytes either way)", intSetting(func(cfg *server_config) *int { return &cfg.Limits.Max_Description_Chars })},
+    {"max-query-results", "the most tasks sent for one page of a query (clients page through the rest)", intSetting(func(cfg *server_config) *int { return &cfg.Limits.Max_Query_Results })},
+    {"metrics-listen", "localhost address to serve Prometheus metrics, /healthz and /readyz on (empty for off)", stringSetting(func(cfg *server_config) *string { return &cfg.Metrics_Listen })},
+    {"log-level", "debug, info, warn or error", stringSetting(func(cfg *server_config) *string { return &cfg.Log_Level })},
+    {"log-format", "text or json", stringSetting(func(cfg *server_config) *string { return &cfg.Log_Format })},
+    {"access-log", "file to write the access log to (one line per message handled) instead of the main log", stringSetting(func(cfg *server_config) *string { return &cfg.Access_Log })},
+}
+
+func envName(setting_name string) string {
+    return ENV_PREFIX + strings.ToUpper(strings.ReplaceAll(setting_name, "-", "_"))
+}
+
+// What was given on the command line.  Only the settings that were actually passed end up in overrides, so that
+// they win over the config file and environment without the flags' defaults stomping on everything else.
+type command_line struct {
+    config_path string
+    config_explicit bool
+    print_config bool
+    state_graph bool
+    overrides map[string]string
+}
+
+func parseCommandLine(args []string, usage_out io.Writer) (*command_line, error) {
+    cmd := &command_line{overrides: make(map[string]string)}
+    flags := flag.NewFlagSet("server", flag.ContinueOnError)
+    flags.SetOutput(usage_out)
+    flags.StringVar(&cmd.config_path, "config", DEFAULT_CONFIG_FILENAME, "config file to read")
+    flags.BoolVar(&cmd.print_config, "print-config", false, "print the config the server would run with (after the file, environment and flags) and exit")
+    flags.BoolVar(&cmd.state_graph, "state-graph", false, "print the session state machine as a Graphviz diagram and exit")
+    for _, setting := range config_settings {
+        flags.String(setting.name, "", setting.usage + " (env " + envName(setting.name) + ")")
+    }
+    if err_status := flags.Parse(args); err_status != nil {
+        return nil, err_status
+    }
+    if flags.NArg() > 0 {
+        return nil, fmt.Errorf("unexpected argument %q", flags.Arg(0))
+    }
+    flags.Visit(func(f *flag.Flag) {
+        switch f.Name {
+            case "config":
+                cmd.config_explicit = true
+            case "print-config", "state-graph":
+            default:
+                cmd.overrides[f.Name] = f.Value.String()
+        }
+    })
+    return cmd, nil
+}
+
+// Build the config from the defaults, the config file, the environment and the command line, in that order, and
+// check that it makes sense.  A missing config file is only a problem if one was asked for by name.
+func loadConfig(cmd *command_line) (*server_config, error) {
+    cfg := defaultConfig()
+    raw, err_status := os.ReadFile(cmd.config_path)
+    if err_status != nil && !(errors.Is(err_status, fs.ErrNotExist) && !cmd.config_explicit) {
+        return nil, err_status
+    }
+    if err_status == nil {
+        decoder := json.NewDecoder(strings.NewReader(string(raw)))
+        decoder.DisallowUnknownFields() // a typo in a setting name should be an error, not silently ignored
+        if err_status = decoder.Decode(cfg); err_status != nil {
+            return nil, fmt.Errorf("%v: %w", cmd.config_path, err_status)
+        }
+    }
+    for _, setting := range config_settings {
+        if value, found := os.LookupEnv(envName(setting.name)); found {
+            if err_status = setting.apply(cfg, value); err_status != nil {
+                return nil, fmt.Errorf("%v: %w", envName(setting.name), err_status)
+            }
+        }
+    }
+    for _, setting := range config_settings {
+        if value, found := cmd.overrides[setting.name]; found {
+            if err_status = setting.apply(cfg, value); err_status != nil {
+                return nil, fmt.Errorf("-%v: %w", setting.name, err_status)
+            }
+        }
+    }
+    if err_status = cfg.validate(); err_status != nil {
+        return nil, err_status
+    }
+    return cfg, nil
+}
+
+// Check every setting, reporting everything that's wrong at once rather than one problem per restart.
+// Loads the users file along the way, since the only way to know it's any good is to read it.
+func (cfg *server_config) validate() error {
+    problems := []error{}
+    addresses := map[string]string{"listen": cfg.Listen, "gateway_listen": cfg.Gateway_Listen, "metrics_listen": cfg.Metrics_Listen}
+    for _, name := range []string{"listen", "gateway_listen", "metrics_listen"} {
+        addr := addresses[name]
+        if addr == "" && name != "listen" {
+            continue
+        }
+        host, _, err_status := net.SplitHostPort(addr)
+        if err_status != nil {
+            problems = append(problems, fmt.Errorf("%v: %w", name, err_status))
+        } else if name == "metrics_listen" && !isLoopback(host) {
+            // nothing on it needs a login, so it isn't something to put on the network
+            problems = append(problems, fmt.Errorf("metrics_listen has to be a localhost address, not %v", addr))
+        }
+        for _, other := range []string{"listen", "gateway_listen", "metrics_listen"} {
+            if other < name && addr != "" && addr == addresses[other] {
+                problems = append(problems, fmt.Errorf("%v and %v can't both be %v", other, name, addr))
+            }
+        }
+    }
+
+    switch cfg.Storage.Backend {
+        case STORAGE_FILE:
+            if cfg.Storage.Path == "" {
+                problems = append(problems, errors.New("storage.path is needed for the file storage backend"))
+            }
+        case STORAGE_MEMORY:
+        default:
+            problems = append(problems, fmt.Errorf("storage.backend %q isn't one of %v or %v", cfg.Storage.Backend, STORAGE_FILE, STORAGE_MEMORY))
+    }
+
+    switch cfg.Auth.Backend {
+        case AUTH_STATIC:
+            if cfg.Auth.Username == "" || cfg.Auth.Password == "" {
+                problems = append(problems, errors.New("auth.username and auth.password are needed for the static auth backend"))
+            }
+        case AUTH_USERS_FILE:
+            users, err_status := loadUsersFile(cfg.Auth.Users_File)
+            if err_status != nil {
+                problems = append(problems, fmt.Errorf("auth.users_file: %w", err_status))
+            }
+            cfg.users = users
+        default:
+            problems = append(problems, fmt.Errorf("auth.backend %q isn't one of %v or %v", cfg.Auth.Backend, AUTH_STATIC, AUTH_USERS_FILE))
+    }
+
+    if cfg.Timeouts.Session_Idle < 0 || cfg.Timeouts.Gateway_Read < 0 || cfg.Timeouts.Gateway_Write < 0 {
+        problems = append(problems, errors.New("timeouts can't be negative"))
+    }
+
+    if (cfg.TLS.Cert_File == "") != (cfg.TLS.Key_File == "") {
+        problems = append(problems, errors.New("tls.cert_file and tls.key_file have to be given together"))
+    } else if cfg.TLS.Cert_File != "" {
+        if _, err_status := tls.LoadX509KeyPair(cfg.TLS.Cert_File, cfg.TLS.Key_File); err_status != nil {
+            problems = append(problems, fmt.Errorf("tls: %w", err_status))
+        }
+    }
+
+    if cfg.Limits.Message_Rate <= 0 || cfg.Limits.Message_Burst < 1 {
+        problems = append(problems, errors.New("limits.message_rate has to be more than 0 and limits.message_burst at least 1"))
+    }
+    if cfg.Timeouts.Shutdown <= 0 {
+        problems = append(problems, errors.New("timeouts.shutdown has to be more than 0"))
+    }
+    if cfg.Limits.Max_Sessions < 0 || cfg.Limits.Max_Sessions_Per_User < 0 {
+        problems = append(problems, errors.New("limits.max_sessions and limits.max_sessions_per_user can't be negative"))
+    }
+    if cfg.Limits.Login_Max_Failures < 1 || cfg.Limits.Login_Lockout <= 0 || cfg.Limits.Login_Max_Lockout < cfg.Limits.Login_Lockout {
+        problems = append(problems, errors.New("limits.login_max_failures has to be at least 1, and limits.login_lockout more than 0 and no more than limits.login_max_lockout"))
+    }
+    if cfg.Limits.Idempotency_Keys < 1 || cfg.Limits.Idempotency_TTL <= 0 {
+        problems = append(problems, errors.New("limits.idempotency_keys has to be at least 1 and limits.idempotency_ttl more than 0"))
+    }
+    if cfg.Limits.Resume_TTL <= 0 {
+        problems = append(problems, errors.New("limits.resume_ttl has to be more than 0"))
+    }
+    if cfg.Limits.Max_Tasks_Per_List < 0 || cfg.Limits.Max_Tasks_Per_List > 65535 {
+        problems = append(problems, errors.New("limits.max_tasks_per_list has to be from 0 to 65535, since that's as many reference numbers as there are"))
+    }
+    if cfg.Limits.Max_Payload_Size < int(ptmp.MAX_PAYLOAD_SIZE) || cfg.Limits.Max_Payload_Size > int(ptmp.LARGEST_PAYLOAD_SIZE) {
+        problems = append(problems, fmt.Errorf("limits.max_payload_size has to be from %v (what every client can send) to %v", ptmp.MAX_PAYLOAD_SIZE, ptmp.LARGEST_PAYLOAD_SIZE))
+    }
+    if cfg.Limits.Max_Title_Chars < 1 || cfg.Limits.Max_Title_Chars > int(ptmp.TITLE_MAX_LENGTH) {
+        problems = append(problems, fmt.Errorf("limits.max_title_chars has to be from 1 to %v, since a title can't be over %v bytes", ptmp.TITLE_MAX_LENGTH, ptmp.TITLE_MAX_LENGTH))
+    }
+    if cfg.Limits.Max_Description_Chars < 1 || cfg.Limits.Max_Description_Chars > int(ptmp.DESCRIPTION_MAX_LENGTH) {
+        problems = append(problems, fmt.Errorf("limits.max_description_chars has to be from 1 to %v, since a description can't be over %v bytes", ptmp.DESCRIPTION_MAX_LENGTH, ptmp.DESCRIPTION_MAX_LENGTH))
+    }
+    if cfg.Limits.Max_Query_Results < 1 || cfg.Limits.Max_Query_Results > 255 {
+        problems = append(problems, errors.New("limits.max_query_results has to be from 1 to 255, since a page and the message that ends it have to fit in one series"))
+    }
+
+    valid_level := false
+    for _, level := range log_levels {
+        valid_level = valid_level || cfg.Log_Level == level
+    }
+    if !valid_level {
+        problems = append(problems, fmt.Errorf("log_level %q isn't one of %v", cfg.Log_Level, strings.Join(log_levels, ", ")))
+    }
+    if cfg.Log_Format != ptmplog.FORMAT_TEXT && cfg.Log_Format != ptmplog.FORMAT_JSON {
+        problems = append(problems, fmt.Errorf("log_format %q isn't one of %v, %v", cfg.Log_Format, ptmplog.FORMAT_TEXT, ptmplog.FORMAT_JSON))
+    }
+    return errors.Join(problems...)
+}
+
+func isLoopback(host string) bool {
+    if host == "localhost" {
+        return true
+    }
+    ip := net.ParseIP(host)
+    return ip != nil && ip.IsLoopback()
+}
+
+// Read a users file: one "username:sha256-of-password-in-hex" per line, with blank lines and #-comments ignored.
+// (echo -n 'the password' | sha256sum gives the hash.)
+func loadUsersFile(path string) (map[string][]byte, error) {
+    if path == "" {
+        return nil, errors.New("no users file given")
+    }
+    fileHandle, err_status := os.Open(path)
+    if err_status != nil {
+        return nil, err_status
+    }
+    defer fileHandle.Close()
+    users := make(map[string][]byte)
+    scanner := bufio.NewScanner(fileHandle)
+    line_num := 0
+    for scanner.Scan() {
+        line_num++
+        line := strings.TrimSpace(scanner.Text())
+        if line == "" || strings.HasPrefix(line, "#") {
+            continue
+        }
+        separator := strings.LastIndex(line, ":")
+        if separator < 1 {
+            return nil, fmt.Errorf("%v:%v: expected username:password-hash", path, line_num)
+        }
+        hash, err_status := hex.DecodeString(line[separator+1:])
+        if err_status != nil || len(hash) != sha256.Size {
+            return nil, fmt.Errorf("%v:%v: the password hash should be %v hex digits of SHA-256", path, line_num, sha256.Size*2)
+        }
+        users[line[:separator]] = hash
+    }
+    if err_status = scanner.Err(); err_status != nil {
+        return nil, err_status
+    }
+    if len(users) == 0 {
+        return nil, fmt.Errorf("%v has no users in it", path)
+    }
+    return users, nil
+}
+
+// Check a username and password against whichever auth backend the config says to use.
+func (cfg *server_config) checkCredentials(uname string, pw string) (bool, bool) {
+    if cfg.Auth.Backend == AUTH_USERS_FILE {
+        hash, found := cfg.users[uname]
+        if !found {
+            return false, false
+        }
+        pw_hash := sha256.Sum256([]byte(pw))
+        return true, subtle.ConstantTimeCompare(hash, pw_hash[:]) == 1
+    }
+    return uname == cfg.Auth.Username, pw == cfg.Auth.Password
+}
+
+// The config as JSON, with the static password blanked out so that it's safe to print.
+func (cfg *server_config) redacted() ([]byte, error) {
+    printable := *cfg
+    if printable.Auth.Password != "" {
+        printable.Auth.Password = "********"
+    }
+    return json.MarshalIndent(printable, "", "    ")
+}
+
+// Put the settings that can change while the server is running into effect.
+func applyConfig(cfg *server_config) {
+    current_config.Store(cfg)
+    level, _ := ptmplog.ParseLevel(cfg.Log_Level) // already validated
+    log_level.Set(level)
+}
+
+// The timeouts that only get read at startup (the shutdown timeout is read when the server is stopping, so it can change).
+func restartOnlyTimeouts(timeouts timeouts_config) timeouts_config {
+    timeouts.Shutdown = 0
+    return timeouts
+}
+
+// Re-read the config whenever the server gets a SIGHUP.  The log level, auth settings and rate limits take effect
+// straight away; listen addresses, storage, timeouts, TLS and where the logs go only get read at startup, so changes to those are
+// logged and otherwise left for the next restart.  A config that doesn't validate is ignored, and the old one stays.
+func reloadOnSIGHUP(cmd *command_line) {
+    signals := make(chan os.Signal, 1)
+    signal.Notify(signals, syscall.SIGHUP)
+    for range signals {
+        new_cfg, err_status := loadConfig(cmd)
+        if err_status != nil {
+            logger.Error("Not reloading the config, it has problems", "error", err_status)
+            continue
+        }
+        old_cfg := current_config.Load()
+        if new_cfg.Listen != old_cfg.Listen || new_cfg.Gateway_Listen != old_cfg.Gateway_Listen || new_cfg.Metrics_Listen != old_cfg.Metrics_Listen || new_cfg.Storage != old_cfg.Storage ||
+           restartOnlyTimeouts(new_cfg.Timeouts) != restartOnlyTimeouts(old_cfg.Timeouts) || new_cfg.TLS != old_cfg.TLS || new_cfg.Log_Format != old_cfg.Log_Format || new_cfg.Access_Log != old_cfg.Access_Log {
+            logger.Warn("The listen addresses, storage, timeouts, TLS or log output settings changed, but those only take effect on a restart")
+        }
+        applyConfig(new_cfg)
+        logger.Info("Reloaded the config", "path", cmd.config_path, "log_level", new_cfg.Log_Level)
+    }
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+    "crypto/sha256"
+    "encoding/hex"
+    "io"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+)
+
+func writeTestFile(t *testing.T, name string, contents string) string {
+    t.Helper()
+    path := filepath.Join(t.TempDir(), name)
+    if err_status := os.WriteFile(path, []byte(contents), 0644); err_status != nil {
+        t.Fatal(err_status)
+    }
+    return path
+}
+
+// The config file, then the environment, then flags, each overriding the last.
+func TestConfigPrecedence(t *testing.T) {
+    path := writeTestFile(t, "server.json", `{"listen": "localhost:2000", "log_level": "warn", "limits": {"message_rate": 5, "message_burst": 10}, "timeouts": {"session_idle": "90s"}}`)
+    t.Setenv(envName("log-level"), "error")
+    t.Setenv(envName("message-burst"), "20")
+    cmd, err_status := parseCommandLine([]string{"-config", path, "-message-burst", "30"}, io.Discard)
+    if err_status != nil {
+        t.Fatal(err_status)
+    }
+    cfg, err_status := loadConfig(cmd)
+    if err_status != nil {
+        t.Fatal(err_status)
+    }
+    if cfg.Listen != "localhost:2000" || cfg.Log_Level != "error" || cfg.Limits.Message_Rate != 5 || cfg.Limits.Message_Burst != 30 ||
+       time.Duration(cfg.Timeouts.Session_Idle) != 90*time.Second || cfg.Gateway_Listen != GATEWAY_HOST {
+        t.Errorf("Got the wrong config: %+v", cfg)
+    }
+}
+
+func TestConfigValidation(t *testing.T) {
+    path := writeTestFile(t, "server.json", `{"listen": "nowhere", "storage": {"backend": "floppy"}, "auth": {"backend": "file"}, "tls": {"cert_file": "cert.pem"}, "log_level": "loud"}`)
+    cmd, _ := parseCommandLine([]string{"-config", path}, io.Discard)
+    _, err_status := loadConfig(cmd)
+    if err_status == nil {
+        t.Fatal("A config with nothing right in it was accepted")
+    }
+    // every problem should be reported at once
+    for _, expected := range []string{"listen", "storage.backend", "auth.users_file", "tls.cert_file", "log_level"} {
+        if !strings.Contains(err_status.Error(), expected) {
+            t.Errorf("The problems didn't mention %v:\n%v", expected, err_status)
+        }
+    }
+
+    // a typo in a setting's name is a problem too, rather than being quietly ignored
+    cmd.config_path = writeTestFile(t, "typo.json", `{"lisen": "localhost:2000"}`)
+    if _, err_status = loadConfig(cmd); err_status == nil {
+        t.Errorf("A config with an unknown setting was accepted")
+    }
+
+    // and a config file that was asked for by name has to be there
+    cmd.config_path = filepath.Join(t.TempDir(), "missing.json")
+    if _, err_status = loadConfig(cmd); err_status == nil {
+        t.Errorf("A missing config file was accepted")
+    }
+}
+
+func TestUsersFileAuth(t *testing.T) {
+    hash := sha256.Sum256([]byte("hunter2"))
+    users := writeTestFile(t, "users", "# the only user\nsomeone:" + hex.EncodeToString(hash[:]) + "\n")
+    cmd, _ := parseCommandLine([]string{"-config", filepath.Join(t.TempDir(), "none.json"), "-auth", "file", "-users-file", users}, io.Discard)
+    cmd.config_explicit = false // no config file, just the flags
+    cfg, err_status := loadConfig(cmd)
+    if err_status != nil {
+        t.Fatal(err_status)
+    }
+    checks := []struct {
+        uname, pw string
+        uname_ok, pw_ok bool
+    }{
+        {"someone", "hunter2", true, true},
+        {"someone", "hunter3", true, false},
+        {VALID_UNAME, VALID_PW, false, false},
+    }
+    for _, check := range checks {
+        uname_ok, pw_ok := cfg.checkCredentials(check.uname, check.pw)
+        if uname_ok != check.uname_ok || pw_ok != check.pw_ok {
+            t.Errorf("%q/%q came back %v/%v instead of %v/%v", check.uname, check.pw, uname_ok, pw_ok, check.uname_ok, check.pw_ok)
+        }
+    }
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "ajb497/ptmp/ptmpclient"
+    "ajb497/ptmp/scenario"
+    "path/filepath"
+    "testing"
+    "time"
+)
+
+// The client's demo session, run against a real server (listening on loopback) so that any change to how the server
+// answers it shows up as a failing step.  run_proj.sh starts the server with the memory backend so the demo can be run
+// again and again, so it's run twice here with the server restarted in between, the way a second run_proj.sh would.
+func TestDemoScenario(t *testing.T) {
+    demo, err_status := scenario.ParseFile(filepath.Join("..", "client", "scenarios", "demo.scenario"))
+    if err_status != nil {
+        t.Fatalf("Unable to read the demo scenario: %v", err_status)
+    }
+
+    old_backend := STORAGE_BACKEND
+    STORAGE_BACKEND = STORAGE_MEMORY
+    t.Cleanup(func() { STORAGE_BACKEND = old_backend })
+    addr := startTestServer(t)
+
+    for run := 1; run <= 2; run++ {
+        if run > 1 {
+            restartStore(t)
+        }
+        ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+        defer cancel()
+        client, err_status := ptmpclient.Dial(ctx, addr)
+        if err_status != nil {
+            t.Fatal(err_status)
+        }
+        report := bytes.Buffer{}
+        result, err_status := demo.Run(ctx, client, &report)
+        client.Close()
+        if err_status != nil || result.Failed > 0 {
+            t.Errorf("Demo scenario run %v failed (%v):\n%v", run, err_status, report.String())
+        }
+    }
+}
+
+// Forget everything in memory and load the store and audit log back in, like the server starting up again in the
+// same directory.
+func restartStore(t *testing.T) {
+    t.Helper()
+    store_lock.Lock()
+    defer store_lock.Unlock()
+    active_tasks = nil
+    trash = make(map[uint16][]trashed_task)
+    audit_log = nil
+    next_task_ref = 0
+    if err_status := loadStore(); err_status != nil {
+        t.Fatal(err_status)
+    }
+    if err_status := loadAuditLog(); err_status != nil {
+        t.Fatal(err_status)
+    }
+}
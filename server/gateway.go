@@ -0,0 +1,684 @@
+package main
+
+import (
+    "context"
+    "crypto/rand"
+    "crypto/tls"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "log/slog"
+    "ajb497/ptmp"
+    "ajb497/ptmp/ptmpserver"
+    mrand "math/rand"
+    "net/http"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// The HTTP gateway lets things that aren't Go programs linking ptmp get at the tasks.  Every request gets
+// translated into the PTMP message that does the same thing and run through the same DFA as messages from the
+// client (against the same store, with the same audit logging), so the gateway can't do anything PTMP can't.
+const GATEWAY_HOST string = "localhost:10102"
+const GATEWAY_API_PREFIX string = "/api/v1"
+const GATEWAY_TOKEN_LIFETIME time.Duration = 12 * time.Hour
+const GATEWAY_MAX_TOKENS_PER_USER int = 16 // past this, issuing a user another token drops the one of theirs that runs out soonest
+
+// The protocol extensions every gateway request's session has, as if its client had offered them at login.
+var GATEWAY_EXTENSIONS = []uint16{ptmp.EXT_DETAILED_ACKS}
+
+// Bearer tokens are handed out by POST /api/v1/tokens in exchange for a username and password, and then stand in
+// for that user (with one PTMP session ID for everything done with the token) until they expire.
+type gateway_token struct {
+    user string
+    session uint32
+    expires time.Time
+}
+
+var gateway_tokens = make(map[string]gateway_token)
+var gateway_tokens_lock sync.Mutex
+
+// What a trashed task looks like in gateway responses.
+type gateway_trashed_task struct {
+    List_ID uint16 `json:"list_id"`
+    Seconds_Until_Purge uint32 `json:"seconds_until_purge"`
+    Task stored_task `json:"task"`
+}
+
+type gateway_list struct {
+    List_ID uint16 `json:"list_id"`
+    Task_Count int `json:"task_count"`
+}
+
+type gateway_task_state struct {
+    Location string `json:"location"`
+    Completed bool `json:"completed"`
+}
+
+// What a history entry looks like in gateway responses.
+type gateway_history_entry struct {
+    Time time.Time `json:"time"`
+    User string `json:"user"`
+    Session uint32 `json:"session"`
+    Msg_Type byte `json:"msg_type"`
+    Response_Code uint16 `json:"response_code"`
+    List_ID uint16 `json:"list_id"`
+    Before gateway_task_state `json:"before"`
+    After gateway_task_state `json:"after"`
+    Task *stored_task `json:"task,omitempty"`
+}
+
+type gateway_error struct {
+    Error string `json:"error"`
+    Response_Code uint16 `json:"response_code,omitempty"`
+}
+
+type gateway_new_task struct {
+    Title string `json:"title"`
+    Description string `json:"description"`
+    Priority uint16 `json:"priority"`
+}
+
+// The gateway's HTTP server, ready for serveGateway (and for Shutdown when the server is stopping).
+func newGateway(cfg *server_config, tls_config *tls.Config) *http.Server {
+    mux := http.NewServeMux()
+    mux.HandleFunc(GATEWAY_API_PREFIX + "/", gatewayRoute)
+    gateway := &http.Server{
+                            Addr: cfg.Gateway_Listen,
+                            Handler: mux,
+                            ReadTimeout: time.Duration(cfg.Timeouts.Gateway_Read),
+                            WriteTimeout: time.Duration(cfg.Timeouts.Gateway_Write),
+                            TLSConfig: tls_config,
+                            ErrorLog: slog.NewLogLogger(logger.Handler(), slog.LevelWarn), // bad handshakes and the like
+                           }
+    return gateway
+}
+
+// Serve the gateway until it fails, or until it's shut down (which returns nil).
+func serveGateway(gateway *http.Server) error {
+    logger.Info("HTTP gateway listening", "address", gateway.Addr, "tls", gateway.TLSConfig != nil)
+    var err_status error
+    if gateway.TLSConfig != nil {
+        err_status = gateway.ListenAndServeTLS("", "") // the certificate is already in the TLS config
+    } else {
+        err_status = gateway.ListenAndServe()
+    }
+    if errors.Is(err_status, http.ErrServerClosed) {
+        return nil
+    }
+    return err_status
+}
+
+// Run a message through the DFA on behalf of a gateway user, exactly as if it had come in from a client that
+// had already logged in as them, and hand back whatever the server would have sent in reply.  The inspect function
+// (if there is one) gets called with the response code while the store is still locked, for the rare case where
+// the reply doesn't say everything the gateway needs to know.  The session gets detailed acks, so that a task that
+// couldn't be changed says why, rather than just the message's overall response code.  Each request gets a session of its own, so they're
+// rate limited by user instead (across basic auth and all of the user's tokens).
+func runLocally(user string, session uint32, msg ptmp.PTMP_Msg, inspect func(uint16)) []*ptmp.PTMP_Msg {
+    ctx := context.Background()
+    if inspect != nil {
+        ctx = context.WithValue(ctx, inspect_key{}, inspect)
+    }
+    recorder := ptmpserver.NewRecorder(msg.Hdr.Msg_Type_ID)
+    ptmp_server.ServeMessage(recorder, &ptmpserver.Request{
+                                                            Msg: &msg,
+                                                            Session: &ptmpserver.Session{State: ptmpserver.STATE_ESTABLISHED, User: user, ID: session, Remote_Addr: "HTTP gateway", Protocol_Version: uint16(ptmp.CURR_PROTOCOL_VERSION), Extensions: GATEWAY_EXTENSIONS, Rate_Limit_Key: "gateway " + user},
+                                                            Received: time.Now(),
+                                                            Context: ctx,
+                                                           })
+    return recorder.Replies
+}
+
+// The context key withStore looks for a runLocally inspect function under.
+type inspect_key struct{}
+
+// Figure out which PTMP user a request is from, using either HTTP basic auth (checked the same way as a
+// Request_Connection) or a bearer token from POST /api/v1/tokens.
+func gatewayAuth(w http.ResponseWriter, r *http.Request) (string, uint32, bool) {
+    auth_header := r.Header.Get("Authorization")
+    if strings.HasPrefix(auth_header, "Bearer ") {
+        token := strings.TrimSpace(strings.TrimPrefix(auth_header, "Bearer "))
+        gateway_tokens_lock.Lock()
+        found, known := gateway_tokens[token]
+        if known && time.Now().After(found.expires) {
+            delete(gateway_tokens, token)
+            known = false
+        }
+        gateway_tokens_lock.Unlock()
+        if known {
+            return found.user, found.session, true
+        }
+    } else if uname, pw, has_basic := r.BasicAuth(); has_basic {
+        credentials_ok, throttled := gatewayCheckCredentials(w, r, uname, pw)
+        if throttled {
+            return "", 0, false
+        }
+        if credentials_ok {
+            return uname, mrand.Uint32(), true // each basic-auth request is its own session
+        }
+    }
+    w.Header().Add("WWW-Authenticate", `Basic realm="ptmp"`)
+    w.Header().Add("WWW-Authenticate", `Bearer realm="ptmp"`)
+    writeJSONResponse(w, http.StatusUnauthorized, gateway_error{Error: "A valid username and password (basic auth) or bearer token is required."})
+    return "", 0, false
+}
+
+// Check a username and password from a gateway request, going through the same login throttle as the PTMP
+// handshake so that the gateway isn't a way around it.  If the user or address is locked out, the credentials
+// aren't checked at all and the request gets a 429 (and throttled comes back true).
+func gatewayCheckCredentials(w http.ResponseWriter, r *http.Request, uname string, pw string) (bool, bool) {
+    throttle := ptmp_server.Login_Throttle
+    if throttle != nil {
+        if remaining := throttle.LockedOut(uname, r.RemoteAddr); remaining > 0 {
+            w.Header().Set("Retry-After", strconv.Itoa(int(remaining.Seconds()) + 1))
+            writeJSONResponse(w, http.StatusTooManyRequests, gateway_error{Error: "Too many failed logins, try again later.", Response_Code: ptmp.LOGIN_THROTTLED})
+            return false, true
+        }
+    }
+    uname_good, pw_good := checkCredentials(uname, pw)
+    if throttle != nil {
+        if uname_good && pw_good {
+            throttle.Succeeded(uname)
+        } else {
+            throttle.Failed(uname, r.RemoteAddr)
+        }
+    }
+    return uname_good && pw_good, false
+}
+
+func writeJSONResponse(w http.ResponseWriter, status int, body interface{}) {
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(status)
+    encoder := json.NewEncoder(w)
+    encoder.SetIndent("", "  ")
+    encoder.Encode(body)
+}
+
+// How each PTMP response code comes across as an HTTP status.
+func httpStatusFor(response_code uint16) int {
+    switch response_code {
+        case ptmp.SINGULAR_MSG_SUCCESS, ptmp.MSG_SERIES_SUCCESS:
+            return http.StatusOK
+        case ptmp.LIST_DOES_NOT_EXIST, ptmp.TASK_DOES_NOT_EXIST:
+            return http.StatusNotFound
+        case ptmp.INVALID_NAME, ptmp.SYNTAX_ERROR:
+            return http.StatusBadRequest
+        case ptmp.UNABLE_TO_COMPLY:
+            return http.StatusUnprocessableEntity
+        case ptmp.MSG_CONTEXT_INVALID:
+            return http.StatusConflict
+        case ptmp.MSG_NOT_IMPLEMENTED:
+            return http.StatusNotImplemented
+        case ptmp.TEAPOT:
+            return http.StatusTeapot
+        case ptmp.RATE_LIMITED, ptmp.LOGIN_THROTTLED, ptmp.TOO_MANY_SESSIONS:
+            return http.StatusTooManyRequests
+    }
+    return http.StatusInternalServerError
+}
+
+// What an acknowledgment says, plain or detailed (gateway sessions get detailed ones).  The gateway only ever names
+// one task at a time, so when a detailed one failed, it's the first item that failed that says why (UNABLE_TO_COMPLY
+// for a task that's there but can't be removed, say, under the message's overall TASK_DOES_NOT_EXIST).
+func ackResult(reply *ptmp.PTMP_Msg) (uint16, string, bool) {
+    switch reply.Hdr.Msg_Type_ID {
+        case ptmp.ACKNOWLEDGMENT:
+            return ptmp.DecodePayload[ptmp.Acknowledgment](reply.Pld).Response_Code, "", true
+        case ptmp.DETAILED_ACKNOWLEDGMENT:
+            ack := ptmp.DecodePayload[ptmp.Detailed_Acknowledgment](reply.Pld)
+            if ack.Response_Code != ptmp.SINGULAR_MSG_SUCCESS && ack.Response_Code != ptmp.MSG_SERIES_SUCCESS {
+                for _, item := range ack.Item_Results {
+                    if item.Response_Code != ptmp.SINGULAR_MSG_SUCCESS {
+                        return item.Response_Code, string(ack.Diagnostic), true
+                    }
+                }
+            }
+            return ack.Response_Code, string(ack.Diagnostic), true
+    }
+    return 0, "", false
+}
+
+func writeRefusal(w http.ResponseWriter, response_code uint16, diagnostic string) {
+    if diagnostic == "" {
+        diagnostic = "The server refused the request."
+    }
+    writeJSONResponse(w, httpStatusFor(response_code), gateway_error{Error: diagnostic, Response_Code: response_code})
+}
+
+// For the messages that only ever get an acknowledgment back, pass its response code along as the HTTP response.
+func writeAckResponse(w http.ResponseWriter, replies []*ptmp.PTMP_Msg, success_status int, success_body interface{}) {
+    if len(replies) == 0 {
+        writeJSONResponse(w, http.StatusInternalServerError, gateway_error{Error: "The server didn't acknowledge the request."})
+        return
+    }
+    response_code, diagnostic, is_ack := ackResult(replies[0])
+    if !is_ack {
+        writeJSONResponse(w, http.StatusInternalServerError, gateway_error{Error: "The server didn't acknowledge the request."})
+        return
+    }
+    if response_code != ptmp.SINGULAR_MSG_SUCCESS {
+        writeRefusal(w, response_code, diagnostic)
+        return
+    }
+    if success_body == nil {
+        w.WriteHeader(success_status)
+        return
+    }
+    writeJSONResponse(w, success_status, success_body)
+}
+
+// For the query messages: an acknowledgment means either there was nothing to send (UNABLE_TO_COMPLY, which comes
+// across as an empty array) or something went wrong; otherwise the info messages are handed to collect one at a time.
+func writeQueryResponse(w http.ResponseWriter, replies []*ptmp.PTMP_Msg, results interface{}, collect func(*ptmp.PTMP_Msg)) {
+    if len(replies) > 0 {
+        if response_code, diagnostic, is_ack := ackResult(replies[0]); is_ack {
+            if response_code != ptmp.UNABLE_TO_COMPLY {
+                writeRefusal(w, response_code, diagnostic)
+                return
+            }
+            replies = nil
+        }
+    }
+    for _, reply := range replies {
+        collect(reply)
+    }
+    writeJSONResponse(w, http.StatusOK, results)
+}
+
+func parseUint16(in_str string) (uint16, bool) {
+    value, err_status := strconv.ParseUint(in_str, 10, 16)
+    return uint16(value), err_status == nil
+}
+
+// All of the API goes through here.  The paths are simple enough that they're picked apart by hand:
+//
+//     POST   /api/v1/tokens
+//     GET    /api/v1/schema
+//     GET    /api/v1/lists
+//     GET    /api/v1/lists/{list}/tasks             (min_priority, max_priority)
+//     POST   /api/v1/lists/{list}/tasks
+//     DELETE /api/v1/lists/{list}/tasks/{ref}       (permit_incomplete)
+//     POST   /api/v1/lists/{list}/tasks/{ref}/complete
+//     GET    /api/v1/lists/{list}/trash
+//     DELETE /api/v1/lists/{list}/trash[/{ref}]
+//     POST   /api/v1/lists/{list}/trash/{ref}/restore
+//     GET    /api/v1/lists/{list}/history           (task)
+func gatewayRoute(w http.ResponseWriter, r *http.Request) {
+    parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, GATEWAY_API_PREFIX), "/"), "/")
+    logger.Debug("HTTP gateway request", "method", r.Method, "path", r.URL.Path, "remote", r.RemoteAddr)
+
+    if len(parts) == 1 && parts[0] == "schema" && r.Method == http.MethodGet {
+        writeJSONResponse(w, http.StatusOK, gatewaySchema())
+        return
+    }
+    if len(parts) == 1 && parts[0] == "tokens" && r.Method == http.MethodPost {
+        issueToken(w, r)
+        return
+    }
+    if parts[0] != "lists" {
+        writeJSONResponse(w, http.StatusNotFound, gateway_error{Error: "No such endpoint, see " + GATEWAY_API_PREFIX + "/schema."})
+        return
+    }
+
+    user, session, authed := gatewayAuth(w, r)
+    if !authed {
+        return
+    }
+    if len(parts) == 1 {
+        if r.Method != http.MethodGet {
+            writeJSONResponse(w, http.StatusMethodNotAllowed, gateway_error{Error: "Only GET is supported here."})
+            return
+        }
+        listLists(w, user, session)
+        return
+    }
+
+    list_id, list_ok := parseUint16(parts[1])
+    if !list_ok {
+        writeJSONResponse(w, http.StatusBadRequest, gateway_error{Error: "List IDs are numbers from 0 to 65535."})
+        return
+    }
+    var ref uint16
+    if len(parts) >= 4 {
+        var ref_ok bool
+        if ref, ref_ok = parseUint16(parts[3]); !ref_ok {
+            writeJSONResponse(w, http.StatusBadRequest, gateway_error{Error: "Task reference numbers are numbers from 0 to 65535."})
+            return
+        }
+    }
+
+    route := r.Method + " " + strings.Join(append([]string{"lists", "{list}"}, placeholders(parts[2:])...), "/")
+    switch route {
+        case "GET lists/{list}/tasks":
+            queryTasks(w, r, user, session, list_id)
+        case "POST lists/{list}/tasks":
+            createTask(w, r, user, session, list_id)
+        case "DELETE lists/{list}/tasks/{ref}":
+            permit_incomplete := r.URL.Query().Get("permit_incomplete") == "true"
+            writeAckResponse(w, runLocally(user, session, ptmp.Prep_Remove_Tasks(permit_incomplete, list_id, []uint16{ref}), nil), http.StatusNoContent, nil)
+        case "POST lists/{list}/tasks/{ref}/complete":
+            writeAckResponse(w, runLocally(user, session, ptmp.Prep_Mark_Task_Completed(list_id, ref), nil), http.StatusNoContent, nil)
+        case "GET lists/{list}/trash":
+            queryTrash(w, user, session, list_id)
+        case "DELETE lists/{list}/trash":
+            writeAckResponse(w, runLocally(user, session, ptmp.Prep_Purge_Trash(list_id, []uint16{}), nil), http.StatusNoContent, nil)
+        case "DELETE lists/{list}/trash/{ref}":
+            writeAckResponse(w, runLocally(user, session, ptmp.Prep_Purge_Trash(list_id, []uint16{ref}), nil), http.StatusNoContent, nil)
+        case "POST lists/{list}/trash/{ref}/restore":
+            writeAckResponse(w, runLocally(user, session, ptmp.Prep_Restore_Tasks(list_id, []uint16{ref}), nil), http.StatusNoContent, nil)
+        case "GET lists/{list}/history":
+            queryHistory(w, r, user, session, list_id)
+        default:
+            writeJSONResponse(w, http.StatusNotFound, gateway_error{Error: "No such endpoint, see " + GATEWAY_API_PREFIX + "/schema."})
+    }
+}
+
+// Swap the task reference number in a path out for {ref} so that routes can be matched by name.
+func placeholders(parts []string) []string {
+    out := append([]string{}, parts...)
+    if len(out) >= 2 {
+        out[1] = "{ref}"
+    }
+    return out
+}
+
+func issueToken(w http.ResponseWriter, r *http.Request) {
+    uname, pw, has_basic := r.BasicAuth()
+    credentials_ok, throttled := false, false
+    if has_basic {
+        credentials_ok, throttled = gatewayCheckCredentials(w, r, uname, pw)
+    }
+    if throttled {
+        return
+    }
+    if !credentials_ok {
+        w.Header().Set("WWW-Authenticate", `Basic realm="ptmp"`)
+        writeJSONResponse(w, http.StatusUnauthorized, gateway_error{Error: "Tokens are only handed out for a valid username and password (basic auth)."})
+        return
+    }
+    raw := make([]byte, 32)
+    if _, err_status := rand.Read(raw); err_status != nil {
+        writeJSONResponse(w, http.StatusInternalServerError, gateway_error{Error: "Unable to generate a token."})
+        return
+    }
+    token := hex.EncodeToString(raw)
+    expires := time.Now().Add(GATEWAY_TOKEN_LIFETIME)
+    gateway_tokens_lock.Lock()
+    pruneTokens(uname, time.Now())
+    gateway_tokens[token] = gateway_token{user: uname, session: mrand.Uint32(), expires: expires}
+    gateway_tokens_lock.Unlock()
+    writeJSONResponse(w, http.StatusCreated, map[string]interface{}{"token": token, "expires": expires})
+}
+
+// Make room for another of the user's tokens: forget every token that has run out (otherwise they'd only go when
+// someone presented them again, which may be never), and if the user still has as many as they're allowed, the one
+// of theirs that runs out soonest.  The caller holds gateway_tokens_lock.
+func pruneTokens(user string, now time.Time) {
+    users_tokens := 0
+    soonest := ""
+    for token, found := range gateway_tokens {
+        if now.After(found.expires) {
+            delete(gateway_tokens, token)
+            continue
+        }
+        if found.user != user {
+            continue
+        }
+        users_tokens++
+        if soonest == "" || found.expires.Before(gateway_tokens[soonest].expires) {
+            soonest = token
+        }
+    }
+    if users_tokens >= GATEWAY_MAX_TOKENS_PER_USER {
+        delete(gateway_tokens, soonest)
+    }
+}
+
+// List management isn't part of PTMP yet and list 1 is the only list there is, so this is just list 1 with
+// however many tasks a Query_Tasks turns up for it.
+func listLists(w http.ResponseWriter, user string, session uint32) {
+    lists := []gateway_list{{List_ID: 1}}
+    writeQueryResponse(w, runLocally(user, session, ptmp.Prep_Query_Tasks(0, 65535), nil), &lists, func(reply *ptmp.PTMP_Msg) {
+        lists[0].Task_Count += len(ptmp.DecodePayload[ptmp.Task_Information](reply.Pld).Task_Infos)
+    })
+}
+
+// A version 2 Query_Tasks, so that the list in the path counts like it does everywhere else (a list that isn't
+// there is a 404), a page at a time until the cursor runs out.
+func queryTasks(w http.ResponseWriter, r *http.Request, user string, session uint32, list_id uint16) {
+    min_priority, max_priority := uint16(0), uint16(65535)
+    if value := r.URL.Query().Get("min_priority"); value != "" {
+        parsed, ok := parseUint16(value)
+        if !ok {
+            writeJSONResponse(w, http.StatusBadRequest, gateway_error{Error: "min_priority must be a number from 0 to 65535."})
+            return
+        }
+        min_priority = parsed
+    }
+    if value := r.URL.Query().Get("max_priority"); value != "" {
+        parsed, ok := parseUint16(value)
+        if !ok {
+            writeJSONResponse(w, http.StatusBadRequest, gateway_error{Error: "max_priority must be a number from 0 to 65535."})
+            return
+        }
+        max_priority = parsed
+    }
+    tasks := []stored_task{}
+    var cursor []byte
+    for {
+        replies := runLocally(user, session, ptmp.Prep_Query_Tasks_V2(min_priority, max_priority, []uint16{list_id}, ptmp.QUERY_ANY_STATUS, 0, "", nil, 0, 0, cursor), nil)
+        if len(replies) == 0 || replies[0].Hdr.Msg_Type_ID != ptmp.TASK_INFORMATION {
+            writeQueryResponse(w, replies, &tasks, nil) // (an acknowledgment here is always the server turning the query down)
+            return
+        }
+        cursor = nil
+        for _, reply := range replies {
+            info := ptmp.DecodePayload[ptmp.Task_Information](reply.Pld)
+            for _, tinfo := range info.Task_Infos {
+                tasks = append(tasks, taskToStored(tinfo))
+            }
+            if reply.Hdr.Msgs_To_Follow == 0 {
+                cursor = info.Next_Cursor
+            }
+        }
+        if len(cursor) == 0 {
+            break
+        }
+    }
+    writeJSONResponse(w, http.StatusOK, tasks)
+}
+
+func createTask(w http.ResponseWriter, r *http.Request, user string, session uint32, list_id uint16) {
+    new_task := gateway_new_task{}
+    if err_status := json.NewDecoder(r.Body).Decode(&new_task); err_status != nil {
+        writeJSONResponse(w, http.StatusBadRequest, gateway_error{Error: "Unable to parse the task: " + err_status.Error()})
+        return
+    }
+    // Prep_Create_New_Task panics on out-of-range lengths, so those get caught here first.
+    if len(new_task.Title) < 1 || len(new_task.Title) > int(ptmp.TITLE_MAX_LENGTH) {
+        writeJSONResponse(w, http.StatusBadRequest, gateway_error{Error: "title must be between 1 and " + strconv.Itoa(int(ptmp.TITLE_MAX_LENGTH)) + " characters long."})
+        return
+    }
+    if len(new_task.Description) < 1 || len(new_task.Description) > int(ptmp.DESCRIPTION_MAX_LENGTH) {
+        writeJSONResponse(w, http.StatusBadRequest, gateway_error{Error: "description must be between 1 and " + strconv.Itoa(int(ptmp.DESCRIPTION_MAX_LENGTH)) + " characters long."})
+        return
+    }
+    // The acknowledgment only says what reference number the new task got, and the whole task goes back in the
+    // response, so it gets looked up while the store is still locked.
+    var created stored_task
+    replies := runLocally(user, session, ptmp.Prep_Create_New_Task(list_id, new_task.Priority, new_task.Title, new_task.Description), func(response_code uint16) {
+        if response_code != ptmp.SINGULAR_MSG_SUCCESS {
+            return
+        }
+        for _, task := range active_tasks {
+            if task.Task_Reference_Number == next_task_ref-1 {
+                created = taskToStored(task)
+            }
+        }
+    })
+    writeAckResponse(w, replies, http.StatusCreated, created)
+}
+
+func queryTrash(w http.ResponseWriter, user string, session uint32, list_id uint16) {
+    trashed := []gateway_trashed_task{}
+    writeQueryResponse(w, runLocally(user, session, ptmp.Prep_Query_Trash(list_id), nil), &trashed, func(reply *ptmp.PTMP_Msg) {
+        for _, tt := range ptmp.DecodePayload[ptmp.Trash_Information](reply.Pld).Trashed_Tasks {
+            trashed = append(trashed, gateway_trashed_task{List_ID: tt.List_ID, Seconds_Until_Purge: tt.Seconds_Until_Purge, Task: taskToStored(tt.Task)})
+        }
+    })
+}
+
+func locationToGateway(location byte, completion byte) gateway_task_state {
+    names := map[byte]string{ptmp.TASK_LOCATION_NONE: "none", ptmp.TASK_LOCATION_ACTIVE: "active", ptmp.TASK_LOCATION_TRASH: "trash"}
+    return gateway_task_state{Location: names[location], Completed: ptmp.Byte2Bool(completion)}
+}
+
+func queryHistory(w http.ResponseWriter, r *http.Request, user string, session uint32, list_id uint16) {
+    whole_list := true
+    var task_ref uint16
+    if value := r.URL.Query().Get("task"); value != "" {
+        parsed, ok := parseUint16(value)
+        if !ok {
+            writeJSONResponse(w, http.StatusBadRequest, gateway_error{Error: "task must be a number from 0 to 65535."})
+            return
+        }
+        whole_list, task_ref = false, parsed
+    }
+    entries := []gateway_history_entry{}
+    writeQueryResponse(w, runLocally(user, session, ptmp.Prep_Query_History(list_id, whole_list, task_ref), nil), &entries, func(reply *ptmp.PTMP_Msg) {
+        for _, entry := range ptmp.DecodePayload[ptmp.History_Information](reply.Pld).Entries {
+            out := gateway_history_entry{
+                                         Time: time.Unix(entry.Timestamp, 0).UTC(),
+                                         User: string(entry.Username),
+                                         Session: entry.Session_ID,
+                                         Msg_Type: entry.Msg_Type_ID,
+                                         Response_Code: entry.Response_Code,
+                                         List_ID: entry.List_ID,
+                                         Before: locationToGateway(entry.Before_Location, entry.Before_Completion_Status),
+                                         After: locationToGateway(entry.After_Location, entry.After_Completion_Status),
+                                        }
+            if entry.Before_Location != ptmp.TASK_LOCATION_NONE || entry.After_Location != ptmp.TASK_LOCATION_NONE {
+                task := taskToStored(entry.Task)
+                out.Task = &task
+            }
+            entries = append(entries, out)
+        }
+    })
+}
+
+// An OpenAPI-style description of the gateway, served at /api/v1/schema so that people (and tools) can see what's
+// there without reading this file.
+func gatewaySchema() map[string]interface{} {
+    ref := func(name string) map[string]interface{} {
+        return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+    }
+    array_of := func(name string) map[string]interface{} {
+        return map[string]interface{}{"type": "array", "items": ref(name)}
+    }
+    json_body := func(schema map[string]interface{}) map[string]interface{} {
+        return map[string]interface{}{"content": map[string]interface{}{"application/json": map[string]interface{}{"schema": schema}}}
+    }
+    param := func(name string, in string, required bool, description string) map[string]interface{} {
+        return map[string]interface{}{"name": name, "in": in, "required": required, "description": description, "schema": map[string]interface{}{"type": "integer", "minimum": 0, "maximum": 65535}}
+    }
+    list_param := param("list", "path", true, "List ID (list 1 is the only list the server has).")
+    ref_param := param("ref", "path", true, "Task reference number.")
+    errors := map[string]interface{}{
+        "401": map[string]interface{}{"description": "Missing or bad credentials."},
+        "404": json_body(ref("Error")),
+        "422": json_body(ref("Error")),
+    }
+    operation := func(summary string, ptmp_msg string, params []interface{}, request interface{}, ok_code string, ok_response map[string]interface{}) map[string]interface{} {
+        responses := map[string]interface{}{ok_code: ok_response}
+        for code, response := range errors {
+            responses[code] = response
+        }
+        op := map[string]interface{}{"summary": summary, "x-ptmp-message": ptmp_msg, "parameters": params, "responses": responses}
+        if request != nil {
+            op["requestBody"] = request
+        }
+        return op
+    }
+    no_content := map[string]interface{}{"description": "Done."}
+    with_body := func(schema map[string]interface{}) map[string]interface{} {
+        response := json_body(schema)
+        response["description"] = "Done."
+        return response
+    }
+
+    return map[string]interface{}{
+        "openapi": "3.0.3",
+        "info": map[string]interface{}{"title": "PTMP HTTP gateway", "version": "1"},
+        "servers": []interface{}{map[string]interface{}{"url": GATEWAY_API_PREFIX}},
+        "security": []interface{}{map[string]interface{}{"basic": []string{}}, map[string]interface{}{"bearer": []string{}}},
+        "paths": map[string]interface{}{
+            "/tokens": map[string]interface{}{
+                "post": map[string]interface{}{"summary": "Trade a username and password (basic auth) for a bearer token.", "security": []interface{}{map[string]interface{}{"basic": []string{}}},
+                                               "responses": map[string]interface{}{"201": with_body(ref("Token")), "401": errors["401"]}},
+            },
+            "/schema": map[string]interface{}{
+                "get": map[string]interface{}{"summary": "This document.", "security": []interface{}{}, "responses": map[string]interface{}{"200": no_content}},
+            },
+            "/lists": map[string]interface{}{
+                "get": operation("The lists on the server.", "QUERY_TASKS", []interface{}{}, nil, "200", with_body(array_of("List"))),
+            },
+            "/lists/{list}/tasks": map[string]interface{}{
+                "get": operation("Tasks in a list.", "QUERY_TASKS",
+                                 []interface{}{list_param, param("min_priority", "query", false, "Lowest priority to include."), param("max_priority", "query", false, "Highest priority to include.")},
+                                 nil, "200", with_body(array_of("Task"))),
+                "post": operation("Create a task.", "CREATE_NEW_TASK", []interface{}{list_param}, json_body(ref("NewTask")), "201", with_body(ref("Task"))),
+            },
+            "/lists/{list}/tasks/{ref}": map[string]interface{}{
+                "delete": operation("Move a task to the list's trash.", "REMOVE_TASK",
+                                    []interface{}{list_param, ref_param, map[string]interface{}{"name": "permit_incomplete", "in": "query", "required": false, "schema": map[string]interface{}{"type": "boolean"}}},
+                                    nil, "204", no_content),
+            },
+            "/lists/{list}/tasks/{ref}/complete": map[string]interface{}{
+                "post": operation("Mark a task completed.", "MARK_TASK_COMPLETED", []interface{}{list_param, ref_param}, nil, "204", no_content),
+            },
+            "/lists/{list}/trash": map[string]interface{}{
+                "get": operation("Tasks in the list's trash.", "QUERY_TRASH", []interface{}{list_param}, nil, "200", with_body(array_of("TrashedTask"))),
+                "delete": operation("Permanently delete everything in the list's trash.", "PURGE_TRASH", []interface{}{list_param}, nil, "204", no_content),
+            },
+            "/lists/{list}/trash/{ref}": map[string]interface{}{
+                "delete": operation("Permanently delete one task from the trash.", "PURGE_TRASH", []interface{}{list_param, ref_param}, nil, "204", no_content),
+            },
+            "/lists/{list}/trash/{ref}/restore": map[string]interface{}{
+                "post": operation("Move a task from the trash back onto the list.", "RESTORE_TASKS", []interface{}{list_param, ref_param}, nil, "204", no_content),
+            },
+            "/lists/{list}/history": map[string]interface{}{
+                "get": operation("Recorded changes to a list, or to one task in it.", "QUERY_HISTORY",
+                                 []interface{}{list_param, param("task", "query", false, "Only show the history of this task.")}, nil, "200", with_body(array_of("HistoryEntry"))),
+            },
+        },
+        "components": map[string]interface{}{
+            "securitySchemes": map[string]interface{}{
+                "basic": map[string]interface{}{"type": "http", "scheme": "basic"},
+                "bearer": map[string]interface{}{"type": "http", "scheme": "bearer"},
+            },
+            "schemas": map[string]interface{}{
+                "Error": map[string]interface{}{"type": "object", "properties": map[string]interface{}{"error": map[string]string{"type": "string"}, "response_code": map[string]string{"type": "integer"}}},
+                "Token": map[string]interface{}{"type": "object", "properties": map[string]interface{}{"token": map[string]string{"type": "string"}, "expires": map[string]string{"type": "string", "format": "date-time"}}},
+                "List": map[string]interface{}{"type": "object", "properties": map[string]interface{}{"list_id": map[string]string{"type": "integer"}, "task_count": map[string]string{"type": "integer"}}},
+                "Task": map[string]interface{}{"type": "object", "properties": map[string]interface{}{
+                    "ref": map[string]string{"type": "integer"}, "priority": map[string]string{"type": "integer"}, "title": map[string]string{"type": "string"},
+                    "description": map[string]string{"type": "string"}, "completed": map[string]string{"type": "boolean"}}},
+                "NewTask": map[string]interface{}{"type": "object", "required": []string{"title", "description"}, "properties": map[string]interface{}{
+                    "title": map[string]interface{}{"type": "string", "minLength": 1, "maxLength": ptmp.TITLE_MAX_LENGTH},
+                    "description": map[string]interface{}{"type": "string", "minLength": 1, "maxLength": ptmp.DESCRIPTION_MAX_LENGTH},
+                    "priority": map[string]interface{}{"type": "integer", "minimum": 0, "maximum": 65535}}},
+                "TrashedTask": map[string]interface{}{"type": "object", "properties": map[string]interface{}{
+                    "list_id": map[string]string{"type": "integer"}, "seconds_until_purge": map[string]string{"type": "integer"}, "task": ref("Task")}},
+                "TaskState": map[string]interface{}{"type": "object", "properties": map[string]interface{}{
+                    "location": map[string]interface{}{"type": "string", "enum": []string{"none", "active", "trash"}}, "completed": map[string]string{"type": "boolean"}}},
+                "HistoryEntry": map[string]interface{}{"type": "object", "properties": map[string]interface{}{
+                    "time": map[string]string{"type": "string", "format": "date-time"}, "user": map[string]string{"type": "string"}, "session": map[string]string{"type": "integer"},
+                    "msg_type": map[string]string{"type": "integer"}, "response_code": map[string]string{"type": "integer"}, "list_id": map[string]string{"type": "integer"},
+                    "before": ref("TaskState"), "after": ref("TaskState"), "task": ref("Task")}},
+            },
+        },
+    }
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+    "ajb497/ptmp"
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+)
+
+// Send one request through the gateway (the same handler newGateway serves) with the auth set however set_auth
+// likes, and hand back what it answered.
+func gatewayRequest(t *testing.T, method string, path string, body string, set_auth func(*http.Request)) *httptest.ResponseRecorder {
+    t.Helper()
+    gateway := newGateway(current_config.Load(), nil)
+    request := httptest.NewRequest(method, GATEWAY_API_PREFIX + path, strings.NewReader(body))
+    if set_auth != nil {
+        set_auth(request)
+    }
+    response := httptest.NewRecorder()
+    gateway.Handler.ServeHTTP(response, request)
+    return response
+}
+
+func basicAuth(uname string, pw string) func(*http.Request) {
+    return func(request *http.Request) { request.SetBasicAuth(uname, pw) }
+}
+
+func bearerAuth(token string) func(*http.Request) {
+    return func(request *http.Request) { request.Header.Set("Authorization", "Bearer " + token) }
+}
+
+func TestGatewayAuth(t *testing.T) {
+    startTestServer(t)
+    for _, test := range []struct {
+        name string
+        set_auth func(*http.Request)
+    }{
+        {"no credentials", nil},
+        {"a bad password", basicAuth(VALID_UNAME, "wrong")},
+        {"a bad username", basicAuth("Nobody", VALID_PW)},
+        {"a made up token", bearerAuth("0123456789abcdef")},
+    } {
+        response := gatewayRequest(t, http.MethodGet, "/lists", "", test.set_auth)
+        if response.Code != http.StatusUnauthorized || len(response.Header().Values("WWW-Authenticate")) != 2 {
+            t.Errorf("A request with %v got %v (WWW-Authenticate %v)", test.name, response.Code, response.Header().Values("WWW-Authenticate"))
+        }
+    }
+
+    if response := gatewayRequest(t, http.MethodPost, "/tokens", "", basicAuth(VALID_UNAME, "wrong")); response.Code != http.StatusUnauthorized {
+        t.Errorf("A token for a bad password got %v", response.Code)
+    }
+    if response := gatewayRequest(t, http.MethodPost, "/tokens", "", nil); response.Code != http.StatusUnauthorized {
+        t.Errorf("A token without any credentials got %v", response.Code)
+    }
+    response := gatewayRequest(t, http.MethodPost, "/tokens", "", basicAuth(VALID_UNAME, VALID_PW))
+    issued := struct {
+        Token string `json:"token"`
+    }{}
+    if response.Code != http.StatusCreated || json.Unmarshal(response.Body.Bytes(), &issued) != nil || issued.Token == "" {
+        t.Fatalf("A token for good credentials got %v: %v", response.Code, response.Body.String())
+    }
+    for _, set_auth := range []func(*http.Request){basicAuth(VALID_UNAME, VALID_PW), bearerAuth(issued.Token)} {
+        if response = gatewayRequest(t, http.MethodGet, "/lists", "", set_auth); response.Code != http.StatusOK {
+            t.Errorf("Listing the lists with good credentials got %v: %v", response.Code, response.Body.String())
+        }
+    }
+}
+
+// Every route, in an order that leaves the store the way the next one needs it: each once the way it works, and
+// once the way it doesn't.
+func TestGatewayRoutes(t *testing.T) {
+    startTestServer(t)
+    authed := basicAuth(VALID_UNAME, VALID_PW)
+    for _, step := range []struct {
+        method string
+        path string
+        body string
+        status int
+        contains string
+    }{
+        {http.MethodGet, "/schema", "", http.StatusOK, `"openapi"`},
+        {http.MethodGet, "/nowhere", "", http.StatusNotFound, "schema"},
+
+        {http.MethodPost, "/lists/1/tasks", `{"title": "Grade this", "description": "Give it an A", "priority": 9000}`, http.StatusCreated, `"ref": 0`},
+        {http.MethodPost, "/lists/1/tasks", `{"title": "Grade that", "description": "Give it a B", "priority": 10}`, http.StatusCreated, `"ref": 1`},
+        {http.MethodPost, "/lists/7/tasks", `{"title": "Nowhere", "description": "List 7 isn't there"}`, http.StatusNotFound, `"response_code": 401`},
+        {http.MethodPost, "/lists/1/tasks", `{"title": ""}`, http.StatusBadRequest, "title"},
+        {http.MethodPost, "/lists/1/tasks", `not json`, http.StatusBadRequest, "parse"},
+
+        {http.MethodGet, "/lists", "", http.StatusOK, `"task_count": 2`},
+        {http.MethodPut, "/lists", "", http.StatusMethodNotAllowed, "GET"},
+        {http.MethodGet, "/lists/1/tasks?min_priority=100", "", http.StatusOK, "Grade this"},
+        {http.MethodGet, "/lists/7/tasks", "", http.StatusNotFound, `"response_code": 401`},
+        {http.MethodGet, "/lists/1/tasks?max_priority=lots", "", http.StatusBadRequest, "max_priority"},
+        {http.MethodGet, "/lists/one/tasks", "", http.StatusBadRequest, "List IDs"},
+
+        {http.MethodPost, "/lists/1/tasks/0/complete", "", http.StatusNoContent, ""},
+        {http.MethodPost, "/lists/1/tasks/99/complete", "", http.StatusNotFound, ""},
+        {http.MethodDelete, "/lists/1/tasks/0", "", http.StatusNoContent, ""},
+        {http.MethodDelete, "/lists/1/tasks/1", "", http.StatusUnprocessableEntity, `"response_code": 400`}, // (there, but not completed)
+        {http.MethodDelete, "/lists/1/tasks/99", "", http.StatusNotFound, `"response_code": 402`},
+        {http.MethodDelete, "/lists/1/tasks/1?permit_incomplete=true", "", http.StatusNoContent, ""},
+        {http.MethodDelete, "/lists/1/tasks/x", "", http.StatusBadRequest, "reference numbers"},
+
+        {http.MethodGet, "/lists/1/trash", "", http.StatusOK, "Grade that"},
+        {http.MethodGet, "/lists/7/trash", "", http.StatusNotFound, ""},
+        {http.MethodPost, "/lists/1/trash/1/restore", "", http.StatusNoContent, ""},
+        {http.MethodPost, "/lists/1/trash/1/restore", "", http.StatusNotFound, ""},
+        {http.MethodDelete, "/lists/1/trash/0", "", http.StatusNoContent, ""},
+        {http.MethodDelete, "/lists/1/trash/0", "", http.StatusNotFound, ""},
+        {http.MethodDelete, "/lists/1/trash", "", http.StatusNoContent, ""},
+        {http.MethodDelete, "/lists/7/trash", "", http.StatusNotFound, ""},
+
+        {http.MethodGet, "/lists/1/history?task=1", "", http.StatusOK, `"location": "trash"`},
+        {http.MethodGet, "/lists/1/history?task=lots", "", http.StatusBadRequest, "task"},
+        {http.MethodGet, "/lists/7/history", "", http.StatusNotFound, ""},
+    } {
+        response := gatewayRequest(t, step.method, step.path, step.body, authed)
+        if response.Code != step.status || !strings.Contains(response.Body.String(), step.contains) {
+            t.Errorf("%v %v got %v, expected %v with %q in:\n%v", step.method, step.path, response.Code, step.status, step.contains, response.Body.String())
+        }
+    }
+}
+
+// The server sends a query's tasks a page at a time, and the gateway follows the cursor until it has all of them.
+func TestGatewayTasksFollowCursor(t *testing.T) {
+    startTestServer(t)
+    old_cfg := current_config.Load()
+    cfg := *old_cfg
+    cfg.Limits.Max_Query_Results = 2
+    current_config.Store(&cfg)
+    defer current_config.Store(old_cfg)
+
+    authed := basicAuth(VALID_UNAME, VALID_PW)
+    for _, title := range []string{"One", "Two", "Three", "Four", "Five"} {
+        gatewayRequest(t, http.MethodPost, "/lists/1/tasks", `{"title": "` + title + `", "description": "Paged"}`, authed)
+    }
+    response := gatewayRequest(t, http.MethodGet, "/lists/1/tasks", "", authed)
+    tasks := []stored_task{}
+    if response.Code != http.StatusOK || json.Unmarshal(response.Body.Bytes(), &tasks) != nil || len(tasks) != 5 {
+        t.Errorf("Got %v with %v tasks, expected all 5:\n%v", response.Code, len(tasks), response.Body.String())
+    }
+}
+
+// Tokens that have run out are forgotten when the next one is issued, and a user can't hold more than
+// GATEWAY_MAX_TOKENS_PER_USER however many they ask for.
+func TestGatewayTokenLimits(t *testing.T) {
+    startTestServer(t)
+    gateway_tokens_lock.Lock()
+    gateway_tokens = map[string]gateway_token{"expired": {user: "Somebody Else", expires: time.Now().Add(-time.Minute)}}
+    gateway_tokens_lock.Unlock()
+
+    latest := struct {
+        Token string `json:"token"`
+    }{}
+    for ii := 0; ii < GATEWAY_MAX_TOKENS_PER_USER + 3; ii++ {
+        response := gatewayRequest(t, http.MethodPost, "/tokens", "", basicAuth(VALID_UNAME, VALID_PW))
+        if response.Code != http.StatusCreated || json.Unmarshal(response.Body.Bytes(), &latest) != nil {
+            t.Fatalf("Token %v got %v: %v", ii, response.Code, response.Body.String())
+        }
+    }
+    gateway_tokens_lock.Lock()
+    _, expired_kept := gateway_tokens["expired"]
+    held := len(gateway_tokens)
+    gateway_tokens_lock.Unlock()
+    if expired_kept || held != GATEWAY_MAX_TOKENS_PER_USER {
+        t.Errorf("Holding %v tokens (the expired one kept: %v), expected %v", held, expired_kept, GATEWAY_MAX_TOKENS_PER_USER)
+    }
+    if response := gatewayRequest(t, http.MethodGet, "/lists", "", bearerAuth(latest.Token)); response.Code != http.StatusOK {
+        t.Errorf("The newest token got %v", response.Code)
+    }
+}
+
+// Every gateway request is a session of its own, so the rate limit has to follow the user instead, whether they
+// come in with basic auth or a token.
+func TestGatewayRateLimit(t *testing.T) {
+    startTestServer(t)
+    old_cfg := current_config.Load()
+    cfg := *old_cfg
+    cfg.Limits.Message_Rate = 0.001
+    cfg.Limits.Message_Burst = 2
+    current_config.Store(&cfg)
+    defer current_config.Store(old_cfg)
+
+    response := gatewayRequest(t, http.MethodPost, "/tokens", "", basicAuth(VALID_UNAME, VALID_PW))
+    issued := struct {
+        Token string `json:"token"`
+    }{}
+    if json.Unmarshal(response.Body.Bytes(), &issued) != nil {
+        t.Fatalf("Couldn't get a token: %v", response.Body.String())
+    }
+    for ii, set_auth := range []func(*http.Request){basicAuth(VALID_UNAME, VALID_PW), bearerAuth(issued.Token)} {
+        if response = gatewayRequest(t, http.MethodGet, "/lists", "", set_auth); response.Code != http.StatusOK {
+            t.Errorf("Request %v within the burst got %v: %v", ii, response.Code, response.Body.String())
+        }
+    }
+    if response = gatewayRequest(t, http.MethodGet, "/lists", "", basicAuth(VALID_UNAME, VALID_PW)); response.Code != http.StatusTooManyRequests {
+        t.Errorf("The request over the limit got %v: %v", response.Code, response.Body.String())
+    }
+}
+
+func TestHTTPStatusFor(t *testing.T) {
+    for response_code, status := range map[uint16]int{
+        ptmp.SINGULAR_MSG_SUCCESS: http.StatusOK,
+        ptmp.MSG_SERIES_SUCCESS: http.StatusOK,
+        ptmp.LIST_DOES_NOT_EXIST: http.StatusNotFound,
+        ptmp.TASK_DOES_NOT_EXIST: http.StatusNotFound,
+        ptmp.SYNTAX_ERROR: http.StatusBadRequest,
+        ptmp.UNABLE_TO_COMPLY: http.StatusUnprocessableEntity,
+        ptmp.MSG_CONTEXT_INVALID: http.StatusConflict,
+        ptmp.MSG_NOT_IMPLEMENTED: http.StatusNotImplemented,
+        ptmp.RATE_LIMITED: http.StatusTooManyRequests,
+        ptmp.TEAPOT: http.StatusTeapot,
+        ptmp.CONDITIONAL_ORDER_FAILURE: http.StatusInternalServerError,
+    } {
+        if got := httpStatusFor(response_code); got != status {
+            t.Errorf("Response code %v came across as %v, expected %v", response_code, got, status)
+        }
+    }
+}
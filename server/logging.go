@@ -0,0 +1,48 @@
+package main
+
+import (
+    "ajb497/ptmp/ptmplog"
+    "log/slog"
+    "os"
+)
+
+// Everything the server logs goes through logger, and the one line per handled message through access_logger.
+// Until main sets them up from the config they log text to stderr, and the tests swap them for ones that discard everything.
+var log_level = new(slog.LevelVar) // set from the config, and can change when it's reloaded
+var logger = slog.New(must(ptmplog.NewHandler(os.Stderr, ptmplog.FORMAT_TEXT, log_level)))
+var access_logger = logger.With("log", "access")
+
+func must(handler slog.Handler, err_status error) slog.Handler {
+    if err_status != nil {
+        panic(err_status)
+    }
+    return handler
+}
+
+// Point the logs wherever the config says, in the format it says.  The access log goes to its own file if it has
+// one (always at info, since that's the level its lines are logged at), or otherwise into the main log tagged log=access.
+func setupLogging(cfg *server_config) error {
+    handler, err_status := ptmplog.NewHandler(os.Stderr, cfg.Log_Format, log_level)
+    if err_status != nil {
+        return err_status
+    }
+    logger = slog.New(handler)
+    access_logger = logger.With("log", "access")
+    if cfg.Access_Log != "" {
+        access_file, err_status := os.OpenFile(cfg.Access_Log, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+        if err_status != nil {
+            return err_status
+        }
+        access_handler, _ := ptmplog.NewHandler(access_file, cfg.Log_Format, slog.LevelInfo)
+        access_logger = slog.New(access_handler)
+    }
+    slog.SetDefault(logger) // so that anything still using the log package ends up in the same place
+    return nil
+}
+
+// For the handful of things that can't go on without whatever just failed.
+func fatal(msg string, args ...interface{}) {
+    logger.Error(msg, args...)
+    os.Exit(EXIT_FAILURE)
+}
+
@@ -0,0 +1,74 @@
+package main
+
+import (
+    "ajb497/ptmp/ptmpclient"
+    "ajb497/ptmp/ptmplog"
+    "bytes"
+    "context"
+    "log/slog"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+)
+
+// A buffer the server's goroutines can log into while the test reads it.
+type locked_buffer struct {
+    lock sync.Mutex
+    buff bytes.Buffer
+}
+
+func (lb *locked_buffer) Write(p []byte) (int, error) {
+    lb.lock.Lock()
+    defer lb.lock.Unlock()
+    return lb.buff.Write(p)
+}
+
+func (lb *locked_buffer) String() string {
+    lb.lock.Lock()
+    defer lb.lock.Unlock()
+    return lb.buff.String()
+}
+
+// Even with every message logged payload and all, the password that came in with the login never makes it into the
+// log, and every message handled gets an access log line of its own.
+func TestLoggingRedactsCredentials(t *testing.T) {
+    var output locked_buffer
+    handler, _ := ptmplog.NewHandler(&output, ptmplog.FORMAT_JSON, slog.LevelDebug)
+    old_logger, old_access_logger := logger, access_logger
+    logger = slog.New(handler)
+    access_logger = logger.With("log", "access")
+    t.Cleanup(func() { logger, access_logger = old_logger, old_access_logger })
+    addr := startTestServer(t)
+
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+    client, err_status := ptmpclient.Dial(ctx, addr)
+    if err_status != nil {
+        t.Fatal(err_status)
+    }
+    if err_status = client.Login(ctx, VALID_UNAME, VALID_PW); err_status != nil {
+        t.Fatal(err_status)
+    }
+    if err_status = client.CreateTask(ctx, 1, 10, "Logged task", "Shows up in the debug log"); err_status != nil {
+        t.Fatal(err_status)
+    }
+    client.Close()
+
+    // the access log line for a message is written once it's been answered, so give the server a moment to catch up
+    for deadline := time.Now().Add(2*time.Second); time.Now().Before(deadline) && strings.Count(output.String(), `"log":"access"`) < 2; {
+        time.Sleep(10*time.Millisecond)
+    }
+    logged := output.String()
+    if strings.Contains(logged, VALID_PW) {
+        t.Errorf("The password made it into the log:\n%v", logged)
+    }
+    for _, expected := range []string{ptmplog.REDACTED, `"type":"REQUEST_CONNECTION"`, `"title":"Logged task"`, `"user":"` + VALID_UNAME + `"`} {
+        if !strings.Contains(logged, expected) {
+            t.Errorf("The log is missing %v:\n%v", expected, logged)
+        }
+    }
+    if access_lines := strings.Count(logged, `"log":"access"`); access_lines < 2 {
+        t.Errorf("Got %v access log lines for a login and a new task", access_lines)
+    }
+}
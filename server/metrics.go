@@ -0,0 +1,71 @@
+package main
+
+import (
+    "ajb497/ptmp/ptmpserver"
+    "fmt"
+    "net/http"
+    "strings"
+    "sync/atomic"
+    "time"
+)
+
+const METRICS_PREFIX string = "ptmp_"
+
+// Whether the PTMP listener is up and accepting clients, for /readyz.
+var listener_up atomic.Bool
+
+// The metrics listener, for whoever is keeping an eye on the server (Prometheus, a load balancer's health checks, a
+// supervisor).  It only listens on localhost, so none of it asks for a login.
+//     GET /metrics   Prometheus text format: sessions, messages by type and response code, failed logins,
+//                    handler latency, bytes in and out, and how big the store is
+//     GET /healthz   200 as long as the process is up and answering
+//     GET /readyz    200 once the PTMP listener is up and the store has loaded and is being written fine, 503 otherwise
+func serveMetrics(cfg *server_config) error {
+    mux := http.NewServeMux()
+    mux.HandleFunc("/metrics", writeMetrics)
+    mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+        fmt.Fprintln(w, "ok")
+    })
+    mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+        problems := readinessProblems()
+        if len(problems) > 0 {
+            w.WriteHeader(http.StatusServiceUnavailable)
+            fmt.Fprintln(w, strings.Join(problems, "\n"))
+            return
+        }
+        fmt.Fprintln(w, "ready")
+    })
+    metrics_server := &http.Server{Addr: cfg.Metrics_Listen, Handler: mux, ReadTimeout: 10*time.Second, WriteTimeout: 10*time.Second}
+    logger.Info("Metrics listening", "address", cfg.Metrics_Listen)
+    return metrics_server.ListenAndServe()
+}
+
+// Everything standing in the way of serving clients, or nothing if the server is good to go.
+func readinessProblems() []string {
+    problems := []string{}
+    if !listener_up.Load() {
+        problems = append(problems, "not accepting PTMP connections")
+    }
+    return append(problems, storageProblems()...)
+}
+
+func writeMetrics(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+    server_metrics.WritePrometheus(w, METRICS_PREFIX)
+
+    store_lock.Lock()
+    num_active, num_trashed := len(active_tasks), 0
+    for _, list_trash := range trash {
+        num_trashed += len(list_trash)
+    }
+    num_audit := len(audit_log)
+    store_lock.Unlock()
+    fmt.Fprintf(w, "# HELP %vstore_tasks Tasks in the store, by whether they're active or in the trash.\n# TYPE %vstore_tasks gauge\n", METRICS_PREFIX, METRICS_PREFIX)
+    fmt.Fprintf(w, "%vstore_tasks{state=\"active\"} %v\n%vstore_tasks{state=\"trashed\"} %v\n", METRICS_PREFIX, num_active, METRICS_PREFIX, num_trashed)
+    ptmpserver.WritePrometheusMetric(w, METRICS_PREFIX + "audit_records", "gauge", "Records in the audit log.", float64(num_audit))
+    ready := 0.0
+    if len(readinessProblems()) == 0 {
+        ready = 1
+    }
+    ptmpserver.WritePrometheusMetric(w, METRICS_PREFIX + "ready", "gauge", "1 when /readyz would say the server is ready.", ready)
+}
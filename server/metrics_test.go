@@ -0,0 +1,54 @@
+package main
+
+import (
+    "ajb497/ptmp/ptmpclient"
+    "context"
+    "errors"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestMetricsAndReadiness(t *testing.T) {
+    addr := startTestServer(t)
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+    for _, password := range []string{"wrong", VALID_PW} {
+        client, err_status := ptmpclient.Dial(ctx, addr)
+        if err_status != nil {
+            t.Fatal(err_status)
+        }
+        if err_status = client.Login(ctx, VALID_UNAME, password); err_status == nil {
+            client.CreateTask(ctx, 1, 10, "Counted", "Shows up in the metrics")
+        }
+        client.Close()
+    }
+
+    scrape := httptest.NewRecorder()
+    writeMetrics(scrape, httptest.NewRequest("GET", "/metrics", nil))
+    metrics := scrape.Body.String()
+    for _, expected := range []string{"ptmp_handshake_failures_total ", `ptmp_messages_total{msg_type="CREATE_NEW_TASK",response_code="200"}`,
+                                      `ptmp_handler_duration_seconds_bucket{msg_type="CREATE_NEW_TASK",le="+Inf"}`, `ptmp_store_tasks{state="active"} 1`} {
+        if !strings.Contains(metrics, expected) {
+            t.Errorf("The metrics are missing %v:\n%v", expected, metrics)
+        }
+    }
+    if strings.Contains(metrics, "ptmp_handshake_failures_total 0") {
+        t.Errorf("The refused login wasn't counted:\n%v", metrics)
+    }
+
+    listener_up.Store(true)
+    defer listener_up.Store(false)
+    noteHealth(&store_health, nil)
+    noteHealth(&audit_health, nil)
+    if problems := readinessProblems(); len(problems) != 0 {
+        t.Errorf("A server with everything up wasn't ready: %v", problems)
+    }
+    noteHealth(&store_health, errors.New("disk full"))
+    listener_up.Store(false)
+    if problems := readinessProblems(); len(problems) != 2 {
+        t.Errorf("Expected the listener and the failed store write to be reported, got %v", problems)
+    }
+    noteHealth(&store_health, nil)
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+    "bytes"
+    "encoding/binary"
+    "fmt"
+    "ajb497/ptmp"
+    "ajb497/ptmp/ptmpserver"
+    "regexp"
+    "sort"
+    "strings"
+    "unicode/utf8"
+)
+
+// A version 2 Query_Tasks, checked over and made ready to run against the store (see ptmp.Query_Tasks_V2).
+type task_query struct {
+    min_priority uint16
+    max_priority uint16
+    completion byte
+    search func(text []byte) bool // nil when there's nothing to search for
+    search_title bool
+    search_description bool
+    sort_keys []ptmp.Sort_Key
+    offset int
+    limit int
+    after *ptmp.T_Inf // the last task of the page before, with only what the sort looks at filled in (nil for the first page)
+}
+
+// Check a query over, and compile its search, so that running it is just a pass over the tasks.  Anything that
+// doesn't make sense comes back as the response code to answer with, and a diagnostic saying why.
+func parseTaskQuery(msg ptmp.Query_Tasks_V2) (*task_query, uint16, string) {
+    // Same deal as everywhere else, list 1 is the only list there is, so asking for every list is asking for list 1.
+    for _, listId := range msg.List_IDs {
+        if listId != 1 {
+            return nil, ptmp.LIST_DOES_NOT_EXIST, listMissingDiagnostic(listId)
+        }
+    }
+    query := &task_query{
+                         min_priority: msg.Minimum_Priority,
+                         max_priority: msg.Maximum_Priority,
+                         completion: msg.Completion_Filter,
+                         sort_keys: msg.Sort_Keys,
+                         offset: int(msg.Offset),
+                         limit: current_config.Load().Limits.Max_Query_Results,
+                        }
+    if msg.Limit > 0 && int(msg.Limit) < query.limit {
+        query.limit = int(msg.Limit)
+    }
+    if query.completion > ptmp.QUERY_COMPLETED_ONLY {
+        return nil, ptmp.SYNTAX_ERROR, fmt.Sprintf("completion filter %v isn't one the server knows", query.completion)
+    }
+    if len(query.sort_keys) > int(ptmp.QUERY_MAX_SORT_KEYS) {
+        return nil, ptmp.SYNTAX_ERROR, fmt.Sprintf("a query can only be sorted by %v keys", ptmp.QUERY_MAX_SORT_KEYS)
+    }
+    for _, key := range query.sort_keys {
+        if key.Key > ptmp.SORT_BY_STATUS {
+            return nil, ptmp.SYNTAX_ERROR, fmt.Sprintf("sort key %v isn't one the server knows", key.Key)
+        }
+    }
+
+    known_flags := ptmp.SEARCH_IN_TITLE | ptmp.SEARCH_IN_DESCRIPTION | ptmp.SEARCH_IGNORE_CASE | ptmp.SEARCH_REGEX
+    if msg.Search_Flags & ^known_flags != 0 {
+        return nil, ptmp.SYNTAX_ERROR, fmt.Sprintf("search flags %#x aren't ones the server knows", msg.Search_Flags & ^known_flags)
+    }
+    if len(msg.Search) > int(ptmp.SEARCH_MAX_LENGTH) || !utf8.Valid(msg.Search) {
+        return nil, ptmp.SYNTAX_ERROR, fmt.Sprintf("the search has to be UTF-8, and no more than %v bytes", ptmp.SEARCH_MAX_LENGTH)
+    }
+    query.search_title = msg.Search_Flags & ptmp.SEARCH_IN_TITLE != 0
+    query.search_description = msg.Search_Flags & ptmp.SEARCH_IN_DESCRIPTION != 0
+    if !query.search_title && !query.search_description {
+        query.search_title, query.search_description = true, true
+    }
+    ignore_case := msg.Search_Flags & ptmp.SEARCH_IGNORE_CASE != 0
+    if msg.Search_Flags & ptmp.SEARCH_REGEX != 0 {
+        // (Go's regular expressions run in time linear in the text, so there's no pattern a client could send that
+        // would tie the store up)
+        pattern := string(msg.Search)
+        if ignore_case {
+            pattern = "(?i)" + pattern
+        }
+        compiled, err_status := regexp.Compile(pattern)
+        if err_status != nil {
+            return nil, ptmp.SYNTAX_ERROR, fmt.Sprintf("the search isn't a regular expression: %v", err_status)
+        }
+        query.search = compiled.Match
+    } else if len(msg.Search) > 0 && ignore_case {
+        needle := []byte(strings.ToLower(string(msg.Search)))
+        query.search = func(text []byte) bool { return bytes.Contains(bytes.ToLower(text), needle) }
+    } else if len(msg.Search) > 0 {
+        needle := msg.Search
+        query.search = func(text []byte) bool { return bytes.Contains(text, needle) }
+    }
+
+    if len(msg.Cursor) > 0 {
+        after, cursor_ok := decodeCursor(msg.Cursor, query.sort_keys)
+        if !cursor_ok {
+            return nil, ptmp.SYNTAX_ERROR, "the cursor isn't one this server gave out for a query sorted this way"
+        }
+        query.after = after
+    }
+    return query, ptmp.SINGULAR_MSG_SUCCESS, ""
+}
+
+// Whether a task is one the query is asking for.  The cheap checks go first, so that the search only has to look
+// at the tasks that get that far.
+func (query *task_query) selects(task *ptmp.T_Inf) bool {
+    if task.Task_Priority_Value < query.min_priority || task.Task_Priority_Value > query.max_priority {
+        return false
+    }
+    completed := ptmp.Byte2Bool(task.Completion_Status)
+    if (query.completion == ptmp.QUERY_INCOMPLETE_ONLY && completed) || (query.completion == ptmp.QUERY_COMPLETED_ONLY && !completed) {
+        return false
+    }
+    if query.search == nil {
+        return true
+    }
+    return (query.search_title && query.search(task.Task_Title)) || (query.search_description && query.search(task.Task_Description))
+}
+
+// Which of two tasks comes first in the query's order: negative for a, positive for b.  Reference numbers settle
+// anything the sort keys don't, and no two tasks share one, so it's never 0 for two different tasks.
+func (query *task_query) compare(a *ptmp.T_Inf, b *ptmp.T_Inf) int {
+    for _, key := range query.sort_keys {
+        order := 0
+        switch key.Key {
+            case ptmp.SORT_BY_REFERENCE:
+                order = int(a.Task_Reference_Number) - int(b.Task_Reference_Number)
+            case ptmp.SORT_BY_PRIORITY:
+                order = int(a.Task_Priority_Value) - int(b.Task_Priority_Value)
+            case ptmp.SORT_BY_TITLE:
+                order = bytes.Compare(a.Task_Title, b.Task_Title)
+            case ptmp.SORT_BY_STATUS:
+                order = int(ptmp.Bool2Byte(ptmp.Byte2Bool(a.Completion_Status))) - int(ptmp.Bool2Byte(ptmp.Byte2Bool(b.Completion_Status)))
+        }
+        if ptmp.Byte2Bool(key.Descending) {
+            order = -order
+        }
+        if order != 0 {
+            return order
+        }
+    }
+    return int(a.Task_Reference_Number) - int(b.Task_Reference_Number)
+}
+
+// Run the query against the tasks: one pass to pick out the ones it asks for, and then only those (past the
+// cursor) get sorted.  Comes back with the page, how many tasks matched in all, and the cursor for the next page
+// (nil if there isn't one).
+func (query *task_query) run(tasks []ptmp.T_Inf) ([]ptmp.T_Inf, int, []byte) {
+    matched := []ptmp.T_Inf{}
+    total := 0
+    for ii := range tasks {
+        if !query.selects(&tasks[ii]) {
+            continue
+        }
+        total++
+        if query.after != nil && query.compare(&tasks[ii], query.after) <= 0 {
+            continue // (on a page that's already been sent)
+        }
+        matched = append(matched, tasks[ii])
+    }
+    sort.Slice(matched, func(a int, b int) bool { return query.compare(&matched[a], &matched[b]) < 0 })
+    if query.offset >= len(matched) {
+        return []ptmp.T_Inf{}, total, nil
+    }
+    matched = matched[query.offset:]
+    if len(matched) <= query.limit {
+        return matched, total, nil
+    }
+    page := matched[:query.limit]
+    return page, total, encodeCursor(&page[len(page)-1], query.sort_keys)
+}
+
+// A cursor is everything the sort needs to know about the last task on a page, so that the next page can pick up
+// after it whether or not it's still there: the sort keys it was made for, then the task's reference number,
+// priority and completion status, then its title (only when the sort goes by titles, since that's the big one).
+func encodeCursor(last *ptmp.T_Inf, sort_keys []ptmp.Sort_Key) []byte {
+    cursor := []byte{byte(len(sort_keys))}
+    with_title := false
+    for _, key := range sort_keys {
+        cursor = append(cursor, key.Key, ptmp.Bool2Byte(ptmp.Byte2Bool(key.Descending)))
+        with_title = with_title || key.Key == ptmp.SORT_BY_TITLE
+    }
+    cursor = binary.BigEndian.AppendUint16(cursor, last.Task_Reference_Number)
+    cursor = binary.BigEndian.AppendUint16(cursor, last.Task_Priority_Value)
+    cursor = append(cursor, ptmp.Bool2Byte(ptmp.Byte2Bool(last.Completion_Status)))
+    if with_title {
+        cursor = append(cursor, last.Task_Title...)
+    }
+    return cursor
+}
+
+// The task a cursor stands for, as long as it was made for the same sort keys.
+func decodeCursor(cursor []byte, sort_keys []ptmp.Sort_Key) (*ptmp.T_Inf, bool) {
+    if len(cursor) < 1 || int(cursor[0]) != len(sort_keys) || len(cursor) < 1 + 2*len(sort_keys) + 5 {
+        return nil, false
+    }
+    with_title := false
+    for ii, key := range sort_keys {
+        if cursor[1+2*ii] != key.Key || cursor[2+2*ii] != ptmp.Bool2Byte(ptmp.Byte2Bool(key.Descending)) {
+            return nil, false
+        }
+        with_title = with_title || key.Key == ptmp.SORT_BY_TITLE
+    }
+    rest := cursor[1+2*len(sort_keys):]
+    after := &ptmp.T_Inf{
+                         Task_Reference_Number: binary.BigEndian.Uint16(rest[0:2]),
+                         Task_Priority_Value: binary.BigEndian.Uint16(rest[2:4]),
+                         Completion_Status: rest[4],
+                        }
+    if with_title {
+        after.Task_Title = rest[5:]
+    } else if len(rest) > 5 {
+        return nil, false
+    }
+    return after, true
+}
+
+// Answer a version 2 Query_Tasks: a Task_Information for each task on the page, in order, and then one with no
+// tasks saying how many matched in all and where the next page starts.  Unlike the version 1 query, finding
+// nothing isn't UNABLE_TO_COMPLY, it's a page with nothing on it.
+func answerTaskQuery(w ptmpserver.ResponseWriter, r *ptmpserver.Request, msg ptmp.Query_Tasks_V2) {
+    query, response_code, diagnostic := parseTaskQuery(msg)
+    if response_code != ptmp.SINGULAR_MSG_SUCCESS {
+        ptmpserver.AckDetailed(w, r, response_code, nil, diagnostic)
+        return
+    }
+    page, total, next_cursor := query.run(active_tasks)
+    for ii := range page {
+        w.Send(ptmp.Prep_Task_Information(page[ii:ii+1], byte(len(page)-ii)))
+    }
+    w.Send(ptmp.Prep_Task_Page_End(uint16(total), next_cursor))
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+    "ajb497/ptmp"
+    "testing"
+)
+
+func queryTestTask(ref uint16, priority uint16, title string, description string, completed bool) ptmp.T_Inf {
+    return ptmp.T_Inf{
+                      Task_Reference_Number: ref,
+                      Task_Priority_Value: priority,
+                      Length_of_Title: byte(len(title)),
+                      Task_Title: []byte(title),
+                      Description_Length: uint16(len(description)),
+                      Task_Description: []byte(description),
+                      Completion_Status: ptmp.Bool2Byte(completed),
+                     }
+}
+
+func parseTestQuery(t *testing.T, msg ptmp.PTMP_Msg) *task_query {
+    t.Helper()
+    query, response_code, diagnostic := parseTaskQuery(*ptmp.DecodePayload[ptmp.Query_Tasks_V2](msg.Pld))
+    if response_code != ptmp.SINGULAR_MSG_SUCCESS {
+        t.Fatalf("The query was turned away with %v: %v", response_code, diagnostic)
+    }
+    return query
+}
+
+// Paging through a search with a cursor gets every match exactly once, in order, even when the store changes
+// between pages.
+func TestTaskQueriesSearchSortAndPage(t *testing.T) {
+    tasks := []ptmp.T_Inf{
+        queryTestTask(0, 10, "Buy milk", "the oat kind", false),
+        queryTestTask(1, 50, "Walk dog", "before it rains", false),
+        queryTestTask(2, 30, "MILK the cow", "", false),
+        queryTestTask(3, 30, "Return library books", "and pick up milk", false),
+        queryTestTask(4, 90, "Milkshake", "", true),
+        queryTestTask(5, 70, "Call about milk delivery", "", false),
+    }
+    by_priority := []ptmp.Sort_Key{{Key: ptmp.SORT_BY_PRIORITY, Descending: 1}}
+    search := func(cursor []byte) ptmp.PTMP_Msg {
+        return ptmp.Prep_Query_Tasks_V2(0, 65535, []uint16{1}, ptmp.QUERY_INCOMPLETE_ONLY, ptmp.SEARCH_IGNORE_CASE, "milk", by_priority, 2, 0, cursor)
+    }
+
+    page, total, cursor := parseTestQuery(t, search(nil)).run(tasks)
+    if total != 4 || len(page) != 2 || page[0].Task_Reference_Number != 5 || page[1].Task_Reference_Number != 2 || cursor == nil {
+        t.Fatalf("The first page was %v of %v (cursor %v)", page, total, cursor)
+    }
+    // one task from the page that was already sent goes away, and a new one turns up further down
+    tasks = append(tasks[1:], queryTestTask(6, 20, "Milk again", "", false))
+    page, total, cursor = parseTestQuery(t, search(cursor)).run(tasks)
+    if total != 4 || len(page) != 2 || page[0].Task_Reference_Number != 3 || page[1].Task_Reference_Number != 6 || cursor != nil {
+        t.Fatalf("The second (and last) page was %v of %v (cursor %v)", page, total, cursor)
+    }
+
+    titles_only := parseTestQuery(t, ptmp.Prep_Query_Tasks_V2(0, 65535, nil, ptmp.QUERY_ANY_STATUS, ptmp.SEARCH_IN_TITLE | ptmp.SEARCH_REGEX, "^[A-Z][a-z]+ (dog|again)$", nil, 0, 1, nil))
+    if page, total, _ = titles_only.run(tasks); total != 2 || len(page) != 1 || page[0].Task_Reference_Number != 6 {
+        t.Errorf("A regular expression on titles, skipping the first match, got %v of %v", page, total)
+    }
+}
+
+func TestTaskQueriesThatDontMakeSense(t *testing.T) {
+    by_title := []ptmp.Sort_Key{{Key: ptmp.SORT_BY_TITLE}}
+    title_cursor := encodeCursor(&ptmp.T_Inf{Task_Title: []byte("Walk dog")}, by_title)
+    for _, bad := range []struct {
+        msg ptmp.PTMP_Msg
+        response_code uint16
+    }{
+        {ptmp.Prep_Query_Tasks_V2(0, 65535, []uint16{1, 2}, ptmp.QUERY_ANY_STATUS, 0, "", nil, 0, 0, nil), ptmp.LIST_DOES_NOT_EXIST},
+        {ptmp.Prep_Query_Tasks_V2(0, 65535, nil, 3, 0, "", nil, 0, 0, nil), ptmp.SYNTAX_ERROR},
+        {ptmp.Prep_Query_Tasks_V2(0, 65535, nil, ptmp.QUERY_ANY_STATUS, 0x10, "", nil, 0, 0, nil), ptmp.SYNTAX_ERROR},
+        {ptmp.Prep_Query_Tasks_V2(0, 65535, nil, ptmp.QUERY_ANY_STATUS, ptmp.SEARCH_REGEX, "(unclosed", nil, 0, 0, nil), ptmp.SYNTAX_ERROR},
+        {ptmp.Prep_Query_Tasks_V2(0, 65535, nil, ptmp.QUERY_ANY_STATUS, 0, "", []ptmp.Sort_Key{{Key: 9}}, 0, 0, nil), ptmp.SYNTAX_ERROR},
+        {ptmp.Prep_Query_Tasks_V2(0, 65535, nil, ptmp.QUERY_ANY_STATUS, 0, "", nil, 0, 0, title_cursor), ptmp.SYNTAX_ERROR},
+        {ptmp.Prep_Query_Tasks_V2(0, 65535, nil, ptmp.QUERY_ANY_STATUS, 0, "", by_title, 0, 0, []byte{1, 2}), ptmp.SYNTAX_ERROR},
+    } {
+        if _, response_code, _ := parseTaskQuery(*ptmp.DecodePayload[ptmp.Query_Tasks_V2](bad.msg.Pld)); response_code != bad.response_code {
+            t.Errorf("Query %+v got %v, expected %v", *ptmp.DecodePayload[ptmp.Query_Tasks_V2](bad.msg.Pld), response_code, bad.response_code)
+        }
+    }
+    if _, response_code, _ := parseTaskQuery(*ptmp.DecodePayload[ptmp.Query_Tasks_V2](ptmp.Prep_Query_Tasks_V2(0, 65535, nil, 0, 0, "", by_title, 0, 0, title_cursor).Pld)); response_code != ptmp.SINGULAR_MSG_SUCCESS {
+        t.Errorf("A cursor for the same sort was turned away with %v", response_code)
+    }
+}
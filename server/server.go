@@ -1,190 +1,205 @@
 package main
 
 import (
-    "io"
-    "log"
+    "crypto/tls"
+    "errors"
+    "flag"
+    "fmt"
     "ajb497/ptmp"
-    "time"
+    "ajb497/ptmp/ptmpserver"
     "strings"
     "net"
+    "net/http"
+    "os"
+    "os/signal"
+    "sync"
+    "syscall"
+    "time"
 )
 
-var buff_incoming = make([]byte, 2048) // Incoming buffer is intentionally oversized to ensure no possible issues with running out of space when receiving a message
-const HOST string = "localhost:10101" // Per assignment specification, server hard-codes the port number.
+// These are all just defaults now, which the config file, environment or command line can change (see config.go).
+const HOST string = "localhost:10101" // Per assignment specification, this is the port number unless told otherwise.
 const BASE_PROTO string = "tcp" // I had been implementing this using QUIC originally, but I figured that might count as a 3rd party library, so went down to just TCP
-const LOGGING_ENABLED bool = true
 const VALID_UNAME string = "Ed Ucational"
 const VALID_PW string = "p@55w0rd" // because we believe in super high security here at Alec's Computer Code and Fishing Tackle Emporium
 
-var active_proto_version uint16 = 1 // I've only made one of these so far
-var exts_enabled = make([]uint16, 0) // And I have not yet needed to extend it beyond my original spec... mostly because I haven't even coded the entirety of the original spec yet.
+var active_proto_version uint16 = 2 // the newest one we speak, version 1 clients still get version 1
+var server_version = "ptmp-server dev" // what clients are told when they ask for our capabilities; release builds set it with -ldflags "-X main.server_version=..."
+var exts_enabled = []uint16{ptmp.EXT_DETAILED_ACKS, ptmp.EXT_IDEMPOTENCY_KEYS, ptmp.EXT_SESSION_RESUMPTION} // the extensions to the original spec that clients can ask for
 var proto_versions_supported = make([]uint16, 1)
-var timeout_permitted uint16 = 60 // Not actually used at the moment, but timeout as a concept would exist in fuller implementations of the spec
+
+// By default, a session can send this many messages in a row, and then this many a second after that, before it gets RATE_LIMITED.
+const MESSAGE_BURST int = 100
+const MESSAGE_RATE float64 = 20
+// And the server takes this many clients at once, this many of them logged in as the same user.
+const MAX_SESSIONS int = 100
+const MAX_SESSIONS_PER_USER int = 10
+// Five wrong passwords in a row are free, and then each one after that locks the user (and the address it came from)
+// out of logging in for twice as long as the last, starting at a second and topping out at a quarter of an hour.
+const LOGIN_MAX_FAILURES int = 5
+const LOGIN_LOCKOUT time.Duration = time.Second
+const LOGIN_MAX_LOCKOUT time.Duration = 15*time.Minute
+// A client retrying a change it never heard back about gets the first answer back (instead of the change being made
+// twice) as long as the retry is one of the last thousand keyed messages from that user, within the hour.
+const IDEMPOTENCY_KEYS int = 1000
+const IDEMPOTENCY_TTL time.Duration = time.Hour
+// A client whose connection dropped can log back in with its session token (instead of its password) for this long.
+const RESUME_TTL time.Duration = 5*time.Minute
+// Lists can be as long as anyone likes, unless the config says otherwise.
+const MAX_TASKS_PER_LIST int = 0
+// Titles and descriptions can have as many characters as fit in their bytes, unless the config says otherwise.
+const MAX_TITLE_CHARS int = 255
+const MAX_DESCRIPTION_CHARS int = 511
+// Clients that ask for bigger payloads than the original 1024 bytes can have up to this much.
+const MAX_PAYLOAD_SIZE int = 16384
+// A version 2 Query_Tasks gets at most this many tasks at once, and has to page through the rest.
+const MAX_QUERY_RESULTS int = 100
 
 // Some convenient member variables for the server that all functions can access
-var rcvdMsg *ptmp.PTMP_Msg
-var connectionEstablished bool = false
-var conn net.Conn
-var exit_program bool = false
+var ptmp_server *ptmpserver.Server
+var server_metrics = ptmpserver.NewMetrics()
 var active_tasks []ptmp.T_Inf
+var next_task_ref uint16 = 0 // reference numbers can't just be the length of the task list anymore, since removed tasks can come back out of the trash with their old numbers
+var store_lock sync.Mutex // guards active_tasks and the trash, since the trash sweeper and the HTTP gateway run alongside the client connection
 
-// Initial setup of the connection.
-func connect_to_client(addr string) (net.Conn, error) {
-    if LOGGING_ENABLED {
-        log.Printf("Server is initializing")
+// Put together the protocol server with a handler for each of the message types we implement, and the middleware
+// that every message goes through on its way to them.
+func newServer() *ptmpserver.Server {
+    srv := ptmpserver.NewServer(checkCredentials)
+    srv.Protocol_Version = active_proto_version
+    srv.Version = server_version
+    srv.Extensions = exts_enabled
+    srv.Logger = logger
+    srv.Metrics = server_metrics
+    rate_limits := func() (float64, int) {
+        limits := current_config.Load().Limits // read every time, since the limits can change on a reload
+        return limits.Message_Rate, limits.Message_Burst
     }
-
-    listener, err_status := net.Listen(BASE_PROTO, addr)
-
-    if err_status != nil {
-        return nil, err_status
+    srv.Session_Limits = func() ptmpserver.SessionLimits {
+        limits := current_config.Load().Limits
+        return ptmpserver.SessionLimits{Max_Sessions: limits.Max_Sessions, Max_Sessions_Per_User: limits.Max_Sessions_Per_User}
     }
-    if LOGGING_ENABLED {
-        log.Printf("Server finalizing setup.")
+    srv.Login_Throttle = ptmpserver.NewLoginThrottle(func() ptmpserver.ThrottlePolicy {
+        limits := current_config.Load().Limits
+        return ptmpserver.ThrottlePolicy{Max_Failures: limits.Login_Max_Failures, Lockout: time.Duration(limits.Login_Lockout), Max_Lockout: time.Duration(limits.Login_Max_Lockout)}
+    })
+    idempotency := ptmpserver.NewIdempotencyCache(func() ptmpserver.IdempotencyPolicy {
+        limits := current_config.Load().Limits
+        return ptmpserver.IdempotencyPolicy{Max_Keys_Per_User: limits.Idempotency_Keys, TTL: time.Duration(limits.Idempotency_TTL)}
+    })
+    srv.Session_Tokens = ptmpserver.NewSessionTokens(func() ptmpserver.ResumptionPolicy {
+        return ptmpserver.ResumptionPolicy{TTL: time.Duration(current_config.Load().Limits.Resume_TTL)}
+    })
+    srv.Task_Limits = func() ptmpserver.TaskLimits {
+        limits := current_config.Load().Limits
+        return ptmpserver.TaskLimits{Max_Tasks_Per_List: uint16(limits.Max_Tasks_Per_List), Max_Title_Chars: uint16(limits.Max_Title_Chars), Max_Description_Chars: uint16(limits.Max_Description_Chars)}
     }
-    this_conn, err_status := listener.Accept()
-    if err_status != nil {
-        return nil, err_status
+    srv.Max_Payload_Size = func() uint16 {
+        return uint16(current_config.Load().Limits.Max_Payload_Size)
     }
+    srv.Use(ptmpserver.Recover, ptmpserver.AccessLog(access_logger), server_metrics.Middleware, ptmpserver.RateLimitFunc(rate_limits), ptmpserver.RequireLogin, idempotency.Middleware, withStore)
+    srv.Atomically = storeTransaction
 
-    return this_conn, nil
-}
-
-// This is the core function where the server will be spending most of its time.
-func recv() error {
-
-    // Continuously look for incoming messages.
-    for false == exit_program {
-        // any incoming data gets put into our receipt buffer
-        num_bytes_in, err_status := conn.Read(buff_incoming)
-        if (err_status != nil) && (err_status!= io.ErrUnexpectedEOF) {
-            log.Printf("Error attempting to read from client:\n\t%+v\n", err_status)
-            return err_status
+    srv.HandleFunc(ptmp.CREATE_NEW_TASK, func(w ptmpserver.ResponseWriter, r *ptmpserver.Request) {
+        // we'll take in the new task and add it into our active task list so that it can be
+        // referenced in other traffic with the client.
+        incoming_contents := ptmp.DecodePayload[ptmp.Create_New_Task](r.Msg.Pld)
+        response_code, ref := addTaskToList(*incoming_contents, r.Session.Protocol_Version)
+        if response_code != ptmp.SINGULAR_MSG_SUCCESS {
+            w.Ack(response_code)
+            return
         }
-        if LOGGING_ENABLED {
-            log.Printf("Server has receved a message from the client.")
+        // (sessions with detailed acks hear what reference number it got, so they don't have to go looking for it)
+        ptmpserver.AckDetailed(w, r, response_code, []ptmp.Item_Result{{Task_Reference_Number: ref, Response_Code: response_code}}, "")
+    })
+    srv.HandleFunc(ptmp.QUERY_TASKS, func(w ptmpserver.ResponseWriter, r *ptmpserver.Request) {
+        // the header says which version of the query this is, since they're laid out differently
+        if r.Msg.Hdr.Protocol_Version >= ptmp.PROTOCOL_VERSION_2 {
+            answerTaskQuery(w, r, *ptmp.DecodePayload[ptmp.Query_Tasks_V2](r.Msg.Pld))
+            return
         }
-        // By decoding the packet, we get the header information, and once we have that, we can go into our normal server logic of what to do about each message type (DFA).
-        rcvdMsg = ptmp.DecodePacket(buff_incoming[0:num_bytes_in])
-
-        // Once we've got the header decoded and the full message stored as rcvdMsg, we can go into our server-side logic
-        // of what to actually do now that we've received something from the client.
-        determine_response()
-    }
-    conn.Close()
-    return nil
+        incoming_contents := ptmp.DecodePayload[ptmp.Query_Tasks](r.Msg.Pld)
+        sendTaskInfo(w, incoming_contents.Minimum_Priority, incoming_contents.Maximum_Priority) // We're in one of the few messages that doesn't get responded-to with an ack, so there's special logic to respond to this one
+    })
+    srv.HandleFunc(ptmp.REMOVE_TASK, func(w ptmpserver.ResponseWriter, r *ptmpserver.Request) {
+        incoming_contents := ptmp.DecodePayload[ptmp.Remove_Tasks](r.Msg.Pld)
+        removeTasks(w, r, incoming_contents.List_ID, incoming_contents.Tasks_To_Remove, ptmp.Byte2Bool(incoming_contents.Permit_Remove_Incomplete)) // handles its own ack-sending
+    })
+    srv.HandleFunc(ptmp.MARK_TASK_COMPLETED, func(w ptmpserver.ResponseWriter, r *ptmpserver.Request) {
+        incoming_contents := ptmp.DecodePayload[ptmp.Mark_Task_Completed](r.Msg.Pld)
+        completeTask(w, incoming_contents.List_ID, incoming_contents.Task_To_Mark) // handles its own ack-sending
+    })
+    srv.HandleFunc(ptmp.QUERY_TRASH, func(w ptmpserver.ResponseWriter, r *ptmpserver.Request) {
+        incoming_contents := ptmp.DecodePayload[ptmp.Query_Trash](r.Msg.Pld)
+        sendTrashInfo(w, incoming_contents.List_ID) // like QUERY_TASKS, answered with info messages rather than an ack when there's something to send
+    })
+    srv.HandleFunc(ptmp.RESTORE_TASKS, func(w ptmpserver.ResponseWriter, r *ptmpserver.Request) {
+        incoming_contents := ptmp.DecodePayload[ptmp.Restore_Tasks](r.Msg.Pld)
+        restoreTasks(w, r, incoming_contents.List_ID, incoming_contents.Tasks_To_Restore) // handles its own ack-sending
+    })
+    srv.HandleFunc(ptmp.PURGE_TRASH, func(w ptmpserver.ResponseWriter, r *ptmpserver.Request) {
+        incoming_contents := ptmp.DecodePayload[ptmp.Purge_Trash](r.Msg.Pld)
+        purgeTrash(w, r, incoming_contents.List_ID, incoming_contents.Tasks_To_Purge) // handles its own ack-sending
+    })
+    srv.HandleFunc(ptmp.QUERY_HISTORY, func(w ptmpserver.ResponseWriter, r *ptmpserver.Request) {
+        incoming_contents := ptmp.DecodePayload[ptmp.Query_History](r.Msg.Pld)
+        sendHistory(w, *incoming_contents) // answered with history messages rather than an ack when there's something to send
+    })
+    return srv
 }
 
-// If something needs to get sent to the client, it can be provided here as a byte stream and it'll get shot right out.
-func xmit(packet_out []byte) (int, error) {
-
-	num_bytes_out, err_status := conn.Write(packet_out)
-    if err_status != nil {
-        log.Printf("Error writing to client: %+v\n", err_status)
-        return 0, err_status
-    }
-    if LOGGING_ENABLED {
-        log.Printf("Wrote a response to the client.\n")
-    }
-    return num_bytes_out, err_status
+// The innermost middleware: the handlers all work on the task store, so they run with it locked, and whatever they
+// changed gets recorded in the audit log before anyone else gets a look at it.
+func withStore(next ptmpserver.Handler) ptmpserver.Handler {
+    return ptmpserver.HandlerFunc(func(w ptmpserver.ResponseWriter, r *ptmpserver.Request) {
+        store_lock.Lock()
+        defer store_lock.Unlock()
+        before := snapshotTaskStates()
+        next.ServePTMP(w, r)
+        auditMessage(r, w.ResponseCode(), before)
+        if inspect, found := r.Context.Value(inspect_key{}).(func(uint16)); found {
+            inspect(w.ResponseCode())
+        }
+    })
 }
 
-// This is the main server business logic function - this is where we go when we receive incoming
-// messages and then decide how to proceed (DFA).
-func determine_response() {
-    // first part of the DFA is setting up the connection, so if that's not done yet, the protocol is in a different state.
-    if connectionEstablished {
-        // We can't decode the body until we know what the overall message type is
-        // And our action is going to depend on what type of message we're receiving (and if it's in the right context)
-        switch rcvdMsg.Hdr.Msg_Type_ID {
-            case ptmp.REQUEST_CONNECTION:
-                // To get into this switch/case, you need to be in an already-established connection, so sending
-                // another Request_Connection at this point is contextually invalid.
-                sendAck(ptmp.MSG_CONTEXT_INVALID)
-            case ptmp.CREATE_NEW_TASK:
-                // we'll take in the new task and add it into our active task list so that it can be
-                // referenced in other traffic with the client.
-                incoming_contents := ptmp.DecodePayload[ptmp.Create_New_Task](rcvdMsg.Pld)
-                sendAck(addTaskToList(*incoming_contents))
-            case ptmp.CLOSE_CONNECTION:
-                incoming_contents := ptmp.DecodePayload[ptmp.Close_Connection](rcvdMsg.Pld)
-                if LOGGING_ENABLED {
-                    log.Printf("\nReceived a Close_Connection message.\n\tClient to await ack before closing: %v\n", incoming_contents.Will_Await_Ack)
-                }
-                // We'll only bother sending the ACK if the client said they cared about waiting for it.
-                if ptmp.Byte2Bool(incoming_contents.Will_Await_Ack) {
-                    sendAck(ptmp.SINGULAR_MSG_SUCCESS)
-                }
-                exit_program = true // client said it's done, so we are too [since this is a demo program that only connects to our one special client]
-                connectionEstablished = false // this shouldn't be needed, but just to be safe, we're declaring the connection officially dis-established
-            case ptmp.QUERY_TASKS:
-                sendTaskInfo() // We're in one of the few messages that doesn't get responded-to with an ack, so there's special logic to respond to this one
-            case ptmp.REMOVE_TASK:
-                incoming_contents := ptmp.DecodePayload[ptmp.Remove_Tasks](rcvdMsg.Pld)
-                removeTasks(incoming_contents.Tasks_To_Remove, ptmp.Byte2Bool(incoming_contents.Permit_Remove_Incomplete)) // handles its own ack-sending
-            case ptmp.MARK_TASK_COMPLETED:
-                incoming_contents := ptmp.DecodePayload[ptmp.Mark_Task_Completed](rcvdMsg.Pld)
-                completeTask(incoming_contents.List_ID, incoming_contents.Task_To_Mark) // handles its own ack-sending
-            default:
-                if LOGGING_ENABLED {
-                    log.Printf("Received a message of type %v that we don't have implemented.\n", rcvdMsg.Hdr.Msg_Type_ID)
-                }
-                // If you made it here, you sent a message with an ID in the header that I do not yet have a server implementation to handle.
-                sendAck(ptmp.MSG_NOT_IMPLEMENTED)
+// Transactions are made from inside withStore, so the store is already locked for the whole thing, and all that's
+// left to do here is put it back the way it was if any of the changes fail.
+func storeTransaction(apply func() bool) {
+    saved := captureStore()
+    made := false
+    defer func() {
+        if !made {
+            restoreStore(saved) // (including when a handler panics partway through)
         }
-    } else {
-        // the message we got better be a REQUEST_CONNECTION
-        if rcvdMsg.Hdr.Msg_Type_ID == ptmp.REQUEST_CONNECTION {
-            incoming_contents := ptmp.DecodePayload[ptmp.Request_Connection](rcvdMsg.Pld)
-            // The trailing null bytes from the username and password byte arrays need to be trimmed out in order
-            // to make the straight string comparison with stored values behave as expected
-            the_uname := byteArray2Str(incoming_contents.Username[:])
-            the_pw := byteArray2Str(incoming_contents.Password[:])
-            if LOGGING_ENABLED {
-                log.Printf("The username provided was '%v', password '%v'.", the_uname, the_pw)
-            }
-            uname_good := the_uname == VALID_UNAME
-            pw_good := the_pw == VALID_PW
-            // We still send a connection rules message in response even if the username and password are not valid, but we do note that fact
-            // in the response message.
-            sendConnRules(uname_good, pw_good)
+    }()
+    made = apply()
+}
 
-            // The connection is only considered established once the username and password combo checks-out, otherwise, the client will
-            // need to send another connection request and retry the username/password combo.
-            if uname_good && pw_good {
-                connectionEstablished = true
-            }
-            if LOGGING_ENABLED {
-                if connectionEstablished {
-                    log.Printf("Connection has been established (username and password checked out).\n")
-                } else {
-                    log.Printf("Connection unable to be established.\n\tUsername received: %v\n\tUsername accepted: %v\n\tPassword Received: %v\n\tPassword accepted: %v\n\n",
-                               the_uname,
-                               VALID_UNAME,
-                               the_pw,
-                               VALID_PW)
-                }
-            }
-        } else {
-            // If the connection hasn't been established with the proper handshake, any message we received right now that isn't a request connection is out of context
-            sendAck(ptmp.MSG_CONTEXT_INVALID)
-        }
-    }
+// The one place that decides whether a username and password are any good, shared by the handshake and the HTTP gateway.
+func checkCredentials(uname string, pw string) (bool, bool) {
+    return current_config.Load().checkCredentials(uname, pw)
 }
 
-func byteArray2Str(in_bytes []byte) string {
-    // Used for handling incoming message contents as strings, and removes those pesky trailing null bytes that may or may not be present depending on the field.
-    return strings.Trim(string(in_bytes[:]), "\x00")
+// Used for handling incoming message contents as strings.  Version 1 clients may have padded them out with null
+// bytes, so those get trimmed off the end, but from version 2 on a string is exactly what was sent.
+func bytesToStr(in_bytes []byte, version uint16) string {
+    if version < uint16(ptmp.PROTOCOL_VERSION_2) {
+        return strings.TrimRight(string(in_bytes), "\x00")
+    }
+    return string(in_bytes)
 }
 
-func addTaskToList(newTaskMsg ptmp.Create_New_Task) uint16 {
-    title := byteArray2Str(newTaskMsg.Task_Title[:])
-    // It shouldn't be possible for the title
-    // to be beyond the maximum length at this point, but
-    // it was the only thing I could think of to demonstrate
-    // the use of the response code
-    if uint16(len(title)) > ptmp.TITLE_MAX_LENGTH {
-        return ptmp.INVALID_NAME
+// Comes back with the response code, and the reference number the new task got if it was made.
+func addTaskToList(newTaskMsg ptmp.Create_New_Task, version uint16) (uint16, uint16) {
+    title := bytesToStr(newTaskMsg.Task_Title, version)
+    description := bytesToStr(newTaskMsg.Task_Description, version)
+    // Titles and descriptions have to be UTF-8, and keep to the limits in both bytes (what the messages have room
+    // for) and characters (what the config allows).
+    limits := current_config.Load().Limits
+    if !ptmp.ValidText(title, ptmp.TITLE_MAX_LENGTH, uint16(limits.Max_Title_Chars)) ||
+       !ptmp.ValidText(description, ptmp.DESCRIPTION_MAX_LENGTH, uint16(limits.Max_Description_Chars)) {
+        return ptmp.INVALID_NAME, 0
     }
 
     // and another error code you could get is trying to add something to a list
@@ -193,12 +208,16 @@ func addTaskToList(newTaskMsg ptmp.Create_New_Task) uint16 {
     // we'll just say that list number 1 is the only valid one to add tasks to,
     // and any other list number specified will result in an error
     if 1 != newTaskMsg.Associated_List_ID {
-        return ptmp.LIST_DOES_NOT_EXIST
+        return ptmp.LIST_DOES_NOT_EXIST, 0
+    }
+    // A full list doesn't take any more until something comes off of it.  Tasks coming back out of the trash don't
+    // count against this, since they were already on the list once.
+    if max_tasks := limits.Max_Tasks_Per_List; max_tasks > 0 && len(active_tasks) >= max_tasks {
+        return ptmp.UNABLE_TO_COMPLY, 0
     }
-    description := byteArray2Str(newTaskMsg.Task_Description[:])
     // For convenience, we'll store tasks in the same format that the Task_Information message will look for when sending info back to the client.
     thisTask := ptmp.T_Inf{
-                      Task_Reference_Number: uint16(len(active_tasks)),
+                      Task_Reference_Number: next_task_ref,
                       Task_Priority_Value: newTaskMsg.Priority_Value,
                       Length_of_Title: byte(len(title)),
                       Task_Title: []byte(title),
@@ -206,92 +225,115 @@ func addTaskToList(newTaskMsg ptmp.Create_New_Task) uint16 {
                       Task_Description: []byte(description),
                       Completion_Status: ptmp.Bool2Byte(false),
     }
-    if LOGGING_ENABLED {
-        log.Printf("\nNew task received from client and being added to the list:\n\tTitle: %v\n\tList // Priority: %v // %v\n\tDescription: %v\n\n",
-                   title,
-                   newTaskMsg.Associated_List_ID,
-                   newTaskMsg.Priority_Value,
-                   description)
-    }
+    logger.Debug("New task received from client and being added to the list", "ref", next_task_ref, "title", title,
+                 "list", newTaskMsg.Associated_List_ID, "priority", newTaskMsg.Priority_Value, "description", description)
     active_tasks = append(active_tasks, thisTask) // record this task as actually being on our list of tasks
-    return ptmp.SINGULAR_MSG_SUCCESS
-}
-
-// Shoot off an ACK message back to the client with the specified response code.
-func sendAck(response_code uint16) {
-    ack := ptmp.Prep_Acknowledgment(response_code, rcvdMsg.Hdr.Msg_Type_ID)
-    encoded := ptmp.EncodePacket(ack)
-    xmit(encoded)
+    next_task_ref++
+    return ptmp.SINGULAR_MSG_SUCCESS, thisTask.Task_Reference_Number
 }
 
-// To be sent in response to a Connection_Request message, gives some requirements for how the session will go.
-func sendConnRules(uname_ok bool, pw_ok bool) {
-    conn_rules := ptmp.Prep_Connection_Rules(uname_ok, pw_ok, active_proto_version, []uint16{})
-    encoded := ptmp.EncodePacket(conn_rules)
-	xmit(encoded)
-}
-
-func sendTaskInfo() {
-    if len(active_tasks) > 0 {
+// The version 1 query, which only narrows things down by priority (see answerTaskQuery for version 2).
+func sendTaskInfo(w ptmpserver.ResponseWriter, min_priority uint16, max_priority uint16) {
+    matched := []ptmp.T_Inf{}
+    for _, task := range active_tasks {
+        if task.Task_Priority_Value >= min_priority && task.Task_Priority_Value <= max_priority {
+            matched = append(matched, task)
+        }
+    }
+    if len(matched) > 0 {
         // The original plan for these was that each message would have as many task information
         // structs packed into them as possible, but I'm reevaluating that and preferring
         // to just send one task information structure per message
-        for ii := len(active_tasks)-1; ii >= 0; ii-- {
-            tinfo := ptmp.Prep_Task_Information(active_tasks[ii:ii+1],byte(ii))
-            encoded := ptmp.EncodePacket(tinfo)
-            xmit(encoded)
-            time.Sleep(250*time.Millisecond) // Testing has made me concerned about each side sending messages too quickly and the receiver could end up missing something, so I've put this in to slow down on repeated sends
-    }
+        for ii := len(matched)-1; ii >= 0; ii-- {
+            tinfo := ptmp.Prep_Task_Information(matched[ii:ii+1],byte(ii))
+            w.Send(tinfo) // the server paces these out, since they're read one at a time
+        }
     } else {
         // no tasks to send, but client still expects to see a response message, so send an ACK with a relevant code
-        sendAck(ptmp.UNABLE_TO_COMPLY)
+        w.Ack(ptmp.UNABLE_TO_COMPLY)
     }
 
 }
 
-// Go through our task list and remove the tasks with the specified IDs.
-func removeTasks(task_ids []uint16, permit_incomplete bool) {
-    // Loop through our tasks list (backwards, since we're relying on its length and chopping items out of it).
-    for ii := len(active_tasks)-1; ii >= 0; ii-- {
-        // See if we can find the matching task ID in our list of tasks to remove.
-        for jj := len(task_ids)-1; jj >= 0; jj-- {
-            if active_tasks[ii].Task_Reference_Number == task_ids[jj] &&
-               (ptmp.Byte2Bool(active_tasks[ii].Completion_Status) || permit_incomplete){
-                   // in here, the current task ID matches one of the IDs specified for removal, and it is considered valid to remove it
-
-                   // I looked at a few different ways to remove items from slices in go, and this "append everything except the item to be removed"
-                   // was the one that was clearest to me how it was being done, so that's what I felt safest implementing
-                   temp_arr := []uint16{}
-                   for kk := 0; kk < len(task_ids); kk++ {
-                       if kk != jj {
-                           temp_arr = append(temp_arr, task_ids[kk])
-                       }
-                   }
-                   task_ids = temp_arr
-
-                   temp_arr2 := []ptmp.T_Inf{}
-                   for kk := 0; kk < len(active_tasks); kk++ {
-                       if kk != ii {
-                           temp_arr2 = append(temp_arr2, active_tasks[kk])
-                       }
-                   }
-                   active_tasks = temp_arr2
+// Go through the tasks to remove, in the order the client listed them, and move each one we can into the list's
+// trash.  Removal isn't all-or-nothing (that's what transactions are for): everything that can be removed is, and
+// the client gets told how each one went (when it asked for detailed acks) along with an overall code from
+// ItemsResponseCode.
+func removeTasks(w ptmpserver.ResponseWriter, r *ptmpserver.Request, listId uint16, task_ids []uint16, permit_incomplete bool) {
+    // Same deal as completeTask, list 1 is the only list there is.
+    if listId != 1 {
+        ptmpserver.AckDetailed(w, r, ptmp.LIST_DOES_NOT_EXIST, nil, listMissingDiagnostic(listId))
+        return
+    }
+    items := []ptmp.Item_Result{}
+    for _, task_id := range task_ids {
+        // Not finding it at all is TASK_DOES_NOT_EXIST (which also covers the same ID being listed twice, since it's
+        // gone by the second time around), and finding it but not being allowed to remove it is UNABLE_TO_COMPLY.
+        result := ptmp.Item_Result{Task_Reference_Number: task_id, Response_Code: ptmp.TASK_DOES_NOT_EXIST}
+        for ii := 0; ii < len(active_tasks); ii++ {
+            if active_tasks[ii].Task_Reference_Number != task_id {
+                continue
+            }
+            if !ptmp.Byte2Bool(active_tasks[ii].Completion_Status) && !permit_incomplete {
+                result.Response_Code = ptmp.UNABLE_TO_COMPLY
                 break
             }
+            moveToTrash(listId, active_tasks[ii]) // removal isn't permanent anymore, the trash sweeper takes care of that once the retention period is up
+
+            // I looked at a few different ways to remove items from slices in go, and this "append everything except the item to be removed"
+            // was the one that was clearest to me how it was being done, so that's what I felt safest implementing
+            temp_arr := []ptmp.T_Inf{}
+            for kk := 0; kk < len(active_tasks); kk++ {
+                if kk != ii {
+                    temp_arr = append(temp_arr, active_tasks[kk])
+                }
+            }
+            active_tasks = temp_arr
+            result.Response_Code = ptmp.SINGULAR_MSG_SUCCESS
+            break
         }
+        items = append(items, result)
     }
-    // If any tasks are left in the list of what was supposed to be removed, that means we didn't find it (or it was invalid to remove it, which I'm classifying as the same error state as it simply not existing).
-    if len(task_ids) > 0 {
-        sendAck(ptmp.TASK_DOES_NOT_EXIST)
-    } else {
-        sendAck(ptmp.SINGULAR_MSG_SUCCESS)
+    // Clients that didn't ask for detailed acks get TASK_DOES_NOT_EXIST if anything couldn't be removed (which is
+    // what it's always been, whether the task was missing or just not completed).
+    ptmpserver.AckDetailed(w, r, ptmpserver.ItemsResponseCode(r, items, ptmp.TASK_DOES_NOT_EXIST), items, itemsDiagnostic("removed", items))
+}
+
+// What went wrong with an item, for the diagnostics.
+var item_problems = map[uint16]string{
+    ptmp.TASK_DOES_NOT_EXIST: "doesn't exist",
+    ptmp.UNABLE_TO_COMPLY: "isn't completed (and incomplete tasks weren't permitted)",
+}
+
+// A diagnostic for a multi-item message saying how many of the items were done and what was wrong with the rest,
+// e.g. "removed 3 of 5 tasks; task 7 doesn't exist; task 9 isn't completed (...)".  Empty if everything worked,
+// since there's nothing to explain.
+func itemsDiagnostic(done string, items []ptmp.Item_Result) string {
+    problems := []string{}
+    for _, item := range items {
+        if item.Response_Code == ptmp.SINGULAR_MSG_SUCCESS {
+            continue
+        }
+        problem, known := item_problems[item.Response_Code]
+        if !known {
+            problem = fmt.Sprintf("failed with response code %v", item.Response_Code)
+        }
+        problems = append(problems, fmt.Sprintf("task %v %v", item.Task_Reference_Number, problem))
+    }
+    if len(problems) == 0 {
+        return ""
     }
+    return fmt.Sprintf("%v %v of %v tasks; %v", done, len(items)-len(problems), len(items), strings.Join(problems, "; "))
+}
+
+func listMissingDiagnostic(listId uint16) string {
+    return fmt.Sprintf("list %v doesn't exist (this server only has list 1)", listId)
 }
 
-func completeTask(listId uint16, taskId uint16) {
+func completeTask(w ptmpserver.ResponseWriter, listId uint16, taskId uint16) {
     // Again, I omitted the list-management messages, so only list ID 1 is valid for this demonstration of the protocol.
     if listId != 1 {
-        sendAck(ptmp.LIST_DOES_NOT_EXIST)
+        w.Ack(ptmp.LIST_DOES_NOT_EXIST)
         return
     }
 
@@ -307,20 +349,109 @@ func completeTask(listId uint16, taskId uint16) {
 
     // Send the appropriate ACK code depending on whether the task was successfully found in our list.
     if !foundRightTask {
-        sendAck(ptmp.TASK_DOES_NOT_EXIST)
+        w.Ack(ptmp.TASK_DOES_NOT_EXIST)
     } else {
-        sendAck(ptmp.SINGULAR_MSG_SUCCESS)
+        w.Ack(ptmp.SINGULAR_MSG_SUCCESS)
     }
 
 }
 
 func main() {
-	proto_versions_supported[0] = active_proto_version
-	var err error
-	// set up the server to listen for incoming connections, and then receive (and handle) incoming messages until the client says we're done
-    conn, err = connect_to_client(HOST)
-    if LOGGING_ENABLED {
-        log.Printf("Server just initialized, error is %+v", err)
-    }
-    recv()
+    cmd, err_status := parseCommandLine(os.Args[1:], os.Stderr)
+    if errors.Is(err_status, flag.ErrHelp) {
+        return
+    }
+    if err_status != nil {
+        fatal("Unable to parse the command line", "error", err_status)
+    }
+    cfg, err_status := loadConfig(cmd)
+    if cmd.print_config {
+        // print whatever we can even if it's not valid, so that it's clear where the problem came from
+        if err_status != nil {
+            fmt.Fprintf(os.Stderr, "The config has problems:\n%v\n", err_status)
+            os.Exit(EXIT_FAILURE)
+        }
+        printable, _ := cfg.redacted()
+        fmt.Println(string(printable))
+        return
+    }
+    if err_status != nil {
+        fatal("The config has problems", "error", err_status)
+    }
+    applyConfig(cfg)
+    if err_status := setupLogging(cfg); err_status != nil {
+        fatal("Unable to set up logging", "error", err_status)
+    }
+    go reloadOnSIGHUP(cmd)
+
+    proto_versions_supported[0] = active_proto_version
+    ptmp_server = newServer()
+    ptmp_server.Idle_Timeout = time.Duration(cfg.Timeouts.Session_Idle)
+    if cmd.state_graph {
+        if err_status := ptmpserver.WriteStateGraph(os.Stdout, ptmp_server.Transitions); err_status != nil {
+            fatal("Unable to write the state graph", "error", err_status)
+        }
+        return
+    }
+
+    // metrics and health checks come up first, so that there's something to ask while the store is loading
+    if cfg.Metrics_Listen != "" {
+        go func() {
+            if err_status := serveMetrics(cfg); err_status != nil {
+                logger.Error("Metrics listener stopped", "error", err_status)
+            }
+        }()
+    }
+
+    // pick up where we left off last time before doing anything else
+    DATA_DIR = cfg.Storage.Path
+    STORAGE_BACKEND = cfg.Storage.Backend
+    if err_status := loadStore(); err_status != nil {
+        fatal("Unable to load the task store", "path", DATA_DIR, "error", err_status)
+    }
+    noteHealth(&store_health, nil)
+    if err_status := loadAuditLog(); err_status != nil {
+        fatal("Unable to load the audit log", "path", DATA_DIR, "error", err_status)
+    }
+    noteHealth(&audit_health, nil)
+    go sweepTrash()
+
+    var tls_config *tls.Config
+    if cfg.TLS.Cert_File != "" {
+        cert, err_status := tls.LoadX509KeyPair(cfg.TLS.Cert_File, cfg.TLS.Key_File)
+        if err_status != nil {
+            fatal("Unable to load the TLS certificate", "error", err_status)
+        }
+        tls_config = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+    }
+    var gateway *http.Server
+    if cfg.Gateway_Listen != "" {
+        gateway = newGateway(cfg, tls_config)
+        go func() {
+            if err_status := serveGateway(gateway); err_status != nil {
+                logger.Error("HTTP gateway stopped", "error", err_status)
+            }
+        }()
+    }
+    listener, err := net.Listen(BASE_PROTO, cfg.Listen)
+    if err != nil {
+        fatal("Unable to listen", "address", cfg.Listen, "error", err)
+    }
+    logger.Info("Server is listening", "address", cfg.Listen, "tls", tls_config != nil, "storage", STORAGE_BACKEND, "log_level", cfg.Log_Level)
+    if tls_config != nil {
+        listener = tls.NewListener(listener, tls_config)
+    }
+    signals := make(chan os.Signal, 2)
+    signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+    exit_status := make(chan int, 1)
+    go func() { exit_status <- shutdownOnSignal(signals, gateway) }()
+
+    // receive (and handle) incoming messages from clients until we're asked to stop.
+    listener_up.Store(true)
+    err_status = ptmp_server.Serve(listener)
+    listener_up.Store(false)
+    if !ptmp_server.ShuttingDown() {
+        fatal("Stopped accepting connections", "error", err_status)
+    }
+    os.Exit(<-exit_status)
 }
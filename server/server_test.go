@@ -0,0 +1,61 @@
+package main
+
+import (
+    "ajb497/ptmp/conformance"
+    "ajb497/ptmp/ptmplog"
+    "io"
+    "log"
+    "net"
+    "os"
+    "testing"
+)
+
+func TestMain(m *testing.M) {
+    // The server logs everything it does, which drowns out the test results (go test -v still shows which tests ran).
+    log.SetOutput(io.Discard)
+    logger = ptmplog.Discard()
+    access_logger = logger
+    os.Exit(m.Run())
+}
+
+// Start the server listening on a loopback port, with an empty data directory of its own, and return its address.
+func startTestServer(t *testing.T) string {
+    t.Helper()
+    // DATA_DIR is relative to wherever the server is running, so run it somewhere empty.
+    old_dir, _ := os.Getwd()
+    if err_status := os.Chdir(t.TempDir()); err_status != nil {
+        t.Fatal(err_status)
+    }
+    t.Cleanup(func() { os.Chdir(old_dir) })
+    resetServer()
+
+    listener, err_status := net.Listen(BASE_PROTO, "127.0.0.1:0")
+    if err_status != nil {
+        t.Fatal(err_status)
+    }
+    t.Cleanup(func() { listener.Close() })
+    ptmp_server = newServer()
+    go ptmp_server.Serve(listener)
+    return listener.Addr().String()
+}
+
+// Forget every task, trashed task and history record.
+func resetServer() {
+    store_lock.Lock()
+    defer store_lock.Unlock()
+    active_tasks = nil
+    trash = make(map[uint16][]trashed_task)
+    audit_log = nil
+    next_task_ref = 0
+    os.RemoveAll(DATA_DIR)
+}
+
+func TestConformance(t *testing.T) {
+    addr := startTestServer(t)
+    conformance.Run(t, conformance.Target{
+                                          Dial: func() (net.Conn, error) { return net.Dial(BASE_PROTO, addr) },
+                                          Username: VALID_UNAME,
+                                          Password: VALID_PW,
+                                          Reset: resetServer,
+                                         })
+}
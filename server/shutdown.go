@@ -0,0 +1,72 @@
+package main
+
+import (
+    "context"
+    "net/http"
+    "os"
+    "sync"
+    "time"
+)
+
+// How long sessions get to finish up when the server is asked to stop, unless the config says otherwise.
+const SHUTDOWN_TIMEOUT time.Duration = 10*time.Second
+
+// What the server's exit status means, for whatever started it (a supervisor deciding whether to restart it, or
+// whether somebody needs to look at the data directory).
+const (
+    EXIT_OK int = 0 // stopped when asked to, with everything finished and saved
+    EXIT_FAILURE int = 1 // couldn't start, or stopped for some reason other than being asked to
+    EXIT_DRAIN_TIMEOUT int = 2 // stopped when asked to and everything was saved, but some sessions had to be cut off
+    EXIT_FLUSH_FAILED int = 3 // stopped, but the store couldn't be saved on the way out, so changes may have been lost
+)
+
+// Wait for a SIGINT or SIGTERM on signals, then stop the server gracefully and return the exit status to stop with:
+//  1. stop accepting PTMP connections and gateway requests
+//  2. send every session a Close_Connection once whatever it sent last has been handled (sessions in the middle
+//     of a series get to finish it), and let the gateway finish the requests it has
+//  3. after the shutdown timeout (or a second signal), cut off whoever is left
+//  4. wait for any handler still working on the store, and save the store one last time
+func shutdownOnSignal(signals chan os.Signal, gateway *http.Server) int {
+    received := <-signals
+    timeout := time.Duration(current_config.Load().Timeouts.Shutdown)
+    logger.Info("Shutting down", "signal", received.String(), "timeout", timeout)
+    ctx, cancel := context.WithTimeout(context.Background(), timeout)
+    defer cancel()
+    go func() {
+        // Impatient operators get to skip the wait, but the store still gets saved.
+        if second, open := <-signals; open {
+            logger.Warn("Got another signal, not waiting for sessions to finish", "signal", second.String())
+            cancel()
+        }
+    }()
+
+    exit_status := EXIT_OK
+    var wait sync.WaitGroup
+    if gateway != nil {
+        wait.Add(1)
+        go func() {
+            defer wait.Done()
+            if err_status := gateway.Shutdown(ctx); err_status != nil {
+                logger.Warn("HTTP gateway requests didn't finish in time", "error", err_status)
+                gateway.Close()
+            }
+        }()
+    }
+    if err_status := ptmp_server.Shutdown(ctx); err_status != nil {
+        logger.Warn("Sessions didn't finish in time and were cut off", "error", err_status)
+        exit_status = EXIT_DRAIN_TIMEOUT
+    }
+    wait.Wait()
+
+    // Anything still being handled has the store locked, so once we have the lock, nothing is halfway through a
+    // change, and nothing else gets to start one before we exit.
+    store_lock.Lock()
+    err_status := saveStore()
+    noteHealth(&store_health, err_status)
+    if err_status != nil {
+        logger.Error("Unable to save the task store on the way out", "path", DATA_DIR, "error", err_status)
+        exit_status = EXIT_FLUSH_FAILED
+    }
+    logger.Info("Server stopped", "exit_status", exit_status)
+    return exit_status
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io/fs"
+    "ajb497/ptmp"
+    "os"
+    "path/filepath"
+    "sort"
+    "sync/atomic"
+    "time"
+)
+
+// Everything the server needs to remember between runs lives in this directory (relative to wherever the server is started),
+// unless the storage backend is "memory", in which case nothing is remembered at all.  Both come from the config at startup.
+var DATA_DIR string = "data"
+var STORAGE_BACKEND string = STORAGE_FILE
+const STORE_FILENAME string = "store.json"
+
+// The on-disk version of a task.  T_Inf keeps the title and description as []byte, which would come out as base64
+// in JSON, so tasks get converted to this friendlier form on the way to the file.
+type stored_task struct {
+    Reference_Number uint16 `json:"ref"`
+    Priority uint16 `json:"priority"`
+    Title string `json:"title"`
+    Description string `json:"description"`
+    Completed bool `json:"completed"`
+}
+
+type stored_trashed_task struct {
+    stored_task
+    Removed_At time.Time `json:"removed_at"`
+}
+
+type store_file struct {
+    Next_Task_Ref uint16 `json:"next_task_ref"`
+    Tasks []stored_task `json:"tasks"`
+    Trash map[uint16][]stored_trashed_task `json:"trash"`
+}
+
+func taskToStored(task ptmp.T_Inf) stored_task {
+    return stored_task{
+                       Reference_Number: task.Task_Reference_Number,
+                       Priority: task.Task_Priority_Value,
+                       Title: string(task.Task_Title),
+                       Description: string(task.Task_Description),
+                       Completed: ptmp.Byte2Bool(task.Completion_Status),
+                      }
+}
+
+func storedToTask(st stored_task) ptmp.T_Inf {
+    return ptmp.T_Inf{
+                      Task_Reference_Number: st.Reference_Number,
+                      Task_Priority_Value: st.Priority,
+                      Length_of_Title: byte(len(st.Title)),
+                      Task_Title: []byte(st.Title),
+                      Description_Length: uint16(len(st.Description)),
+                      Task_Description: []byte(st.Description),
+                      Completion_Status: ptmp.Bool2Byte(st.Completed),
+                     }
+}
+
+// How the last write to the store and to the audit log went, for /readyz.  Both are nil until main has loaded
+// them, and then point at the error from the most recent write (nil when it worked).
+var store_health atomic.Pointer[error]
+var audit_health atomic.Pointer[error]
+
+func noteHealth(health *atomic.Pointer[error], err_status error) {
+    health.Store(&err_status)
+}
+
+// What's keeping the store from being usable, if anything.
+func storageProblems() []string {
+    problems := []string{}
+    for name, health := range map[string]*atomic.Pointer[error]{"store": &store_health, "audit log": &audit_health} {
+        last := health.Load()
+        if last == nil {
+            problems = append(problems, name + " not loaded yet")
+        } else if *last != nil {
+            problems = append(problems, fmt.Sprintf("last write to the %v failed: %v", name, *last))
+        }
+    }
+    sort.Strings(problems)
+    return problems
+}
+
+// Read the tasks and trash back in from the data directory.  Not having a store file yet is fine (first run),
+// anything else going wrong is reported so that we don't start up empty and then overwrite someone's tasks.
+func loadStore() error {
+    if STORAGE_BACKEND == STORAGE_MEMORY {
+        return nil
+    }
+    raw, err_status := os.ReadFile(filepath.Join(DATA_DIR, STORE_FILENAME))
+    if errors.Is(err_status, fs.ErrNotExist) {
+        return nil
+    }
+    if err_status != nil {
+        return err_status
+    }
+    contents := store_file{}
+    if err_status = json.Unmarshal(raw, &contents); err_status != nil {
+        return err_status
+    }
+    next_task_ref = contents.Next_Task_Ref
+    active_tasks = []ptmp.T_Inf{}
+    for _, st := range contents.Tasks {
+        active_tasks = append(active_tasks, storedToTask(st))
+    }
+    trash = make(map[uint16][]trashed_task)
+    for listId, list_trash := range contents.Trash {
+        for _, st := range list_trash {
+            trash[listId] = append(trash[listId], trashed_task{info: storedToTask(st.stored_task), removed_at: st.Removed_At})
+        }
+    }
+    logger.Info("Loaded the task store", "tasks", len(active_tasks), "trashed_lists", len(trash), "path", DATA_DIR)
+    return nil
+}
+
+// Write the tasks and trash out to the data directory.  The file is written to the side and then renamed over
+// the old one so that a crash partway through doesn't leave us with half a store.
+func saveStore() error {
+    if STORAGE_BACKEND == STORAGE_MEMORY {
+        return nil
+    }
+    contents := store_file{
+                           Next_Task_Ref: next_task_ref,
+                           Tasks: []stored_task{},
+                           Trash: make(map[uint16][]stored_trashed_task),
+                          }
+    for _, task := range active_tasks {
+        contents.Tasks = append(contents.Tasks, taskToStored(task))
+    }
+    for listId, list_trash := range trash {
+        for _, tt := range list_trash {
+            contents.Trash[listId] = append(contents.Trash[listId], stored_trashed_task{stored_task: taskToStored(tt.info), Removed_At: tt.removed_at})
+        }
+    }
+    raw, err_status := json.MarshalIndent(contents, "", "  ")
+    if err_status != nil {
+        return err_status
+    }
+    if err_status = os.MkdirAll(DATA_DIR, 0755); err_status != nil {
+        return err_status
+    }
+    store_path := filepath.Join(DATA_DIR, STORE_FILENAME)
+    if err_status = os.WriteFile(store_path + ".tmp", raw, 0644); err_status != nil {
+        return err_status
+    }
+    return os.Rename(store_path + ".tmp", store_path)
+}
+
+// Everything in the store that a message can change, copied so that it can be put back the way it was.
+type store_state struct {
+    tasks []ptmp.T_Inf
+    trash map[uint16][]trashed_task
+    next_task_ref uint16
+}
+
+// The slices get copied too, since the handlers change tasks (and take them out of the trash) in place.
+func captureStore() store_state {
+    saved := store_state{tasks: append([]ptmp.T_Inf{}, active_tasks...), trash: make(map[uint16][]trashed_task), next_task_ref: next_task_ref}
+    for listId, list_trash := range trash {
+        saved.trash[listId] = append([]trashed_task{}, list_trash...)
+    }
+    return saved
+}
+
+func restoreStore(saved store_state) {
+    active_tasks = saved.tasks
+    trash = saved.trash
+    next_task_ref = saved.next_task_ref
+}
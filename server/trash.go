@@ -0,0 +1,142 @@
+package main
+
+import (
+    "ajb497/ptmp"
+    "ajb497/ptmp/ptmpserver"
+    "sort"
+    "time"
+)
+
+const TRASH_RETENTION time.Duration = 7 * 24 * time.Hour // how long a removed task hangs around before the sweeper gets rid of it for good
+const TRASH_SWEEP_INTERVAL time.Duration = time.Minute
+
+// A removed task, along with when it was removed so that we know when it's due to be permanently deleted.
+type trashed_task struct {
+    info ptmp.T_Inf
+    removed_at time.Time
+}
+
+// Each list gets its own trash, keyed by list ID.
+var trash = make(map[uint16][]trashed_task)
+
+// Put a task that was just removed from the active list into the trash of the list it was removed from.
+func moveToTrash(listId uint16, task ptmp.T_Inf) {
+    trash[listId] = append(trash[listId], trashed_task{info: task, removed_at: time.Now()})
+}
+
+// Send the contents of a list's trash back to the client, one task per message just like sendTaskInfo does.
+func sendTrashInfo(w ptmpserver.ResponseWriter, listId uint16) {
+    if listId != 1 {
+        w.Ack(ptmp.LIST_DOES_NOT_EXIST)
+        return
+    }
+    list_trash := trash[listId]
+    if len(list_trash) == 0 {
+        // nothing in the trash, but the client is still waiting to hear back from us
+        w.Ack(ptmp.UNABLE_TO_COMPLY)
+        return
+    }
+    for ii := len(list_trash)-1; ii >= 0; ii-- {
+        remaining := TRASH_RETENTION - time.Since(list_trash[ii].removed_at)
+        if remaining < 0 {
+            remaining = 0
+        }
+        tinfo := ptmp.Trashed_T_Inf{
+                                    List_ID: listId,
+                                    Seconds_Until_Purge: uint32(remaining / time.Second),
+                                    Task: list_trash[ii].info,
+                                   }
+        w.Send(ptmp.Prep_Trash_Information([]ptmp.Trashed_T_Inf{tinfo}, byte(ii)))
+    }
+}
+
+// Pull the specified tasks back out of the trash and put them back on the active list.
+func restoreTasks(w ptmpserver.ResponseWriter, r *ptmpserver.Request, listId uint16, task_ids []uint16) {
+    if listId != 1 {
+        ptmpserver.AckDetailed(w, r, ptmp.LIST_DOES_NOT_EXIST, nil, listMissingDiagnostic(listId))
+        return
+    }
+    restored, items := takeFromTrash(listId, task_ids)
+    active_tasks = append(active_tasks, restored...)
+    // keep the active list in the order the tasks were created so that restored tasks don't end up shuffled to the end
+    sort.Slice(active_tasks, func(ii, jj int) bool {
+        return active_tasks[ii].Task_Reference_Number < active_tasks[jj].Task_Reference_Number
+    })
+    logger.Debug("Restored tasks from the trash", "list", listId, "restored", len(restored))
+    // Same as with removal, anything we couldn't find gets reported as not existing (but everything we could find still gets restored).
+    ptmpserver.AckDetailed(w, r, ptmpserver.ItemsResponseCode(r, items, ptmp.TASK_DOES_NOT_EXIST), items, itemsDiagnostic("restored", items))
+}
+
+// Permanently delete the specified tasks from a list's trash (or the whole trash for that list if no tasks are specified).
+func purgeTrash(w ptmpserver.ResponseWriter, r *ptmpserver.Request, listId uint16, task_ids []uint16) {
+    if listId != 1 {
+        ptmpserver.AckDetailed(w, r, ptmp.LIST_DOES_NOT_EXIST, nil, listMissingDiagnostic(listId))
+        return
+    }
+    if len(task_ids) == 0 {
+        logger.Debug("Purging the whole trash", "list", listId, "purged", len(trash[listId]))
+        delete(trash, listId)
+        w.Ack(ptmp.SINGULAR_MSG_SUCCESS)
+        return
+    }
+    purged, items := takeFromTrash(listId, task_ids)
+    logger.Debug("Purged tasks from the trash", "list", listId, "purged", len(purged))
+    ptmpserver.AckDetailed(w, r, ptmpserver.ItemsResponseCode(r, items, ptmp.TASK_DOES_NOT_EXIST), items, itemsDiagnostic("purged", items))
+}
+
+// Take the tasks with the given IDs out of a list's trash, returning the tasks that were found and how each of the
+// requested IDs went (TASK_DOES_NOT_EXIST for the ones that weren't in there).
+func takeFromTrash(listId uint16, task_ids []uint16) ([]ptmp.T_Inf, []ptmp.Item_Result) {
+    found := []ptmp.T_Inf{}
+    items := []ptmp.Item_Result{}
+    for _, task_id := range task_ids {
+        list_trash := trash[listId]
+        result := ptmp.Item_Result{Task_Reference_Number: task_id, Response_Code: ptmp.TASK_DOES_NOT_EXIST}
+        for ii := 0; ii < len(list_trash); ii++ {
+            if list_trash[ii].info.Task_Reference_Number == task_id {
+                found = append(found, list_trash[ii].info)
+                trash[listId] = append(list_trash[:ii], list_trash[ii+1:]...)
+                result.Response_Code = ptmp.SINGULAR_MSG_SUCCESS
+                break
+            }
+        }
+        items = append(items, result)
+    }
+    return found, items
+}
+
+// Permanently delete anything that has been in the trash longer than the retention period.
+func purgeExpired(now time.Time) {
+    for listId, list_trash := range trash {
+        kept := []trashed_task{}
+        for _, tt := range list_trash {
+            if now.Sub(tt.removed_at) < TRASH_RETENTION {
+                kept = append(kept, tt)
+            }
+        }
+        if len(kept) != len(list_trash) {
+            logger.Info("Sweeper permanently deleted expired tasks from the trash", "list", listId, "deleted", len(list_trash)-len(kept))
+        }
+        if len(kept) == 0 {
+            delete(trash, listId)
+        } else {
+            trash[listId] = kept
+        }
+    }
+}
+
+// Runs in the background for the life of the server, periodically clearing out expired trash.
+func sweepTrash() {
+    ticker := time.NewTicker(TRASH_SWEEP_INTERVAL)
+    defer ticker.Stop()
+    for now := range ticker.C {
+        // the sweeper runs alongside the sessions, the gateway and the metrics listener, so it takes the store lock like they do
+        store_lock.Lock()
+        before := snapshotTaskStates()
+        purgeExpired(now)
+        if len(snapshotTaskStates()) != len(before) {
+            recordChanges(SWEEPER_USER, 0, ptmp.PURGE_TRASH, ptmp.SINGULAR_MSG_SUCCESS, 1, before)
+        }
+        store_lock.Unlock()
+    }
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+    "reflect"
+    "testing"
+    "time"
+)
+
+// How long ago a task was removed, for filling the trash with.
+type test_trashed struct {
+    ref uint16
+    age time.Duration
+}
+
+// The sweeper keeps whatever was removed less than TRASH_RETENTION ago (in the order it was removed), and a list whose
+// trash ends up with nothing in it doesn't keep an entry in the trash at all.
+func TestPurgeExpired(t *testing.T) {
+    t.Cleanup(func() { trash = make(map[uint16][]trashed_task) })
+    now := time.Now()
+    for _, test := range []struct {
+        name string
+        trashed map[uint16][]test_trashed
+        want map[uint16][]uint16 // refs left in each list's trash
+    }{
+        {"nothing expired",
+         map[uint16][]test_trashed{1: {{0, time.Hour}, {1, 6*24*time.Hour}}},
+         map[uint16][]uint16{1: {0, 1}}},
+        {"some expired",
+         map[uint16][]test_trashed{1: {{0, 8*24*time.Hour}, {1, time.Hour}, {2, TRASH_RETENTION + time.Second}, {3, time.Minute}}, 2: {{4, time.Minute}}},
+         map[uint16][]uint16{1: {1, 3}, 2: {4}}},
+        {"a whole list expired",
+         map[uint16][]test_trashed{1: {{0, 8*24*time.Hour}, {1, 30*24*time.Hour}}, 2: {{2, time.Hour}}},
+         map[uint16][]uint16{2: {2}}},
+        {"right on the retention period",
+         map[uint16][]test_trashed{1: {{0, TRASH_RETENTION}, {1, TRASH_RETENTION - time.Second}}},
+         map[uint16][]uint16{1: {1}}},
+        {"an empty list",
+         map[uint16][]test_trashed{1: {}, 2: {{0, time.Hour}}},
+         map[uint16][]uint16{2: {0}}},
+        {"no trash at all",
+         map[uint16][]test_trashed{},
+         map[uint16][]uint16{}},
+    } {
+        trash = make(map[uint16][]trashed_task)
+        for listId, list_trash := range test.trashed {
+            trash[listId] = []trashed_task{}
+            for _, tt := range list_trash {
+                trash[listId] = append(trash[listId], trashed_task{info: queryTestTask(tt.ref, 1, "Trashed", "", false), removed_at: now.Add(-tt.age)})
+            }
+        }
+
+        purgeExpired(now)
+
+        left := map[uint16][]uint16{}
+        for listId, list_trash := range trash {
+            left[listId] = []uint16{}
+            for _, tt := range list_trash {
+                left[listId] = append(left[listId], tt.info.Task_Reference_Number)
+            }
+        }
+        if !reflect.DeepEqual(left, test.want) {
+            t.Errorf("%v: the trash was left with %v, expected %v", test.name, left, test.want)
+        }
+    }
+}